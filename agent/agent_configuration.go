@@ -6,6 +6,7 @@ type AgentConfiguration struct {
 	ConfigPath                 string
 	BootstrapScript            string
 	BuildPath                  string
+	BuildPathMinFreeSpace      DiskSpaceThreshold
 	HooksPath                  string
 	GitMirrorsPath             string
 	GitMirrorsLockTimeout      int
@@ -15,6 +16,12 @@ type AgentConfiguration struct {
 	GitCloneMirrorFlags        string
 	GitCleanFlags              string
 	GitFetchFlags              string
+	GitCloneDepth              int
+	GitSparseCheckoutPaths     string
+	GitLFS                     bool
+	GitLFSInclude              string
+	GitLFSExclude              string
+	GitLFSSkipSmudge           bool
 	GitSubmodules              bool
 	SSHKeyscan                 bool
 	CommandEval                bool
@@ -28,10 +35,13 @@ type AgentConfiguration struct {
 	DisconnectAfterIdleTimeout int
 	CancelGracePeriod          int
 	EnableJobLogTmpfile        bool
+	MaxJobLogSize              int
+	JobLogTailSize             int
 	Shell                      string
 	Profile                    string
 	RedactedVars               []string
 	AcquireJob                 string
 	TracingBackend             string
 	TracingServiceName         string
+	EventStream                string
 }
@@ -72,3 +72,29 @@ func (r *AgentPool) Stop(graceful bool) {
 		worker.Stop(graceful)
 	}
 }
+
+// Pause stops every worker from accepting new jobs
+func (r *AgentPool) Pause() {
+	for _, worker := range r.workers {
+		worker.Pause()
+	}
+}
+
+// Resume lets every worker accept new jobs again
+func (r *AgentPool) Resume() {
+	for _, worker := range r.workers {
+		worker.Resume()
+	}
+}
+
+// CancelJobs cancels the jobs that any of the workers are running, returning
+// the first error from canceling one
+func (r *AgentPool) CancelJobs() error {
+	var firstErr error
+	for _, worker := range r.workers {
+		if err := worker.CancelJob(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
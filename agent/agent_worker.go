@@ -8,9 +8,11 @@ import (
 	"net/http"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/events"
 	"github.com/buildkite/agent/v3/logger"
 	"github.com/buildkite/agent/v3/metrics"
 	"github.com/buildkite/agent/v3/process"
@@ -33,6 +35,9 @@ type AgentWorkerConfig struct {
 
 	// The configuration of the agent from the CLI
 	AgentConfiguration AgentConfiguration
+
+	// Where to write job lifecycle events, if anywhere
+	Events *events.Stream
 }
 
 type agentStats struct {
@@ -43,6 +48,12 @@ type agentStats struct {
 
 	// The last error that occurred during heartbeat, or nil if it was successful
 	lastHeartbeatError error
+
+	// When the agent connected to Buildkite, or zero if it isn't connected
+	connectedAt time.Time
+
+	// The job that's running, if any
+	jobID string
 }
 
 type AgentWorker struct {
@@ -66,6 +77,9 @@ type AgentWorker struct {
 	// Metrics scope for the agent
 	metrics *metrics.Scope
 
+	// The stream of lifecycle events for the agent
+	events *events.Stream
+
 	// Whether to enable debug
 	debug bool
 
@@ -75,11 +89,15 @@ type AgentWorker struct {
 	// The signal to use for cancellation
 	cancelSig process.Signal
 
-	// Stop controls
+	// Stop controls. The stop mutex can be held while a job is canceled,
+	// which can take as long as the cancel grace period.
 	stop      chan struct{}
-	stopping  bool
+	stopping  atomicBool
 	stopMutex sync.Mutex
 
+	// Whether the worker has been paused, and so isn't accepting new jobs
+	paused atomicBool
+
 	// The index of this agent worker
 	spawnIndex int
 
@@ -87,12 +105,29 @@ type AgentWorker struct {
 	// JobRunner here
 	jobRunner *JobRunner
 
+	// Removes old checkouts before jobs when the disk is running out of
+	// space, or nil if the agent isn't configured to
+	checkoutEvictor *CheckoutEvictor
+
 	// retrySleepFunc is useful for testing retry loops fast
 	// Hopefully this can be replaced with a global setting for tests in future:
 	// https://github.com/buildkite/roko/issues/2
 	retrySleepFunc func(time.Duration)
 }
 
+// atomicBool is a bool that can be read and written without a lock
+type atomicBool struct{ v int32 }
+
+func (b *atomicBool) Load() bool { return atomic.LoadInt32(&b.v) == 1 }
+
+func (b *atomicBool) Store(v bool) {
+	var i int32
+	if v {
+		i = 1
+	}
+	atomic.StoreInt32(&b.v, i)
+}
+
 type errUnrecoverable struct {
 	action   string
 	response *api.Response
@@ -119,10 +154,16 @@ func (e *errUnrecoverable) Unwrap() error {
 
 // Creates the agent worker and initializes its API Client
 func NewAgentWorker(l logger.Logger, a *api.AgentRegisterResponse, m *metrics.Collector, apiClient APIClient, c AgentWorkerConfig) *AgentWorker {
+	var checkoutEvictor *CheckoutEvictor
+	if c.AgentConfiguration.BuildPath != "" && !c.AgentConfiguration.BuildPathMinFreeSpace.IsZero() {
+		checkoutEvictor = NewCheckoutEvictor(l, c.AgentConfiguration.BuildPath, a.Name, c.AgentConfiguration.BuildPathMinFreeSpace)
+	}
+
 	return &AgentWorker{
 		logger:             l,
 		agent:              a,
 		metricsCollector:   m,
+		events:             c.Events.With(a.Name, ""),
 		apiClient:          apiClient.FromAgentRegisterResponse(a),
 		debug:              c.Debug,
 		debugHTTP:          c.DebugHTTP,
@@ -130,28 +171,46 @@ func NewAgentWorker(l logger.Logger, a *api.AgentRegisterResponse, m *metrics.Co
 		stop:               make(chan struct{}),
 		cancelSig:          c.CancelSignal,
 		spawnIndex:         c.SpawnIndex,
+		checkoutEvictor:    checkoutEvictor,
 		retrySleepFunc:     time.Sleep, // https://github.com/buildkite/roko/issues/2
 	}
 }
 
 const workerStatusPart = `{{if le .LastPing.Seconds 2.0}}✅{{else}}❌{{end}} Last ping: {{.LastPing}} ago <br/>
 {{if le .LastHeartbeat.Seconds 60.0}}✅{{else}}❌{{end}} Last heartbeat: {{.LastHeartbeat}} ago<br/>
-{{if .LastHeartbeatError}}❌{{else}}✅{{end}} Last heartbeat error: {{printf "%v" .LastHeartbeatError}}`
+{{if .LastHeartbeatError}}❌{{else}}✅{{end}} Last heartbeat error: {{.LastHeartbeatError}}
+{{with .CheckoutEviction}}<br/>
+{{if .LastError}}❌{{else}}✅{{end}} Build path free space: {{.FreeSpace}} of {{.TotalSpace}}{{if .LastError}} ({{.LastError}}){{end}}<br/>
+🧹 Checkouts removed: {{.Evicted}}, freeing {{.FreedSpace}}{{end}}`
 
 func (a *AgentWorker) statusCallback(context.Context) (any, error) {
 	a.stats.Lock()
 	defer a.stats.Unlock()
 
+	var lastHeartbeatError string
+	if a.stats.lastHeartbeatError != nil {
+		lastHeartbeatError = a.stats.lastHeartbeatError.Error()
+	}
+
+	var checkoutEviction *CheckoutEvictionStats
+	if a.checkoutEvictor != nil {
+		stats := a.checkoutEvictor.Stats()
+		checkoutEviction = &stats
+	}
+
+	// This is also served as JSON, so durations are in nanoseconds
 	return struct {
-		SpawnIndex         int
-		LastHeartbeat      time.Duration
-		LastHeartbeatError error
-		LastPing           time.Duration
+		SpawnIndex         int                    `json:"spawn_index"`
+		LastHeartbeat      time.Duration          `json:"last_heartbeat_ago_ns"`
+		LastHeartbeatError string                 `json:"last_heartbeat_error,omitempty"`
+		LastPing           time.Duration          `json:"last_ping_ago_ns"`
+		CheckoutEviction   *CheckoutEvictionStats `json:"checkout_eviction,omitempty"`
 	}{
 		SpawnIndex:         a.spawnIndex,
 		LastHeartbeat:      time.Since(a.stats.lastHeartbeat),
-		LastHeartbeatError: a.stats.lastHeartbeatError,
+		LastHeartbeatError: lastHeartbeatError,
 		LastPing:           time.Since(a.stats.lastPing),
+		CheckoutEviction:   checkoutEviction,
 	}, nil
 }
 
@@ -160,6 +219,7 @@ func (a *AgentWorker) Start(ctx context.Context, idleMonitor *IdleMonitor) error
 	a.metrics = a.metricsCollector.Scope(metrics.Tags{
 		"agent_name": a.agent.Name,
 	})
+	a.metrics.Gauge("agent.busy", 0)
 
 	ctx, done := status.AddItem(ctx, fmt.Sprintf("Worker %d", a.spawnIndex), workerStatusPart, a.statusCallback)
 	defer done()
@@ -193,6 +253,11 @@ func (a *AgentWorker) Start(ctx context.Context, idleMonitor *IdleMonitor) error
 
 	go a.runHeartbeatLoop(heartbeatCtx)
 
+	// Remove any log spools left behind by jobs that didn't finish
+	if a.agentConfiguration.BuildPath != "" {
+		removeLogSpools(a.logger, a.agentConfiguration.BuildPath)
+	}
+
 	// If the agent is booted in acquisition mode, then we don't need to
 	// bother about starting the ping loop.
 	if a.agentConfiguration.AcquireJob != "" {
@@ -261,7 +326,9 @@ func (a *AgentWorker) runPingLoop(ctx context.Context, idleMonitor *IdleMonitor)
 
 	// Continue this loop until the closing of the stop channel signals termination
 	for {
-		if !a.stopping {
+		if a.Paused() {
+			setStat("⏸️ Paused, not accepting jobs")
+		} else if !a.stopping.Load() {
 			setStat("📡 Pinging Buildkite for work")
 			job, err := a.Ping(ctx)
 			if err != nil {
@@ -344,7 +411,7 @@ func (a *AgentWorker) Stop(graceful bool) {
 	defer a.stopMutex.Unlock()
 
 	if graceful {
-		if a.stopping {
+		if a.stopping.Load() {
 			a.logger.Warn("Agent is already gracefully stopping...")
 		} else {
 			// If we have a job, tell the user that we'll wait for
@@ -374,7 +441,7 @@ func (a *AgentWorker) Stop(graceful bool) {
 
 	// We don't need to do the below operations again since we've already
 	// done them before
-	if a.stopping {
+	if a.stopping.Load() {
 		return
 	}
 
@@ -383,7 +450,51 @@ func (a *AgentWorker) Stop(graceful bool) {
 	close(a.stop)
 
 	// Mark the agent as stopping
-	a.stopping = true
+	a.stopping.Store(true)
+}
+
+// Pause stops the agent from accepting new work, without stopping it. Any job
+// it's running carries on.
+func (a *AgentWorker) Pause() {
+	a.stopMutex.Lock()
+	defer a.stopMutex.Unlock()
+
+	if !a.paused.Load() {
+		a.logger.Info("Pausing agent. No new jobs will be accepted until it's resumed")
+	}
+	a.paused.Store(true)
+}
+
+// Resume lets a paused agent accept new work again
+func (a *AgentWorker) Resume() {
+	a.stopMutex.Lock()
+	defer a.stopMutex.Unlock()
+
+	if a.paused.Load() {
+		a.logger.Info("Resuming agent")
+	}
+	a.paused.Store(false)
+}
+
+// Paused returns whether the agent has been paused
+func (a *AgentWorker) Paused() bool {
+	return a.paused.Load()
+}
+
+// CancelJob cancels the job the agent is running, if there is one. Unlike
+// Stop, the agent carries on running afterwards.
+func (a *AgentWorker) CancelJob() error {
+	a.stopMutex.Lock()
+	jobRunner := a.jobRunner
+	a.stopMutex.Unlock()
+
+	if jobRunner == nil {
+		return nil
+	}
+
+	// Canceling waits for the job to finish, so it's done without the lock
+	a.logger.Info("Canceling the current job...")
+	return jobRunner.Cancel()
 }
 
 // Connects the agent to the Buildkite Agent API, retrying up to 30 times if it
@@ -398,8 +509,13 @@ func (a *AgentWorker) Connect(ctx context.Context) error {
 		_, err := a.apiClient.Connect(ctx)
 		if err != nil {
 			a.logger.Warn("%s (%s)", err, r)
+			return err
 		}
-		return err
+
+		a.stats.Lock()
+		a.stats.connectedAt = time.Now()
+		a.stats.Unlock()
+		return nil
 	})
 }
 
@@ -446,7 +562,11 @@ func (a *AgentWorker) Heartbeat(ctx context.Context) error {
 // Performs a ping that checks Buildkite for a job or action to take
 // Returns a job, or nil if none is found
 func (a *AgentWorker) Ping(ctx context.Context) (*api.Job, error) {
+	pingStart := time.Now()
 	ping, resp, pingErr := a.apiClient.Ping(ctx)
+	if pingErr == nil {
+		a.metrics.Gauge("ping.latency.seconds", time.Since(pingStart).Seconds())
+	}
 	// wait a minute, where's my if err != nil block? TL;DR look for pingErr ~20 lines down
 	// the api client returns an error if the response code isn't a 2xx, but there's still information in resp and ping
 	// that we need to check out to do special handling for specific error codes or messages in the response body
@@ -546,7 +666,7 @@ func (a *AgentWorker) AcquireAndRunJob(ctx context.Context, jobId string) error
 	).DoWithContext(ctx, func(r *roko.Retrier) error {
 		// If this agent has been asked to stop, don't even bother
 		// doing any retry checks and just bail.
-		if a.stopping {
+		if a.stopping.Load() {
 			r.Break()
 		}
 
@@ -638,20 +758,51 @@ func (a *AgentWorker) RunJob(ctx context.Context, acceptResponse *api.Job) error
 		"queue":    acceptResponse.Env["BUILDKITE_AGENT_META_DATA_QUEUE"],
 	})
 
+	// Busy workers are counted by summing this across agents
+	a.metrics.Gauge("agent.busy", 1)
+	defer a.metrics.Gauge("agent.busy", 0)
+
+	jobEvents := a.events.With("", acceptResponse.ID)
+	if err := jobEvents.Emit(events.Event{Type: events.JobAccepted}); err != nil {
+		a.logger.Warn("%s", err)
+	}
+
+	// Make room for the job's checkout before the bootstrap starts on it
+	if a.checkoutEvictor != nil {
+		checkoutPath, exists := acceptResponse.Env["BUILDKITE_BUILD_CHECKOUT_PATH"]
+		if !exists {
+			checkoutPath = a.checkoutEvictor.CheckoutPath(acceptResponse.Env["BUILDKITE_ORGANIZATION_SLUG"], acceptResponse.Env["BUILDKITE_PIPELINE_SLUG"])
+		}
+		if err := a.checkoutEvictor.Evict(checkoutPath); err != nil {
+			a.logger.Warn("Couldn't remove old checkouts from the build path (%s)", err)
+		}
+	}
+
 	// Now that we've got a job to do, we can start it.
 	jr, err := NewJobRunner(a.logger, jobMetricsScope, a.agent, acceptResponse, a.apiClient, JobRunnerConfig{
 		Debug:              a.debug,
 		DebugHTTP:          a.debugHTTP,
 		CancelSignal:       a.cancelSig,
 		AgentConfiguration: a.agentConfiguration,
+		Events:             jobEvents,
 	})
 	if err != nil {
 		return fmt.Errorf("Failed to initialize job: %v", err)
 	}
+	a.stopMutex.Lock()
 	a.jobRunner = jr
+	a.stopMutex.Unlock()
+	a.stats.Lock()
+	a.stats.jobID = acceptResponse.ID
+	a.stats.Unlock()
 	defer func() {
 		// No more job, no more runner.
+		a.stopMutex.Lock()
 		a.jobRunner = nil
+		a.stopMutex.Unlock()
+		a.stats.Lock()
+		a.stats.jobID = ""
+		a.stats.Unlock()
 	}()
 
 	// Start running the job
@@ -667,6 +818,11 @@ func (a *AgentWorker) RunJob(ctx context.Context, acceptResponse *api.Job) error
 // disconnect as fast as possible.
 func (a *AgentWorker) Disconnect(ctx context.Context) error {
 	a.logger.Info("Disconnecting...")
+
+	// Even if the disconnect call fails, this worker is done with Buildkite
+	a.stats.Lock()
+	a.stats.connectedAt = time.Time{}
+	a.stats.Unlock()
 	err := roko.NewRetrier(
 		roko.WithMaxAttempts(4),
 		roko.WithStrategy(roko.Constant(1*time.Second)),
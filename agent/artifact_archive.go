@@ -0,0 +1,328 @@
+package agent
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/klauspost/compress/zstd"
+)
+
+// artifactBundleMarker is the first file in every bundle that
+// `artifact upload --bundle` creates, so that `artifact download` can tell
+// them apart from other archives, which it leaves alone
+const artifactBundleMarker = ".buildkite-artifact-bundle"
+
+// artifactArchiveFormat returns the format of an archive from its name,
+// either "zip", "tar.gz" or "tar.zst", or "" if it isn't one we can bundle into
+func artifactArchiveFormat(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return "zip"
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(lower, ".tar.zst"):
+		return "tar.zst"
+	default:
+		return ""
+	}
+}
+
+// writeArtifactBundle writes the files of artifacts to an archive at
+// archivePath, named by their artifact paths
+func writeArtifactBundle(archivePath string, artifacts []*api.Artifact) error {
+	format := artifactArchiveFormat(archivePath)
+	if format == "" {
+		return fmt.Errorf("can't bundle artifacts into %q, bundles need to be .zip, .tar.gz, .tgz or .tar.zst files", archivePath)
+	}
+
+	f, err := os.Create(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var add func(name string, fi os.FileInfo, r io.Reader) error
+	var finish func() error
+
+	switch format {
+	case "zip":
+		zw := zip.NewWriter(f)
+		add = func(name string, fi os.FileInfo, r io.Reader) error {
+			header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+			if fi != nil {
+				header.Modified = fi.ModTime()
+				header.SetMode(fi.Mode().Perm())
+			}
+			w, err := zw.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(w, r)
+			return err
+		}
+		finish = zw.Close
+
+	case "tar.gz", "tar.zst":
+		cw, err := tarCompressor(format, f)
+		if err != nil {
+			return err
+		}
+		tw := tar.NewWriter(cw)
+		add = func(name string, fi os.FileInfo, r io.Reader) error {
+			header := &tar.Header{Name: name, Mode: 0o644, Typeflag: tar.TypeReg}
+			if fi != nil {
+				header.Mode = int64(fi.Mode().Perm())
+				header.Size = fi.Size()
+				header.ModTime = fi.ModTime()
+			}
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			_, err := io.Copy(tw, r)
+			return err
+		}
+		finish = func() error {
+			if err := tw.Close(); err != nil {
+				return err
+			}
+			return cw.Close()
+		}
+	}
+
+	if err := add(artifactBundleMarker, nil, strings.NewReader("")); err != nil {
+		return err
+	}
+
+	for _, artifact := range artifacts {
+		name := path.Clean(filepath.ToSlash(artifact.Path))
+		if !isLocalArchivePath(name) {
+			return fmt.Errorf("can't bundle %q, it's outside the working directory", artifact.Path)
+		}
+
+		if err := addFileToArchive(add, name, artifact.AbsolutePath); err != nil {
+			return fmt.Errorf("adding %q to bundle: %w", artifact.Path, err)
+		}
+	}
+
+	if err := finish(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func addFileToArchive(add func(string, os.FileInfo, io.Reader) error, name, absolutePath string) error {
+	src, err := os.Open(absolutePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	return add(name, fi, src)
+}
+
+// isArtifactBundle returns whether the file at archivePath is a bundle made
+// by `artifact upload --bundle`
+func isArtifactBundle(archivePath string) (bool, error) {
+	switch artifactArchiveFormat(archivePath) {
+	case "zip":
+		zr, err := zip.OpenReader(archivePath)
+		if err != nil {
+			// Not every file called .zip is one
+			return false, nil
+		}
+		defer zr.Close()
+		return len(zr.File) > 0 && zr.File[0].Name == artifactBundleMarker, nil
+
+	case "tar.gz", "tar.zst":
+		f, err := os.Open(archivePath)
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+
+		cr, err := tarDecompressor(artifactArchiveFormat(archivePath), f)
+		if err != nil {
+			return false, nil
+		}
+		defer cr.Close()
+		header, err := tar.NewReader(cr).Next()
+		if err != nil {
+			return false, nil
+		}
+		return header.Name == artifactBundleMarker, nil
+
+	default:
+		return false, nil
+	}
+}
+
+// unpackArtifactBundle extracts the files in a bundle into destination,
+// returning how many there were
+func unpackArtifactBundle(archivePath, destination string) (int, error) {
+	count := 0
+	extract := func(name string, mode os.FileMode, r io.Reader) error {
+		if name == artifactBundleMarker {
+			return nil
+		}
+
+		name = path.Clean(name)
+		if !isLocalArchivePath(name) {
+			return fmt.Errorf("bundle contains %q, which is outside the destination", name)
+		}
+
+		target := filepath.Join(destination, filepath.FromSlash(name))
+		// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
+		if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+			return err
+		}
+
+		if mode == 0 {
+			mode = 0o644
+		}
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		count++
+		return f.Close()
+	}
+
+	switch artifactArchiveFormat(archivePath) {
+	case "zip":
+		zr, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return 0, err
+		}
+		defer zr.Close()
+
+		for _, file := range zr.File {
+			if !file.Mode().IsRegular() {
+				continue
+			}
+			rc, err := file.Open()
+			if err != nil {
+				return count, err
+			}
+			err = extract(file.Name, file.Mode().Perm(), rc)
+			rc.Close()
+			if err != nil {
+				return count, err
+			}
+		}
+
+	case "tar.gz", "tar.zst":
+		f, err := os.Open(archivePath)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+
+		cr, err := tarDecompressor(artifactArchiveFormat(archivePath), f)
+		if err != nil {
+			return 0, err
+		}
+		defer cr.Close()
+		tr := tar.NewReader(cr)
+		for {
+			header, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return count, err
+			}
+			if header.Typeflag != tar.TypeReg {
+				continue
+			}
+			if err := extract(header.Name, os.FileMode(header.Mode).Perm(), tr); err != nil {
+				return count, err
+			}
+		}
+
+	default:
+		return 0, fmt.Errorf("%q isn't a bundle", archivePath)
+	}
+
+	return count, nil
+}
+
+// tarCompressor compresses what's written to it into w, for a tar based
+// archive format
+func tarCompressor(format string, w io.Writer) (io.WriteCloser, error) {
+	if format == "tar.zst" {
+		return zstd.NewWriter(w)
+	}
+	return gzip.NewWriter(w), nil
+}
+
+// tarDecompressor decompresses r, for a tar based archive format
+func tarDecompressor(format string, r io.Reader) (io.ReadCloser, error) {
+	if format == "tar.zst" {
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return gzip.NewReader(r)
+}
+
+// isLocalArchivePath returns whether a cleaned, slash separated path stays
+// within the directory it's relative to
+func isLocalArchivePath(name string) bool {
+	return name != "." && name != ".." && !path.IsAbs(name) &&
+		!strings.HasPrefix(name, "../") && !filepath.IsAbs(filepath.FromSlash(name))
+}
+
+// gzipArtifact compresses the file of an artifact into a temporary file,
+// returning a copy of the artifact to upload it with and a function that
+// removes the temporary file
+func gzipArtifact(artifact *api.Artifact) (*api.Artifact, func(), error) {
+	src, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer src.Close()
+
+	dst, err := os.CreateTemp("", "buildkite-artifact-*.gz")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { os.Remove(dst.Name()) }
+
+	gw := gzip.NewWriter(dst)
+	_, err = io.Copy(gw, src)
+	if err == nil {
+		err = gw.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("compressing %q: %w", artifact.Path, err)
+	}
+
+	compressed := *artifact
+	compressed.AbsolutePath = dst.Name()
+	compressed.ContentEncoding = "gzip"
+	return &compressed, cleanup, nil
+}
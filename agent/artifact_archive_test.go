@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestArtifactBundleRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{
+		"a.txt":             "a",
+		"dir/b.txt":         "b",
+		"dir/nested/c.json": "{}",
+	}
+
+	var artifacts []*api.Artifact
+	for path, content := range files {
+		abs := filepath.Join(src, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(abs), 0o777); err != nil {
+			t.Fatalf("os.MkdirAll() error = %v", err)
+		}
+		if err := os.WriteFile(abs, []byte(content), 0o644); err != nil {
+			t.Fatalf("os.WriteFile() error = %v", err)
+		}
+		artifacts = append(artifacts, &api.Artifact{Path: path, AbsolutePath: abs})
+	}
+
+	for _, name := range []string{"bundle.zip", "bundle.tar.gz", "bundle.tgz", "bundle.tar.zst"} {
+		t.Run(name, func(t *testing.T) {
+			archivePath := filepath.Join(t.TempDir(), name)
+			if err := writeArtifactBundle(archivePath, artifacts); err != nil {
+				t.Fatalf("writeArtifactBundle() error = %v", err)
+			}
+
+			bundle, err := isArtifactBundle(archivePath)
+			if err != nil || !bundle {
+				t.Fatalf("isArtifactBundle() = (%t, %v), want (true, nil)", bundle, err)
+			}
+
+			dest := t.TempDir()
+			count, err := unpackArtifactBundle(archivePath, dest)
+			if err != nil {
+				t.Fatalf("unpackArtifactBundle() error = %v", err)
+			}
+			if count != len(files) {
+				t.Errorf("unpackArtifactBundle() count = %d, want %d", count, len(files))
+			}
+
+			for path, want := range files {
+				got, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(path)))
+				if err != nil {
+					t.Errorf("os.ReadFile(%q) error = %v", path, err)
+					continue
+				}
+				if string(got) != want {
+					t.Errorf("unpacked %q = %q, want %q", path, got, want)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(dest, artifactBundleMarker)); !os.IsNotExist(err) {
+				t.Errorf("the bundle marker was unpacked, os.Stat() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestArtifactBundleRejectsPathsOutsideWorkingDirectory(t *testing.T) {
+	abs := filepath.Join(t.TempDir(), "a.txt")
+	if err := os.WriteFile(abs, []byte("a"), 0o644); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+
+	err := writeArtifactBundle(filepath.Join(t.TempDir(), "bundle.zip"), []*api.Artifact{
+		{Path: "../a.txt", AbsolutePath: abs},
+	})
+	if err == nil {
+		t.Errorf("writeArtifactBundle() error = nil, want an error for ../a.txt")
+	}
+}
+
+func TestUnpackArtifactBundleRejectsPathsOutsideDestination(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "evil.zip")
+	f, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatalf("os.Create() error = %v", err)
+	}
+	zw := zip.NewWriter(f)
+	for _, name := range []string{artifactBundleMarker, "../../escaped.txt"} {
+		if _, err := zw.Create(name); err != nil {
+			t.Fatalf("zw.Create(%q) error = %v", name, err)
+		}
+	}
+	zw.Close()
+	f.Close()
+
+	dest := filepath.Join(t.TempDir(), "dest")
+	if _, err := unpackArtifactBundle(archivePath, dest); err == nil {
+		t.Errorf("unpackArtifactBundle() error = nil, want an error for ../../escaped.txt")
+	}
+}
+
+func TestIsArtifactBundleIgnoresOtherArchives(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "lambda.zip")
+	f, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatalf("os.Create() error = %v", err)
+	}
+	zw := zip.NewWriter(f)
+	if _, err := zw.Create("index.js"); err != nil {
+		t.Fatalf("zw.Create() error = %v", err)
+	}
+	zw.Close()
+	f.Close()
+
+	if bundle, err := isArtifactBundle(archivePath); err != nil || bundle {
+		t.Errorf("isArtifactBundle() = (%t, %v), want (false, nil)", bundle, err)
+	}
+}
+
+func TestGzippedArtifactIsDecompressedOnDownload(t *testing.T) {
+	content := "some log output\n"
+	abs := filepath.Join(t.TempDir(), "build.log")
+	if err := os.WriteFile(abs, []byte(content), 0o644); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+
+	compressed, cleanup, err := gzipArtifact(&api.Artifact{Path: "build.log", AbsolutePath: abs})
+	if err != nil {
+		t.Fatalf("gzipArtifact() error = %v", err)
+	}
+	defer cleanup()
+
+	if compressed.ContentEncoding != "gzip" {
+		t.Errorf("compressed.ContentEncoding = %q, want gzip", compressed.ContentEncoding)
+	}
+
+	// Check it's really gzipped
+	f, err := os.Open(compressed.AbsolutePath)
+	if err != nil {
+		t.Fatalf("os.Open() error = %v", err)
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip.NewReader() error = %v", err)
+	}
+	if got, _ := io.ReadAll(gr); string(got) != content {
+		t.Errorf("decompressed artifact = %q, want %q", got, content)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		http.ServeFile(w, r, compressed.AbsolutePath)
+	}))
+	defer server.Close()
+
+	// With and without the transport asking for gzip itself
+	for _, headers := range []map[string]string{nil, {"Accept-Encoding": "gzip"}} {
+		dest := t.TempDir()
+		err := NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+			URL:         server.URL,
+			Path:        "build.log",
+			Destination: dest,
+			Headers:     headers,
+			Retries:     1,
+		}).Start(context.Background())
+		if err != nil {
+			t.Fatalf("Download.Start() error = %v", err)
+		}
+
+		got, err := os.ReadFile(filepath.Join(dest, "build.log"))
+		if err != nil {
+			t.Fatalf("os.ReadFile() error = %v", err)
+		}
+		if string(got) != content {
+			t.Errorf("downloaded with headers %v = %q, want %q", headers, got, content)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// ArtifactBackend stores artifacts somewhere other than Buildkite's own
+// artifact storage. Backends are registered against the URL scheme of the
+// upload destinations they handle, e.g. "s3" for s3://my-bucket/foo.
+type ArtifactBackend interface {
+	// NewUploader returns an Uploader for uploading artifacts to a destination
+	NewUploader(l logger.Logger, c ArtifactBackendUploaderConfig) (Uploader, error)
+
+	// NewDownloader returns a Downloader for an artifact that was uploaded
+	// to a destination
+	NewDownloader(l logger.Logger, c ArtifactBackendDownloaderConfig) (Downloader, error)
+}
+
+// Downloader downloads a single artifact
+type Downloader interface {
+	Start(context.Context) error
+}
+
+type ArtifactBackendUploaderConfig struct {
+	// The context of the upload, for uploaders that can't be given one with
+	// each artifact. Defaults to context.Background().
+	Context context.Context
+
+	// Where the artifacts are being uploaded to, for example,
+	// s3://my-bucket-name/foo/bar
+	Destination string
+
+	// The build and job the artifacts belong to
+	BuildID string
+	JobID   string
+
+	// The size of the parts that large files are uploaded in, and how many
+	// parts of each file to upload at once, for backends that upload in parts
+	PartSize        int64
+	PartConcurrency int
+
+	// Whether or not HTTP calls should be debugged
+	DebugHTTP bool
+}
+
+type ArtifactBackendDownloaderConfig struct {
+	// Where the artifact was uploaded to, for example,
+	// s3://my-bucket-name/foo/bar
+	UploadDestination string
+
+	// The URL of the artifact
+	URL string
+
+	// The root directory of the download
+	Destination string
+
+	// The relative path that should be preserved in the download folder,
+	// also its location in the upload destination
+	Path string
+
+	// How many times should it retry the download before giving up
+	Retries int
+
+	// How long each attempt at downloading can take, if there's a limit
+	Timeout time.Duration
+
+	// If failed responses should be dumped to the log
+	DebugHTTP bool
+}
+
+var (
+	artifactBackendsMu sync.RWMutex
+	artifactBackends   = map[string]ArtifactBackend{
+		"s3":   &s3Backend{clients: map[string]*s3.S3{}},
+		"gs":   gsBackend{},
+		"rt":   artifactoryBackend{},
+		"az":   azureBlobBackend{},
+		"file": fileBackend{},
+	}
+
+	// From RFC 3986
+	artifactBackendSchemeRE = regexp.MustCompile(`^[a-z][a-z0-9+.-]*$`)
+)
+
+// RegisterArtifactBackend makes a backend available for upload destinations
+// with the URL scheme. Each scheme can only be registered once.
+func RegisterArtifactBackend(scheme string, backend ArtifactBackend) error {
+	if !artifactBackendSchemeRE.MatchString(scheme) {
+		return fmt.Errorf("invalid artifact backend scheme %q", scheme)
+	}
+
+	artifactBackendsMu.Lock()
+	defer artifactBackendsMu.Unlock()
+
+	if _, exists := artifactBackends[scheme]; exists {
+		return fmt.Errorf("an artifact backend for %s:// is already registered", scheme)
+	}
+	artifactBackends[scheme] = backend
+	return nil
+}
+
+// artifactBackendFor returns the backend registered for the scheme of the
+// destination, if there is one
+func artifactBackendFor(destination string) (ArtifactBackend, bool) {
+	scheme, _, found := strings.Cut(destination, "://")
+	if !found {
+		return nil, false
+	}
+
+	// Blob service URLs are https:// URLs, but need authorizing like az://
+	if isAzureBlobURL(destination) {
+		scheme = "az"
+	}
+
+	artifactBackendsMu.RLock()
+	defer artifactBackendsMu.RUnlock()
+
+	backend, ok := artifactBackends[scheme]
+	return backend, ok
+}
+
+// artifactBackendSchemes returns the schemes with registered backends, sorted
+// and formatted for messages, e.g. "gs://, rt:// or s3://"
+func artifactBackendSchemes() string {
+	artifactBackendsMu.RLock()
+	schemes := make([]string, 0, len(artifactBackends))
+	for scheme := range artifactBackends {
+		schemes = append(schemes, scheme+"://")
+	}
+	artifactBackendsMu.RUnlock()
+
+	sort.Strings(schemes)
+	if len(schemes) == 1 {
+		return schemes[0]
+	}
+	return strings.Join(schemes[:len(schemes)-1], ", ") + " or " + schemes[len(schemes)-1]
+}
+
+// s3Backend shares S3 clients between downloads, since creating them is kind
+// of an expensive operation, and each one only applies to one bucket
+type s3Backend struct {
+	mu      sync.Mutex
+	clients map[string]*s3.S3
+}
+
+func (b *s3Backend) NewUploader(l logger.Logger, c ArtifactBackendUploaderConfig) (Uploader, error) {
+	return NewS3Uploader(l, S3UploaderConfig{
+		Destination:     c.Destination,
+		PartSize:        c.PartSize,
+		PartConcurrency: c.PartConcurrency,
+		DebugHTTP:       c.DebugHTTP,
+	})
+}
+
+func (b *s3Backend) NewDownloader(l logger.Logger, c ArtifactBackendDownloaderConfig) (Downloader, error) {
+	bucketName, _ := ParseS3Destination(c.UploadDestination)
+
+	b.mu.Lock()
+	client, has := b.clients[bucketName]
+	if !has {
+		var err error
+		client, err = NewS3Client(l, bucketName)
+		if err != nil {
+			b.mu.Unlock()
+			return nil, fmt.Errorf("failed to create S3 client for bucket %s: %w", bucketName, err)
+		}
+		b.clients[bucketName] = client
+	}
+	b.mu.Unlock()
+
+	return NewS3Downloader(l, S3DownloaderConfig{
+		S3Client:    client,
+		Path:        c.Path,
+		S3Path:      c.UploadDestination,
+		Destination: c.Destination,
+		Retries:     c.Retries,
+		Timeout:     c.Timeout,
+		DebugHTTP:   c.DebugHTTP,
+	}), nil
+}
+
+type gsBackend struct{}
+
+func (gsBackend) NewUploader(l logger.Logger, c ArtifactBackendUploaderConfig) (Uploader, error) {
+	// Resumable uploads send their chunks in order, one at a time, so
+	// there's no PartConcurrency
+	return NewGSUploader(l, GSUploaderConfig{
+		Destination: c.Destination,
+		PartSize:    c.PartSize,
+		DebugHTTP:   c.DebugHTTP,
+	})
+}
+
+func (gsBackend) NewDownloader(l logger.Logger, c ArtifactBackendDownloaderConfig) (Downloader, error) {
+	return NewGSDownloader(l, GSDownloaderConfig{
+		Path:        c.Path,
+		Bucket:      c.UploadDestination,
+		Destination: c.Destination,
+		Retries:     c.Retries,
+		Timeout:     c.Timeout,
+		DebugHTTP:   c.DebugHTTP,
+	}), nil
+}
+
+type artifactoryBackend struct{}
+
+func (artifactoryBackend) NewUploader(l logger.Logger, c ArtifactBackendUploaderConfig) (Uploader, error) {
+	return NewArtifactoryUploader(l, ArtifactoryUploaderConfig{
+		Destination: c.Destination,
+		DebugHTTP:   c.DebugHTTP,
+	})
+}
+
+func (artifactoryBackend) NewDownloader(l logger.Logger, c ArtifactBackendDownloaderConfig) (Downloader, error) {
+	return NewArtifactoryDownloader(l, ArtifactoryDownloaderConfig{
+		Path:        c.Path,
+		Repository:  c.UploadDestination,
+		Destination: c.Destination,
+		Retries:     c.Retries,
+		Timeout:     c.Timeout,
+		DebugHTTP:   c.DebugHTTP,
+	}), nil
+}
+
+type azureBlobBackend struct{}
+
+func (azureBlobBackend) NewUploader(l logger.Logger, c ArtifactBackendUploaderConfig) (Uploader, error) {
+	return NewAzureBlobUploader(l, AzureBlobUploaderConfig{
+		Destination: c.Destination,
+		DebugHTTP:   c.DebugHTTP,
+	})
+}
+
+func (azureBlobBackend) NewDownloader(l logger.Logger, c ArtifactBackendDownloaderConfig) (Downloader, error) {
+	return NewAzureBlobDownloader(l, AzureBlobDownloaderConfig{
+		UploadDestination: c.UploadDestination,
+		Path:              c.Path,
+		Destination:       c.Destination,
+		Retries:           c.Retries,
+		Timeout:           c.Timeout,
+		DebugHTTP:         c.DebugHTTP,
+	}), nil
+}
+
+type fileBackend struct{}
+
+func (fileBackend) NewUploader(l logger.Logger, c ArtifactBackendUploaderConfig) (Uploader, error) {
+	return NewFileUploader(l, FileUploaderConfig{
+		Destination: c.Destination,
+		BuildID:     c.BuildID,
+		JobID:       c.JobID,
+	})
+}
+
+func (fileBackend) NewDownloader(l logger.Logger, c ArtifactBackendDownloaderConfig) (Downloader, error) {
+	return NewFileDownloader(l, FileDownloaderConfig{
+		URL:         c.URL,
+		Path:        c.Path,
+		Destination: c.Destination,
+	}), nil
+}
+
+// newDefaultDownloader returns a Downloader for artifacts in Buildkite's own
+// artifact storage
+func newDefaultDownloader(l logger.Logger, url string, c ArtifactBackendDownloaderConfig) Downloader {
+	return NewDownload(l, http.DefaultClient, DownloadConfig{
+		URL:         url,
+		Path:        c.Path,
+		Destination: c.Destination,
+		Retries:     c.Retries,
+		Timeout:     c.Timeout,
+		DebugHTTP:   c.DebugHTTP,
+	})
+}
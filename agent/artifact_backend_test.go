@@ -0,0 +1,192 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/shellwords"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// registerTestArtifactBackend registers a backend for the duration of a test
+func registerTestArtifactBackend(t *testing.T, scheme string, backend ArtifactBackend) {
+	t.Helper()
+	require.NoError(t, RegisterArtifactBackend(scheme, backend))
+	t.Cleanup(func() {
+		artifactBackendsMu.Lock()
+		defer artifactBackendsMu.Unlock()
+		delete(artifactBackends, scheme)
+	})
+}
+
+func TestRegisterArtifactBackend(t *testing.T) {
+	backend := &ExternalArtifactBackend{Command: "true"}
+
+	assert.Error(t, RegisterArtifactBackend("s3", backend), "builtin backends can't be replaced")
+	assert.Error(t, RegisterArtifactBackend("My Store", backend))
+
+	registerTestArtifactBackend(t, "myobj", backend)
+	assert.Error(t, RegisterArtifactBackend("myobj", backend))
+
+	got, ok := artifactBackendFor("myobj://bucket/foo")
+	assert.True(t, ok)
+	assert.Equal(t, backend, got)
+
+	_, ok = artifactBackendFor("myobj")
+	assert.False(t, ok)
+	_, ok = artifactBackendFor("nope://bucket")
+	assert.False(t, ok)
+
+	assert.Equal(t, "az://, file://, gs://, myobj://, rt:// or s3://", artifactBackendSchemes())
+}
+
+func TestParseExternalArtifactBackend(t *testing.T) {
+	scheme, backend, err := ParseExternalArtifactBackend("myobj=/usr/local/bin/myobj-artifacts --verbose")
+	require.NoError(t, err)
+	assert.Equal(t, "myobj", scheme)
+	assert.Equal(t, "/usr/local/bin/myobj-artifacts --verbose", backend.Command)
+
+	_, backend, err = ParseExternalArtifactBackend(`myobj="/opt/my backends/myobj" --verbose`)
+	require.NoError(t, err)
+	assert.Equal(t, `"/opt/my backends/myobj" --verbose`, backend.Command)
+
+	for _, s := range []string{"myobj", "=cmd", "myobj= ", `myobj="/opt/my backends/myobj`} {
+		_, _, err := ParseExternalArtifactBackend(s)
+		assert.Error(t, err, "ParseExternalArtifactBackend(%q)", s)
+	}
+}
+
+func TestExternalArtifactBackend(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test backend is a shell script")
+	}
+
+	// A "remote" store, that the script copies files to and from
+	dir := t.TempDir()
+	store := filepath.Join(dir, "store")
+	// In a path with a space, which the command has to quote
+	script := filepath.Join(dir, "my backends", "backend.sh")
+	require.NoError(t, os.MkdirAll(filepath.Dir(script), 0o755))
+	require.NoError(t, os.WriteFile(script, []byte(`#!/bin/sh
+set -eu
+case "$1" in
+  upload) mkdir -p "$(dirname "`+store+`/$3")" && cp "$4" "`+store+`/$3" ;;
+  download) cp "`+store+`/$3" "$4" ;;
+  *) echo "unknown command $1" >&2; exit 1 ;;
+esac
+`), 0o755))
+
+	backend := &ExternalArtifactBackend{Command: shellwords.Quote(script)}
+
+	src := filepath.Join(dir, "llamas.txt")
+	require.NoError(t, os.WriteFile(src, []byte("llamas"), 0o644))
+
+	uploader, err := backend.NewUploader(logger.Discard, ArtifactBackendUploaderConfig{Destination: "myobj://bucket/"})
+	require.NoError(t, err)
+
+	artifact := &api.Artifact{Path: "pkg/llamas.txt", AbsolutePath: src}
+	assert.Equal(t, "myobj://bucket/pkg/llamas.txt", uploader.URL(artifact))
+	require.NoError(t, uploader.Upload(artifact))
+
+	downloads := filepath.Join(dir, "downloads")
+	downloader, err := backend.NewDownloader(logger.Discard, ArtifactBackendDownloaderConfig{
+		UploadDestination: "myobj://bucket/",
+		Path:              "pkg/llamas.txt",
+		Destination:       downloads,
+		Retries:           1,
+	})
+	require.NoError(t, err)
+	require.NoError(t, downloader.Start(context.Background()))
+
+	got, err := os.ReadFile(filepath.Join(downloads, "pkg", "llamas.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "llamas", string(got))
+
+	// Failures include what the command said
+	downloader, err = backend.NewDownloader(logger.Discard, ArtifactBackendDownloaderConfig{
+		UploadDestination: "myobj://bucket/",
+		Path:              "alpacas.txt",
+		Destination:       downloads,
+		Retries:           1,
+	})
+	require.NoError(t, err)
+	err = downloader.Start(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "alpacas.txt")
+
+	// Uploads stop with the upload's context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	uploader, err = backend.NewUploader(logger.Discard, ArtifactBackendUploaderConfig{Context: ctx, Destination: "myobj://bucket/"})
+	require.NoError(t, err)
+	assert.ErrorIs(t, uploader.Upload(artifact), context.Canceled)
+}
+
+type fakeArtifactBackend struct {
+	downloaded chan string
+}
+
+func (b *fakeArtifactBackend) NewUploader(logger.Logger, ArtifactBackendUploaderConfig) (Uploader, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (b *fakeArtifactBackend) NewDownloader(l logger.Logger, c ArtifactBackendDownloaderConfig) (Downloader, error) {
+	return fakeDownloader{
+		path:       c.UploadDestination + c.Path,
+		target:     getTargetPath(c.Path, c.Destination),
+		downloaded: b.downloaded,
+	}, nil
+}
+
+type fakeDownloader struct {
+	path       string
+	target     string
+	downloaded chan string
+}
+
+func (d fakeDownloader) Start(context.Context) error {
+	d.downloaded <- d.path
+	return os.WriteFile(d.target, []byte(d.path), 0o644)
+}
+
+func TestArtifactDownloaderUsesRegisteredBackend(t *testing.T) {
+	backend := &fakeArtifactBackend{downloaded: make(chan string, 1)}
+	registerTestArtifactBackend(t, "fake", backend)
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.RequestURI() {
+		case "/builds/my-build/artifacts/search?state=finished":
+			fmt.Fprint(rw, `[{
+				"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+				"file_size": 3,
+				"path": "llamas.txt",
+				"url": "fake://bucket/llamas.txt",
+				"upload_destination": "fake://bucket/"
+			}]`)
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID:     "my-build",
+		Destination: t.TempDir(),
+	})
+	require.NoError(t, d.Download(context.Background()))
+	assert.Equal(t, "fake://bucket/llamas.txt", <-backend.downloaded)
+}
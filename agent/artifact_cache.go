@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// The object metadata that uploaders keep an artifact's SHA-256 in
+const artifactDigestMetadataKey = "sha256"
+
+var sha256SumRE = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// artifactBlobKey returns the key of the blob for an artifact's content,
+// which is shared by every job uploading to the bucket, or false if it
+// doesn't have a SHA-256
+func artifactBlobKey(artifact *api.Artifact) (string, bool) {
+	if !sha256SumRE.MatchString(artifact.Sha256Sum) {
+		return "", false
+	}
+	return "sha256/" + artifact.Sha256Sum, true
+}
+
+func artifactDigestMetadata(artifact *api.Artifact) map[string]string {
+	if artifact.Sha256Sum == "" {
+		return nil
+	}
+	return map[string]string{artifactDigestMetadataKey: artifact.Sha256Sum}
+}
+
+// checkArtifactBlob checks the size, content encoding and metadata of the
+// blob for an artifact's content against the artifact, before it's copied.
+// Anything that can write to the bucket can write to a blob's key, so its
+// key alone isn't enough to trust it.
+func checkArtifactBlob(artifact *api.Artifact, size int64, encoding string, metadata map[string]string) error {
+	var sha256sum string
+	for k, v := range metadata {
+		// S3 canonicalizes the case of metadata keys
+		if strings.EqualFold(k, artifactDigestMetadataKey) {
+			sha256sum = v
+		}
+	}
+	if sha256sum != artifact.Sha256Sum {
+		return fmt.Errorf("the blob for %s has a sha256 of %q, expected %q", artifact.Path, sha256sum, artifact.Sha256Sum)
+	}
+
+	// Compressed blobs aren't the size of the artifact
+	if encoding == "" && size != artifact.FileSize {
+		return fmt.Errorf("the blob for %s is %d bytes, expected %d", artifact.Path, size, artifact.FileSize)
+	}
+	return nil
+}
+
+// checkArtifactDigest checks the file at path against the SHA-256 of the
+// artifact, or its SHA-1 if it doesn't have one. Artifacts with neither
+// aren't checked.
+func checkArtifactDigest(path string, artifact *api.Artifact) error {
+	var h hash.Hash
+	var want string
+	switch {
+	case artifact.Sha256Sum != "":
+		h, want = sha256.New(), artifact.Sha256Sum
+	case artifact.Sha1Sum != "":
+		h, want = sha1.New(), artifact.Sha1Sum
+	default:
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := fmt.Sprintf("%x", h.Sum(nil)); got != want {
+		return fmt.Errorf("%s has a checksum of %s, expected %s", artifact.Path, got, want)
+	}
+	return nil
+}
+
+// ArtifactCache keeps downloaded artifacts by their SHA-256, so that ones
+// with the same content as an artifact downloaded before don't need to be
+// downloaded again
+type ArtifactCache struct {
+	// The directory the cache is kept in
+	Dir string
+}
+
+func (c *ArtifactCache) path(sha256sum string) string {
+	return filepath.Join(c.Dir, "sha256", sha256sum[:2], sha256sum)
+}
+
+// Get copies the cached content of an artifact to target, returning whether
+// it was cached
+func (c *ArtifactCache) Get(artifact *api.Artifact, target string) (bool, error) {
+	if !sha256SumRE.MatchString(artifact.Sha256Sum) {
+		return false, nil
+	}
+
+	cached := c.path(artifact.Sha256Sum)
+	if _, err := os.Stat(cached); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if err := copyFileAtomically(cached, target); err != nil {
+		return false, err
+	}
+
+	// Anything can write to the cache directory, so make sure it hasn't
+	// been changed since it was cached
+	if err := checkArtifactDigest(target, artifact); err != nil {
+		os.Remove(cached)
+		return false, nil
+	}
+	return true, nil
+}
+
+// Put adds the content of an artifact, which has been checked against its
+// SHA-256, to the cache
+func (c *ArtifactCache) Put(artifact *api.Artifact, path string) error {
+	if !sha256SumRE.MatchString(artifact.Sha256Sum) {
+		return nil
+	}
+	return copyFileAtomically(path, c.path(artifact.Sha256Sum))
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// The checksums of "hello"
+const (
+	helloSha1   = "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"
+	helloSha256 = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+)
+
+func TestCheckArtifactDigest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(path, []byte("hello"), 0o644); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		artifact api.Artifact
+		wantErr  bool
+	}{
+		{name: "sha256", artifact: api.Artifact{Sha256Sum: helloSha256, Sha1Sum: "wrong"}},
+		{name: "sha1 fallback", artifact: api.Artifact{Sha1Sum: helloSha1}},
+		{name: "no checksums", artifact: api.Artifact{}},
+		{name: "sha256 mismatch", artifact: api.Artifact{Sha256Sum: helloSha1 + "0000", Sha1Sum: helloSha1}, wantErr: true},
+		{name: "sha1 mismatch", artifact: api.Artifact{Sha1Sum: helloSha256}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkArtifactDigest(path, &tc.artifact)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("checkArtifactDigest() error = %v, want error: %t", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestArtifactCache(t *testing.T) {
+	cache := &ArtifactCache{Dir: t.TempDir()}
+	artifact := &api.Artifact{Path: "hello.txt", Sha256Sum: helloSha256}
+
+	src := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(src, []byte("hello"), 0o644); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+
+	target := filepath.Join(t.TempDir(), "out", "hello.txt")
+	if hit, err := cache.Get(artifact, target); err != nil || hit {
+		t.Fatalf("cache.Get() before Put = (%t, %v), want (false, nil)", hit, err)
+	}
+
+	if err := cache.Put(artifact, src); err != nil {
+		t.Fatalf("cache.Put() error = %v", err)
+	}
+	if hit, err := cache.Get(artifact, target); err != nil || !hit {
+		t.Fatalf("cache.Get() after Put = (%t, %v), want (true, nil)", hit, err)
+	}
+	if got, _ := os.ReadFile(target); string(got) != "hello" {
+		t.Errorf("cached copy = %q, want %q", got, "hello")
+	}
+
+	// A cache entry that's been changed is thrown away
+	if err := os.WriteFile(cache.path(helloSha256), []byte("goodbye"), 0o644); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+	if hit, err := cache.Get(artifact, target); err != nil || hit {
+		t.Errorf("cache.Get() of a changed entry = (%t, %v), want (false, nil)", hit, err)
+	}
+	if _, err := os.Stat(cache.path(helloSha256)); !os.IsNotExist(err) {
+		t.Errorf("changed cache entry wasn't removed, os.Stat() error = %v", err)
+	}
+
+	// Digests that aren't SHA-256s aren't used as paths
+	if err := cache.Put(&api.Artifact{Sha256Sum: "../../etc"}, src); err != nil {
+		t.Errorf("cache.Put() with an invalid digest error = %v, want nil", err)
+	}
+}
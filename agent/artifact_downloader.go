@@ -4,16 +4,23 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net/http"
 	"os"
+	pathpkg "path"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/logger"
 	"github.com/buildkite/agent/v3/pool"
+	"github.com/buildkite/roko"
+)
+
+const (
+	ArtifactConflictOverwrite = "overwrite"
+	ArtifactConflictSkip      = "skip"
+	ArtifactConflictFail      = "fail"
 )
 
 type ArtifactDownloaderConfig struct {
@@ -32,6 +39,38 @@ type ArtifactDownloaderConfig struct {
 	// Where we'll be downloading artifacts to
 	Destination string
 
+	// How long each attempt at downloading an artifact can take, if there's
+	// a limit
+	DownloadTimeout time.Duration
+
+	// Whether to check downloaded artifacts against their SHA-256 (or SHA-1),
+	// downloading them again if they don't match
+	Verify bool
+
+	// A directory to keep downloaded artifacts in by their SHA-256, and reuse
+	// them from, if any
+	CacheDir string
+
+	// Exclude artifacts with paths matching any of these globs
+	Exclude []string
+
+	// How many leading components to remove from the paths of artifacts,
+	// skipping artifacts with no more than that
+	StripComponents int
+
+	// Whether to download every artifact into the destination itself,
+	// without the directories in its path
+	Flatten bool
+
+	// What to do when more than one artifact would be downloaded to the
+	// same file, or a file is already there: ArtifactConflictOverwrite
+	// (the default), ArtifactConflictSkip or ArtifactConflictFail
+	OnConflict string
+
+	// Whether to leave bundles made by `artifact upload --bundle` as they
+	// are, rather than unpacking them
+	NoUnpack bool
+
 	// Whether to show HTTP debugging
 	DebugHTTP bool
 }
@@ -56,6 +95,13 @@ func NewArtifactDownloader(l logger.Logger, ac APIClient, c ArtifactDownloaderCo
 }
 
 func (a *ArtifactDownloader) Download(ctx context.Context) error {
+	switch a.conf.OnConflict {
+	case "", ArtifactConflictOverwrite, ArtifactConflictSkip, ArtifactConflictFail:
+	default:
+		return fmt.Errorf("Invalid conflict behaviour %q, it should be %s, %s or %s", a.conf.OnConflict,
+			ArtifactConflictOverwrite, ArtifactConflictSkip, ArtifactConflictFail)
+	}
+
 	// Turn the download destination into an absolute path and confirm it exists
 	downloadDestination, _ := filepath.Abs(a.conf.Destination)
 	fileInfo, err := os.Stat(downloadDestination)
@@ -73,79 +119,35 @@ func (a *ArtifactDownloader) Download(ctx context.Context) error {
 		return err
 	}
 
-	artifactCount := len(artifacts)
-
-	if artifactCount == 0 {
+	if len(artifacts) == 0 {
 		return errors.New("No artifacts found for downloading")
 	}
 
-	a.logger.Info("Found %d artifacts. Starting to download to: %s", artifactCount, downloadDestination)
+	downloads, err := a.plan(artifacts, downloadDestination)
+	if err != nil {
+		return err
+	}
+
+	a.logger.Info("Found %d artifacts. Starting to download to: %s", len(downloads), downloadDestination)
+
+	var cache *ArtifactCache
+	if a.conf.CacheDir != "" {
+		cache = &ArtifactCache{Dir: a.conf.CacheDir}
+	}
 
 	p := pool.New(pool.MaxConcurrencyLimit)
 	errors := []error{}
-	s3Clients, err := a.generateS3Clients(artifacts)
-	if err != nil {
-		return fmt.Errorf("failed to generate S3 clients for artifact upload: %w", err)
-	}
 
-	for _, artifact := range artifacts {
-		// Create new instance of the artifact for the goroutine
+	for _, d := range downloads {
+		// Create new instance of the download for the goroutine
 		// See: http://golang.org/doc/effective_go.html#channels
-		artifact := artifact
+		d := d
 
 		p.Spawn(func() {
-			// Convert windows paths to slashes, otherwise we get a literal
-			// download of "dir/dir/file" vs sub-directories on non-windows agents
-			path := artifact.Path
-			if runtime.GOOS != "windows" {
-				path = strings.Replace(path, `\`, `/`, -1)
-			}
-
-			// Handle downloading from S3, GS, or RT
-			var dler interface {
-				Start(context.Context) error
-			}
-			switch {
-			case strings.HasPrefix(artifact.UploadDestination, "s3://"):
-				bucketName, _ := ParseS3Destination(artifact.UploadDestination)
-				dler = NewS3Downloader(a.logger, S3DownloaderConfig{
-					S3Client:    s3Clients[bucketName],
-					Path:        path,
-					S3Path:      artifact.UploadDestination,
-					Destination: downloadDestination,
-					Retries:     5,
-					DebugHTTP:   a.conf.DebugHTTP,
-				})
-			case strings.HasPrefix(artifact.UploadDestination, "gs://"):
-				dler = NewGSDownloader(a.logger, GSDownloaderConfig{
-					Path:        path,
-					Bucket:      artifact.UploadDestination,
-					Destination: downloadDestination,
-					Retries:     5,
-					DebugHTTP:   a.conf.DebugHTTP,
-				})
-			case strings.HasPrefix(artifact.UploadDestination, "rt://"):
-				dler = NewArtifactoryDownloader(a.logger, ArtifactoryDownloaderConfig{
-					Path:        path,
-					Repository:  artifact.UploadDestination,
-					Destination: downloadDestination,
-					Retries:     5,
-					DebugHTTP:   a.conf.DebugHTTP,
-				})
-			default:
-				dler = NewDownload(a.logger, http.DefaultClient, DownloadConfig{
-					URL:         artifact.URL,
-					Path:        path,
-					Destination: downloadDestination,
-					Retries:     5,
-					DebugHTTP:   a.conf.DebugHTTP,
-				})
-			}
-
 			// If the downloaded encountered an error, lock
 			// the pool, collect it, then unlock the pool
 			// again.
-			if err := dler.Start(ctx); err != nil {
+			if err := a.download(ctx, d, downloadDestination, cache); err != nil {
 				a.logger.Error("Failed to download artifact: %s", err)
 
 				p.Lock()
@@ -164,27 +166,230 @@ func (a *ArtifactDownloader) Download(ctx context.Context) error {
 	return nil
 }
 
-// We want to have as few S3 clients as possible, as creating them is kind of an expensive operation
-// But it's also theoretically possible that we'll have multiple artifacts with different S3 buckets, and each
-// S3Client only applies to one bucket, so we need to store the S3 clients in a map, one for each bucket
-func (a *ArtifactDownloader) generateS3Clients(artifacts []*api.Artifact) (map[string]*s3.S3, error) {
-	s3Clients := map[string]*s3.S3{}
+// artifactDownload is an artifact, and where it's downloaded to
+type artifactDownload struct {
+	artifact *api.Artifact
+
+	// The artifact's path, with slashes
+	path string
+
+	// The file it's downloaded to
+	target string
+}
+
+// plan works out where each artifact is downloaded to, leaving out excluded
+// artifacts and resolving conflicts between artifacts with the same target
+func (a *ArtifactDownloader) plan(artifacts []*api.Artifact, destination string) ([]artifactDownload, error) {
+	var downloads []artifactDownload
+	byTarget := map[string]int{}
 
 	for _, artifact := range artifacts {
-		if !strings.HasPrefix(artifact.UploadDestination, "s3://") {
+		// Convert windows paths to slashes, otherwise we get a literal
+		// download of "dir/dir/file" vs sub-directories on non-windows agents
+		path := artifact.Path
+		if runtime.GOOS != "windows" {
+			path = strings.Replace(path, `\`, `/`, -1)
+		}
+
+		local, err := a.localPath(path)
+		if err != nil {
+			return nil, err
+		}
+		if local == "" {
+			continue
+		}
+
+		d := artifactDownload{
+			artifact: artifact,
+			path:     path,
+			target:   getTargetPath(local, destination),
+		}
+
+		if i, conflict := byTarget[d.target]; conflict {
+			other := downloads[i].artifact
+			switch a.conf.OnConflict {
+			case ArtifactConflictFail:
+				return nil, fmt.Errorf("%s from job %s and %s from job %s would both be downloaded to %s",
+					other.Path, other.JobID, artifact.Path, artifact.JobID, d.target)
+			case ArtifactConflictSkip:
+				a.logger.Info("Skipping %s from job %s, %s from job %s is downloaded to %s",
+					artifact.Path, artifact.JobID, other.Path, other.JobID, d.target)
+			default:
+				a.logger.Info("Downloading %s from job %s to %s, instead of %s from job %s",
+					artifact.Path, artifact.JobID, d.target, other.Path, other.JobID)
+				downloads[i] = d
+			}
 			continue
 		}
 
-		bucketName, _ := ParseS3Destination(artifact.UploadDestination)
-		if _, has := s3Clients[bucketName]; !has {
-			client, err := NewS3Client(a.logger, bucketName)
-			if err != nil {
-				return nil, fmt.Errorf("failed to create S3 client for bucket %s: %w", bucketName, err)
+		if a.conf.OnConflict == ArtifactConflictSkip || a.conf.OnConflict == ArtifactConflictFail {
+			if _, err := os.Lstat(d.target); err == nil {
+				if a.conf.OnConflict == ArtifactConflictFail {
+					return nil, fmt.Errorf("%s would be downloaded to %s, which already exists", artifact.Path, d.target)
+				}
+				a.logger.Info("Skipping %s, %s already exists", artifact.Path, d.target)
+				continue
 			}
+		}
+
+		byTarget[d.target] = len(downloads)
+		downloads = append(downloads, d)
+	}
+
+	return downloads, nil
+}
+
+// localPath returns the path within the destination to download an artifact
+// to, or "" if it's excluded
+func (a *ArtifactDownloader) localPath(artifactPath string) (string, error) {
+	for _, pattern := range a.conf.Exclude {
+		excluded, err := matchArtifactGlob(pattern, artifactPath)
+		if err != nil {
+			return "", err
+		}
+		if excluded {
+			a.logger.Debug("Skipping %s, it matches %q", artifactPath, pattern)
+			return "", nil
+		}
+	}
+
+	local := artifactPath
+	if a.conf.StripComponents > 0 {
+		components := strings.Split(strings.TrimPrefix(local, "/"), "/")
+		if len(components) <= a.conf.StripComponents {
+			a.logger.Debug("Skipping %s, it has no more than %d path components", artifactPath, a.conf.StripComponents)
+			return "", nil
+		}
+		local = strings.Join(components[a.conf.StripComponents:], "/")
+	}
+	if a.conf.Flatten {
+		local = pathpkg.Base(local)
+	}
+	return local, nil
+}
 
-			s3Clients[bucketName] = client
+// download downloads one artifact. It's downloaded into a directory of its
+// own and then moved into place, so that downloads going to the same target
+// never write to the same file at once.
+func (a *ArtifactDownloader) download(ctx context.Context, d artifactDownload, destination string, cache *ArtifactCache) error {
+	// Use a copy with the same content from the cache if there is one
+	if cache != nil {
+		cached, err := cache.Get(d.artifact, d.target)
+		if err != nil {
+			return err
 		}
+		if cached {
+			a.logger.Info("Using cached copy of \"%s\"", d.path)
+			return a.unpack(d.path, d.target, destination)
+		}
+	}
+
+	staging, err := os.MkdirTemp(destination, ".buildkite-artifact-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	conf := ArtifactBackendDownloaderConfig{
+		UploadDestination: d.artifact.UploadDestination,
+		URL:               d.artifact.URL,
+		Path:              d.path,
+		Destination:       staging,
+		Retries:           5,
+		Timeout:           a.conf.DownloadTimeout,
+		DebugHTTP:         a.conf.DebugHTTP,
+	}
+
+	// Download from the backend the artifact was uploaded to, or from
+	// Buildkite if it doesn't have one
+	var dler Downloader
+	if backend, ok := artifactBackendFor(d.artifact.UploadDestination); ok {
+		dler, err = backend.NewDownloader(a.logger, conf)
+		if err != nil {
+			return err
+		}
+	} else {
+		dler = newDefaultDownloader(a.logger, d.artifact.URL, conf)
+	}
+
+	// Artifacts are always verified before they're cached
+	staged := getTargetPath(d.path, staging)
+	if a.conf.Verify || cache != nil {
+		err = a.downloadVerified(ctx, dler, d.artifact, staged)
+	} else {
+		err = dler.Start(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
+	if err := os.MkdirAll(filepath.Dir(d.target), 0777); err != nil {
+		return fmt.Errorf("Failed to create folder for %s (%T: %v)", d.target, err, err)
+	}
+	if err := os.Rename(staged, d.target); err != nil {
+		return err
+	}
+
+	if cache != nil {
+		if err := cache.Put(d.artifact, d.target); err != nil {
+			a.logger.Warn("Couldn't cache \"%s\": %s", d.artifact.Path, err)
+		}
+	}
+
+	return a.unpack(d.path, d.target, destination)
+}
+
+// downloadVerified downloads an artifact and checks it against its digest,
+// downloading it again if it doesn't match. If it never matches, the file is
+// removed.
+func (a *ArtifactDownloader) downloadVerified(ctx context.Context, dler Downloader, artifact *api.Artifact, target string) error {
+	if artifact.Sha256Sum == "" && artifact.Sha1Sum == "" {
+		a.logger.Warn("\"%s\" has no checksum to verify it against", artifact.Path)
+		return dler.Start(ctx)
+	}
+
+	err := roko.NewRetrier(
+		roko.WithMaxAttempts(3),
+		roko.WithStrategy(roko.Constant(time.Second)),
+	).DoWithContext(ctx, func(r *roko.Retrier) error {
+		// The downloader retries failed downloads itself
+		if err := dler.Start(ctx); err != nil {
+			r.Break()
+			return err
+		}
+		if err := checkArtifactDigest(target, artifact); err != nil {
+			a.logger.Warn("%s (%s)", err, r)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		os.Remove(target)
+		return fmt.Errorf("Failed to verify %s: %w", artifact.Path, err)
+	}
+
+	a.logger.Debug("Verified \"%s\"", artifact.Path)
+	return nil
+}
+
+// unpack extracts a downloaded artifact into the destination if it's a
+// bundle, and removes the bundle
+func (a *ArtifactDownloader) unpack(path, archivePath, destination string) error {
+	if a.conf.NoUnpack || artifactArchiveFormat(path) == "" {
+		return nil
+	}
+
+	bundle, err := isArtifactBundle(archivePath)
+	if err != nil || !bundle {
+		return err
+	}
+
+	count, err := unpackArtifactBundle(archivePath, destination)
+	if err != nil {
+		return fmt.Errorf("Failed to unpack %s: %w", path, err)
 	}
+	a.logger.Info("Unpacked %d files from \"%s\"", count, path)
 
-	return s3Clients, nil
+	return os.Remove(archivePath)
 }
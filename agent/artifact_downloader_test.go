@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/buildkite/agent/v3/api"
@@ -48,3 +49,128 @@ func TestArtifactDownloaderConnectsToEndpoint(t *testing.T) {
 		t.Errorf("d.Download() = %v", err)
 	}
 }
+
+// sequenceDownloader writes each of its contents to target in turn, one per
+// download
+type sequenceDownloader struct {
+	target   string
+	contents []string
+	starts   int
+}
+
+func (d *sequenceDownloader) Start(context.Context) error {
+	content := d.contents[d.starts]
+	if d.starts < len(d.contents)-1 {
+		d.starts++
+	}
+	return os.WriteFile(d.target, []byte(content), 0o644)
+}
+
+func TestArtifactDownloaderVerifiesDownloads(t *testing.T) {
+	artifact := &api.Artifact{Path: "hello.txt", Sha256Sum: helloSha256}
+	a := NewArtifactDownloader(logger.Discard, nil, ArtifactDownloaderConfig{Verify: true})
+
+	t.Run("downloads again after a mismatch", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "hello.txt")
+		dler := &sequenceDownloader{target: target, contents: []string{"hel", "hello"}}
+
+		if err := a.downloadVerified(context.Background(), dler, artifact, target); err != nil {
+			t.Fatalf("a.downloadVerified() error = %v", err)
+		}
+		if got, _ := os.ReadFile(target); string(got) != "hello" {
+			t.Errorf("downloaded %q, want %q", got, "hello")
+		}
+	})
+
+	t.Run("fails and removes the file if it never matches", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "hello.txt")
+		dler := &sequenceDownloader{target: target, contents: []string{"goodbye"}}
+
+		if err := a.downloadVerified(context.Background(), dler, artifact, target); err == nil {
+			t.Fatalf("a.downloadVerified() error = nil, want a checksum mismatch")
+		}
+		if _, err := os.Stat(target); !os.IsNotExist(err) {
+			t.Errorf("the mismatched download is still there, os.Stat() error = %v", err)
+		}
+	})
+}
+
+func TestArtifactDownloaderLocalPath(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		conf ArtifactDownloaderConfig
+		path string
+		want string
+	}{
+		{name: "unchanged", path: "dist/linux/app", want: "dist/linux/app"},
+		{name: "strip", conf: ArtifactDownloaderConfig{StripComponents: 1}, path: "dist/linux/app", want: "linux/app"},
+		{name: "strip everything", conf: ArtifactDownloaderConfig{StripComponents: 3}, path: "dist/linux/app", want: ""},
+		{name: "flatten", conf: ArtifactDownloaderConfig{Flatten: true}, path: "dist/linux/app", want: "app"},
+		{name: "excluded", conf: ArtifactDownloaderConfig{Exclude: []string{"**/*.map"}}, path: "dist/js/app.js.map", want: ""},
+		{name: "not excluded", conf: ArtifactDownloaderConfig{Exclude: []string{"**/*.map"}}, path: "dist/js/app.js", want: "dist/js/app.js"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a := NewArtifactDownloader(logger.Discard, nil, tc.conf)
+			got, err := a.localPath(tc.path)
+			if err != nil {
+				t.Fatalf("a.localPath(%q) error = %v", tc.path, err)
+			}
+			if got != tc.want {
+				t.Errorf("a.localPath(%q) = %q, want %q", tc.path, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestArtifactDownloaderPlanConflicts(t *testing.T) {
+	dest := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dest, "existing.txt"), nil, 0o644); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+
+	artifacts := []*api.Artifact{
+		{Path: "a/report.txt", JobID: "job-1"},
+		{Path: "b/report.txt", JobID: "job-2"},
+		{Path: "existing.txt", JobID: "job-1"},
+	}
+
+	jobsOf := func(downloads []artifactDownload) map[string]string {
+		jobs := map[string]string{}
+		for _, d := range downloads {
+			rel, _ := filepath.Rel(dest, d.target)
+			jobs[filepath.ToSlash(rel)] = d.artifact.JobID
+		}
+		return jobs
+	}
+
+	for _, tc := range []struct {
+		onConflict string
+		want       map[string]string
+		wantErr    bool
+	}{
+		{onConflict: ArtifactConflictOverwrite, want: map[string]string{"report.txt": "job-2", "existing.txt": "job-1"}},
+		{onConflict: ArtifactConflictSkip, want: map[string]string{"report.txt": "job-1"}},
+		{onConflict: ArtifactConflictFail, wantErr: true},
+	} {
+		t.Run(tc.onConflict, func(t *testing.T) {
+			a := NewArtifactDownloader(logger.Discard, nil, ArtifactDownloaderConfig{
+				Flatten:    true,
+				OnConflict: tc.onConflict,
+			})
+
+			downloads, err := a.plan(artifacts, dest)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("a.plan() error = nil, want a conflict")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("a.plan() error = %v", err)
+			}
+			if got := jobsOf(downloads); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("a.plan() downloads = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
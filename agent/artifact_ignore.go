@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// The ignore file that's read from the working directory when uploading
+// artifacts, if there is one
+const DefaultArtifactIgnoreFile = ".buildkiteignore"
+
+// matchArtifactGlob returns whether a slash separated artifact path matches a
+// glob, where * and ? match within a path component, and ** matches any
+// number of whole components
+func matchArtifactGlob(pattern, name string) (bool, error) {
+	if _, err := path.Match(strings.ReplaceAll(pattern, "**", "*"), ""); err != nil {
+		return false, fmt.Errorf("invalid glob %q: %w", pattern, err)
+	}
+	return matchGlobComponents(strings.Split(pattern, "/"), strings.Split(name, "/")), nil
+}
+
+func matchGlobComponents(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchGlobComponents(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// readArtifactIgnoreFile reads the globs in an ignore file. Like a
+// .gitignore, each line is a pattern, and lines that are blank or start with
+// # are skipped. Patterns without a slash match at any depth, ones starting
+// with a slash only match from the working directory, and ones ending with a
+// slash only match directories. A pattern matching a directory matches
+// everything in it. Negated patterns aren't supported.
+func readArtifactIgnoreFile(l logger.Logger, filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var globs []string
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "!") {
+			l.Warn("%s:%d: negated patterns aren't supported, skipping %q", filename, lineNum, line)
+			continue
+		}
+		globs = append(globs, ignorePatternGlobs(line)...)
+	}
+	return globs, scanner.Err()
+}
+
+// ignorePatternGlobs turns an ignore file pattern into globs for
+// matchArtifactGlob, which match what the pattern does and everything under
+// it, as the pattern may match a directory
+func ignorePatternGlobs(pattern string) []string {
+	dirOnly := strings.HasSuffix(pattern, "/")
+	pattern = strings.TrimSuffix(pattern, "/")
+
+	switch {
+	case strings.HasPrefix(pattern, "/"):
+		pattern = strings.TrimPrefix(pattern, "/")
+	case !strings.Contains(pattern, "/"):
+		pattern = "**/" + pattern
+	}
+
+	if dirOnly {
+		return []string{pattern + "/**"}
+	}
+	return []string{pattern, pattern + "/**"}
+}
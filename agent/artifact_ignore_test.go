@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestMatchArtifactGlob(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*.log", "build.log", true},
+		{"*.log", "logs/build.log", false},
+		{"**/*.log", "build.log", true},
+		{"**/*.log", "logs/a/build.log", true},
+		{"node_modules/**", "node_modules/a/b.js", true},
+		{"node_modules/**", "src/node_modules/a.js", false},
+		{"**/node_modules/**", "src/node_modules/a.js", true},
+		{"dist/*/app", "dist/linux/app", true},
+		{"dist/*/app", "dist/linux/arm/app", false},
+	} {
+		got, err := matchArtifactGlob(tc.pattern, tc.name)
+		if err != nil {
+			t.Errorf("matchArtifactGlob(%q, %q) error = %v", tc.pattern, tc.name, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("matchArtifactGlob(%q, %q) = %t, want %t", tc.pattern, tc.name, got, tc.want)
+		}
+	}
+
+	if _, err := matchArtifactGlob("[", "a"); err == nil {
+		t.Errorf("matchArtifactGlob(%q) error = nil, want an invalid glob error", "[")
+	}
+}
+
+func TestReadArtifactIgnoreFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), ".buildkiteignore")
+	contents := `# Comments and blank lines are skipped
+
+*.tmp
+/coverage
+node_modules/
+docs/*.md
+!keep.tmp
+vendor
+`
+	if err := os.WriteFile(filename, []byte(contents), 0o644); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+
+	globs, err := readArtifactIgnoreFile(logger.Discard, filename)
+	if err != nil {
+		t.Fatalf("readArtifactIgnoreFile() error = %v", err)
+	}
+
+	want := []string{
+		"**/*.tmp", "**/*.tmp/**",
+		"coverage", "coverage/**",
+		"**/node_modules/**",
+		"docs/*.md", "docs/*.md/**",
+		"**/vendor", "**/vendor/**",
+	}
+	if len(globs) != len(want) {
+		t.Fatalf("readArtifactIgnoreFile() = %q, want %q", globs, want)
+	}
+	for i := range want {
+		if globs[i] != want[i] {
+			t.Errorf("readArtifactIgnoreFile()[%d] = %q, want %q", i, globs[i], want[i])
+		}
+	}
+
+	// Patterns without a trailing slash match directories too, and so
+	// everything in them
+	for name, wantIgnored := range map[string]bool{
+		"build.tmp":            true,
+		"coverage/index.html":  true,
+		"src/coverage/a.html":  false,
+		"vendor/x.js":          true,
+		"lib/vendor/pkg/y.js":  true,
+		"vendored.js":          false,
+		"node_modules/a/b.js":  true,
+		"docs/readme.md":       true,
+		"docs/guide/readme.md": false,
+	} {
+		ignored := false
+		for _, glob := range globs {
+			if ok, _ := matchArtifactGlob(glob, name); ok {
+				ignored = true
+			}
+		}
+		if ignored != wantIgnored {
+			t.Errorf("%q ignored = %t, want %t", name, ignored, wantIgnored)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package agent
 
 import (
 	"context"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/buildkite/agent/v3/api"
@@ -52,6 +54,32 @@ func (a *ArtifactSearcher) Search(ctx context.Context, query, scope string, incl
 		})
 		return searchErr
 	})
+	if err != nil {
+		return artifacts, err
+	}
+
+	a.resolveFileArtifacts(artifacts)
+
+	return artifacts, nil
+}
+
+// resolveFileArtifacts points the absolute paths of artifacts uploaded to a
+// file:// destination at where they are in that directory, rather than where
+// they were uploaded from
+func (a *ArtifactSearcher) resolveFileArtifacts(artifacts []*api.Artifact) {
+	for _, artifact := range artifacts {
+		if !strings.HasPrefix(artifact.UploadDestination, "file://") {
+			continue
+		}
 
-	return artifacts, err
+		path, err := localPathFromFileURL(artifact.URL)
+		if err != nil {
+			a.logger.Warn("Couldn't find where artifact %q is in %s (%s)", artifact.Path, artifact.UploadDestination, err)
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			a.logger.Warn("Artifact %q isn't in %s on this machine (%s)", artifact.Path, artifact.UploadDestination, err)
+		}
+		artifact.AbsolutePath = path
+	}
 }
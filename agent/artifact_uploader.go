@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/sha1"
 	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -15,6 +16,7 @@ import (
 	"time"
 
 	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/events"
 	"github.com/buildkite/agent/v3/experiments"
 	"github.com/buildkite/agent/v3/logger"
 	"github.com/buildkite/agent/v3/mime"
@@ -32,6 +34,9 @@ type ArtifactUploaderConfig struct {
 	// The ID of the Job
 	JobID string
 
+	// The ID of the Build the job belongs to
+	BuildID string
+
 	// The path of the uploads
 	Paths string
 
@@ -46,6 +51,34 @@ type ArtifactUploaderConfig struct {
 
 	// Whether to follow symbolic links when resolving globs
 	FollowSymlinks bool
+
+	// Skip files with paths matching any of these globs
+	Exclude []string
+
+	// A file of patterns to skip files matching, like a .gitignore. If it's
+	// empty, DefaultArtifactIgnoreFile is used if it exists.
+	IgnoreFile string
+
+	// Where to write a JSON manifest of the uploaded artifacts, if anywhere
+	Manifest string
+
+	// An archive to bundle all the files into, and upload instead of them
+	Bundle string
+
+	// Whether to gzip each file, and upload it with a Content-Encoding
+	Gzip bool
+
+	// Whether to copy files that have been uploaded to the bucket before
+	// with the same SHA-256, instead of uploading them again
+	Dedup bool
+
+	// The size of the parts that large files are uploaded in, and how many
+	// parts of each file to upload at once, where the destination supports it
+	PartSize        int64
+	PartConcurrency int
+
+	// Where to write upload progress events, if anywhere
+	Events *events.Stream
 }
 
 type ArtifactUploader struct {
@@ -79,6 +112,15 @@ func (a *ArtifactUploader) Upload(ctx context.Context) error {
 	} else {
 		a.logger.Info("Found %d files that match \"%s\"", len(artifacts), a.conf.Paths)
 
+		if a.conf.Bundle != "" {
+			bundle, cleanup, err := a.bundle(artifacts)
+			if err != nil {
+				return err
+			}
+			defer cleanup()
+			artifacts = []*api.Artifact{bundle}
+		}
+
 		if err := a.upload(ctx, artifacts); err != nil {
 			return err
 		}
@@ -87,6 +129,13 @@ func (a *ArtifactUploader) Upload(ctx context.Context) error {
 	return nil
 }
 
+// emit writes an event to the event stream, if there is one
+func (a *ArtifactUploader) emit(e events.Event) {
+	if err := a.conf.Events.Emit(e); err != nil {
+		a.logger.Warn("%s", err)
+	}
+}
+
 func isDir(path string) bool {
 	fi, err := os.Stat(path)
 	if err != nil {
@@ -101,6 +150,11 @@ func (a *ArtifactUploader) Collect() (artifacts []*api.Artifact, err error) {
 		return nil, err
 	}
 
+	excludes, err := a.excludes()
+	if err != nil {
+		return nil, err
+	}
+
 	// file paths are deduplicated after resolving globs etc
 	seenPaths := make(map[string]bool)
 
@@ -170,6 +224,13 @@ func (a *ArtifactUploader) Collect() (artifacts []*api.Artifact, err error) {
 				path = filepath.ToSlash(path)
 			}
 
+			if excluded, err := isExcluded(filepath.ToSlash(path), excludes); err != nil {
+				return nil, err
+			} else if excluded {
+				a.logger.Debug("Skipping excluded path %s", file)
+				continue
+			}
+
 			// Build an artifact object using the paths we have.
 			artifact, err := a.build(path, absolutePath, globPath)
 			if err != nil {
@@ -183,6 +244,67 @@ func (a *ArtifactUploader) Collect() (artifacts []*api.Artifact, err error) {
 	return artifacts, nil
 }
 
+// bundle archives the files of artifacts into a temporary file, returning the
+// artifact for it and a function that removes it
+func (a *ArtifactUploader) bundle(artifacts []*api.Artifact) (*api.Artifact, func(), error) {
+	if a.conf.Gzip {
+		return nil, nil, errors.New("Artifacts can't be both bundled and gzipped, bundles are already compressed")
+	}
+
+	dir, err := os.MkdirTemp("", "buildkite-artifact-bundle")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	archivePath := filepath.Join(dir, filepath.Base(a.conf.Bundle))
+	if err := writeArtifactBundle(archivePath, artifacts); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	artifact, err := a.build(filepath.ToSlash(a.conf.Bundle), archivePath, a.conf.Bundle)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	a.logger.Info("Bundled %d files into %s (%d bytes)", len(artifacts), artifact.Path, artifact.FileSize)
+	return artifact, cleanup, nil
+}
+
+// excludes returns the globs of files to skip, from the configuration and
+// the ignore file
+func (a *ArtifactUploader) excludes() ([]string, error) {
+	excludes := append([]string{}, a.conf.Exclude...)
+
+	ignoreFile := a.conf.IgnoreFile
+	if ignoreFile == "" {
+		if _, err := os.Stat(DefaultArtifactIgnoreFile); err != nil {
+			return excludes, nil
+		}
+		ignoreFile = DefaultArtifactIgnoreFile
+	}
+
+	globs, err := readArtifactIgnoreFile(a.logger, ignoreFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read ignore file: %w", err)
+	}
+	a.logger.Debug("Read %d patterns from %s", len(globs), ignoreFile)
+
+	return append(excludes, globs...), nil
+}
+
+func isExcluded(path string, excludes []string) (bool, error) {
+	for _, glob := range excludes {
+		excluded, err := matchArtifactGlob(glob, path)
+		if err != nil || excluded {
+			return excluded, err
+		}
+	}
+	return false, nil
+}
+
 func (a *ArtifactUploader) build(path string, absolutePath string, globPath string) (*api.Artifact, error) {
 	// Temporarily open the file to get its size
 	file, err := os.Open(absolutePath)
@@ -235,25 +357,21 @@ func (a *ArtifactUploader) upload(ctx context.Context, artifacts []*api.Artifact
 
 	// Determine what uploader to use
 	if a.conf.Destination != "" {
-		if strings.HasPrefix(a.conf.Destination, "s3://") {
-			uploader, err = NewS3Uploader(a.logger, S3UploaderConfig{
-				Destination: a.conf.Destination,
-				DebugHTTP:   a.conf.DebugHTTP,
-			})
-		} else if strings.HasPrefix(a.conf.Destination, "gs://") {
-			uploader, err = NewGSUploader(a.logger, GSUploaderConfig{
-				Destination: a.conf.Destination,
-				DebugHTTP:   a.conf.DebugHTTP,
-			})
-		} else if strings.HasPrefix(a.conf.Destination, "rt://") {
-			uploader, err = NewArtifactoryUploader(a.logger, ArtifactoryUploaderConfig{
-				Destination: a.conf.Destination,
-				DebugHTTP:   a.conf.DebugHTTP,
-			})
-		} else {
-			return errors.New(fmt.Sprintf("Invalid upload destination: '%v'. Only s3://, gs:// or rt:// upload destinations are allowed. Did you forget to surround your artifact upload pattern in double quotes?", a.conf.Destination))
+		backend, ok := artifactBackendFor(a.conf.Destination)
+		if !ok {
+			return errors.New(fmt.Sprintf("Invalid upload destination: '%v'. Only %s upload destinations are allowed. Did you forget to surround your artifact upload pattern in double quotes?", a.conf.Destination, artifactBackendSchemes()))
 		}
 
+		uploader, err = backend.NewUploader(a.logger, ArtifactBackendUploaderConfig{
+			Context:         ctx,
+			Destination:     a.conf.Destination,
+			BuildID:         a.conf.BuildID,
+			JobID:           a.conf.JobID,
+			PartSize:        a.conf.PartSize,
+			PartConcurrency: a.conf.PartConcurrency,
+			DebugHTTP:       a.conf.DebugHTTP,
+		})
+
 		a.logger.Info("Uploading to %q, using your agent configuration", a.conf.Destination)
 	} else {
 		uploader = NewFormUploader(a.logger, FormUploaderConfig{
@@ -268,6 +386,14 @@ func (a *ArtifactUploader) upload(ctx context.Context, artifacts []*api.Artifact
 		return fmt.Errorf("Error creating uploader: %v", err)
 	}
 
+	if _, ok := uploader.(contentEncodingUploader); a.conf.Gzip && !ok {
+		return errors.New("Gzipped artifacts can only be uploaded to S3, Google Cloud Storage or Azure Blob Storage destinations")
+	}
+
+	if _, ok := uploader.(dedupUploader); a.conf.Dedup && !ok {
+		return errors.New("Deduplicating artifacts is only supported for S3 and Google Cloud Storage destinations")
+	}
+
 	// Set the URLs of the artifacts based on the uploader
 	for _, artifact := range artifacts {
 		artifact.URL = uploader.URL(artifact)
@@ -297,7 +423,20 @@ func (a *ArtifactUploader) upload(ctx context.Context, artifacts []*api.Artifact
 
 	// A map to keep track of artifact states and how many we've uploaded
 	artifactStates := make(map[string]string)
+
+	// The final state of every artifact, for the manifest
+	finalStates := make(map[string]string)
 	artifactStatesUploaded := 0
+
+	// Keep track of progress for the event stream
+	progress := events.Event{ArtifactsTotal: len(artifacts)}
+	for _, artifact := range artifacts {
+		progress.ArtifactBytesTotal += artifact.FileSize
+	}
+
+	started := progress
+	started.Type = events.ArtifactUploadStarted
+	a.emit(started)
 	var artifactStatesMutex sync.Mutex
 
 	// Spin up a gourtine that'll uploading artifact statuses every few
@@ -368,19 +507,8 @@ func (a *ArtifactUploader) upload(ctx context.Context, artifacts []*api.Artifact
 
 			var state string
 
-			// Upload the artifact and then set the state depending
-			// on whether or not it passed. We'll retry the upload
-			// a couple of times before giving up.
-			err := roko.NewRetrier(
-				roko.WithMaxAttempts(10),
-				roko.WithStrategy(roko.Constant(5*time.Second)),
-			).DoWithContext(ctx, func(r *roko.Retrier) error {
-				if err := uploader.Upload(artifact); err != nil {
-					a.logger.Warn("%s (%s)", err, r)
-					return err
-				}
-				return nil
-			})
+			err := a.uploadArtifact(ctx, uploader, artifact)
+
 			// Did the upload eventually fail?
 			if err != nil {
 				a.logger.Error("Error uploading artifact \"%s\": %s", artifact.Path, err)
@@ -403,6 +531,19 @@ func (a *ArtifactUploader) upload(ctx context.Context, artifacts []*api.Artifact
 			// nothing else is changing it at the same time.
 			artifactStatesMutex.Lock()
 			artifactStates[artifact.ID] = state
+			finalStates[artifact.ID] = state
+
+			if state == "finished" {
+				progress.ArtifactsUploaded++
+				progress.ArtifactBytes += artifact.FileSize
+			} else {
+				progress.ArtifactsFailed++
+			}
+			uploaded := progress
+			uploaded.Type = events.ArtifactUploadProgress
+			uploaded.ArtifactPath = artifact.Path
+			a.emit(uploaded)
+
 			artifactStatesMutex.Unlock()
 		})
 	}
@@ -412,16 +553,139 @@ func (a *ArtifactUploader) upload(ctx context.Context, artifacts []*api.Artifact
 	// Wait for the pool to finish
 	p.Wait()
 
+	// Let the uploader clean up anything left over from failed uploads
+	if closer, ok := uploader.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			a.logger.Warn("Error cleaning up after uploads: %s", err)
+		}
+	}
+
 	a.logger.Debug("Uploads complete, waiting for upload status to be sent to buildkite...")
 
 	// Wait for the statuses to finish uploading
 	stateUploaderWaitGroup.Wait()
 
+	if a.conf.Manifest != "" {
+		if err := writeArtifactManifest(a.conf.Manifest, a.conf.Destination, artifacts, finalStates); err != nil {
+			errors = append(errors, err)
+			a.logger.Error("Error writing artifact manifest: %s", err)
+		} else {
+			a.logger.Info("Wrote a manifest of %d artifacts to %s", len(artifacts), a.conf.Manifest)
+		}
+	}
+
+	finished := progress
+	finished.Type = events.ArtifactUploadFinished
+
 	if len(errors) > 0 {
-		return fmt.Errorf("There were errors with uploading some of the artifacts")
+		err := fmt.Errorf("There were errors with uploading some of the artifacts")
+		finished.Error = err.Error()
+		a.emit(finished)
+		return err
 	}
 
+	a.emit(finished)
+
 	a.logger.Info("Artifact uploads completed successfully")
 
 	return nil
 }
+
+// uploadArtifact uploads the file of an artifact, retrying a few times before
+// giving up. When deduplicating, an artifact with the same content as one
+// that's been uploaded to the bucket before, by any job, is copied from it
+// within the bucket instead.
+func (a *ArtifactUploader) uploadArtifact(ctx context.Context, uploader Uploader, artifact *api.Artifact) error {
+	dedup, _ := uploader.(dedupUploader)
+	if !a.conf.Dedup {
+		dedup = nil
+	}
+
+	if dedup != nil {
+		copied, err := dedup.copyFromBlob(artifact)
+		if err != nil {
+			a.logger.Warn("Couldn't copy \"%s\" from an upload with the same content, uploading it instead: %s", artifact.Path, err)
+		}
+		if copied {
+			a.logger.Info("Skipped uploading \"%s\", it was copied from an upload with the same content", artifact.Path)
+			return nil
+		}
+	}
+
+	// Compress the artifact first if it's to be gzipped
+	upload := artifact
+	if a.conf.Gzip {
+		var cleanup func()
+		var err error
+		upload, cleanup, err = gzipArtifact(artifact)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+	}
+
+	err := roko.NewRetrier(
+		roko.WithMaxAttempts(10),
+		roko.WithStrategy(roko.Constant(5*time.Second)),
+	).DoWithContext(ctx, func(r *roko.Retrier) error {
+		if err := uploader.Upload(upload); err != nil {
+			a.logger.Warn("%s (%s)", err, r)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Keep a copy under its content's digest, for later uploads of the same
+	// content to be copied from
+	if dedup != nil {
+		if err := dedup.copyToBlob(artifact); err != nil {
+			a.logger.Warn("Couldn't keep a copy of \"%s\" for uploads of the same content to skip: %s", artifact.Path, err)
+		}
+	}
+	return nil
+}
+
+// artifactManifest is the JSON that's written by `artifact upload --manifest`
+type artifactManifest struct {
+	UploadDestination string                  `json:"upload_destination,omitempty"`
+	Artifacts         []artifactManifestEntry `json:"artifacts"`
+}
+
+type artifactManifestEntry struct {
+	ID        string `json:"id"`
+	Path      string `json:"path"`
+	URL       string `json:"url"`
+	FileSize  int64  `json:"file_size"`
+	Sha1Sum   string `json:"sha1sum"`
+	Sha256Sum string `json:"sha256sum,omitempty"`
+	State     string `json:"state"`
+}
+
+// writeArtifactManifest writes the artifacts, and the states they finished
+// uploading in, to a file as JSON
+func writeArtifactManifest(filename, destination string, artifacts []*api.Artifact, states map[string]string) error {
+	manifest := artifactManifest{
+		UploadDestination: destination,
+		Artifacts:         make([]artifactManifestEntry, 0, len(artifacts)),
+	}
+	for _, artifact := range artifacts {
+		manifest.Artifacts = append(manifest.Artifacts, artifactManifestEntry{
+			ID:        artifact.ID,
+			Path:      artifact.Path,
+			URL:       artifact.URL,
+			FileSize:  artifact.FileSize,
+			Sha1Sum:   artifact.Sha1Sum,
+			Sha256Sum: artifact.Sha256Sum,
+			State:     states[artifact.ID],
+		})
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0o644)
+}
@@ -308,3 +308,64 @@ func TestCollectWithDuplicateMatchesFollowingSymlinks(t *testing.T) {
 		paths,
 	)
 }
+
+func TestCollectWithExclusions(t *testing.T) {
+	wd, _ := os.Getwd()
+	root := filepath.Join(wd, "..")
+	os.Chdir(root)
+	defer os.Chdir(wd)
+
+	ignoreFile := filepath.Join(t.TempDir(), "ignore")
+	if err := os.WriteFile(ignoreFile, []byte("# Symlinked fixtures\nlinks/\n"), 0o644); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+
+	uploader := NewArtifactUploader(logger.Discard, nil, ArtifactUploaderConfig{
+		Paths:      filepath.Join("test", "fixtures", "artifacts", "**", "*.jpg"),
+		Exclude:    []string{"**/folder/*.jpg"},
+		IgnoreFile: ignoreFile,
+	})
+
+	artifacts, err := uploader.Collect()
+	if err != nil {
+		t.Fatalf("uploader.Collect() error = %v", err)
+	}
+
+	paths := []string{}
+	for _, a := range artifacts {
+		paths = append(paths, a.Path)
+	}
+	assert.ElementsMatch(
+		t,
+		[]string{
+			filepath.Join("test", "fixtures", "artifacts", "Mr Freeze.jpg"),
+			filepath.Join("test", "fixtures", "artifacts", "this is a folder with a space", "The Terminator.jpg"),
+		},
+		paths,
+	)
+}
+
+func TestWriteArtifactManifest(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "manifest.json")
+	artifacts := []*api.Artifact{
+		{ID: "a1", Path: "llamas.txt", URL: "https://example.com/llamas.txt", FileSize: 6, Sha1Sum: "sha1", Sha256Sum: "sha256"},
+		{ID: "a2", Path: "alpacas.txt", URL: "https://example.com/alpacas.txt", FileSize: 7, Sha1Sum: "sha1"},
+	}
+
+	err := writeArtifactManifest(filename, "s3://bucket/path", artifacts, map[string]string{"a1": "finished", "a2": "error"})
+	if err != nil {
+		t.Fatalf("writeArtifactManifest() error = %v", err)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("os.ReadFile() error = %v", err)
+	}
+	assert.JSONEq(t, `{
+		"upload_destination": "s3://bucket/path",
+		"artifacts": [
+			{"id": "a1", "path": "llamas.txt", "url": "https://example.com/llamas.txt", "file_size": 6, "sha1sum": "sha1", "sha256sum": "sha256", "state": "finished"},
+			{"id": "a2", "path": "alpacas.txt", "url": "https://example.com/alpacas.txt", "file_size": 7, "sha1sum": "sha1", "state": "error"}
+		]
+	}`, string(data))
+}
@@ -10,6 +10,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/buildkite/agent/v3/logger"
 )
@@ -28,6 +29,9 @@ type ArtifactoryDownloaderConfig struct {
 	// How many times should it retry the download before giving up
 	Retries int
 
+	// How long each attempt at downloading can take, if there's a limit
+	Timeout time.Duration
+
 	// If failed responses should be dumped to the log
 	DebugHTTP bool
 }
@@ -74,6 +78,7 @@ func (d ArtifactoryDownloader) Start(ctx context.Context) error {
 		Path:        d.conf.Path,
 		Destination: d.conf.Destination,
 		Retries:     d.conf.Retries,
+		Timeout:     d.conf.Timeout,
 		Headers:     headers,
 		DebugHTTP:   d.conf.DebugHTTP,
 	}).Start(ctx)
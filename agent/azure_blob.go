@@ -0,0 +1,210 @@
+package agent
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The Blob service REST API version requests are made with
+	azureBlobAPIVersion = "2020-10-02"
+
+	azureBlobHostSuffix = ".blob.core.windows.net"
+)
+
+// AzureBlobLocation is a container in an Azure Storage account, and a path
+// within it that blobs are kept under
+type AzureBlobLocation struct {
+	// The storage account name
+	Account string
+
+	// The container name
+	Container string
+
+	// The path within the container
+	Path string
+
+	// The Blob service endpoint, for example,
+	// https://my-account.blob.core.windows.net
+	Endpoint string
+}
+
+// ParseAzureBlobDestination parses a destination given as either
+// az://my-account/my-container/foo/bar or
+// https://my-account.blob.core.windows.net/my-container/foo/bar.
+//
+// BUILDKITE_AZURE_BLOB_ENDPOINT overrides the endpoint for az://
+// destinations, so that an emulator like Azurite can be used, for example,
+// http://127.0.0.1:10000/devstoreaccount1
+func ParseAzureBlobDestination(destination string) (*AzureBlobLocation, error) {
+	var account, rest string
+	switch {
+	case strings.HasPrefix(destination, "az://"):
+		account, rest, _ = strings.Cut(strings.TrimPrefix(destination, "az://"), "/")
+
+	case isAzureBlobURL(destination):
+		u, err := url.Parse(destination)
+		if err != nil {
+			return nil, err
+		}
+		account = strings.TrimSuffix(u.Hostname(), azureBlobHostSuffix)
+		rest = strings.TrimPrefix(u.Path, "/")
+
+	default:
+		return nil, fmt.Errorf("%q isn't an Azure Blob Storage destination", destination)
+	}
+
+	container, path, _ := strings.Cut(rest, "/")
+	if account == "" || container == "" {
+		return nil, fmt.Errorf("Azure Blob Storage destination %q needs an account and a container, like az://my-account/my-container", destination)
+	}
+
+	endpoint := "https://" + account + azureBlobHostSuffix
+	if override := os.Getenv("BUILDKITE_AZURE_BLOB_ENDPOINT"); override != "" && strings.HasPrefix(destination, "az://") {
+		endpoint = strings.TrimSuffix(override, "/")
+	}
+
+	return &AzureBlobLocation{
+		Account:   account,
+		Container: container,
+		Path:      strings.Trim(path, "/"),
+		Endpoint:  endpoint,
+	}, nil
+}
+
+// isAzureBlobURL returns whether the destination is a Blob service URL
+func isAzureBlobURL(destination string) bool {
+	u, err := url.Parse(destination)
+	return err == nil && u.Scheme == "https" && strings.HasSuffix(u.Hostname(), azureBlobHostSuffix)
+}
+
+// BlobURL returns the URL of the blob for an artifact path
+func (l *AzureBlobLocation) BlobURL(artifactPath string) string {
+	segments := []string{l.Container}
+	if l.Path != "" {
+		segments = append(segments, strings.Split(l.Path, "/")...)
+	}
+	segments = append(segments, strings.Split(strings.TrimPrefix(artifactPath, "/"), "/")...)
+
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return l.Endpoint + "/" + strings.Join(segments, "/")
+}
+
+// azureBlobCredentials authorize requests with either a shared access
+// signature, or an account key
+type azureBlobCredentials struct {
+	sasToken   string
+	accountKey []byte
+}
+
+// azureBlobCredentialsFromEnv reads credentials from
+// BUILDKITE_AZURE_BLOB_SAS_TOKEN or BUILDKITE_AZURE_BLOB_ACCOUNT_KEY
+func azureBlobCredentialsFromEnv() (*azureBlobCredentials, error) {
+	if sas := os.Getenv("BUILDKITE_AZURE_BLOB_SAS_TOKEN"); sas != "" {
+		return &azureBlobCredentials{sasToken: strings.TrimPrefix(sas, "?")}, nil
+	}
+
+	if key := os.Getenv("BUILDKITE_AZURE_BLOB_ACCOUNT_KEY"); key != "" {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("BUILDKITE_AZURE_BLOB_ACCOUNT_KEY isn't valid base64: %v", err)
+		}
+		return &azureBlobCredentials{accountKey: decoded}, nil
+	}
+
+	return nil, errors.New("Must set BUILDKITE_AZURE_BLOB_SAS_TOKEN or BUILDKITE_AZURE_BLOB_ACCOUNT_KEY when using an Azure Blob Storage destination")
+}
+
+// authorize adds the headers (or query parameters) that authorize the
+// request to an account. It must be called after all other headers are set.
+func (c *azureBlobCredentials) authorize(req *http.Request, account string) {
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureBlobAPIVersion)
+
+	if c.sasToken != "" {
+		if req.URL.RawQuery == "" {
+			req.URL.RawQuery = c.sasToken
+		} else {
+			req.URL.RawQuery += "&" + c.sasToken
+		}
+		return
+	}
+
+	req.Header.Set("Authorization", "SharedKey "+account+":"+c.sign(azureBlobStringToSign(req, account)))
+}
+
+// sign returns the Shared Key signature of a string
+func (c *azureBlobCredentials) sign(stringToSign string) string {
+	mac := hmac.New(sha256.New, c.accountKey)
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// azureBlobStringToSign builds the string that's signed for Shared Key
+// authorization. See
+// https://learn.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func azureBlobStringToSign(req *http.Request, account string) string {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	var sb strings.Builder
+	for _, s := range []string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, which x-ms-date replaces
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	} {
+		sb.WriteString(s)
+		sb.WriteString("\n")
+	}
+
+	// Canonicalized headers
+	var msHeaders []string
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			msHeaders = append(msHeaders, lower)
+		}
+	}
+	sort.Strings(msHeaders)
+	for _, name := range msHeaders {
+		sb.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+
+	// Canonicalized resource
+	sb.WriteString("/" + account + req.URL.EscapedPath())
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := query[name]
+		sort.Strings(values)
+		sb.WriteString("\n" + strings.ToLower(name) + ":" + strings.Join(values, ","))
+	}
+
+	return sb.String()
+}
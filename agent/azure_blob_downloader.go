@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+type AzureBlobDownloaderConfig struct {
+	// Where the artifact was uploaded to, for example,
+	// az://my-account/my-container/foo/bar
+	UploadDestination string
+
+	// The root directory of the download
+	Destination string
+
+	// The relative path that should be preserved in the download folder,
+	// also its location in the container
+	Path string
+
+	// How many times should it retry the download before giving up
+	Retries int
+
+	// How long each attempt at downloading can take, if there's a limit
+	Timeout time.Duration
+
+	// If failed responses should be dumped to the log
+	DebugHTTP bool
+}
+
+type AzureBlobDownloader struct {
+	// The download config
+	conf AzureBlobDownloaderConfig
+
+	// The logger instance to use
+	logger logger.Logger
+}
+
+func NewAzureBlobDownloader(l logger.Logger, c AzureBlobDownloaderConfig) *AzureBlobDownloader {
+	return &AzureBlobDownloader{
+		conf:   c,
+		logger: l,
+	}
+}
+
+func (d AzureBlobDownloader) Start(ctx context.Context) error {
+	location, err := ParseAzureBlobDestination(d.conf.UploadDestination)
+	if err != nil {
+		return err
+	}
+
+	credentials, err := azureBlobCredentialsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	// Each request is authorized separately, since resumed downloads sign
+	// their Range header too
+	return NewDownload(d.logger, http.DefaultClient, DownloadConfig{
+		URL:         location.BlobURL(d.conf.Path),
+		Path:        d.conf.Path,
+		Destination: d.conf.Destination,
+		Retries:     d.conf.Retries,
+		Timeout:     d.conf.Timeout,
+		Authorize: func(req *http.Request) {
+			credentials.authorize(req, location.Account)
+		},
+		DebugHTTP: d.conf.DebugHTTP,
+	}).Start(ctx)
+}
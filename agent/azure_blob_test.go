@@ -0,0 +1,186 @@
+package agent
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The well known Azurite account key
+const azuriteAccountKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+func TestParseAzureBlobDestination(t *testing.T) {
+	for _, tc := range []struct {
+		dest string
+		want AzureBlobLocation
+	}{
+		{
+			dest: "az://my-account/my-container",
+			want: AzureBlobLocation{Account: "my-account", Container: "my-container", Endpoint: "https://my-account.blob.core.windows.net"},
+		},
+		{
+			dest: "az://my-account/my-container/foo/bar/",
+			want: AzureBlobLocation{Account: "my-account", Container: "my-container", Path: "foo/bar", Endpoint: "https://my-account.blob.core.windows.net"},
+		},
+		{
+			dest: "https://my-account.blob.core.windows.net/my-container/foo",
+			want: AzureBlobLocation{Account: "my-account", Container: "my-container", Path: "foo", Endpoint: "https://my-account.blob.core.windows.net"},
+		},
+	} {
+		got, err := ParseAzureBlobDestination(tc.dest)
+		require.NoError(t, err, "ParseAzureBlobDestination(%q)", tc.dest)
+		assert.Equal(t, tc.want, *got, "ParseAzureBlobDestination(%q)", tc.dest)
+	}
+
+	for _, dest := range []string{"az://my-account", "s3://my-bucket", "https://example.com/my-container"} {
+		_, err := ParseAzureBlobDestination(dest)
+		assert.Error(t, err, "ParseAzureBlobDestination(%q)", dest)
+	}
+}
+
+func TestAzureBlobLocationBlobURL(t *testing.T) {
+	l := AzureBlobLocation{Container: "my-container", Path: "foo", Endpoint: "https://my-account.blob.core.windows.net"}
+	assert.Equal(t, "https://my-account.blob.core.windows.net/my-container/foo/pkg/llamas%20and%20alpacas.txt", l.BlobURL("pkg/llamas and alpacas.txt"))
+}
+
+func TestAzureBlobSharedKeySignature(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPut, "http://127.0.0.1:10000/devstoreaccount1/my-container/foo/llamas%20and%20alpacas.txt", strings.NewReader("llamas"))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	req.Header.Set("x-ms-date", "Mon, 02 Jan 2006 15:04:05 GMT")
+	req.Header.Set("x-ms-version", azureBlobAPIVersion)
+
+	got := azureBlobStringToSign(req, "devstoreaccount1")
+	want := "PUT\n\n\n6\n\ntext/plain\n\n\n\n\n\n\n" +
+		"x-ms-blob-type:BlockBlob\nx-ms-date:Mon, 02 Jan 2006 15:04:05 GMT\nx-ms-version:2020-10-02\n" +
+		"/devstoreaccount1/devstoreaccount1/my-container/foo/llamas%20and%20alpacas.txt"
+	assert.Equal(t, want, got)
+
+	key, err := base64.StdEncoding.DecodeString(azuriteAccountKey)
+	require.NoError(t, err)
+	creds := &azureBlobCredentials{accountKey: key}
+	assert.Equal(t, "pLURpHauJ73ANcW3QkZigRvgkCJ3A/fkgUHAyeg7UIs=", creds.sign(got))
+}
+
+// fakeAzurite stores blobs in memory, checking that requests are authorized
+type fakeAzurite struct {
+	creds *azureBlobCredentials
+
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func (f *fakeAzurite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("x-ms-version") == "" || r.Header.Get("x-ms-date") == "" {
+		http.Error(w, "missing x-ms headers", http.StatusBadRequest)
+		return
+	}
+
+	if f.creds.sasToken != "" {
+		if r.URL.Query().Get("sig") != "llamas" {
+			http.Error(w, "bad SAS", http.StatusForbidden)
+			return
+		}
+	} else {
+		want := "SharedKey devstoreaccount1:" + f.creds.sign(azureBlobStringToSign(r, "devstoreaccount1"))
+		if r.Header.Get("Authorization") != want {
+			w.Header().Set("x-ms-error-code", "AuthenticationFailed")
+			http.Error(w, "bad signature", http.StatusForbidden)
+			return
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			http.Error(w, "bad blob type", http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		f.blobs[r.URL.Path] = body
+		w.WriteHeader(http.StatusCreated)
+
+	case http.MethodGet:
+		body, ok := f.blobs[r.URL.Path]
+		if !ok {
+			w.Header().Set("x-ms-error-code", "BlobNotFound")
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Write(body)
+	}
+}
+
+func TestAzureBlobUploadAndDownload(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+	}{
+		{name: "account key", env: map[string]string{"BUILDKITE_AZURE_BLOB_ACCOUNT_KEY": azuriteAccountKey}},
+		{name: "SAS token", env: map[string]string{"BUILDKITE_AZURE_BLOB_SAS_TOKEN": "?sv=2020-10-02&sig=llamas"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			creds, err := azureBlobCredentialsFromEnv()
+			require.NoError(t, err)
+
+			fake := &fakeAzurite{creds: creds, blobs: map[string][]byte{}}
+			server := httptest.NewServer(fake)
+			defer server.Close()
+			t.Setenv("BUILDKITE_AZURE_BLOB_ENDPOINT", server.URL+"/devstoreaccount1")
+
+			dir := t.TempDir()
+			src := filepath.Join(dir, "llamas.txt")
+			require.NoError(t, os.WriteFile(src, []byte("llamas"), 0o644))
+
+			uploader, err := NewAzureBlobUploader(logger.Discard, AzureBlobUploaderConfig{
+				Destination: "az://devstoreaccount1/my-container/my-job",
+			})
+			require.NoError(t, err)
+
+			artifact := &api.Artifact{Path: "pkg/llamas.txt", AbsolutePath: src, ContentType: "text/plain"}
+			assert.Equal(t, server.URL+"/devstoreaccount1/my-container/my-job/pkg/llamas.txt", uploader.URL(artifact))
+			require.NoError(t, uploader.Upload(artifact))
+			assert.Equal(t, "llamas", string(fake.blobs["/devstoreaccount1/my-container/my-job/pkg/llamas.txt"]))
+
+			downloads := filepath.Join(dir, "downloads")
+			err = NewAzureBlobDownloader(logger.Discard, AzureBlobDownloaderConfig{
+				UploadDestination: "az://devstoreaccount1/my-container/my-job",
+				Path:              "pkg/llamas.txt",
+				Destination:       downloads,
+				Retries:           1,
+			}).Start(context.Background())
+			require.NoError(t, err)
+
+			got, err := os.ReadFile(filepath.Join(downloads, "pkg", "llamas.txt"))
+			require.NoError(t, err)
+			assert.Equal(t, "llamas", string(got))
+		})
+	}
+}
+
+func TestAzureBlobUploaderNeedsCredentials(t *testing.T) {
+	t.Setenv("BUILDKITE_AZURE_BLOB_SAS_TOKEN", "")
+	t.Setenv("BUILDKITE_AZURE_BLOB_ACCOUNT_KEY", "")
+
+	_, err := NewAzureBlobUploader(logger.Discard, AzureBlobUploaderConfig{Destination: "az://my-account/my-container"})
+	assert.Error(t, err)
+}
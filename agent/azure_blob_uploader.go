@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"os"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+type AzureBlobUploaderConfig struct {
+	// The destination which includes the storage account, container and
+	// path, for example, az://my-account/my-container/foo/bar
+	Destination string
+
+	// Whether or not HTTP calls should be debugged
+	DebugHTTP bool
+}
+
+type AzureBlobUploader struct {
+	// Where the artifacts are uploaded to
+	location *AzureBlobLocation
+
+	// How requests are authorized
+	credentials *azureBlobCredentials
+
+	// The HTTP client to use
+	client *http.Client
+
+	// The configuration
+	conf AzureBlobUploaderConfig
+
+	// The logger instance to use
+	logger logger.Logger
+}
+
+func NewAzureBlobUploader(l logger.Logger, c AzureBlobUploaderConfig) (*AzureBlobUploader, error) {
+	location, err := ParseAzureBlobDestination(c.Destination)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := azureBlobCredentialsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	l.Debug("Authorizing Azure Blob Storage requests to account %q", location.Account)
+
+	return &AzureBlobUploader{
+		location:    location,
+		credentials: credentials,
+		client:      &http.Client{},
+		conf:        c,
+		logger:      l,
+	}, nil
+}
+
+func (u *AzureBlobUploader) URL(artifact *api.Artifact) string {
+	return u.location.BlobURL(artifact.Path)
+}
+
+func (u *AzureBlobUploader) uploadsContentEncoding() {}
+
+func (u *AzureBlobUploader) Upload(artifact *api.Artifact) error {
+	u.logger.Debug("Reading file \"%s\"", artifact.AbsolutePath)
+	f, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file %q (%v)", artifact.AbsolutePath, err)
+	}
+
+	u.logger.Debug("Uploading \"%s\" to `%s`", artifact.Path, u.URL(artifact))
+
+	req, err := http.NewRequest(http.MethodPut, u.URL(artifact), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = fi.Size()
+	if fi.Size() == 0 {
+		// Otherwise the request would be sent chunked, which Put Blob
+		// doesn't support
+		req.Body = http.NoBody
+	}
+	req.Header.Set("Content-Type", artifact.ContentType)
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	if artifact.ContentEncoding != "" {
+		req.Header.Set("x-ms-blob-content-encoding", artifact.ContentEncoding)
+	}
+	u.credentials.authorize(req, u.location.Account)
+
+	res, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		if u.conf.DebugHTTP {
+			if dump, err := httputil.DumpResponse(res, true); err == nil {
+				u.logger.Debug("\n%s", string(dump))
+			}
+		}
+		return fmt.Errorf("uploading %s to Azure Blob Storage failed: %s (%s)",
+			artifact.Path, res.Status, res.Header.Get("x-ms-error-code"))
+	}
+
+	return nil
+}
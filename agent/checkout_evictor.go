@@ -0,0 +1,288 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/utils"
+)
+
+// DiskSpaceThreshold is an amount of free disk space, either a number of
+// bytes or a percentage of the disk. The zero value is no threshold at all.
+type DiskSpaceThreshold struct {
+	Bytes   uint64
+	Percent float64
+}
+
+var diskSpaceThresholdPattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*(%|[kmgt]i?b?|b)?$`)
+
+// ParseDiskSpaceThreshold parses a threshold like "10%", "500MB" or "20GiB".
+// Sizes are in powers of 1024, and a plain number is a number of bytes.
+func ParseDiskSpaceThreshold(s string) (DiskSpaceThreshold, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return DiskSpaceThreshold{}, nil
+	}
+
+	matches := diskSpaceThresholdPattern.FindStringSubmatch(strings.ToLower(s))
+	if matches == nil {
+		return DiskSpaceThreshold{}, fmt.Errorf("invalid amount of disk space %q, it should be a percentage like 10%% or a size like 20GB", s)
+	}
+
+	value, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return DiskSpaceThreshold{}, err
+	}
+
+	unit := strings.TrimSuffix(strings.TrimSuffix(matches[2], "b"), "i")
+	switch unit {
+	case "%":
+		if value > 100 {
+			return DiskSpaceThreshold{}, fmt.Errorf("invalid amount of disk space %q, it's more than 100%%", s)
+		}
+		return DiskSpaceThreshold{Percent: value}, nil
+	case "":
+		return DiskSpaceThreshold{Bytes: uint64(value)}, nil
+	}
+
+	multiplier := uint64(1)
+	for _, u := range "kmgt" {
+		multiplier *= 1024
+		if string(u) == unit {
+			break
+		}
+	}
+	return DiskSpaceThreshold{Bytes: uint64(value * float64(multiplier))}, nil
+}
+
+// IsZero returns whether there's no threshold
+func (t DiskSpaceThreshold) IsZero() bool {
+	return t.Bytes == 0 && t.Percent == 0
+}
+
+// Exceeds returns whether free bytes of a disk with total bytes is more than
+// the threshold
+func (t DiskSpaceThreshold) Exceeds(free, total uint64) bool {
+	if t.Percent > 0 {
+		return float64(free) >= float64(total)*t.Percent/100
+	}
+	return free >= t.Bytes
+}
+
+func (t DiskSpaceThreshold) String() string {
+	if t.Percent > 0 {
+		return strconv.FormatFloat(t.Percent, 'f', -1, 64) + "%"
+	}
+	return formatBytes(t.Bytes)
+}
+
+// CheckoutEvictionStats are what a CheckoutEvictor has done, for the status
+// page
+type CheckoutEvictionStats struct {
+	LastChecked time.Time `json:"last_checked"`
+	FreeBytes   uint64    `json:"free_bytes"`
+	TotalBytes  uint64    `json:"total_bytes"`
+	Evicted     int       `json:"evicted"`
+	FreedBytes  uint64    `json:"freed_bytes"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+func (s CheckoutEvictionStats) FreeSpace() string  { return formatBytes(s.FreeBytes) }
+func (s CheckoutEvictionStats) TotalSpace() string { return formatBytes(s.TotalBytes) }
+func (s CheckoutEvictionStats) FreedSpace() string { return formatBytes(s.FreedBytes) }
+
+// CheckoutEvictor removes the checkouts of an agent from the build path,
+// least recently used first, when the disk it's on is running out of space.
+// Each agent worker has its own, as it only ever looks at the checkouts of
+// its own agent, which aren't in use between jobs.
+type CheckoutEvictor struct {
+	logger  logger.Logger
+	dir     string
+	minFree DiskSpaceThreshold
+
+	// diskSpace is replaced in tests
+	diskSpace func(path string) (free, total uint64, err error)
+
+	mu    sync.Mutex
+	stats CheckoutEvictionStats
+}
+
+func NewCheckoutEvictor(l logger.Logger, buildPath, agentName string, minFree DiskSpaceThreshold) *CheckoutEvictor {
+	return &CheckoutEvictor{
+		logger:    l,
+		dir:       filepath.Join(buildPath, utils.DirForAgentName(agentName)),
+		minFree:   minFree,
+		diskSpace: diskSpace,
+	}
+}
+
+// CheckoutPath returns where the bootstrap checks out the pipeline of a job,
+// unless the job says otherwise
+func (e *CheckoutEvictor) CheckoutPath(orgSlug, pipelineSlug string) string {
+	return filepath.Join(e.dir, orgSlug, pipelineSlug)
+}
+
+// Stats returns what the evictor has done so far
+func (e *CheckoutEvictor) Stats() CheckoutEvictionStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.stats
+}
+
+// Evict removes checkouts, least recently used first, until there's more
+// free space than the threshold, keeping the checkout at keep. It then marks
+// keep as being used.
+func (e *CheckoutEvictor) Evict(keep string) error {
+	err := e.evict(keep)
+
+	e.mu.Lock()
+	e.stats.LastChecked = time.Now()
+	e.stats.LastError = ""
+	if err != nil {
+		e.stats.LastError = err.Error()
+	}
+	e.mu.Unlock()
+
+	now := time.Now()
+	if cerr := os.Chtimes(keep, now, now); cerr != nil && !os.IsNotExist(cerr) && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (e *CheckoutEvictor) evict(keep string) error {
+	// There's nothing to remove before the agent's first checkout
+	if _, err := os.Stat(e.dir); os.IsNotExist(err) {
+		return nil
+	}
+
+	free, total, err := e.checkDiskSpace()
+	if err != nil {
+		return err
+	}
+	if e.minFree.Exceeds(free, total) {
+		return nil
+	}
+
+	checkouts, err := e.checkouts(keep)
+	if err != nil {
+		return err
+	}
+
+	e.logger.Info("Only %s of %s is free on the disk with the build path, removing the least recently used of %d checkouts to free up to %s",
+		formatBytes(free), formatBytes(total), len(checkouts), e.minFree)
+
+	for _, checkout := range checkouts {
+		if err := os.RemoveAll(checkout); err != nil {
+			return fmt.Errorf("removing checkout %s: %w", checkout, err)
+		}
+		// Remove the organization's directory too once it's empty
+		_ = os.Remove(filepath.Dir(checkout))
+
+		before := free
+		if free, total, err = e.checkDiskSpace(); err != nil {
+			return err
+		}
+
+		e.mu.Lock()
+		e.stats.Evicted++
+		if free > before {
+			e.stats.FreedBytes += free - before
+		}
+		e.mu.Unlock()
+
+		e.logger.Info("Removed checkout %s, %s is now free", checkout, formatBytes(free))
+		if e.minFree.Exceeds(free, total) {
+			return nil
+		}
+	}
+
+	e.logger.Warn("There are no more checkouts to remove, and only %s of %s is free on the disk with the build path", formatBytes(free), formatBytes(total))
+	return nil
+}
+
+func (e *CheckoutEvictor) checkDiskSpace() (free, total uint64, err error) {
+	free, total, err = e.diskSpace(e.dir)
+	if err != nil {
+		return 0, 0, fmt.Errorf("checking free disk space: %w", err)
+	}
+
+	e.mu.Lock()
+	e.stats.FreeBytes, e.stats.TotalBytes = free, total
+	e.mu.Unlock()
+
+	return free, total, nil
+}
+
+// checkouts returns the checkouts in the agent's directory of the build
+// path, least recently used first, which is when the agent last started a
+// job with them or when the bootstrap last changed them
+func (e *CheckoutEvictor) checkouts(keep string) ([]string, error) {
+	type checkout struct {
+		path    string
+		modTime time.Time
+	}
+
+	orgs, err := os.ReadDir(e.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var checkouts []checkout
+	for _, org := range orgs {
+		if !org.IsDir() {
+			continue
+		}
+		pipelines, err := os.ReadDir(filepath.Join(e.dir, org.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, pipeline := range pipelines {
+			path := filepath.Join(e.dir, org.Name(), pipeline.Name())
+			if !pipeline.IsDir() || path == filepath.Clean(keep) {
+				continue
+			}
+			fi, err := pipeline.Info()
+			if err != nil {
+				return nil, err
+			}
+			checkouts = append(checkouts, checkout{path: path, modTime: fi.ModTime()})
+		}
+	}
+
+	sort.Slice(checkouts, func(i, j int) bool {
+		return checkouts[i].modTime.Before(checkouts[j].modTime)
+	})
+
+	paths := make([]string, len(checkouts))
+	for i, c := range checkouts {
+		paths[i] = c.path
+	}
+	return paths, nil
+}
+
+// formatBytes formats a number of bytes in the largest unit that fits, in
+// powers of 1024
+func formatBytes(bytes uint64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	div, exp := uint64(unit), 0
+	for n := bytes / unit; n >= unit && exp < 3; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(bytes)/float64(div), "KMGT"[exp])
+}
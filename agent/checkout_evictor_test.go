@@ -0,0 +1,183 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseDiskSpaceThreshold(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		input string
+		want  DiskSpaceThreshold
+	}{
+		{input: "", want: DiskSpaceThreshold{}},
+		{input: "10%", want: DiskSpaceThreshold{Percent: 10}},
+		{input: "12.5 %", want: DiskSpaceThreshold{Percent: 12.5}},
+		{input: "4096", want: DiskSpaceThreshold{Bytes: 4096}},
+		{input: "512B", want: DiskSpaceThreshold{Bytes: 512}},
+		{input: "2k", want: DiskSpaceThreshold{Bytes: 2 << 10}},
+		{input: "500MB", want: DiskSpaceThreshold{Bytes: 500 << 20}},
+		{input: "20GiB", want: DiskSpaceThreshold{Bytes: 20 << 30}},
+		{input: "1.5gb", want: DiskSpaceThreshold{Bytes: 3 << 29}},
+		{input: "1TB", want: DiskSpaceThreshold{Bytes: 1 << 40}},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.input, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := ParseDiskSpaceThreshold(test.input)
+			if err != nil {
+				t.Fatalf("ParseDiskSpaceThreshold(%q) error = %v", test.input, err)
+			}
+			if diff := cmp.Diff(got, test.want); diff != "" {
+				t.Errorf("ParseDiskSpaceThreshold(%q) diff (-got +want):\n%s", test.input, diff)
+			}
+		})
+	}
+}
+
+func TestParseDiskSpaceThresholdErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, input := range []string{"lots", "10PB", "-5%", "150%", "GB"} {
+		if _, err := ParseDiskSpaceThreshold(input); err == nil {
+			t.Errorf("ParseDiskSpaceThreshold(%q) error = nil, want an error", input)
+		}
+	}
+}
+
+func TestDiskSpaceThresholdExceeds(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		threshold   DiskSpaceThreshold
+		free, total uint64
+		want        bool
+	}{
+		{threshold: DiskSpaceThreshold{Percent: 10}, free: 10, total: 100, want: true},
+		{threshold: DiskSpaceThreshold{Percent: 10}, free: 9, total: 100, want: false},
+		{threshold: DiskSpaceThreshold{Bytes: 1024}, free: 1024, total: 1 << 20, want: true},
+		{threshold: DiskSpaceThreshold{Bytes: 1024}, free: 1023, total: 1 << 20, want: false},
+	}
+
+	for _, test := range tests {
+		if got := test.threshold.Exceeds(test.free, test.total); got != test.want {
+			t.Errorf("%s.Exceeds(%d, %d) = %t, want %t", test.threshold, test.free, test.total, got, test.want)
+		}
+	}
+}
+
+// fakeDisk pretends that each checkout in the build path takes up the same
+// amount of space on a disk
+type fakeDisk struct {
+	dir                   string
+	baseFree, perCheckout uint64
+	total                 uint64
+}
+
+func (d fakeDisk) diskSpace(string) (free, total uint64, err error) {
+	checkouts, err := filepath.Glob(filepath.Join(d.dir, "*", "*"))
+	if err != nil {
+		return 0, 0, err
+	}
+	return d.baseFree - uint64(len(checkouts))*d.perCheckout, d.total, nil
+}
+
+func makeCheckouts(t *testing.T, dir string, lastUsed map[string]time.Time) {
+	t.Helper()
+
+	for checkout, modTime := range lastUsed {
+		path := filepath.Join(dir, checkout)
+		if err := os.MkdirAll(filepath.Join(path, ".git"), 0o755); err != nil {
+			t.Fatalf("os.MkdirAll() error = %v", err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("os.Chtimes() error = %v", err)
+		}
+	}
+}
+
+func TestCheckoutEvictorRemovesLeastRecentlyUsedCheckouts(t *testing.T) {
+	t.Parallel()
+
+	buildPath := t.TempDir()
+	e := NewCheckoutEvictor(logger.Discard, buildPath, "my-agent-1", DiskSpaceThreshold{Percent: 55})
+
+	now := time.Now()
+	makeCheckouts(t, filepath.Join(buildPath, "my-agent-1"), map[string]time.Time{
+		"org/oldest":       now.Add(-3 * time.Hour),
+		"other-org/older":  now.Add(-2 * time.Hour),
+		"org/newest":       now.Add(-time.Hour),
+		"org/current":      now.Add(-4 * time.Hour),
+		"other-org/recent": now.Add(-30 * time.Minute),
+	})
+
+	// 5 checkouts of 10 bytes each leaves 40 of 100 bytes free, so removing
+	// the two least recently used gets above 55
+	e.diskSpace = fakeDisk{dir: e.dir, baseFree: 90, perCheckout: 10, total: 100}.diskSpace
+
+	keep := e.CheckoutPath("org", "current")
+	if err := e.Evict(keep); err != nil {
+		t.Fatalf("e.Evict(%q) error = %v", keep, err)
+	}
+
+	for checkout, wantExists := range map[string]bool{
+		"org/oldest":       false,
+		"other-org/older":  false,
+		"org/newest":       true,
+		"org/current":      true,
+		"other-org/recent": true,
+	} {
+		_, err := os.Stat(filepath.Join(e.dir, checkout))
+		if exists := err == nil; exists != wantExists {
+			t.Errorf("os.Stat(%s) error = %v, want exists = %t", checkout, err, wantExists)
+		}
+	}
+
+	fi, err := os.Stat(keep)
+	if err != nil {
+		t.Fatalf("os.Stat(%q) error = %v", keep, err)
+	}
+	if fi.ModTime().Before(now) {
+		t.Errorf("%s mod time = %v, want it marked as used after %v", keep, fi.ModTime(), now)
+	}
+
+	got := e.Stats()
+	got.LastChecked = time.Time{}
+	want := CheckoutEvictionStats{FreeBytes: 60, TotalBytes: 100, Evicted: 2, FreedBytes: 20}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("e.Stats() diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestCheckoutEvictorLeavesCheckoutsWithEnoughFreeSpace(t *testing.T) {
+	t.Parallel()
+
+	buildPath := t.TempDir()
+	e := NewCheckoutEvictor(logger.Discard, buildPath, "my-agent-1", DiskSpaceThreshold{Bytes: 50})
+
+	makeCheckouts(t, filepath.Join(buildPath, "my-agent-1"), map[string]time.Time{
+		"org/old": time.Now().Add(-24 * time.Hour),
+	})
+	e.diskSpace = fakeDisk{dir: e.dir, baseFree: 90, perCheckout: 10, total: 100}.diskSpace
+
+	if err := e.Evict(e.CheckoutPath("org", "new")); err != nil {
+		t.Fatalf("e.Evict() error = %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(e.dir, "org", "old")); err != nil {
+		t.Errorf("os.Stat(org/old) error = %v, want it kept", err)
+	}
+	if got := e.Stats().Evicted; got != 0 {
+		t.Errorf("e.Stats().Evicted = %d, want 0", got)
+	}
+}
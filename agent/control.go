@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// ControlServer serves an HTTP API on a unix socket, so that other processes
+// on the host (like an autoscaler) can drain the agent without signalling it.
+// Every request has to have an "Authorization: Bearer <token>" header.
+//
+//	GET  /state   reports the state of the agent and its workers
+//	POST /pause   stops the workers from accepting new jobs
+//	POST /resume  lets paused workers accept new jobs again
+//	POST /cancel  cancels any jobs that are running
+//	POST /stop    stops the workers once their jobs have finished, like SIGTERM
+//
+// Each of them responds with the state of the agent, as JSON.
+type ControlServer struct {
+	logger logger.Logger
+	pool   *AgentPool
+	token  []byte
+	path   string
+	ln     net.Listener
+	server *http.Server
+}
+
+// controlState is the body of every control server response
+type controlState struct {
+	State   string         `json:"state"`
+	Workers []WorkerHealth `json:"workers"`
+}
+
+// NewControlServer listens on a unix socket at path, which only the current
+// user can connect to. A socket left behind at path is replaced.
+func NewControlServer(l logger.Logger, pool *AgentPool, path, token string) (*ControlServer, error) {
+	if token == "" {
+		return nil, errors.New("the control server needs a token to authenticate requests with")
+	}
+
+	// A socket left behind by an agent that didn't exit cleanly would stop
+	// us listening, but anything else at path is left alone
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("removing old control socket: %w", err)
+		}
+	}
+
+	ln, err := listenPrivateUnix(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &ControlServer{
+		logger: l,
+		pool:   pool,
+		token:  []byte(token),
+		path:   path,
+		ln:     ln,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/state", c.handle(http.MethodGet, func() error { return nil }))
+	mux.HandleFunc("/pause", c.handle(http.MethodPost, func() error { pool.Pause(); return nil }))
+	mux.HandleFunc("/resume", c.handle(http.MethodPost, func() error { pool.Resume(); return nil }))
+	mux.HandleFunc("/cancel", c.handle(http.MethodPost, pool.CancelJobs))
+	mux.HandleFunc("/stop", c.handle(http.MethodPost, func() error { pool.Stop(true); return nil }))
+	c.server = &http.Server{Handler: mux}
+
+	return c, nil
+}
+
+// Serve handles requests until the server is closed
+func (c *ControlServer) Serve() error {
+	if err := c.server.Serve(c.ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Close stops the server and removes its socket
+func (c *ControlServer) Close() error {
+	err := c.server.Close()
+	if rmErr := os.Remove(c.path); rmErr != nil && !os.IsNotExist(rmErr) && err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// listenPrivateUnix listens on a unix socket at path that only the current
+// user can connect to. Sockets are made with the process umask, so it's made
+// in a directory only we can get into, made private there, and then moved to
+// path. Nobody else ever gets a chance to connect with looser permissions.
+func listenPrivateUnix(path string) (*net.UnixListener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".sock-")
+	if err != nil {
+		return nil, fmt.Errorf("creating private directory for socket: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket won't be at tmpPath by the time it's closed, and Close
+	// removes it from path itself
+	ln.SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmpPath, 0o600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("moving socket into place: %w", err)
+	}
+	return ln, nil
+}
+
+// handle returns a handler that authenticates the request, runs action, and
+// responds with the state of the agent
+func (c *ControlServer) handle(method string, action func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !c.authenticated(r) {
+			c.logger.Warn("Unauthenticated control request: %s %s", r.Method, r.URL.Path)
+			writeControlError(w, http.StatusUnauthorized, "missing or incorrect token")
+			return
+		}
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeControlError(w, http.StatusMethodNotAllowed, fmt.Sprintf("%s only accepts %s", r.URL.Path, method))
+			return
+		}
+
+		if method != http.MethodGet {
+			c.logger.Info("Control request: %s %s", r.Method, r.URL.Path)
+		}
+		if err := action(); err != nil {
+			writeControlError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(c.state())
+	}
+}
+
+func (c *ControlServer) authenticated(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), c.token) == 1
+}
+
+// state sums up the workers as "stopping" if any of them are, otherwise
+// "paused" if any of them are, otherwise "running"
+func (c *ControlServer) state() controlState {
+	s := controlState{State: "running", Workers: c.pool.Health()}
+	for _, worker := range s.Workers {
+		switch {
+		case worker.Stopping:
+			s.State = "stopping"
+		case worker.Paused && s.State == "running":
+			s.State = "paused"
+		}
+	}
+	return s
+}
+
+func writeControlError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{msg})
+}
@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func controlRequest(t *testing.T, path, method, url, token string) (int, controlState) {
+	t.Helper()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+	}
+
+	req, err := http.NewRequest(method, "http://agent"+url, nil)
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var state controlState
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&state))
+	return resp.StatusCode, state
+}
+
+func TestControlServer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+
+	worker := healthTestWorker(1)
+	worker.logger = logger.Discard
+	worker.stats.connectedAt = time.Now()
+	worker.stop = make(chan struct{})
+
+	cs, err := NewControlServer(logger.Discard, NewAgentPool([]*AgentWorker{worker}), path, "llamas")
+	require.NoError(t, err)
+	go cs.Serve()
+	defer cs.Close()
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	// The private directory the socket was made in is cleaned up
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "control.sock", entries[0].Name())
+
+	// Requests without the right token are turned away
+	code, _ := controlRequest(t, path, http.MethodPost, "/pause", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = controlRequest(t, path, http.MethodPost, "/pause", "alpacas")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.False(t, worker.Paused())
+
+	code, state := controlRequest(t, path, http.MethodGet, "/state", "llamas")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "running", state.State)
+	require.Len(t, state.Workers, 1)
+	assert.Equal(t, 1, state.Workers[0].SpawnIndex)
+
+	code, _ = controlRequest(t, path, http.MethodGet, "/pause", "llamas")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	code, state = controlRequest(t, path, http.MethodPost, "/pause", "llamas")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "paused", state.State)
+	assert.True(t, state.Workers[0].Paused)
+	assert.True(t, worker.Paused())
+
+	// There's no job to cancel, which is fine
+	code, state = controlRequest(t, path, http.MethodPost, "/cancel", "llamas")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "paused", state.State)
+
+	code, state = controlRequest(t, path, http.MethodPost, "/resume", "llamas")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "running", state.State)
+	assert.False(t, worker.Paused())
+
+	code, _ = controlRequest(t, path, http.MethodGet, "/stop", "llamas")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	// Workers stop gracefully, as they would for SIGTERM
+	code, state = controlRequest(t, path, http.MethodPost, "/stop", "llamas")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "stopping", state.State)
+	assert.True(t, state.Workers[0].Stopping)
+
+	_, state = controlRequest(t, path, http.MethodGet, "/state", "llamas")
+	assert.Equal(t, "stopping", state.State)
+}
+
+func TestControlServerReplacesOldSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+
+	// Left behind by an agent that didn't exit cleanly
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	require.NoError(t, err)
+	ln.SetUnlinkOnClose(false)
+	ln.Close()
+
+	cs, err := NewControlServer(logger.Discard, NewAgentPool(nil), path, "llamas")
+	require.NoError(t, err)
+	assert.NoError(t, cs.Close())
+
+	_, err = NewControlServer(logger.Discard, NewAgentPool(nil), path, "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,15 @@
+//go:build netbsd
+
+package agent
+
+import "golang.org/x/sys/unix"
+
+// diskSpace returns how many bytes are free for unprivileged users, and how
+// many there are in total, on the disk that path is on
+func diskSpace(path string) (free, total uint64, err error) {
+	var st unix.Statvfs_t
+	if err := unix.Statvfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return st.Bavail * st.Frsize, st.Blocks * st.Frsize, nil
+}
@@ -0,0 +1,15 @@
+//go:build openbsd
+
+package agent
+
+import "golang.org/x/sys/unix"
+
+// diskSpace returns how many bytes are free for unprivileged users, and how
+// many there are in total, on the disk that path is on
+func diskSpace(path string) (free, total uint64, err error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return uint64(st.F_bavail) * uint64(st.F_bsize), st.F_blocks * uint64(st.F_bsize), nil
+}
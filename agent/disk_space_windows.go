@@ -0,0 +1,18 @@
+//go:build windows
+
+package agent
+
+import "golang.org/x/sys/windows"
+
+// diskSpace returns how many bytes are free for the current user, and how
+// many there are in total, on the disk that path is on
+func diskSpace(path string) (free, total uint64, err error) {
+	dir, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := windows.GetDiskFreeSpaceEx(dir, &free, &total, nil); err != nil {
+		return 0, 0, err
+	}
+	return free, total, nil
+}
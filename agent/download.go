@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
@@ -8,6 +9,7 @@ import (
 	"net/http/httputil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -25,12 +27,19 @@ type DownloadConfig struct {
 	// Optional Headers to append to the request
 	Headers map[string]string
 
+	// Optionally authorizes each request, after its other headers are set
+	Authorize func(*http.Request)
+
 	// The relative path that should be preserved in the download folder
 	Path string
 
 	// How many times should it retry the download before giving up
 	Retries int
 
+	// How long each attempt can take, if there's a limit. Attempts carry on
+	// from where the last one got to.
+	Timeout time.Duration
+
 	// If failed responses should be dumped to the log
 	DebugHTTP bool
 }
@@ -44,6 +53,9 @@ type Download struct {
 
 	// The HTTP client to use for downloading
 	client *http.Client
+
+	// Whether downloads have to start from the beginning each attempt
+	noResume bool
 }
 
 func NewDownload(l logger.Logger, client *http.Client, c DownloadConfig) *Download {
@@ -54,8 +66,8 @@ func NewDownload(l logger.Logger, client *http.Client, c DownloadConfig) *Downlo
 	}
 }
 
-func (d Download) Start(ctx context.Context) error {
-	return roko.NewRetrier(
+func (d *Download) Start(ctx context.Context) error {
+	err := roko.NewRetrier(
 		roko.WithMaxAttempts(d.conf.Retries),
 		roko.WithStrategy(roko.Constant(5*time.Second)),
 	).DoWithContext(ctx, func(r *roko.Retrier) error {
@@ -65,6 +77,10 @@ func (d Download) Start(ctx context.Context) error {
 		}
 		return nil
 	})
+	if err != nil {
+		os.Remove(partialDownloadPath(getTargetPath(d.conf.Path, d.conf.Destination)))
+	}
+	return err
 }
 
 func getTargetPath(path string, destination string) string {
@@ -97,13 +113,31 @@ func getTargetPath(path string, destination string) string {
 	return targetFile
 }
 
-func (d Download) try(ctx context.Context) error {
+func (d *Download) try(ctx context.Context) error {
+	if d.conf.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.conf.Timeout)
+		defer cancel()
+	}
+
+	return d.download(ctx)
+}
+
+// download downloads the file, carrying on from an earlier attempt if it can
+func (d *Download) download(ctx context.Context) error {
 	targetFile := getTargetPath(d.conf.Path, d.conf.Destination)
 	targetDirectory, _ := filepath.Split(targetFile)
+	partialFile := partialDownloadPath(targetFile)
 
 	// Show a nice message that we're starting to download the file
 	d.logger.Debug("Downloading %s to %s", d.conf.URL, targetFile)
 
+	// Carry on from where an earlier attempt got to, if there was one
+	var offset int64
+	if fi, err := os.Stat(partialFile); err == nil && !d.noResume {
+		offset = fi.Size()
+	}
+
 	request, err := http.NewRequestWithContext(ctx, "GET", d.conf.URL, nil)
 	if err != nil {
 		return err
@@ -111,6 +145,15 @@ func (d Download) try(ctx context.Context) error {
 	for k, v := range d.conf.Headers {
 		request.Header.Add(k, v)
 	}
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		// A range of gzipped content can't be decompressed, so ask for it
+		// as it is
+		request.Header.Set("Accept-Encoding", "identity")
+	}
+	if d.conf.Authorize != nil {
+		d.conf.Authorize(request)
+	}
 
 	// Start by downloading the file
 	response, err := d.client.Do(request)
@@ -119,6 +162,13 @@ func (d Download) try(ctx context.Context) error {
 	}
 	defer response.Body.Close()
 
+	// The partial file is bigger than the artifact, so it must be of
+	// something else
+	if response.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		os.Remove(partialFile)
+		return &downloadError{response.Status}
+	}
+
 	// Double check the status
 	if response.StatusCode/100 != 2 && response.StatusCode/100 != 3 {
 		if d.conf.DebugHTTP {
@@ -133,30 +183,138 @@ func (d Download) try(ctx context.Context) error {
 		return &downloadError{response.Status}
 	}
 
+	// Go's transport decompresses gzipped artifacts itself, unless the
+	// request already had an Accept-Encoding header
+	body := io.Reader(response.Body)
+	if !response.Uncompressed && strings.EqualFold(response.Header.Get("Content-Encoding"), "gzip") {
+		// Ranges are of the compressed content, which can't be decompressed
+		// from part way through, so these downloads start again each time
+		d.noResume = true
+		if response.StatusCode == http.StatusPartialContent {
+			d.logger.Info("Can't resume downloading \"%s\", it's gzipped, so downloading all of it again", d.conf.Path)
+			response.Body.Close()
+			os.Remove(partialFile)
+			return d.download(ctx)
+		}
+
+		gr, err := gzip.NewReader(response.Body)
+		if err != nil {
+			return fmt.Errorf("Error decompressing %s (%T: %v)", d.conf.URL, err, err)
+		}
+		defer gr.Close()
+		body = gr
+	}
+
+	// The server may ignore the range, and send all of it
+	total := int64(-1)
+	if response.StatusCode == http.StatusPartialContent {
+		// Only a range that starts where the partial file ends can be added
+		// to it
+		first, size, ok := parseContentRange(response.Header.Get("Content-Range"))
+		if !ok || first != offset {
+			d.logger.Info("Can't resume downloading \"%s\" from %d bytes, the server sent %q, so downloading all of it again", d.conf.Path, offset, response.Header.Get("Content-Range"))
+			response.Body.Close()
+			os.Remove(partialFile)
+			return d.download(ctx)
+		}
+
+		d.logger.Info("Resuming download of \"%s\" from %d bytes", d.conf.Path, offset)
+		total = size
+		if total < 0 && response.ContentLength >= 0 {
+			total = offset + response.ContentLength
+		}
+	} else {
+		offset = 0
+		if body == response.Body && !response.Uncompressed {
+			total = response.ContentLength
+		}
+	}
+
 	// Now make the folder for our file
 	// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
 	if err := os.MkdirAll(targetDirectory, 0777); err != nil {
 		return fmt.Errorf("Failed to create folder for %s (%T: %v)", targetFile, err, err)
 	}
 
-	// Create a file to handle the file
-	fileBuffer, err := os.Create(targetFile)
+	// Create a file to download to, or add to the one from last time
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+	fileBuffer, err := os.OpenFile(partialFile, flags, 0o666)
 	if err != nil {
 		return fmt.Errorf("Failed to create file %s (%T: %v)", targetFile, err, err)
 	}
 	defer fileBuffer.Close()
 
 	// Copy the data to the file
-	bytes, err := io.Copy(fileBuffer, response.Body)
-	if err != nil {
+	progress := &downloadProgress{logger: d.logger, path: d.conf.Path, written: offset, total: total, logged: time.Now()}
+	if _, err := io.Copy(io.MultiWriter(fileBuffer, progress), body); err != nil {
 		return fmt.Errorf("Error when copying data %s (%T: %v)", d.conf.URL, err, err)
 	}
+	if err := fileBuffer.Close(); err != nil {
+		return fmt.Errorf("Failed to write file %s (%T: %v)", targetFile, err, err)
+	}
+	if err := os.Rename(partialFile, targetFile); err != nil {
+		return err
+	}
 
-	d.logger.Info("Successfully downloaded \"%s\" %d bytes", d.conf.Path, bytes)
+	d.logger.Info("Successfully downloaded \"%s\" %d bytes", d.conf.Path, progress.written)
 
 	return nil
 }
 
+// parseContentRange parses a Content-Range header of a range of bytes,
+// returning the offset of its first byte and the size of the whole file, or
+// -1 if the size isn't known
+func parseContentRange(header string) (first, size int64, ok bool) {
+	var last int64
+	var sizeStr string
+	if _, err := fmt.Sscanf(header, "bytes %d-%d/%s", &first, &last, &sizeStr); err != nil || first < 0 || last < first {
+		return 0, 0, false
+	}
+	if sizeStr == "*" {
+		return first, -1, true
+	}
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil || size <= last {
+		return 0, 0, false
+	}
+	return first, size, true
+}
+
+// partialDownloadPath returns where a file is downloaded to until it's
+// finished
+func partialDownloadPath(targetFile string) string {
+	return targetFile + ".partial"
+}
+
+// How often the progress of a download is logged
+var downloadProgressInterval = 10 * time.Second
+
+// downloadProgress logs how much of a file has been downloaded every so often
+type downloadProgress struct {
+	logger  logger.Logger
+	path    string
+	written int64
+	total   int64
+	logged  time.Time
+}
+
+func (p *downloadProgress) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+
+	if time.Since(p.logged) >= downloadProgressInterval {
+		p.logged = time.Now()
+		if p.total > 0 {
+			p.logger.Info("Downloading \"%s\": %d%% (%d of %d bytes)", p.path, p.written*100/p.total, p.written, p.total)
+		} else {
+			p.logger.Info("Downloading \"%s\": %d bytes", p.path, p.written)
+		}
+	}
+	return len(b), nil
+}
+
 type downloadError struct {
 	s string
 }
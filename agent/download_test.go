@@ -4,8 +4,21 @@
 package agent
 
 import (
-	"github.com/stretchr/testify/assert"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestGetTargetPath(t *testing.T) {
@@ -51,3 +64,202 @@ func TestGetTargetPath(t *testing.T) {
 	assert.Equal(t, "foo/app/logs/a.log", getTargetPath("app/logs/a.log", "foo/app"))
 	assert.Equal(t, "app/logs/a.log", getTargetPath("app/logs/a.log", "."))
 }
+
+func TestDownloadResumesFromPartialFile(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		first := len(ranges) == 1
+		mu.Unlock()
+
+		if first {
+			// Send some of it, then drop the connection
+			w.Header().Set("Content-Length", "10000")
+			w.Write(content[:4000])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	dest := t.TempDir()
+	d := NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+		URL:         server.URL,
+		Path:        "file.bin",
+		Destination: dest,
+		Retries:     1,
+	})
+
+	if err := d.try(context.Background()); err == nil {
+		t.Fatalf("first d.try() error = nil, want an error from the dropped connection")
+	}
+	if err := d.try(context.Background()); err != nil {
+		t.Fatalf("second d.try() error = %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dest, "file.bin"))
+	if err != nil {
+		t.Fatalf("os.ReadFile() error = %v", err)
+	}
+	assert.Equal(t, content, got)
+	assert.Equal(t, []string{"", "bytes=4000-"}, ranges)
+
+	if _, err := os.Stat(partialDownloadPath(filepath.Join(dest, "file.bin"))); !os.IsNotExist(err) {
+		t.Errorf("the partial file is still there, os.Stat() error = %v", err)
+	}
+}
+
+func TestDownloadStartsAgainWhenRangeIsIgnored(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("all of it"))
+	}))
+	defer server.Close()
+
+	dest := t.TempDir()
+	if err := os.WriteFile(partialDownloadPath(filepath.Join(dest, "file.txt")), []byte("all"), 0o644); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+
+	err := NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+		URL:         server.URL,
+		Path:        "file.txt",
+		Destination: dest,
+		Retries:     1,
+	}).Start(context.Background())
+	if err != nil {
+		t.Fatalf("Download.Start() error = %v", err)
+	}
+
+	got, _ := os.ReadFile(filepath.Join(dest, "file.txt"))
+	assert.Equal(t, "all of it", string(got))
+}
+
+func TestDownloadStartsAgainWhenRangeIsWrong(t *testing.T) {
+	content := "all of it"
+
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+
+		if r.Header.Get("Range") != "" {
+			// A partial response, but not of the range asked for
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(content)-1, len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	dest := t.TempDir()
+	if err := os.WriteFile(partialDownloadPath(filepath.Join(dest, "file.txt")), []byte("all"), 0o644); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+
+	d := NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+		URL:         server.URL,
+		Path:        "file.txt",
+		Destination: dest,
+		Retries:     1,
+	})
+	if err := d.try(context.Background()); err != nil {
+		t.Fatalf("d.try() error = %v", err)
+	}
+
+	got, _ := os.ReadFile(filepath.Join(dest, "file.txt"))
+	assert.Equal(t, content, string(got))
+	assert.Equal(t, []string{"bytes=3-", ""}, ranges)
+}
+
+func TestParseContentRange(t *testing.T) {
+	for header, want := range map[string]struct {
+		first, size int64
+		ok          bool
+	}{
+		"bytes 100-199/200": {first: 100, size: 200, ok: true},
+		"bytes 100-199/*":   {first: 100, size: -1, ok: true},
+		"bytes 100-199/150": {},
+		"bytes 199-100/200": {},
+		"bytes */200":       {},
+		"":                  {},
+	} {
+		first, size, ok := parseContentRange(header)
+		assert.Equal(t, want.ok, ok, header)
+		assert.Equal(t, want.first, first, header)
+		assert.Equal(t, want.size, size, header)
+	}
+}
+
+func TestDownloadStartsAgainInTheSameAttemptWhenRangeIsGzipped(t *testing.T) {
+	content := "some log output\n"
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	gw.Write([]byte(content))
+	gw.Close()
+
+	var mu sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Header.Get("Range")+" "+r.Header.Get("Accept-Encoding"))
+		mu.Unlock()
+
+		// Stored gzipped, so sent gzipped whatever was asked for
+		w.Header().Set("Content-Encoding", "gzip")
+		http.ServeContent(w, r, "build.log", time.Time{}, bytes.NewReader(compressed.Bytes()))
+	}))
+	defer server.Close()
+
+	dest := t.TempDir()
+	if err := os.WriteFile(partialDownloadPath(filepath.Join(dest, "build.log")), []byte("some"), 0o644); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+
+	d := NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+		URL:         server.URL,
+		Path:        "build.log",
+		Destination: dest,
+		Retries:     1,
+	})
+	if err := d.try(context.Background()); err != nil {
+		t.Fatalf("d.try() error = %v", err)
+	}
+
+	got, _ := os.ReadFile(filepath.Join(dest, "build.log"))
+	assert.Equal(t, content, string(got))
+	assert.Equal(t, []string{"bytes=4- identity", " gzip"}, requests)
+}
+
+func TestDownloadTimeoutAppliesToEachAttempt(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	d := NewDownload(logger.Discard, http.DefaultClient, DownloadConfig{
+		URL:         server.URL,
+		Path:        "slow.txt",
+		Destination: t.TempDir(),
+		Retries:     1,
+		Timeout:     50 * time.Millisecond,
+	})
+
+	start := time.Now()
+	err := d.try(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Errorf("d.try() error = %v, want a deadline exceeded error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("d.try() took %v, want it to time out after 50ms", elapsed)
+	}
+}
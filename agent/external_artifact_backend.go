@@ -0,0 +1,132 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/roko"
+	"github.com/buildkite/shellwords"
+)
+
+// ExternalArtifactBackend uploads and downloads artifacts by running a
+// command, so that artifacts can be stored anywhere without changing the
+// agent. The command is run as:
+//
+//	<command> upload <destination> <artifact path> <local file>
+//	<command> download <upload destination> <artifact path> <local file>
+//
+// and should exit non-zero if it fails. Anything it prints is logged.
+type ExternalArtifactBackend struct {
+	// The command to run, which can include arguments, split up like a
+	// shell would
+	Command string
+}
+
+// ParseExternalArtifactBackend parses a backend given as "scheme=command", for
+// example, "myobj=/usr/local/bin/myobj-artifacts"
+func ParseExternalArtifactBackend(s string) (string, *ExternalArtifactBackend, error) {
+	scheme, command, found := strings.Cut(s, "=")
+	if !found || scheme == "" || strings.TrimSpace(command) == "" {
+		return "", nil, fmt.Errorf("artifact backend %q should be given as scheme=command", s)
+	}
+	if _, err := shellwords.Split(command); err != nil {
+		return "", nil, fmt.Errorf("failed to split artifact backend command %q into tokens: %w", command, err)
+	}
+	return scheme, &ExternalArtifactBackend{Command: command}, nil
+}
+
+func (b *ExternalArtifactBackend) NewUploader(l logger.Logger, c ArtifactBackendUploaderConfig) (Uploader, error) {
+	ctx := c.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &externalUploader{ctx: ctx, backend: b, logger: l, destination: c.Destination}, nil
+}
+
+func (b *ExternalArtifactBackend) NewDownloader(l logger.Logger, c ArtifactBackendDownloaderConfig) (Downloader, error) {
+	return &externalDownloader{backend: b, logger: l, conf: c}, nil
+}
+
+// run runs the command with a subcommand and its arguments
+func (b *ExternalArtifactBackend) run(ctx context.Context, l logger.Logger, args ...string) error {
+	fields, err := shellwords.Split(b.Command)
+	if err != nil {
+		return fmt.Errorf("failed to split artifact backend command %q into tokens: %w", b.Command, err)
+	}
+	if len(fields) == 0 {
+		return fmt.Errorf("artifact backend command %q is empty", b.Command)
+	}
+	cmd := exec.CommandContext(ctx, fields[0], append(fields[1:], args...)...)
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err = cmd.Run()
+	if out := strings.TrimSpace(output.String()); out != "" {
+		l.Debug("%s %s: %s", fields[0], args[0], out)
+	}
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %w (%s)", fields[0], args[0], err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+type externalUploader struct {
+	// The context of the upload, as Upload isn't given one
+	ctx context.Context
+
+	backend     *ExternalArtifactBackend
+	logger      logger.Logger
+	destination string
+}
+
+func (u *externalUploader) URL(artifact *api.Artifact) string {
+	return strings.TrimSuffix(u.destination, "/") + "/" + strings.TrimPrefix(filepath.ToSlash(artifact.Path), "/")
+}
+
+func (u *externalUploader) Upload(artifact *api.Artifact) error {
+	return u.backend.run(u.ctx, u.logger, "upload", u.destination, artifact.Path, artifact.AbsolutePath)
+}
+
+type externalDownloader struct {
+	backend *ExternalArtifactBackend
+	logger  logger.Logger
+	conf    ArtifactBackendDownloaderConfig
+}
+
+func (d *externalDownloader) Start(ctx context.Context) error {
+	targetFile := getTargetPath(d.conf.Path, d.conf.Destination)
+
+	// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
+	if err := os.MkdirAll(filepath.Dir(targetFile), 0777); err != nil {
+		return fmt.Errorf("Failed to create folder for %s (%T: %v)", targetFile, err, err)
+	}
+
+	return roko.NewRetrier(
+		roko.WithMaxAttempts(d.conf.Retries),
+		roko.WithStrategy(roko.Constant(5*time.Second)),
+	).DoWithContext(ctx, func(r *roko.Retrier) error {
+		ctx := ctx
+		if d.conf.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d.conf.Timeout)
+			defer cancel()
+		}
+
+		if err := d.backend.run(ctx, d.logger, "download", d.conf.UploadDestination, d.conf.Path, targetFile); err != nil {
+			d.logger.Warn("Error trying to download %s (%s) %s", d.conf.Path, err, r)
+			return err
+		}
+		d.logger.Info("Successfully downloaded \"%s\"", d.conf.Path)
+		return nil
+	})
+}
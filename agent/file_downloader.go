@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"context"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+type FileDownloaderConfig struct {
+	// The file:// URL of the artifact
+	URL string
+
+	// The root directory of the download
+	Destination string
+
+	// The relative path that should be preserved in the download folder
+	Path string
+}
+
+// FileDownloader copies an artifact out of a directory that it was uploaded
+// to by a FileUploader
+type FileDownloader struct {
+	// The download config
+	conf FileDownloaderConfig
+
+	// The logger instance to use
+	logger logger.Logger
+}
+
+func NewFileDownloader(l logger.Logger, c FileDownloaderConfig) *FileDownloader {
+	return &FileDownloader{
+		conf:   c,
+		logger: l,
+	}
+}
+
+func (d FileDownloader) Start(ctx context.Context) error {
+	src, err := localPathFromFileURL(d.conf.URL)
+	if err != nil {
+		return err
+	}
+
+	targetFile := getTargetPath(d.conf.Path, d.conf.Destination)
+	d.logger.Debug("Copying %s to %s", src, targetFile)
+
+	if err := copyFileAtomically(src, targetFile); err != nil {
+		return err
+	}
+
+	d.logger.Info("Successfully downloaded \"%s\"", d.conf.Path)
+	return nil
+}
@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+type FileUploaderConfig struct {
+	// The directory artifacts are copied into, for example,
+	// file:///mnt/artifacts
+	Destination string
+
+	// The build and job the artifacts belong to, which they're kept under
+	// in the directory
+	BuildID string
+	JobID   string
+}
+
+// FileUploader copies artifacts into a directory, like a shared NFS volume,
+// keeping them under the IDs of their build and job
+type FileUploader struct {
+	// The directory artifacts are copied into
+	root string
+
+	// The configuration
+	conf FileUploaderConfig
+
+	// The logger instance to use
+	logger logger.Logger
+}
+
+func NewFileUploader(l logger.Logger, c FileUploaderConfig) (*FileUploader, error) {
+	root, err := ParseFileDestination(c.Destination)
+	if err != nil {
+		return nil, err
+	}
+	if c.BuildID == "" || c.JobID == "" {
+		return nil, errors.New("the build and job IDs are needed to upload artifacts to a file:// destination")
+	}
+
+	return &FileUploader{
+		root:   root,
+		conf:   c,
+		logger: l,
+	}, nil
+}
+
+// ParseFileDestination returns the local path of a file:// destination
+func ParseFileDestination(destination string) (string, error) {
+	return localPathFromFileURL(destination)
+}
+
+// localPathFromFileURL returns the local path of a file:// URL
+func localPathFromFileURL(fileURL string) (string, error) {
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("%q isn't a file:// URL", fileURL)
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("%q must have an absolute path, like file:///mnt/artifacts", fileURL)
+	}
+
+	path := u.Path
+	// file:///C:/artifacts has a path of /C:/artifacts
+	if runtime.GOOS == "windows" && len(path) > 2 && path[0] == '/' && path[2] == ':' {
+		path = path[1:]
+	}
+	if path == "" {
+		return "", fmt.Errorf("%q has no path", fileURL)
+	}
+
+	return filepath.FromSlash(path), nil
+}
+
+// fileArtifactURL returns the file:// URL of an artifact in a directory
+func fileArtifactURL(localPath string) string {
+	path := filepath.ToSlash(localPath)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
+
+func (u *FileUploader) path(artifact *api.Artifact) string {
+	return filepath.Join(u.root, u.conf.BuildID, u.conf.JobID, filepath.FromSlash(artifact.Path))
+}
+
+func (u *FileUploader) URL(artifact *api.Artifact) string {
+	return fileArtifactURL(u.path(artifact))
+}
+
+func (u *FileUploader) Upload(artifact *api.Artifact) error {
+	target := u.path(artifact)
+	u.logger.Debug("Copying \"%s\" to %s", artifact.Path, target)
+
+	return copyFileAtomically(artifact.AbsolutePath, target)
+}
+
+// copyFileAtomically copies a file by way of a temporary file next to the
+// target, so that nothing reading the target sees a partial copy
+func copyFileAtomically(src, target string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q (%v)", src, err)
+	}
+	defer in.Close()
+
+	// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
+	if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+		return fmt.Errorf("Failed to create folder for %s (%T: %v)", target, err, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to copy %q to %q (%v)", src, target, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// CreateTemp makes files only the user can read
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), target)
+}
@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFileDestination(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("paths are unix paths")
+	}
+
+	for dest, want := range map[string]string{
+		"file:///mnt/artifacts":           "/mnt/artifacts",
+		"file://localhost/mnt/artifacts/": "/mnt/artifacts/",
+	} {
+		got, err := ParseFileDestination(dest)
+		require.NoError(t, err, "ParseFileDestination(%q)", dest)
+		assert.Equal(t, want, got, "ParseFileDestination(%q)", dest)
+	}
+
+	for _, dest := range []string{"file://mnt/artifacts", "file://", "s3://my-bucket"} {
+		_, err := ParseFileDestination(dest)
+		assert.Error(t, err, "ParseFileDestination(%q)", dest)
+	}
+}
+
+func TestFileUploadDownloadAndSearch(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "nfs")
+
+	src := filepath.Join(dir, "llamas.txt")
+	require.NoError(t, os.WriteFile(src, []byte("llamas"), 0o600))
+
+	uploader, err := NewFileUploader(logger.Discard, FileUploaderConfig{
+		Destination: fileArtifactURL(root),
+		BuildID:     "my-build",
+		JobID:       "my-job",
+	})
+	require.NoError(t, err)
+
+	artifact := &api.Artifact{Path: "pkg/llamas.txt", AbsolutePath: src}
+	stored := filepath.Join(root, "my-build", "my-job", "pkg", "llamas.txt")
+	assert.Equal(t, fileArtifactURL(stored), uploader.URL(artifact))
+	require.NoError(t, uploader.Upload(artifact))
+
+	got, err := os.ReadFile(stored)
+	require.NoError(t, err)
+	assert.Equal(t, "llamas", string(got))
+
+	// Uploading again replaces it, and leaves nothing else behind
+	require.NoError(t, os.WriteFile(src, []byte("alpacas"), 0o600))
+	require.NoError(t, uploader.Upload(artifact))
+	entries, err := os.ReadDir(filepath.Dir(stored))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// Buildkite knows where it is
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.RequestURI() {
+		case "/builds/my-build/artifacts/search?state=finished":
+			fmt.Fprintf(rw, `[{
+				"id": "4600ac5c-5a13-4e92-bb83-f86f218f7b32",
+				"file_size": 7,
+				"absolute_path": "/somewhere/else/llamas.txt",
+				"path": "pkg/llamas.txt",
+				"url": %q,
+				"upload_destination": %q
+			}]`, uploader.URL(artifact), fileArtifactURL(root))
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ac := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    "llamasforever",
+	})
+
+	artifacts, err := NewArtifactSearcher(logger.Discard, ac, "my-build").Search(context.Background(), "", "", false, false)
+	require.NoError(t, err)
+	require.Len(t, artifacts, 1)
+	assert.Equal(t, stored, artifacts[0].AbsolutePath)
+
+	downloads := filepath.Join(dir, "downloads")
+	require.NoError(t, os.Mkdir(downloads, 0o777))
+	d := NewArtifactDownloader(logger.Discard, ac, ArtifactDownloaderConfig{
+		BuildID:     "my-build",
+		Destination: downloads,
+	})
+	require.NoError(t, d.Download(context.Background()))
+
+	got, err = os.ReadFile(filepath.Join(downloads, "pkg", "llamas.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "alpacas", string(got))
+}
+
+func TestFileUploaderNeedsBuildAndJob(t *testing.T) {
+	_, err := NewFileUploader(logger.Discard, FileUploaderConfig{Destination: "file:///mnt/artifacts", JobID: "my-job"})
+	assert.Error(t, err)
+}
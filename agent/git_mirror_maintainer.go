@@ -0,0 +1,237 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/experiments"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/status"
+	"github.com/gofrs/flock"
+	"github.com/nightlyone/lockfile"
+)
+
+// The bootstrap locks a mirror with files named after it while it clones or
+// updates it, and touches another when a job uses it
+const (
+	gitMirrorCloneLockSuffix  = ".clonelock"
+	gitMirrorUpdateLockSuffix = ".updatelock"
+	gitMirrorLastUsedSuffix   = ".lastused"
+)
+
+type GitMirrorMaintainerConfig struct {
+	// Path where the repository mirrors are stored
+	MirrorsPath string
+
+	// How often to fetch into and garbage collect the mirrors
+	Interval time.Duration
+
+	// Mirrors that no job has used for this long are removed. They're kept
+	// forever if it's 0.
+	MaxUnused time.Duration
+}
+
+// GitMirrorMaintainer looks after the git mirrors the bootstrap makes in the
+// background, so that jobs find more commits already in them and they don't
+// fill the disk. It never waits on a mirror that a job has locked, it tries
+// again next time instead.
+type GitMirrorMaintainer struct {
+	logger logger.Logger
+	conf   GitMirrorMaintainerConfig
+}
+
+func NewGitMirrorMaintainer(l logger.Logger, conf GitMirrorMaintainerConfig) *GitMirrorMaintainer {
+	return &GitMirrorMaintainer{
+		logger: l,
+		conf:   conf,
+	}
+}
+
+// Start maintains the mirrors every interval until the context is done
+func (m *GitMirrorMaintainer) Start(ctx context.Context) {
+	ctx, setStat, done := status.AddSimpleItem(ctx, "Git Mirror Maintainer")
+	defer done()
+
+	ticker := time.NewTicker(m.conf.Interval)
+	defer ticker.Stop()
+
+	for {
+		setStat("🧹 Maintaining git mirrors")
+		m.Maintain(ctx)
+
+		setStat("😴 Waiting until the next maintenance")
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Maintain removes each mirror that hasn't been used for too long, and
+// fetches into and garbage collects the rest
+func (m *GitMirrorMaintainer) Maintain(ctx context.Context) {
+	entries, err := os.ReadDir(m.conf.MirrorsPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			m.logger.Warn("Couldn't read git mirrors path %s (%s)", m.conf.MirrorsPath, err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return
+		}
+		if !entry.IsDir() {
+			continue
+		}
+
+		mirrorDir := filepath.Join(m.conf.MirrorsPath, entry.Name())
+		if err := m.maintainMirror(ctx, mirrorDir); err != nil {
+			m.logger.Warn("Couldn't maintain git mirror %s (%s)", mirrorDir, err)
+		}
+	}
+}
+
+func (m *GitMirrorMaintainer) maintainMirror(ctx context.Context, mirrorDir string) error {
+	lastUsed, err := gitMirrorLastUsed(mirrorDir)
+	if err != nil {
+		return err
+	}
+	if m.conf.MaxUnused > 0 && time.Since(lastUsed) > m.conf.MaxUnused {
+		return m.removeMirror(mirrorDir)
+	}
+
+	// Jobs fetch into mirrors too, so there's no need if one has recently
+	if fi, err := os.Stat(filepath.Join(mirrorDir, "FETCH_HEAD")); err == nil && time.Since(fi.ModTime()) < m.conf.Interval {
+		return nil
+	}
+
+	if fetched, err := m.fetchIntoMirror(ctx, mirrorDir); !fetched || err != nil {
+		return err
+	}
+
+	// Checkouts borrow objects from mirrors with alternates, and still need
+	// them once nothing in the mirror refers to them, so nothing is pruned.
+	// That also makes it safe to do without the lock, which jobs would
+	// otherwise have to wait for.
+	return runGit(ctx, "--git-dir", mirrorDir, "gc", "--auto", "--quiet", "--prune=never")
+}
+
+// fetchIntoMirror fetches into a mirror while holding the lock jobs take to
+// update it, returning false if a job has it. Branches that have been
+// deleted upstream are kept, as checkouts may still need their commits, and
+// garbage collecting is left until the lock's released.
+func (m *GitMirrorMaintainer) fetchIntoMirror(ctx context.Context, mirrorDir string) (bool, error) {
+	unlock, err := tryLockGitMirror(mirrorDir + gitMirrorUpdateLockSuffix)
+	if err != nil {
+		m.logger.Debug("Skipping git mirror %s until next time (%s)", mirrorDir, err)
+		return false, nil
+	}
+	defer unlock()
+
+	m.logger.Debug("Fetching into git mirror %s", mirrorDir)
+	return true, runGit(ctx, "--git-dir", mirrorDir, "fetch", "--no-auto-gc", "origin")
+}
+
+// removeMirror removes a mirror once it has both of the locks that jobs take
+// before cloning or updating it
+func (m *GitMirrorMaintainer) removeMirror(mirrorDir string) error {
+	for _, suffix := range []string{gitMirrorCloneLockSuffix, gitMirrorUpdateLockSuffix} {
+		unlock, err := tryLockGitMirror(mirrorDir + suffix)
+		if err != nil {
+			m.logger.Debug("Skipping git mirror %s until next time (%s)", mirrorDir, err)
+			return nil
+		}
+		defer unlock()
+	}
+
+	// A job might have used it before we got the locks
+	lastUsed, err := gitMirrorLastUsed(mirrorDir)
+	if err != nil {
+		return err
+	}
+	if time.Since(lastUsed) <= m.conf.MaxUnused {
+		return nil
+	}
+
+	m.logger.Info("Removing git mirror %s, it hasn't been used since %s", mirrorDir, lastUsed.Format(time.RFC3339))
+	if err := os.RemoveAll(mirrorDir); err != nil {
+		return err
+	}
+	return os.Remove(mirrorDir + gitMirrorLastUsedSuffix)
+}
+
+// gitMirrorLastUsed returns when a job last used a mirror. Mirrors that jobs
+// haven't recorded using yet are counted as being used now.
+func gitMirrorLastUsed(mirrorDir string) (time.Time, error) {
+	path := mirrorDir + gitMirrorLastUsedSuffix
+
+	fi, err := os.Stat(path)
+	if err == nil {
+		return fi.ModTime(), nil
+	}
+	if !os.IsNotExist(err) {
+		return time.Time{}, err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Now(), f.Close()
+}
+
+// tryLockGitMirror takes a lock on a mirror the same way the bootstrap does,
+// without waiting for it, and returns a function that releases it
+func tryLockGitMirror(path string) (func(), error) {
+	absolutePathToLock, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if experiments.IsEnabled("flock-file-locks") {
+		lock := flock.New(absolutePathToLock + "f")
+		locked, err := lock.TryLock()
+		if err != nil {
+			return nil, err
+		}
+		if !locked {
+			return nil, fmt.Errorf("%s is locked by another process", lock.Path())
+		}
+		return func() { _ = lock.Unlock() }, nil
+	}
+
+	lock, err := lockfile.New(absolutePathToLock)
+	if err != nil {
+		return nil, err
+	}
+	if err := lock.TryLock(); err != nil {
+		return nil, err
+	}
+	return func() { _ = lock.Unlock() }, nil
+}
+
+func runGit(ctx context.Context, args ...string) error {
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(output.String()))
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// newTestGitMirror makes a repository with a commit, and a mirror of it in
+// mirrorsPath, returning both of their paths
+func newTestGitMirror(t *testing.T, mirrorsPath string) (string, string) {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+
+	repo := t.TempDir()
+	commitToTestRepo(t, repo, "first")
+
+	mirrorDir := filepath.Join(mirrorsPath, "repo")
+	if err := runGit(context.Background(), "clone", "--mirror", "--quiet", "--", repo, mirrorDir); err != nil {
+		t.Fatalf("runGit(clone) error = %v", err)
+	}
+	return repo, mirrorDir
+}
+
+func commitToTestRepo(t *testing.T, repo, name string) {
+	t.Helper()
+
+	if err := os.WriteFile(filepath.Join(repo, name), []byte(name), 0o644); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"add", name},
+		{"-c", "user.name=Test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", name},
+	} {
+		if err := runGit(context.Background(), append([]string{"-C", repo}, args...)...); err != nil {
+			t.Fatalf("runGit(%s) error = %v", args[0], err)
+		}
+	}
+}
+
+func headOf(t *testing.T, gitDir string) string {
+	t.Helper()
+
+	out, err := exec.Command("git", "--git-dir", gitDir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		t.Fatalf("git rev-parse HEAD error = %v", err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestGitMirrorMaintainerFetchesIntoMirrors(t *testing.T) {
+	mirrorsPath := t.TempDir()
+	repo, mirrorDir := newTestGitMirror(t, mirrorsPath)
+	commitToTestRepo(t, repo, "second")
+
+	NewGitMirrorMaintainer(logger.Discard, GitMirrorMaintainerConfig{
+		MirrorsPath: mirrorsPath,
+		Interval:    time.Hour,
+		MaxUnused:   24 * time.Hour,
+	}).Maintain(context.Background())
+
+	if got, want := headOf(t, mirrorDir), headOf(t, filepath.Join(repo, ".git")); got != want {
+		t.Errorf("mirror HEAD = %s, want %s", got, want)
+	}
+
+	// Mirrors that jobs haven't recorded using are counted from now
+	if _, err := os.Stat(mirrorDir + gitMirrorLastUsedSuffix); err != nil {
+		t.Errorf("os.Stat(%s) error = %v", mirrorDir+gitMirrorLastUsedSuffix, err)
+	}
+}
+
+func TestGitMirrorMaintainerSkipsLockedMirrors(t *testing.T) {
+	mirrorsPath := t.TempDir()
+	repo, mirrorDir := newTestGitMirror(t, mirrorsPath)
+	before := headOf(t, mirrorDir)
+	commitToTestRepo(t, repo, "second")
+
+	// As if a job in another process were updating the mirror. Lock files
+	// hold the pid of their owner, and pid 1 is always running.
+	if err := os.WriteFile(mirrorDir+gitMirrorUpdateLockSuffix, []byte("1\n"), 0o644); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+
+	NewGitMirrorMaintainer(logger.Discard, GitMirrorMaintainerConfig{
+		MirrorsPath: mirrorsPath,
+		Interval:    time.Hour,
+	}).Maintain(context.Background())
+
+	if got := headOf(t, mirrorDir); got != before {
+		t.Errorf("mirror HEAD = %s, want it left at %s while locked", got, before)
+	}
+}
+
+func TestGitMirrorMaintainerKeepsObjectsCheckoutsMayBorrow(t *testing.T) {
+	mirrorsPath := t.TempDir()
+	repo, mirrorDir := newTestGitMirror(t, mirrorsPath)
+	commitToTestRepo(t, repo, "second")
+	if err := runGit(context.Background(), "-C", repo, "branch", "feature", "HEAD~1"); err != nil {
+		t.Fatalf("runGit(branch) error = %v", err)
+	}
+	if err := runGit(context.Background(), "--git-dir", mirrorDir, "fetch", "--quiet", "origin"); err != nil {
+		t.Fatalf("runGit(fetch) error = %v", err)
+	}
+	rewritten := headOf(t, mirrorDir)
+
+	// The feature branch is deleted and the main one is force pushed, after
+	// checkouts have borrowed their commits from the mirror
+	for _, args := range [][]string{
+		{"branch", "-D", "feature"},
+		{"-c", "user.name=Test", "-c", "user.email=test@example.com", "commit", "--quiet", "--amend", "-m", "rewritten"},
+	} {
+		if err := runGit(context.Background(), append([]string{"-C", repo}, args...)...); err != nil {
+			t.Fatalf("runGit(%s) error = %v", args[0], err)
+		}
+	}
+
+	// As if the last fetch was a while ago
+	longAgo := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(mirrorDir, "FETCH_HEAD"), longAgo, longAgo); err != nil {
+		t.Fatalf("os.Chtimes() error = %v", err)
+	}
+
+	// Make sure gc runs before Maintain returns, and would prune anything it
+	// could
+	for _, args := range [][]string{
+		{"repack", "-q"},
+		{"config", "fetch.unpackLimit", "1"},
+		{"config", "gc.autoPackLimit", "1"},
+		{"config", "gc.pruneExpire", "now"},
+		{"config", "gc.autoDetach", "false"},
+	} {
+		if err := runGit(context.Background(), append([]string{"--git-dir", mirrorDir}, args...)...); err != nil {
+			t.Fatalf("runGit(%s) error = %v", args[0], err)
+		}
+	}
+
+	NewGitMirrorMaintainer(logger.Discard, GitMirrorMaintainerConfig{
+		MirrorsPath: mirrorsPath,
+		Interval:    time.Hour,
+	}).Maintain(context.Background())
+
+	if got, want := headOf(t, mirrorDir), headOf(t, filepath.Join(repo, ".git")); got != want {
+		t.Errorf("mirror HEAD = %s, want %s", got, want)
+	}
+	if err := runGit(context.Background(), "--git-dir", mirrorDir, "rev-parse", "--verify", "--quiet", "refs/heads/feature"); err != nil {
+		t.Errorf("the deleted feature branch was pruned from the mirror: %v", err)
+	}
+	if err := runGit(context.Background(), "--git-dir", mirrorDir, "cat-file", "-e", rewritten+"^{commit}"); err != nil {
+		t.Errorf("the rewritten commit %s was removed from the mirror: %v", rewritten, err)
+	}
+}
+
+func TestGitMirrorMaintainerRemovesUnusedMirrors(t *testing.T) {
+	mirrorsPath := t.TempDir()
+	_, unusedDir := newTestGitMirror(t, mirrorsPath)
+
+	usedDir := filepath.Join(mirrorsPath, "used")
+	if err := os.Rename(unusedDir, usedDir); err != nil {
+		t.Fatalf("os.Rename() error = %v", err)
+	}
+	if err := runGit(context.Background(), "clone", "--mirror", "--quiet", "--", usedDir, unusedDir); err != nil {
+		t.Fatalf("runGit(clone) error = %v", err)
+	}
+
+	longAgo := time.Now().Add(-10 * 24 * time.Hour)
+	for dir, lastUsed := range map[string]time.Time{unusedDir: longAgo, usedDir: time.Now()} {
+		path := dir + gitMirrorLastUsedSuffix
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatalf("os.WriteFile() error = %v", err)
+		}
+		if err := os.Chtimes(path, lastUsed, lastUsed); err != nil {
+			t.Fatalf("os.Chtimes() error = %v", err)
+		}
+	}
+
+	NewGitMirrorMaintainer(logger.Discard, GitMirrorMaintainerConfig{
+		MirrorsPath: mirrorsPath,
+		Interval:    time.Hour,
+		MaxUnused:   7 * 24 * time.Hour,
+	}).Maintain(context.Background())
+
+	for _, path := range []string{unusedDir, unusedDir + gitMirrorLastUsedSuffix} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("os.Stat(%s) error = %v, want it removed", path, err)
+		}
+	}
+	if _, err := os.Stat(usedDir); err != nil {
+		t.Errorf("os.Stat(%s) error = %v, want it kept", usedDir, err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/buildkite/agent/v3/logger"
 	storage "google.golang.org/api/storage/v1"
@@ -24,6 +25,9 @@ type GSDownloaderConfig struct {
 	// How many times should it retry the download before giving up
 	Retries int
 
+	// How long each attempt at downloading can take, if there's a limit
+	Timeout time.Duration
+
 	// If failed responses should be dumped to the log
 	DebugHTTP bool
 }
@@ -57,6 +61,7 @@ func (d GSDownloader) Start(ctx context.Context) error {
 		Path:        d.conf.Path,
 		Destination: d.conf.Destination,
 		Retries:     d.conf.Retries,
+		Timeout:     d.conf.Timeout,
 		DebugHTTP:   d.conf.DebugHTTP,
 	}).Start(ctx)
 }
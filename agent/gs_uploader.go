@@ -23,6 +23,10 @@ type GSUploaderConfig struct {
 	// gs://my-bucket-name/foo/bar
 	Destination string
 
+	// Files are uploaded in chunks of this size, so that a chunk that fails
+	// is retried rather than the whole file
+	PartSize int64
+
 	// Whether or not HTTP calls shoud be debugged
 	DebugHTTP bool
 }
@@ -119,7 +123,79 @@ func (u *GSUploader) URL(artifact *api.Artifact) string {
 	return artifactURL.String()
 }
 
-func (u *GSUploader) Upload(artifact *api.Artifact) error {
+func (u *GSUploader) uploadsContentEncoding() {}
+
+// copyFromBlob copies the blob with the same content as an artifact to the
+// artifact's path, giving it the artifact's content type
+func (u *GSUploader) copyFromBlob(artifact *api.Artifact) (bool, error) {
+	blobKey, ok := artifactBlobKey(artifact)
+	if !ok {
+		return false, nil
+	}
+
+	permission, err := u.resolvePermission()
+	if err != nil {
+		return false, err
+	}
+
+	blob, err := u.service.Objects.Get(u.BucketName, blobKey).Do()
+	if err != nil {
+		if isGSNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := checkArtifactBlob(artifact, int64(blob.Size), blob.ContentEncoding, blob.Metadata); err != nil {
+		return false, err
+	}
+
+	u.logger.Debug("Copying \"%s\" to \"%s\" in bucket \"%s\"", blobKey, u.artifactPath(artifact), u.BucketName)
+
+	object := &storage.Object{
+		ContentType:        artifact.ContentType,
+		ContentEncoding:    blob.ContentEncoding,
+		Metadata:           artifactDigestMetadata(artifact),
+		ContentDisposition: u.contentDisposition(artifact),
+	}
+	call := u.service.Objects.Copy(u.BucketName, blobKey, u.BucketName, u.artifactPath(artifact), object)
+	if permission != "" {
+		call = call.DestinationPredefinedAcl(permission)
+	}
+	if _, err := call.Do(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// copyToBlob copies an artifact that's been uploaded to the blob for its
+// content
+func (u *GSUploader) copyToBlob(artifact *api.Artifact) error {
+	blobKey, ok := artifactBlobKey(artifact)
+	if !ok {
+		return nil
+	}
+
+	permission, err := u.resolvePermission()
+	if err != nil {
+		return err
+	}
+
+	call := u.service.Objects.Copy(u.BucketName, u.artifactPath(artifact), u.BucketName, blobKey, &storage.Object{})
+	if permission != "" {
+		call = call.DestinationPredefinedAcl(permission)
+	}
+	_, err = call.Do()
+	return err
+}
+
+func isGSNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+// resolvePermission returns the predefined ACL to upload objects with, if
+// there is one
+func (u *GSUploader) resolvePermission() (string, error) {
 	permission := os.Getenv("BUILDKITE_GS_ACL")
 
 	// The dirtiest validation method ever...
@@ -129,7 +205,15 @@ func (u *GSUploader) Upload(artifact *api.Artifact) error {
 		permission != "projectPrivate" &&
 		permission != "publicRead" &&
 		permission != "publicReadWrite" {
-		return fmt.Errorf("Invalid GS ACL `%s`", permission)
+		return "", fmt.Errorf("Invalid GS ACL `%s`", permission)
+	}
+	return permission, nil
+}
+
+func (u *GSUploader) Upload(artifact *api.Artifact) error {
+	permission, err := u.resolvePermission()
+	if err != nil {
+		return err
 	}
 
 	if permission == "" {
@@ -142,6 +226,8 @@ func (u *GSUploader) Upload(artifact *api.Artifact) error {
 	object := &storage.Object{
 		Name:               u.artifactPath(artifact),
 		ContentType:        artifact.ContentType,
+		ContentEncoding:    artifact.ContentEncoding,
+		Metadata:           artifactDigestMetadata(artifact),
 		ContentDisposition: u.contentDisposition(artifact),
 	}
 	file, err := os.Open(artifact.AbsolutePath)
@@ -152,7 +238,11 @@ func (u *GSUploader) Upload(artifact *api.Artifact) error {
 	if permission != "" {
 		call = call.PredefinedAcl(permission)
 	}
-	if res, err := call.Media(file, googleapi.ContentType("")).Do(); err == nil {
+	options := []googleapi.MediaOption{googleapi.ContentType("")}
+	if u.conf.PartSize > 0 {
+		options = append(options, googleapi.ChunkSize(int(u.conf.PartSize)))
+	}
+	if res, err := call.Media(file, options...).Do(); err == nil {
 		u.logger.Debug("Created object %v at location %v\n\n", res.Name, res.SelfLink)
 	} else {
 		return errors.New(fmt.Sprintf("Failed to PUT file \"%s\" (%v)", u.artifactPath(artifact), err))
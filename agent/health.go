@@ -0,0 +1,147 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	// How many heartbeat (or ping) intervals can go by without a successful
+	// one before a worker isn't ready any more
+	healthMissedIntervals = 3
+
+	// The interval to use if Buildkite didn't give one
+	healthDefaultInterval = 60 * time.Second
+)
+
+// WorkerHealth is the health of an AgentWorker, as served by /healthz and
+// /readyz
+type WorkerHealth struct {
+	SpawnIndex int    `json:"spawn_index"`
+	Name       string `json:"name"`
+
+	// Whether the worker is connected, heartbeating, pinging and not
+	// stopping or paused. When it isn't, Reasons says why.
+	Ready   bool     `json:"ready"`
+	Reasons []string `json:"reasons,omitempty"`
+
+	Connected          bool       `json:"connected"`
+	Stopping           bool       `json:"stopping"`
+	Paused             bool       `json:"paused"`
+	LastPing           *time.Time `json:"last_ping,omitempty"`
+	LastHeartbeat      *time.Time `json:"last_heartbeat,omitempty"`
+	LastHeartbeatError string     `json:"last_heartbeat_error,omitempty"`
+	JobID              string     `json:"job_id,omitempty"`
+}
+
+// Health reports whether the worker is alive and able to run jobs
+func (a *AgentWorker) Health() WorkerHealth {
+	stopping, paused := a.stopping.Load(), a.paused.Load()
+
+	a.stats.Lock()
+	defer a.stats.Unlock()
+
+	h := WorkerHealth{
+		SpawnIndex: a.spawnIndex,
+		Connected:  !a.stats.connectedAt.IsZero(),
+		Stopping:   stopping,
+		Paused:     paused,
+		JobID:      a.stats.jobID,
+	}
+	if a.agent != nil {
+		h.Name = a.agent.Name
+	}
+	if !a.stats.lastPing.IsZero() {
+		lastPing := a.stats.lastPing
+		h.LastPing = &lastPing
+	}
+	if !a.stats.lastHeartbeat.IsZero() {
+		lastHeartbeat := a.stats.lastHeartbeat
+		h.LastHeartbeat = &lastHeartbeat
+	}
+	if a.stats.lastHeartbeatError != nil {
+		h.LastHeartbeatError = a.stats.lastHeartbeatError.Error()
+	}
+
+	if !h.Connected {
+		h.Reasons = append(h.Reasons, "not connected")
+	}
+	if h.Stopping {
+		h.Reasons = append(h.Reasons, "stopping")
+	}
+	if h.Paused {
+		h.Reasons = append(h.Reasons, "paused")
+	}
+
+	if h.Connected {
+		// Nothing can be late before the worker has connected
+		if a.agent != nil && late(a.stats.lastHeartbeat, a.stats.connectedAt, a.agent.HeartbeatInterval) {
+			h.Reasons = append(h.Reasons, "no recent heartbeat")
+		}
+
+		// The worker doesn't ping while it's running a job, or paused
+		if a.agent != nil && h.JobID == "" && !h.Paused && a.agentConfiguration.AcquireJob == "" &&
+			late(a.stats.lastPing, a.stats.connectedAt, a.agent.PingInterval) {
+			h.Reasons = append(h.Reasons, "no recent ping")
+		}
+	}
+
+	h.Ready = len(h.Reasons) == 0
+	return h
+}
+
+// late returns whether more than a few intervals (in seconds) have gone by
+// since last, or since start if there hasn't been one
+func late(last, start time.Time, intervalSeconds int) bool {
+	interval := time.Duration(intervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = healthDefaultInterval
+	}
+	if last.Before(start) {
+		last = start
+	}
+	return time.Since(last) > healthMissedIntervals*interval
+}
+
+// poolHealth is the body of the /healthz and /readyz responses
+type poolHealth struct {
+	Status  string         `json:"status"`
+	Workers []WorkerHealth `json:"workers"`
+}
+
+// Health returns the health of every worker in the pool
+func (r *AgentPool) Health() []WorkerHealth {
+	health := make([]WorkerHealth, 0, len(r.workers))
+	for _, worker := range r.workers {
+		health = append(health, worker.Health())
+	}
+	return health
+}
+
+// ServeHealthz reports that the agent is alive, along with the health of each
+// worker. It always succeeds while the agent can serve it.
+func (r *AgentPool) ServeHealthz(w http.ResponseWriter, req *http.Request) {
+	writeHealth(w, http.StatusOK, poolHealth{Status: "ok", Workers: r.Health()})
+}
+
+// ServeReadyz reports whether every worker is ready to run jobs, failing with
+// 503 Service Unavailable if any of them aren't
+func (r *AgentPool) ServeReadyz(w http.ResponseWriter, req *http.Request) {
+	h := poolHealth{Status: "ready", Workers: r.Health()}
+	code := http.StatusOK
+	for _, worker := range h.Workers {
+		if !worker.Ready {
+			h.Status = "not ready"
+			code = http.StatusServiceUnavailable
+			break
+		}
+	}
+	writeHealth(w, code, h)
+}
+
+func writeHealth(w http.ResponseWriter, code int, h poolHealth) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(h)
+}
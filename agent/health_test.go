@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func healthTestWorker(spawnIndex int) *AgentWorker {
+	return &AgentWorker{
+		agent: &api.AgentRegisterResponse{
+			Name:              "my-agent",
+			HeartbeatInterval: 10,
+			PingInterval:      2,
+		},
+		spawnIndex: spawnIndex,
+	}
+}
+
+func TestWorkerHealth(t *testing.T) {
+	now := time.Now()
+
+	for _, tc := range []struct {
+		name    string
+		stats   func(*agentStats)
+		stop    bool
+		pause   bool
+		reasons []string
+	}{
+		{
+			name:    "not connected",
+			stats:   func(s *agentStats) {},
+			reasons: []string{"not connected"},
+		},
+		{
+			name:  "just connected",
+			stats: func(s *agentStats) { s.connectedAt = now },
+		},
+		{
+			name: "idle",
+			stats: func(s *agentStats) {
+				s.connectedAt = now.Add(-time.Hour)
+				s.lastHeartbeat = now.Add(-5 * time.Second)
+				s.lastPing = now.Add(-time.Second)
+			},
+		},
+		{
+			name: "wedged",
+			stats: func(s *agentStats) {
+				s.connectedAt = now.Add(-time.Hour)
+				s.lastHeartbeat = now.Add(-time.Minute)
+				s.lastHeartbeatError = errors.New("connection refused")
+				s.lastPing = now.Add(-time.Minute)
+			},
+			reasons: []string{"no recent heartbeat", "no recent ping"},
+		},
+		{
+			name: "running a job",
+			stats: func(s *agentStats) {
+				s.connectedAt = now.Add(-time.Hour)
+				s.lastHeartbeat = now.Add(-5 * time.Second)
+				s.lastPing = now.Add(-time.Minute)
+				s.jobID = "my-job"
+			},
+		},
+		{
+			name: "stopping",
+			stats: func(s *agentStats) {
+				s.connectedAt = now
+			},
+			stop:    true,
+			reasons: []string{"stopping"},
+		},
+		{
+			name: "paused",
+			stats: func(s *agentStats) {
+				s.connectedAt = now.Add(-time.Hour)
+				s.lastHeartbeat = now.Add(-5 * time.Second)
+				s.lastPing = now.Add(-time.Minute)
+			},
+			pause:   true,
+			reasons: []string{"paused"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			worker := healthTestWorker(0)
+			tc.stats(&worker.stats)
+			worker.stopping.Store(tc.stop)
+			worker.paused.Store(tc.pause)
+
+			h := worker.Health()
+			assert.Equal(t, tc.reasons, h.Reasons)
+			assert.Equal(t, len(tc.reasons) == 0, h.Ready)
+			assert.Equal(t, worker.stats.jobID, h.JobID)
+		})
+	}
+}
+
+func TestAgentPoolReadyz(t *testing.T) {
+	ready, wedged := healthTestWorker(1), healthTestWorker(2)
+	ready.stats.connectedAt = time.Now()
+	wedged.stats.connectedAt = time.Now().Add(-time.Hour)
+
+	for _, tc := range []struct {
+		workers []*AgentWorker
+		code    int
+		status  string
+	}{
+		{workers: []*AgentWorker{ready}, code: http.StatusOK, status: "ready"},
+		{workers: []*AgentWorker{ready, wedged}, code: http.StatusServiceUnavailable, status: "not ready"},
+	} {
+		pool := NewAgentPool(tc.workers)
+
+		rec := httptest.NewRecorder()
+		pool.ServeReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		assert.Equal(t, tc.code, rec.Code)
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+		var body poolHealth
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		assert.Equal(t, tc.status, body.Status)
+		assert.Len(t, body.Workers, len(tc.workers))
+
+		// The agent is alive either way
+		rec = httptest.NewRecorder()
+		pool.ServeHealthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+}
@@ -0,0 +1,166 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/api/fakeserver"
+	"github.com/buildkite/agent/v3/events"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/metrics"
+	"github.com/buildkite/bintest/v3"
+)
+
+func TestAgentWorkerRunsJobFromFakeServer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	server := fakeserver.New()
+	defer server.Close()
+
+	job := server.AddJob(&api.Job{
+		ChunksMaxSizeBytes: 1024,
+		Env: map[string]string{
+			"BUILDKITE_COMMAND": "echo hello world",
+		},
+	})
+
+	eventsPath := filepath.Join(t.TempDir(), "events.ndjson")
+	eventStream, err := events.Open(eventsPath)
+	if err != nil {
+		t.Fatalf("events.Open() error = %v", err)
+	}
+	defer eventStream.Close()
+
+	bs, err := bintest.NewMock("buildkite-agent-bootstrap")
+	if err != nil {
+		t.Fatalf("bintest.NewMock() error = %v", err)
+	}
+	defer bs.CheckAndClose(t)
+
+	bs.Expect().Once().AndExitWith(0).AndCallFunc(func(c *bintest.Call) {
+		if got, want := c.GetEnv("BUILDKITE_COMMAND"), "echo hello world"; got != want {
+			t.Errorf("c.GetEnv(BUILDKITE_COMMAND) = %q, want %q", got, want)
+		}
+
+		if got, want := c.GetEnv(events.EnvVar), eventsPath; got != want {
+			t.Errorf("c.GetEnv(%s) = %q, want %q", events.EnvVar, got, want)
+		}
+
+		// The job's processes send their events to the agent to record
+		// metrics from, as well as to the stream
+		stream, err := events.Open(c.GetEnv(events.EnvVar), c.GetEnv(events.RelayEnvVar))
+		if err != nil {
+			t.Errorf("events.Open(%q, %q) error = %v", c.GetEnv(events.EnvVar), c.GetEnv(events.RelayEnvVar), err)
+		}
+		if err := stream.With("fake-agent", job.ID).Emit(events.Event{Type: events.ArtifactUploadFinished, ArtifactsUploaded: 2, ArtifactBytes: 42}); err != nil {
+			t.Errorf("stream.Emit() error = %v", err)
+		}
+		stream.Close()
+
+		fmt.Fprintln(c.Stdout, "hello world")
+		c.Exit(0)
+	})
+
+	l := logger.Discard
+
+	reg, _, err := api.NewClient(l, api.Config{
+		Endpoint: server.URL,
+		Token:    server.RegistrationToken,
+	}).Register(ctx, &api.AgentRegisterRequest{Name: "fake-agent"})
+	if err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	client := api.NewClient(l, api.Config{
+		Endpoint: reg.Endpoint,
+		Token:    reg.AccessToken,
+	})
+
+	mc := metrics.NewCollector(l, metrics.CollectorConfig{Prometheus: true})
+
+	worker := agent.NewAgentWorker(l, reg, mc, client, agent.AgentWorkerConfig{
+		AgentConfiguration: agent.AgentConfiguration{
+			BootstrapScript:    bs.Path,
+			BuildPath:          t.TempDir(),
+			DisconnectAfterJob: true,
+			EventStream:        eventsPath,
+		},
+		Events: eventStream,
+	})
+
+	if err := worker.Connect(ctx); err != nil {
+		t.Fatalf("worker.Connect() error = %v", err)
+	}
+
+	if err := worker.Start(ctx, agent.NewIdleMonitor(1)); err != nil {
+		t.Fatalf("worker.Start() error = %v", err)
+	}
+
+	got, ok := server.Job(job.ID)
+	if !ok {
+		t.Fatalf("server.Job(%q) not found", job.ID)
+	}
+	if got.State != fakeserver.JobStateFinished {
+		t.Errorf("job state = %q, want %q", got.State, fakeserver.JobStateFinished)
+	}
+	if got.ExitStatus != "0" {
+		t.Errorf("job exit status = %q, want %q", got.ExitStatus, "0")
+	}
+	if got.AgentID != reg.UUID {
+		t.Errorf("job agent = %q, want %q", got.AgentID, reg.UUID)
+	}
+	if want := "hello world\n"; got.Log != want {
+		t.Errorf("job log = %q, want %q", got.Log, want)
+	}
+
+	data, err := os.ReadFile(eventsPath)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%q) error = %v", eventsPath, err)
+	}
+
+	var types []events.Type
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e events.Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("json.Unmarshal(%q) error = %v", line, err)
+		}
+		if e.AgentName != "fake-agent" || e.JobID != job.ID {
+			t.Errorf("event %q isn't for agent %q and job %q", line, "fake-agent", job.ID)
+		}
+		if e.Type == events.JobFinished && (e.ExitStatus == nil || *e.ExitStatus != 0) {
+			t.Errorf("job finished event %q doesn't have exit status 0", line)
+		}
+		types = append(types, e.Type)
+	}
+
+	if want := []events.Type{events.JobAccepted, events.JobStarted, events.ArtifactUploadFinished, events.JobFinished}; !reflect.DeepEqual(types, want) {
+		t.Errorf("event types = %v, want %v", types, want)
+	}
+
+	rec := httptest.NewRecorder()
+	mc.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`buildkite_agent_busy{agent_name="fake_agent"} 0`,
+		`buildkite_artifacts_uploaded_bytes_total{agent_name="fake_agent"} 42`,
+		`buildkite_artifacts_uploaded_total{agent_name="fake_agent"} 2`,
+		`buildkite_log_chunks_failed_total{agent_name="fake_agent"} 0`,
+		`buildkite_jobs_success_total{agent_name="fake_agent",exit_code="0"} 1`,
+		`buildkite_ping_latency_seconds{agent_name="fake_agent"} `,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics don't contain %q:\n%s", want, rec.Body.String())
+		}
+	}
+}
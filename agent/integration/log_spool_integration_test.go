@@ -0,0 +1,100 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/api/fakeserver"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/metrics"
+	"github.com/buildkite/bintest/v3"
+)
+
+func TestJobRunnerSpoolsChunksThroughTransientFailures(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	server := fakeserver.New()
+	defer server.Close()
+
+	l := logger.Discard
+
+	reg, _, err := api.NewClient(l, api.Config{
+		Endpoint: server.URL,
+		Token:    server.RegistrationToken,
+	}).Register(ctx, &api.AgentRegisterRequest{})
+	if err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	client := api.NewClient(l, api.Config{
+		Endpoint: reg.Endpoint,
+		Token:    reg.AccessToken,
+	})
+
+	server.AddJob(&api.Job{ChunksMaxSizeBytes: 16})
+
+	ping, _, err := client.Ping(ctx)
+	if err != nil {
+		t.Fatalf("Ping() error = %v", err)
+	}
+	job, _, err := client.AcceptJob(ctx, ping.Job)
+	if err != nil {
+		t.Fatalf("AcceptJob() error = %v", err)
+	}
+
+	bs, err := bintest.NewMock("buildkite-agent-bootstrap")
+	if err != nil {
+		t.Fatalf("bintest.NewMock() error = %v", err)
+	}
+	defer bs.CheckAndClose(t)
+
+	var want strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&want, "line %d of the log\n", i)
+	}
+
+	bs.Expect().Once().AndExitWith(0).AndCallFunc(func(c *bintest.Call) {
+		fmt.Fprint(c.Stdout, want.String())
+		c.Exit(0)
+	})
+
+	// Buildkite can't be reached for the first few chunks
+	server.FailRequests("POST jobs/:id/chunks", 5, http.StatusBadGateway)
+
+	buildPath := t.TempDir()
+
+	jr, err := agent.NewJobRunner(l, metrics.NewCollector(l, metrics.CollectorConfig{}).Scope(metrics.Tags{}), reg, job, client, agent.JobRunnerConfig{
+		AgentConfiguration: agent.AgentConfiguration{
+			BootstrapScript: bs.Path,
+			BuildPath:       buildPath,
+		},
+	})
+	if err != nil {
+		t.Fatalf("agent.NewJobRunner() error = %v", err)
+	}
+
+	if err := jr.Run(ctx); err != nil {
+		t.Fatalf("jr.Run() = %v", err)
+	}
+
+	got, _ := server.Job(job.ID)
+	if got.ChunksFailedCount != 0 {
+		t.Errorf("ChunksFailedCount = %d, want 0", got.ChunksFailedCount)
+	}
+	if got.Log != want.String() {
+		t.Errorf("job log = %q, want %q", got.Log, want.String())
+	}
+
+	if _, err := os.Stat(filepath.Join(buildPath, agent.LogSpoolDirName, job.ID)); !os.IsNotExist(err) {
+		t.Errorf("log spool for the job wasn't removed (stat error = %v)", err)
+	}
+}
@@ -2,16 +2,20 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/events"
 	"github.com/buildkite/agent/v3/experiments"
 	"github.com/buildkite/agent/v3/hook"
 	"github.com/buildkite/agent/v3/logger"
@@ -54,6 +58,9 @@ type JobRunnerConfig struct {
 
 	// Whether to set debug HTTP Requests in the job
 	DebugHTTP bool
+
+	// Where to write lifecycle events for the job, if anywhere
+	Events *events.Stream
 }
 
 type JobRunner struct {
@@ -87,6 +94,20 @@ type JobRunner struct {
 	// The internal log streamer
 	logStreamer *LogStreamer
 
+	// Chunks are kept in the spool until they're uploaded, if there's a
+	// build path to keep them in
+	logSpool *logSpool
+
+	// Signalled when spooled chunks might be uploadable again
+	logSpoolReplay chan struct{}
+
+	// A counter of spooled chunks that Buildkite rejected
+	logSpoolRejected int32
+
+	// Receives the events of the job's processes, so they can be recorded
+	// as metrics
+	eventRelay *events.Relay
+
 	// If the job is being cancelled
 	cancelled bool
 
@@ -127,8 +148,21 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 	runner.logStreamer = NewLogStreamer(l, runner.onUploadChunk, LogStreamerConfig{
 		Concurrency:       3,
 		MaxChunkSizeBytes: job.ChunksMaxSizeBytes,
+		Encoding:          runner.apiClient.Config().ChunkEncoding,
+		MaxSizeBytes:      conf.AgentConfiguration.MaxJobLogSize,
+		TailSizeBytes:     conf.AgentConfiguration.JobLogTailSize,
 	})
 
+	if conf.AgentConfiguration.BuildPath != "" {
+		spool, err := openLogSpool(conf.AgentConfiguration.BuildPath, job.ID)
+		if err != nil {
+			l.Warn("Log chunks for this job won't be spooled to disk (%s)", err)
+		} else {
+			runner.logSpool = spool
+			runner.logSpoolReplay = make(chan struct{}, 1)
+		}
+	}
+
 	// TempDir is not guaranteed to exist
 	tempDir := os.TempDir()
 	if _, err := os.Stat(tempDir); os.IsNotExist(err) {
@@ -146,14 +180,25 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 		runner.envFile = file
 	}
 
+	if runner.metrics.Enabled() {
+		relayPath := filepath.Join(tempDir, fmt.Sprintf("bk-%s.sock", job.ID))
+		if ln, err := listenPrivateUnix(relayPath); err != nil {
+			l.Warn("Metrics won't be recorded from the job's events (%s)", err)
+		} else {
+			runner.eventRelay = events.NewRelay(relayPath, ln, runner.relayEvent)
+		}
+	}
+
 	env, err := runner.createEnvironment()
 	if err != nil {
+		runner.closeEventRelay()
 		return nil, err
 	}
 
 	// The bootstrap-script gets parsed based on the operating system
 	cmd, err := shellwords.Split(conf.AgentConfiguration.BootstrapScript)
 	if err != nil {
+		runner.closeEventRelay()
 		return nil, fmt.Errorf("Failed to split bootstrap-script (%q) into tokens: %v",
 			conf.AgentConfiguration.BootstrapScript, err)
 	}
@@ -220,6 +265,7 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 	if conf.AgentConfiguration.EnableJobLogTmpfile {
 		tmpFile, err = os.CreateTemp("", "buildkite_job_log")
 		if err != nil {
+			runner.closeEventRelay()
 			return nil, err
 		}
 		os.Setenv("BUILDKITE_JOB_LOG_TMPFILE", tmpFile.Name())
@@ -269,12 +315,23 @@ func (r *JobRunner) Run(ctx context.Context) error {
 
 	startedAt := time.Now()
 
+	defer r.closeEventRelay()
+
+	if r.logSpool != nil {
+		defer func() {
+			if err := r.logSpool.Close(); err != nil {
+				r.logger.Warn("Couldn't close the log spool (%s)", err)
+			}
+		}()
+	}
+
 	// Start the build in the Buildkite Agent API. This is the first thing
 	// we do so if it fails, we don't have to worry about cleaning things
 	// up like started log streamer workers, and so on.
 	if err := r.startJob(ctx, startedAt); err != nil {
 		return err
 	}
+	r.emit(events.Event{Type: events.JobStarted})
 
 	// If this agent successfully grabs the job from the API, publish metric for
 	// how long this job was in the queue for, if we can calculate that
@@ -295,6 +352,19 @@ func (r *JobRunner) Run(ctx context.Context) error {
 		return err
 	}
 
+	// Upload chunks that had to be spooled, once the API is reachable again
+	spoolCtx, stopSpoolReplay := context.WithCancel(ctx)
+	defer stopSpoolReplay()
+	spoolReplayerDone := make(chan struct{})
+	if r.logSpool != nil {
+		go func() {
+			defer close(spoolReplayerDone)
+			r.logSpoolReplayer(spoolCtx)
+		}()
+	} else {
+		close(spoolReplayerDone)
+	}
+
 	// Default exit status is no exit status
 	exitStatus := ""
 	signal := ""
@@ -367,6 +437,9 @@ func (r *JobRunner) Run(ctx context.Context) error {
 	// Store the finished at time
 	finishedAt := time.Now()
 
+	// The job's processes have finished, so there are no more events to relay
+	r.closeEventRelay()
+
 	// Stop the header time streamer. This will block until all the chunks
 	// have been uploaded
 	r.headerTimesStreamer.Stop()
@@ -375,9 +448,17 @@ func (r *JobRunner) Run(ctx context.Context) error {
 	// been uploaded
 	r.logStreamer.Stop()
 
+	// Wait for the replayer to finish with the chunks it has claimed before
+	// uploading what's left of the spool
+	stopSpoolReplay()
+	<-spoolReplayerDone
+	failedChunks := r.logStreamer.FailedChunks() + r.flushLogSpool(ctx)
+
+	r.metrics.Count("log.chunks.failed", int64(failedChunks))
+
 	// Warn about failed chunks
-	if count := r.logStreamer.FailedChunks(); count > 0 {
-		r.logger.Warn("%d chunks failed to upload for this job", count)
+	if failedChunks > 0 {
+		r.logger.Warn("%d chunks failed to upload for this job", failedChunks)
 	}
 
 	// Ensure the additional goroutines are stopped.
@@ -411,13 +492,47 @@ func (r *JobRunner) Run(ctx context.Context) error {
 	//
 	// Once we tell the API we're finished it might assign us new work, so make
 	// sure everything else is done first.
-	r.finishJob(ctx, finishedAt, exitStatus, signal, signalReason, r.logStreamer.FailedChunks())
+	r.finishJob(ctx, finishedAt, exitStatus, signal, signalReason, failedChunks)
+
+	finished := events.Event{Type: events.JobFinished, Signal: signal, SignalReason: signalReason}
+	if status, err := strconv.Atoi(exitStatus); err == nil {
+		finished.ExitStatus = events.ExitStatus(status)
+	}
+	r.emit(finished)
 
 	r.logger.Info("Finished job %s", r.job.ID)
 
 	return nil
 }
 
+// emit writes an event to the job's event stream, if there is one
+func (r *JobRunner) emit(e events.Event) {
+	if err := r.conf.Events.Emit(e); err != nil {
+		r.logger.Warn("%s", err)
+	}
+}
+
+// relayEvent records metrics from the events of the job's processes, for the
+// things the agent can't see for itself
+func (r *JobRunner) relayEvent(e events.Event) {
+	if e.Type == events.ArtifactUploadFinished {
+		r.metrics.Count("artifacts.uploaded", int64(e.ArtifactsUploaded))
+		r.metrics.Count("artifacts.failed", int64(e.ArtifactsFailed))
+		r.metrics.Count("artifacts.uploaded.bytes", e.ArtifactBytes)
+	}
+}
+
+// closeEventRelay stops relaying events from the job's processes
+func (r *JobRunner) closeEventRelay() {
+	if r.eventRelay == nil {
+		return
+	}
+	if err := r.eventRelay.Close(); err != nil {
+		r.logger.Warn("Couldn't close the job's event relay (%s)", err)
+	}
+	r.eventRelay = nil
+}
+
 func (r *JobRunner) CancelAndStop() error {
 	r.cancelLock.Lock()
 	r.stopped = true
@@ -447,6 +562,12 @@ func (r *JobRunner) Cancel() error {
 
 	r.cancelled = true
 
+	canceled := events.Event{Type: events.JobCanceled, SignalReason: "cancel"}
+	if r.stopped {
+		canceled.SignalReason = "agent_stop"
+	}
+	r.emit(canceled)
+
 	// First we interrupt the process (ctrl-c or SIGINT)
 	if err := r.process.Interrupt(); err != nil {
 		return err
@@ -521,6 +642,8 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 		"BUILDKITE_GIT_MIRRORS_LOCK_TIMEOUT",
 		"BUILDKITE_GIT_CLEAN_FLAGS",
 		"BUILDKITE_SHELL",
+		events.EnvVar,
+		events.RelayEnvVar,
 	}
 
 	var ignoredEnv []string
@@ -580,6 +703,27 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 	env["BUILDKITE_AGENT_EXPERIMENT"] = strings.Join(experiments.Enabled(), ",")
 	env["BUILDKITE_REDACTED_VARS"] = strings.Join(r.conf.AgentConfiguration.RedactedVars, ",")
 
+	// Sparse checkouts, clone depth and Git LFS depend on the pipeline, so
+	// the agent configuration is only a default that jobs can override
+	if _, exists := env["BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS"]; !exists && r.conf.AgentConfiguration.GitSparseCheckoutPaths != "" {
+		env["BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS"] = r.conf.AgentConfiguration.GitSparseCheckoutPaths
+	}
+	if _, exists := env["BUILDKITE_GIT_CLONE_DEPTH"]; !exists && r.conf.AgentConfiguration.GitCloneDepth > 0 {
+		env["BUILDKITE_GIT_CLONE_DEPTH"] = fmt.Sprintf("%d", r.conf.AgentConfiguration.GitCloneDepth)
+	}
+	if _, exists := env["BUILDKITE_GIT_LFS"]; !exists && r.conf.AgentConfiguration.GitLFS {
+		env["BUILDKITE_GIT_LFS"] = "true"
+	}
+	if _, exists := env["BUILDKITE_GIT_LFS_INCLUDE"]; !exists && r.conf.AgentConfiguration.GitLFSInclude != "" {
+		env["BUILDKITE_GIT_LFS_INCLUDE"] = r.conf.AgentConfiguration.GitLFSInclude
+	}
+	if _, exists := env["BUILDKITE_GIT_LFS_EXCLUDE"]; !exists && r.conf.AgentConfiguration.GitLFSExclude != "" {
+		env["BUILDKITE_GIT_LFS_EXCLUDE"] = r.conf.AgentConfiguration.GitLFSExclude
+	}
+	if _, exists := env["BUILDKITE_GIT_LFS_SKIP_SMUDGE"]; !exists && r.conf.AgentConfiguration.GitLFSSkipSmudge {
+		env["BUILDKITE_GIT_LFS_SKIP_SMUDGE"] = "true"
+	}
+
 	// propagate CancelSignal to bootstrap, unless it's the default SIGTERM
 	if r.conf.CancelSignal != process.SIGTERM {
 		env["BUILDKITE_CANCEL_SIGNAL"] = r.conf.CancelSignal.String()
@@ -607,6 +751,13 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 	}
 	env["BUILDKITE_PLUGIN_VALIDATION"] = fmt.Sprintf("%t", enablePluginValidation)
 
+	if r.conf.AgentConfiguration.EventStream != "" {
+		env[events.EnvVar] = r.conf.AgentConfiguration.EventStream
+	}
+	if r.eventRelay != nil {
+		env[events.RelayEnvVar] = r.eventRelay.Destination()
+	}
+
 	if r.conf.AgentConfiguration.TracingBackend != "" {
 		env["BUILDKITE_TRACING_BACKEND"] = r.conf.AgentConfiguration.TracingBackend
 		env["BUILDKITE_TRACING_SERVICE_NAME"] = r.conf.AgentConfiguration.TracingServiceName
@@ -861,8 +1012,17 @@ func (r *JobRunner) onUploadHeaderTime(ctx context.Context, cursor, total int, t
 }
 
 // onUploadChunk uploads a log streamer chunk. If a valid chunk cannot be
-// uploaded, it will retry for a long time.
+// uploaded, it will retry for a long time. If the log spool is available, the
+// chunk is spooled instead of retried, and uploaded again later.
 func (r *JobRunner) onUploadChunk(ctx context.Context, chunk *LogStreamerChunk) error {
+	if r.logSpool != nil {
+		if err := r.logSpool.Write(chunk); err != nil {
+			r.logger.Warn("Couldn't spool chunk %d to disk (%s)", chunk.Order, err)
+		} else {
+			return r.uploadSpooledChunk(ctx, chunk)
+		}
+	}
+
 	// We consider logs to be an important thing, and we shouldn't give up
 	// on sending the chunk data back to Buildkite. In the event Buildkite
 	// is having downtime or there are connection problems, we'll want to
@@ -879,21 +1039,159 @@ func (r *JobRunner) onUploadChunk(ctx context.Context, chunk *LogStreamerChunk)
 		roko.WithStrategy(roko.Constant(5*time.Second)),
 		roko.WithJitter(),
 	).DoWithContext(ctx, func(retrier *roko.Retrier) error {
-		response, err := r.apiClient.UploadChunk(ctx, r.job.ID, &api.Chunk{
-			Data:     chunk.Data,
-			Sequence: chunk.Order,
-			Offset:   chunk.Offset,
-			Size:     chunk.Size,
-		})
-		if err != nil {
-			if response != nil && (response.StatusCode >= 400 && response.StatusCode <= 499) {
-				r.logger.Warn("Buildkite rejected the chunk upload (%s)", err)
-				retrier.Break()
-			} else {
-				r.logger.Warn("%s (%s)", err, retrier)
+		err := r.uploadChunk(ctx, chunk)
+		if errors.Is(err, errChunkRejected) {
+			retrier.Break()
+		} else if err != nil {
+			r.logger.Warn("%s (%s)", err, retrier)
+		}
+		return err
+	})
+}
+
+// errChunkRejected is returned when Buildkite won't accept a chunk, and
+// uploading it again won't help
+var errChunkRejected = errors.New("Buildkite rejected the chunk upload")
+
+// uploadChunk makes one attempt to upload a chunk
+func (r *JobRunner) uploadChunk(ctx context.Context, chunk *LogStreamerChunk) error {
+	response, err := r.apiClient.UploadChunk(ctx, r.job.ID, &api.Chunk{
+		Data:     chunk.Data,
+		Sequence: chunk.Order,
+		Offset:   chunk.Offset,
+		Size:     chunk.Size,
+		Encoded:  chunk.Encoded,
+	})
+	if err != nil && response != nil && (response.StatusCode >= 400 && response.StatusCode <= 499) {
+		r.logger.Warn("Buildkite rejected the chunk upload (%s)", err)
+		return fmt.Errorf("%w: %v", errChunkRejected, err)
+	}
+	return err
+}
+
+// uploadSpooledChunk makes one attempt to upload a chunk that is in the
+// spool. If it fails for a reason that might not last, the chunk is left in
+// the spool to be uploaded later and no error is returned.
+func (r *JobRunner) uploadSpooledChunk(ctx context.Context, chunk *LogStreamerChunk) error {
+	err := r.uploadChunk(ctx, chunk)
+	if err != nil && !errors.Is(err, errChunkRejected) {
+		r.logger.Warn("Spooled chunk %d to be uploaded later (%s)", chunk.Order, err)
+		r.logSpool.Release(chunk)
+		return nil
+	}
+
+	if rerr := r.logSpool.Remove(chunk); rerr != nil {
+		r.logger.Warn("Couldn't remove chunk %d from the log spool (%s)", chunk.Order, rerr)
+	}
+
+	// Now that the API is reachable, try again with anything that's spooled
+	if err == nil {
+		select {
+		case r.logSpoolReplay <- struct{}{}:
+		default:
+		}
+	}
+
+	return err
+}
+
+// replayLogSpool makes one attempt to upload each spooled chunk, stopping at
+// the first failure. It returns how many chunks were rejected.
+func (r *JobRunner) replayLogSpool(ctx context.Context) (rejected int, err error) {
+	chunks, err := r.logSpool.Claim()
+	if err != nil {
+		return 0, err
+	}
+
+	for i, chunk := range chunks {
+		err := r.uploadChunk(ctx, chunk)
+		if err != nil && !errors.Is(err, errChunkRejected) {
+			for _, c := range chunks[i:] {
+				r.logSpool.Release(c)
 			}
+			return rejected, err
+		}
+		if err != nil {
+			rejected++
+		}
+		if rerr := r.logSpool.Remove(chunk); rerr != nil {
+			r.logger.Warn("Couldn't remove chunk %d from the log spool (%s)", chunk.Order, rerr)
+		}
+	}
+
+	return rejected, nil
+}
+
+// logSpoolReplayer uploads spooled chunks while the job runs, whenever an
+// upload succeeds and every so often
+func (r *JobRunner) logSpoolReplayer(ctx context.Context) {
+	ctx, setStat, done := status.AddSimpleItem(ctx, "Log Spool Replayer")
+	defer done()
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		setStat("😴 Waiting for spooled chunks")
+
+		select {
+		case <-ticker.C:
+		case <-r.logSpoolReplay:
+		case <-ctx.Done():
+			return
 		}
 
+		setStat("📨 Uploading spooled chunks")
+
+		rejected, err := r.replayLogSpool(ctx)
+		if rejected > 0 {
+			atomic.AddInt32(&r.logSpoolRejected, int32(rejected))
+		}
+		if err != nil {
+			r.logger.Debug("[JobRunner] Spooled chunks couldn't be uploaded yet (%s)", err)
+		}
+	}
+}
+
+// logSpoolFlushTimeout is how long the spool is retried for once the job has
+// finished. The job isn't finished until then, so it's kept short.
+const logSpoolFlushTimeout = time.Minute
+
+// flushLogSpool uploads what's left in the log spool once the job has
+// finished, retrying for a little while. It returns how many chunks failed,
+// either because Buildkite rejected them or because they still couldn't be
+// uploaded. Those are dropped, as they can't be uploaded once the job has
+// finished.
+func (r *JobRunner) flushLogSpool(ctx context.Context) int {
+	if r.logSpool == nil {
+		return 0
+	}
+
+	failed := 0
+
+	ctx, cancel := context.WithTimeout(ctx, logSpoolFlushTimeout)
+	defer cancel()
+
+	_ = roko.NewRetrier(
+		roko.TryForever(),
+		roko.WithStrategy(roko.Constant(5*time.Second)),
+		roko.WithJitter(),
+	).DoWithContext(ctx, func(retrier *roko.Retrier) error {
+		rejected, err := r.replayLogSpool(ctx)
+		failed += rejected
+		if err != nil {
+			r.logger.Warn("Couldn't upload spooled chunks (%s) (%s)", err, retrier)
+		}
 		return err
 	})
+
+	remaining, err := r.logSpool.Clear()
+	if err != nil {
+		r.logger.Warn("Couldn't clear the log spool (%s)", err)
+	}
+	if remaining > 0 {
+		r.logger.Warn("%d spooled chunks couldn't be uploaded before the job finished, and were dropped", remaining)
+	}
+
+	return failed + remaining + int(atomic.LoadInt32(&r.logSpoolRejected))
 }
@@ -0,0 +1,575 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	zglob "github.com/mattn/go-zglob"
+)
+
+// LocalAPIClientConfig is the configuration for a LocalAPIClient
+type LocalAPIClientConfig struct {
+	// The job that the client will report on
+	Job *api.Job
+
+	// The directory where meta-data, annotations, artifacts and uploaded
+	// pipelines are recorded
+	Dir string
+
+	// Where the job log is streamed to instead of being uploaded
+	Output io.Writer
+
+	// The endpoint that this client is served on, so that buildkite-agent
+	// commands within the job can reach it. See ServeHTTP.
+	Endpoint string
+
+	// The token that requests to the endpoint must present
+	Token string
+}
+
+// LocalAPIClient is an APIClient that never talks to Buildkite. Job output is
+// written to an io.Writer, and everything else a job might send to the API is
+// recorded to a local directory. It's used to run jobs without an agent
+// connection, for example with `buildkite-agent run`.
+type LocalAPIClient struct {
+	// The configuration
+	conf LocalAPIClientConfig
+
+	// The logger instance to use
+	logger logger.Logger
+
+	// Protects everything below
+	mu sync.Mutex
+
+	// Chunks that arrived ahead of their turn, keyed by sequence number
+	pendingChunks map[int]*api.Chunk
+
+	// The sequence number of the next chunk to write to the output
+	nextChunk int
+
+	// The job as it was last reported by the job runner
+	finished *api.Job
+
+	// Whether the job has been cancelled
+	cancelled bool
+
+	// Recorded artifacts, in the order they were created
+	artifacts []*api.Artifact
+}
+
+// NewLocalAPIClient returns a new LocalAPIClient, creating its record
+// directory if needed
+func NewLocalAPIClient(l logger.Logger, c LocalAPIClientConfig) (*LocalAPIClient, error) {
+	// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
+	for _, dir := range []string{c.Dir, filepath.Join(c.Dir, "annotations"), filepath.Join(c.Dir, "artifacts"), filepath.Join(c.Dir, "pipelines")} {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return nil, fmt.Errorf("Failed to create %s: %v", dir, err)
+		}
+	}
+
+	return &LocalAPIClient{
+		conf:          c,
+		logger:        l,
+		pendingChunks: make(map[int]*api.Chunk),
+		nextChunk:     1,
+	}, nil
+}
+
+// localAPIError is returned by a LocalAPIClient for requests that the real
+// API would reject, carrying the status code it would have used
+type localAPIError struct {
+	status  int
+	message string
+}
+
+func (e *localAPIError) Error() string {
+	return fmt.Sprintf("%d %s", e.status, e.message)
+}
+
+func localResponse(status int) *api.Response {
+	return &api.Response{Response: &http.Response{
+		StatusCode: status,
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Header:     http.Header{},
+	}}
+}
+
+func localErrorResponse(err error) *api.Response {
+	var lerr *localAPIError
+	if errors.As(err, &lerr) {
+		return localResponse(lerr.status)
+	}
+	return localResponse(http.StatusInternalServerError)
+}
+
+func (c *LocalAPIClient) checkJob(jobID string) error {
+	if jobID != c.conf.Job.ID {
+		return &localAPIError{http.StatusNotFound, fmt.Sprintf("No job with ID %q", jobID)}
+	}
+	return nil
+}
+
+// ExitStatus returns the exit status the job finished with, or an empty
+// string if it hasn't finished
+func (c *LocalAPIClient) ExitStatus() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.finished == nil {
+		return ""
+	}
+	return c.finished.ExitStatus
+}
+
+// Cancel marks the job as cancelled, which the job runner will notice the
+// next time it checks the job state
+func (c *LocalAPIClient) Cancel() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cancelled = true
+}
+
+func (c *LocalAPIClient) Config() api.Config {
+	return api.Config{
+		Endpoint: c.conf.Endpoint,
+		Token:    c.conf.Token,
+	}
+}
+
+// FromAgentRegisterResponse returns a client that talks to this client over
+// HTTP, since the interface requires a concrete *api.Client
+func (c *LocalAPIClient) FromAgentRegisterResponse(*api.AgentRegisterResponse) *api.Client {
+	return api.NewClient(c.logger, c.Config())
+}
+
+// FromPing returns a client that talks to this client over HTTP, since the
+// interface requires a concrete *api.Client
+func (c *LocalAPIClient) FromPing(*api.Ping) *api.Client {
+	return api.NewClient(c.logger, c.Config())
+}
+
+// Register fails unless the client has an endpoint and token, as commands
+// within the job couldn't reach it without them
+func (c *LocalAPIClient) Register(ctx context.Context, req *api.AgentRegisterRequest) (*api.AgentRegisterResponse, *api.Response, error) {
+	if c.conf.Endpoint == "" || c.conf.Token == "" {
+		err := &localAPIError{http.StatusUnprocessableEntity, "The local API needs an endpoint and a token to register agents"}
+		return nil, localErrorResponse(err), err
+	}
+
+	return &api.AgentRegisterResponse{
+		UUID:              api.NewUUID(),
+		Name:              req.Name,
+		AccessToken:       c.conf.Token,
+		Endpoint:          c.conf.Endpoint,
+		PingInterval:      1,
+		JobStatusInterval: 1,
+		HeartbeatInterval: 60,
+		Tags:              req.Tags,
+	}, localResponse(http.StatusOK), nil
+}
+
+func (c *LocalAPIClient) Connect(context.Context) (*api.Response, error) {
+	return localResponse(http.StatusOK), nil
+}
+
+func (c *LocalAPIClient) Disconnect(context.Context) (*api.Response, error) {
+	return localResponse(http.StatusOK), nil
+}
+
+func (c *LocalAPIClient) Heartbeat(context.Context) (*api.Heartbeat, *api.Response, error) {
+	now := time.Now().Format(time.RFC3339Nano)
+	return &api.Heartbeat{SentAt: now, ReceivedAt: now}, localResponse(http.StatusOK), nil
+}
+
+// Ping never returns work, the only job a LocalAPIClient knows about is the
+// one it was configured with
+func (c *LocalAPIClient) Ping(context.Context) (*api.Ping, *api.Response, error) {
+	return &api.Ping{}, localResponse(http.StatusOK), nil
+}
+
+func (c *LocalAPIClient) AcquireJob(ctx context.Context, jobID string, _ ...api.Header) (*api.Job, *api.Response, error) {
+	if err := c.checkJob(jobID); err != nil {
+		return nil, localErrorResponse(err), err
+	}
+	return c.conf.Job, localResponse(http.StatusOK), nil
+}
+
+func (c *LocalAPIClient) AcceptJob(ctx context.Context, job *api.Job) (*api.Job, *api.Response, error) {
+	if err := c.checkJob(job.ID); err != nil {
+		return nil, localErrorResponse(err), err
+	}
+	return c.conf.Job, localResponse(http.StatusOK), nil
+}
+
+func (c *LocalAPIClient) StartJob(ctx context.Context, job *api.Job) (*api.Response, error) {
+	if err := c.checkJob(job.ID); err != nil {
+		return localErrorResponse(err), err
+	}
+	return localResponse(http.StatusOK), nil
+}
+
+func (c *LocalAPIClient) FinishJob(ctx context.Context, job *api.Job) (*api.Response, error) {
+	if err := c.checkJob(job.ID); err != nil {
+		return localErrorResponse(err), err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	finished := *job
+	c.finished = &finished
+
+	return localResponse(http.StatusOK), c.writeJSON("job.json", c.finished)
+}
+
+func (c *LocalAPIClient) GetJobState(ctx context.Context, jobID string) (*api.JobState, *api.Response, error) {
+	if err := c.checkJob(jobID); err != nil {
+		return nil, localErrorResponse(err), err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state := "running"
+	switch {
+	case c.finished != nil:
+		state = "finished"
+	case c.cancelled:
+		state = "canceling"
+	}
+
+	return &api.JobState{State: state}, localResponse(http.StatusOK), nil
+}
+
+func (c *LocalAPIClient) SaveHeaderTimes(ctx context.Context, jobID string, _ *api.HeaderTimes) (*api.Response, error) {
+	if err := c.checkJob(jobID); err != nil {
+		return localErrorResponse(err), err
+	}
+	return localResponse(http.StatusOK), nil
+}
+
+// UploadChunk writes the chunk to the output. Chunks can arrive out of order
+// from the log streamer workers, so any that are early are held until the
+// chunks before them have been written.
+func (c *LocalAPIClient) UploadChunk(ctx context.Context, jobID string, chunk *api.Chunk) (*api.Response, error) {
+	if err := c.checkJob(jobID); err != nil {
+		return localErrorResponse(err), err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pendingChunks[chunk.Sequence] = chunk
+
+	for {
+		next, ok := c.pendingChunks[c.nextChunk]
+		if !ok {
+			break
+		}
+		delete(c.pendingChunks, c.nextChunk)
+		c.nextChunk++
+
+		if _, err := io.WriteString(c.conf.Output, next.Data); err != nil {
+			return localResponse(http.StatusInternalServerError), err
+		}
+	}
+
+	return localResponse(http.StatusCreated), nil
+}
+
+// metaData loads the recorded meta-data. The caller must hold c.mu.
+func (c *LocalAPIClient) metaData() (map[string]string, error) {
+	data := map[string]string{}
+	if err := c.readJSON("meta-data.json", &data); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (c *LocalAPIClient) SetMetaData(ctx context.Context, jobID string, metaData *api.MetaData) (*api.Response, error) {
+	if err := c.checkJob(jobID); err != nil {
+		return localErrorResponse(err), err
+	}
+
+	if metaData.Key == "" || strings.TrimSpace(metaData.Value) == "" {
+		err := &localAPIError{http.StatusUnprocessableEntity, "Meta-data key and value can't be blank"}
+		return localErrorResponse(err), err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, err := c.metaData()
+	if err != nil {
+		return localErrorResponse(err), err
+	}
+	data[metaData.Key] = metaData.Value
+
+	if err := c.writeJSON("meta-data.json", data); err != nil {
+		return localErrorResponse(err), err
+	}
+
+	return localResponse(http.StatusOK), nil
+}
+
+func (c *LocalAPIClient) GetMetaData(ctx context.Context, jobID, key string) (*api.MetaData, *api.Response, error) {
+	if err := c.checkJob(jobID); err != nil {
+		return nil, localErrorResponse(err), err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, err := c.metaData()
+	if err != nil {
+		return nil, localErrorResponse(err), err
+	}
+
+	value, ok := data[key]
+	if !ok {
+		err := &localAPIError{http.StatusNotFound, fmt.Sprintf("No key \"%s\" found", key)}
+		return nil, localErrorResponse(err), err
+	}
+
+	return &api.MetaData{Key: key, Value: value}, localResponse(http.StatusOK), nil
+}
+
+func (c *LocalAPIClient) ExistsMetaData(ctx context.Context, jobID, key string) (*api.MetaDataExists, *api.Response, error) {
+	if err := c.checkJob(jobID); err != nil {
+		return nil, localErrorResponse(err), err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, err := c.metaData()
+	if err != nil {
+		return nil, localErrorResponse(err), err
+	}
+
+	_, ok := data[key]
+	return &api.MetaDataExists{Exists: ok}, localResponse(http.StatusOK), nil
+}
+
+func (c *LocalAPIClient) MetaDataKeys(ctx context.Context, jobID string) ([]string, *api.Response, error) {
+	if err := c.checkJob(jobID); err != nil {
+		return nil, localErrorResponse(err), err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, err := c.metaData()
+	if err != nil {
+		return nil, localErrorResponse(err), err
+	}
+
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys, localResponse(http.StatusOK), nil
+}
+
+// annotationPath returns where the annotation for a context is recorded
+func (c *LocalAPIClient) annotationPath(context string) string {
+	if context == "" {
+		context = "default"
+	}
+	return filepath.Join(c.conf.Dir, "annotations", filepath.Base(filepath.Clean("/"+context))+".md")
+}
+
+func (c *LocalAPIClient) Annotate(ctx context.Context, jobID string, annotation *api.Annotation) (*api.Response, error) {
+	if err := c.checkJob(jobID); err != nil {
+		return localErrorResponse(err), err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if annotation.Append {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+
+	path := c.annotationPath(annotation.Context)
+	f, err := os.OpenFile(path, flags, 0666)
+	if err != nil {
+		return localErrorResponse(err), err
+	}
+	defer f.Close()
+
+	if _, err := io.WriteString(f, annotation.Body); err != nil {
+		return localErrorResponse(err), err
+	}
+
+	c.logger.Info("Recorded %s annotation to %s", annotation.Style, path)
+	return localResponse(http.StatusCreated), nil
+}
+
+func (c *LocalAPIClient) AnnotationRemove(ctx context.Context, jobID, context string) (*api.Response, error) {
+	if err := c.checkJob(jobID); err != nil {
+		return localErrorResponse(err), err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.Remove(c.annotationPath(context)); err != nil {
+		if os.IsNotExist(err) {
+			err := &localAPIError{http.StatusNotFound, fmt.Sprintf("No annotation with context %q", context)}
+			return localErrorResponse(err), err
+		}
+		return localErrorResponse(err), err
+	}
+
+	return localResponse(http.StatusOK), nil
+}
+
+// CreateArtifacts records the artifacts and directs the uploader to send
+// them to this client's endpoint, see ServeHTTP
+func (c *LocalAPIClient) CreateArtifacts(ctx context.Context, jobID string, batch *api.ArtifactBatch) (*api.ArtifactBatchCreateResponse, *api.Response, error) {
+	if err := c.checkJob(jobID); err != nil {
+		return nil, localErrorResponse(err), err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	resp := &api.ArtifactBatchCreateResponse{
+		ID:                 batch.ID,
+		UploadInstructions: c.uploadInstructions(),
+	}
+
+	for _, artifact := range batch.Artifacts {
+		recorded := *artifact
+		recorded.ID = api.NewUUID()
+		recorded.JobID = jobID
+		recorded.UploadDestination = batch.UploadDestination
+		recorded.CreatedAt = time.Now().UTC()
+		if recorded.URL == "" {
+			recorded.URL = c.artifactURL(recorded.ID)
+		}
+
+		c.artifacts = append(c.artifacts, &recorded)
+		resp.ArtifactIDs = append(resp.ArtifactIDs, recorded.ID)
+	}
+
+	if err := c.writeJSON("artifacts.json", c.artifacts); err != nil {
+		return nil, localErrorResponse(err), err
+	}
+
+	return resp, localResponse(http.StatusCreated), nil
+}
+
+func (c *LocalAPIClient) UpdateArtifacts(ctx context.Context, jobID string, artifactStates map[string]string) (*api.Response, error) {
+	if err := c.checkJob(jobID); err != nil {
+		return localErrorResponse(err), err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, artifact := range c.artifacts {
+		if state, ok := artifactStates[artifact.ID]; ok && state != "finished" {
+			c.logger.Warn("Artifact %s (%s) finished in state %q", artifact.ID, artifact.Path, state)
+		}
+	}
+
+	return localResponse(http.StatusOK), nil
+}
+
+// SearchArtifacts matches the query against the paths of the recorded
+// artifacts. There is only one job, so the scope is ignored.
+func (c *LocalAPIClient) SearchArtifacts(ctx context.Context, buildID string, opt *api.ArtifactSearchOptions) ([]*api.Artifact, *api.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	found := []*api.Artifact{}
+	for _, artifact := range c.artifacts {
+		if opt != nil && opt.Query != "" {
+			if ok, err := zglob.Match(opt.Query, artifact.Path); err != nil || !ok {
+				continue
+			}
+		}
+		found = append(found, artifact)
+	}
+
+	return found, localResponse(http.StatusOK), nil
+}
+
+func (c *LocalAPIClient) UploadPipeline(ctx context.Context, jobID string, pipeline *api.Pipeline) (*api.Response, error) {
+	if err := c.checkJob(jobID); err != nil {
+		return localErrorResponse(err), err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	uuid := pipeline.UUID
+	if uuid == "" {
+		uuid = api.NewUUID()
+	}
+
+	name := filepath.Join("pipelines", uuid+".json")
+	if err := c.writeJSON(name, pipeline); err != nil {
+		return localErrorResponse(err), err
+	}
+
+	c.logger.Info("Recorded uploaded pipeline to %s", filepath.Join(c.conf.Dir, name))
+	return localResponse(http.StatusCreated), nil
+}
+
+// StepExport isn't supported, as there's no build to export steps from
+func (c *LocalAPIClient) StepExport(ctx context.Context, stepIdOrKey string, _ *api.StepExportRequest) (*api.StepExportResponse, *api.Response, error) {
+	err := &localAPIError{http.StatusNotFound, fmt.Sprintf("Step %q can't be exported from a local build", stepIdOrKey)}
+	return nil, localErrorResponse(err), err
+}
+
+// StepUpdate records the update, there's no build for it to be applied to
+func (c *LocalAPIClient) StepUpdate(ctx context.Context, stepIdOrKey string, update *api.StepUpdate) (*api.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	updates := map[string][]*api.StepUpdate{}
+	if err := c.readJSON("step-updates.json", &updates); err != nil && !os.IsNotExist(err) {
+		return localErrorResponse(err), err
+	}
+	updates[stepIdOrKey] = append(updates[stepIdOrKey], update)
+
+	if err := c.writeJSON("step-updates.json", updates); err != nil {
+		return localErrorResponse(err), err
+	}
+
+	return localResponse(http.StatusOK), nil
+}
+
+func (c *LocalAPIClient) readJSON(name string, v any) error {
+	b, err := os.ReadFile(filepath.Join(c.conf.Dir, name))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (c *LocalAPIClient) writeJSON(name string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(c.conf.Dir, name), b, 0666)
+}
@@ -0,0 +1,165 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalAPIClientWritesChunksInOrder(t *testing.T) {
+	ctx := context.Background()
+	out := &bytes.Buffer{}
+
+	client, err := NewLocalAPIClient(logger.Discard, LocalAPIClientConfig{
+		Job:    &api.Job{ID: "my-job"},
+		Dir:    t.TempDir(),
+		Output: out,
+	})
+	require.NoError(t, err)
+
+	for _, chunk := range []*api.Chunk{
+		{Sequence: 2, Data: "b"},
+		{Sequence: 3, Data: "c"},
+		{Sequence: 1, Data: "a"},
+		{Sequence: 5, Data: "e"},
+	} {
+		_, err := client.UploadChunk(ctx, "my-job", chunk)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, "abc", out.String())
+
+	_, err = client.UploadChunk(ctx, "my-job", &api.Chunk{Sequence: 4, Data: "d"})
+	require.NoError(t, err)
+
+	assert.Equal(t, "abcde", out.String())
+}
+
+func TestLocalAPIClientExitStatus(t *testing.T) {
+	ctx := context.Background()
+	job := &api.Job{ID: "my-job"}
+
+	client, err := NewLocalAPIClient(logger.Discard, LocalAPIClientConfig{
+		Job:    job,
+		Dir:    t.TempDir(),
+		Output: &bytes.Buffer{},
+	})
+	require.NoError(t, err)
+
+	state, _, err := client.GetJobState(ctx, "my-job")
+	require.NoError(t, err)
+	assert.Equal(t, "running", state.State)
+
+	client.Cancel()
+
+	state, _, err = client.GetJobState(ctx, "my-job")
+	require.NoError(t, err)
+	assert.Equal(t, "canceling", state.State)
+
+	job.ExitStatus = "3"
+	_, err = client.FinishJob(ctx, job)
+	require.NoError(t, err)
+
+	assert.Equal(t, "3", client.ExitStatus())
+
+	_, _, err = client.GetJobState(ctx, "other-job")
+	assert.Error(t, err)
+}
+
+func TestLocalAPIClientRegister(t *testing.T) {
+	ctx := context.Background()
+
+	client, err := NewLocalAPIClient(logger.Discard, LocalAPIClientConfig{
+		Job:      &api.Job{ID: "my-job"},
+		Dir:      t.TempDir(),
+		Output:   &bytes.Buffer{},
+		Endpoint: "http://127.0.0.1:1234/",
+		Token:    "llamas",
+	})
+	require.NoError(t, err)
+
+	reg, _, err := client.Register(ctx, &api.AgentRegisterRequest{Name: "my-agent"})
+	require.NoError(t, err)
+	assert.Equal(t, "my-agent", reg.Name)
+	assert.Equal(t, "llamas", reg.AccessToken)
+	assert.Equal(t, "http://127.0.0.1:1234/", reg.Endpoint)
+
+	// Commands within the job couldn't reach it without an endpoint
+	client, err = NewLocalAPIClient(logger.Discard, LocalAPIClientConfig{
+		Job:    &api.Job{ID: "my-job"},
+		Dir:    t.TempDir(),
+		Output: &bytes.Buffer{},
+		Token:  "llamas",
+	})
+	require.NoError(t, err)
+
+	_, resp, err := client.Register(ctx, &api.AgentRegisterRequest{Name: "my-agent"})
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+}
+
+func TestLocalAPIClientServesCommandsFromJob(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	client, err := NewLocalAPIClient(logger.Discard, LocalAPIClientConfig{
+		Job:    &api.Job{ID: "my-job"},
+		Dir:    dir,
+		Output: &bytes.Buffer{},
+		Token:  "llamas",
+	})
+	require.NoError(t, err)
+
+	server := httptest.NewServer(client)
+	defer server.Close()
+
+	// The client a buildkite-agent command in the job would use
+	apiClient := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL + "/",
+		Token:    "llamas",
+	})
+
+	exists, _, err := apiClient.ExistsMetaData(ctx, "my-job", "foo")
+	require.NoError(t, err)
+	assert.False(t, exists.Exists)
+
+	_, err = apiClient.SetMetaData(ctx, "my-job", &api.MetaData{Key: "foo", Value: "bar"})
+	require.NoError(t, err)
+
+	md, _, err := apiClient.GetMetaData(ctx, "my-job", "foo")
+	require.NoError(t, err)
+	assert.Equal(t, "bar", md.Value)
+
+	_, resp, err := apiClient.GetMetaData(ctx, "my-job", "missing")
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	keys, _, err := apiClient.MetaDataKeys(ctx, "my-job")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, keys)
+
+	_, err = apiClient.Annotate(ctx, "my-job", &api.Annotation{Body: "hello", Context: "greeting"})
+	require.NoError(t, err)
+
+	annotation, err := os.ReadFile(filepath.Join(dir, "annotations", "greeting.md"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(annotation))
+
+	// Requests without the token are rejected
+	badClient := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL + "/",
+		Token:    "alpacas",
+	})
+	_, resp, err = badClient.GetMetaData(ctx, "my-job", "foo")
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
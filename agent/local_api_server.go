@@ -0,0 +1,215 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/api/apiserver"
+)
+
+// The form field the artifact file is uploaded in, see uploadInstructions
+const localArtifactFileInput = "file"
+
+// uploadInstructions tells the FormUploader to post artifacts back to this
+// client's endpoint
+func (c *LocalAPIClient) uploadInstructions() *api.ArtifactUploadInstructions {
+	instructions := &api.ArtifactUploadInstructions{
+		Data: map[string]string{
+			"path":  "${artifact:path}",
+			"token": c.conf.Token,
+		},
+	}
+	instructions.Action.URL = c.conf.Endpoint
+	instructions.Action.Method = "POST"
+	instructions.Action.Path = "/artifacts/upload"
+	instructions.Action.FileInput = localArtifactFileInput
+	return instructions
+}
+
+// artifactURL is where an uploaded artifact can be downloaded from
+func (c *LocalAPIClient) artifactURL(id string) string {
+	return fmt.Sprintf("%s/artifacts/%s?token=%s", strings.TrimRight(c.conf.Endpoint, "/"), id, c.conf.Token)
+}
+
+// artifactPath is where the contents of an artifact are stored
+func (c *LocalAPIClient) artifactPath(path string) string {
+	return filepath.Join(c.conf.Dir, "artifacts", filepath.Clean(string(filepath.Separator)+filepath.FromSlash(path)))
+}
+
+// ServeHTTP serves the parts of the Agent API that buildkite-agent commands
+// use from within a job (meta-data, annotations, artifacts, pipeline uploads
+// and step updates), so that they work against a LocalAPIClient.
+func (c *LocalAPIClient) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	// Artifact transfers come from the uploader and downloader, which don't
+	// send the API token as a header
+	if len(parts) == 2 && parts[0] == "artifacts" {
+		if parts[1] == "upload" && r.Method == http.MethodPost {
+			c.serveArtifactUpload(w, r)
+			return
+		}
+		if r.Method == http.MethodGet {
+			c.serveArtifactDownload(w, r, parts[1])
+			return
+		}
+	}
+
+	apiserver.New(localAPIBackend{c: c}).ServeHTTP(w, r)
+}
+
+// localAPIBackend serves the routes a job uses from a LocalAPIClient. The
+// agent's own routes aren't served, as there's only the one job.
+type localAPIBackend struct {
+	apiserver.Unimplemented
+	c *LocalAPIClient
+}
+
+// serverError converts the errors of a LocalAPIClient into the responses the
+// API would have sent
+func serverError(err error) error {
+	var lerr *localAPIError
+	if errors.As(err, &lerr) {
+		return &apiserver.Error{Status: lerr.status, Message: lerr.message}
+	}
+	return err
+}
+
+func (b localAPIBackend) Authenticate(ctx context.Context, token string) error {
+	if token != b.c.conf.Token {
+		return apiserver.Errorf(http.StatusUnauthorized, "Invalid access token")
+	}
+	return nil
+}
+
+func (b localAPIBackend) GetJobState(ctx context.Context, jobID string) (*api.JobState, error) {
+	state, _, err := b.c.GetJobState(ctx, jobID)
+	return state, serverError(err)
+}
+
+func (b localAPIBackend) SetMetaData(ctx context.Context, jobID string, metaData *api.MetaData) error {
+	_, err := b.c.SetMetaData(ctx, jobID, metaData)
+	return serverError(err)
+}
+
+func (b localAPIBackend) GetMetaData(ctx context.Context, jobID, key string) (*api.MetaData, error) {
+	md, _, err := b.c.GetMetaData(ctx, jobID, key)
+	return md, serverError(err)
+}
+
+func (b localAPIBackend) ExistsMetaData(ctx context.Context, jobID, key string) (*api.MetaDataExists, error) {
+	exists, _, err := b.c.ExistsMetaData(ctx, jobID, key)
+	return exists, serverError(err)
+}
+
+func (b localAPIBackend) MetaDataKeys(ctx context.Context, jobID string) ([]string, error) {
+	keys, _, err := b.c.MetaDataKeys(ctx, jobID)
+	return keys, serverError(err)
+}
+
+func (b localAPIBackend) Annotate(ctx context.Context, jobID string, annotation *api.Annotation) error {
+	_, err := b.c.Annotate(ctx, jobID, annotation)
+	return serverError(err)
+}
+
+func (b localAPIBackend) AnnotationRemove(ctx context.Context, jobID, context string) error {
+	_, err := b.c.AnnotationRemove(ctx, jobID, context)
+	return serverError(err)
+}
+
+func (b localAPIBackend) CreateArtifacts(ctx context.Context, jobID string, batch *api.ArtifactBatch) (*api.ArtifactBatchCreateResponse, error) {
+	resp, _, err := b.c.CreateArtifacts(ctx, jobID, batch)
+	return resp, serverError(err)
+}
+
+func (b localAPIBackend) UpdateArtifacts(ctx context.Context, jobID string, artifactStates map[string]string) error {
+	_, err := b.c.UpdateArtifacts(ctx, jobID, artifactStates)
+	return serverError(err)
+}
+
+func (b localAPIBackend) SearchArtifacts(ctx context.Context, buildID string, opt *api.ArtifactSearchOptions) ([]*api.Artifact, error) {
+	artifacts, _, err := b.c.SearchArtifacts(ctx, buildID, opt)
+	return artifacts, serverError(err)
+}
+
+func (b localAPIBackend) UploadPipeline(ctx context.Context, jobID string, pipeline *api.Pipeline) error {
+	_, err := b.c.UploadPipeline(ctx, jobID, pipeline)
+	return serverError(err)
+}
+
+func (b localAPIBackend) StepExport(ctx context.Context, stepIDOrKey string, req *api.StepExportRequest) (*api.StepExportResponse, error) {
+	resp, _, err := b.c.StepExport(ctx, stepIDOrKey, req)
+	return resp, serverError(err)
+}
+
+func (b localAPIBackend) StepUpdate(ctx context.Context, stepIDOrKey string, update *api.StepUpdate) error {
+	_, err := b.c.StepUpdate(ctx, stepIDOrKey, update)
+	return serverError(err)
+}
+
+func (c *LocalAPIClient) serveArtifactUpload(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("token") != c.conf.Token {
+		apiserver.WriteError(w, r, apiserver.Errorf(http.StatusUnauthorized, "Invalid access token"))
+		return
+	}
+
+	file, _, err := r.FormFile(localArtifactFileInput)
+	if err != nil {
+		apiserver.WriteError(w, r, apiserver.Errorf(http.StatusBadRequest, "%v", err))
+		return
+	}
+	defer file.Close()
+
+	path := c.artifactPath(r.FormValue("path"))
+
+	// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		apiserver.WriteError(w, r, err)
+		return
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		apiserver.WriteError(w, r, err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, file); err != nil {
+		apiserver.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (c *LocalAPIClient) serveArtifactDownload(w http.ResponseWriter, r *http.Request, id string) {
+	if r.URL.Query().Get("token") != c.conf.Token {
+		apiserver.WriteError(w, r, apiserver.Errorf(http.StatusUnauthorized, "Invalid access token"))
+		return
+	}
+
+	c.mu.Lock()
+	var found *api.Artifact
+	for _, artifact := range c.artifacts {
+		if artifact.ID == id {
+			found = artifact
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	if found == nil {
+		apiserver.WriteError(w, r, apiserver.Errorf(http.StatusNotFound, "No artifact with ID %q", id))
+		return
+	}
+
+	http.ServeFile(w, r, c.artifactPath(found.Path))
+}
@@ -0,0 +1,250 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/gofrs/flock"
+)
+
+// LogSpoolDirName is the directory within the build path where job log chunks
+// are kept until Buildkite has accepted them
+const LogSpoolDirName = ".log-spool"
+
+const (
+	logSpoolChunkExt = ".chunk"
+	logSpoolLockName = ".lock"
+)
+
+// logSpool is an on-disk store of the log chunks of a job that haven't been
+// uploaded yet. Every chunk is written to the spool before it is uploaded and
+// removed once Buildkite accepts it, so chunks that couldn't be uploaded
+// survive an outage of the Agent API while the job is running.
+//
+// Each job has its own directory in the spool, holding one file per chunk.
+// The directory is locked while a job runner or a replay is using it.
+type logSpool struct {
+	dir  string
+	lock *flock.Flock
+
+	mu       sync.Mutex
+	inflight map[int]bool
+	closed   bool
+}
+
+// openLogSpool opens and locks the spool directory of a job, creating it if
+// needed. It returns an error if the spool is locked by someone else.
+func openLogSpool(buildPath, jobID string) (*logSpool, error) {
+	dir := filepath.Join(buildPath, LogSpoolDirName, jobID)
+
+	// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, fmt.Errorf("creating log spool directory: %w", err)
+	}
+
+	lock := flock.New(filepath.Join(dir, logSpoolLockName))
+	locked, err := lock.TryLock()
+	if err != nil {
+		return nil, fmt.Errorf("locking log spool %s: %w", dir, err)
+	}
+	if !locked {
+		return nil, fmt.Errorf("log spool %s is in use", dir)
+	}
+
+	return &logSpool{
+		dir:      dir,
+		lock:     lock,
+		inflight: make(map[int]bool),
+	}, nil
+}
+
+// chunkPath is where a chunk is stored. The name holds the chunk's position in
+// the log, and the file holds its data.
+func (s *logSpool) chunkPath(chunk *LogStreamerChunk) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%010d-%d-%d%s", chunk.Order, chunk.Offset, chunk.Size, logSpoolChunkExt))
+}
+
+// Write stores a chunk in the spool, and marks it as being uploaded so that
+// it isn't replayed at the same time
+func (s *logSpool) Write(chunk *LogStreamerChunk) error {
+	path := s.chunkPath(chunk)
+
+	// Write to a temporary file first so that a partial chunk is never replayed
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(chunk.Data), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.inflight[chunk.Order] = true
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Remove deletes a chunk that has been dealt with from the spool
+func (s *logSpool) Remove(chunk *LogStreamerChunk) error {
+	s.Release(chunk)
+
+	if err := os.Remove(s.chunkPath(chunk)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Release marks a chunk as no longer being uploaded, so that it can be
+// replayed later
+func (s *logSpool) Release(chunk *LogStreamerChunk) {
+	s.mu.Lock()
+	delete(s.inflight, chunk.Order)
+	s.mu.Unlock()
+}
+
+// Claim returns the chunks in the spool that aren't being uploaded, in order,
+// and marks them as being uploaded. Each one must be removed or released.
+func (s *logSpool) Claim() ([]*LogStreamerChunk, error) {
+	chunks, err := s.chunks()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	claimed := chunks[:0]
+	for _, chunk := range chunks {
+		if s.inflight[chunk.Order] {
+			continue
+		}
+		s.inflight[chunk.Order] = true
+		claimed = append(claimed, chunk)
+	}
+	return claimed, nil
+}
+
+// Clear removes every chunk from the spool, and returns how many there were
+func (s *logSpool) Clear() (int, error) {
+	chunks, err := s.chunks()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, chunk := range chunks {
+		if err := s.Remove(chunk); err != nil {
+			return len(chunks), err
+		}
+	}
+	return len(chunks), nil
+}
+
+// Len returns how many chunks are in the spool
+func (s *logSpool) Len() (int, error) {
+	chunks, err := s.chunks()
+	return len(chunks), err
+}
+
+// chunks reads all the chunks in the spool, in order
+func (s *logSpool) chunks() ([]*LogStreamerChunk, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var chunks []*LogStreamerChunk
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, logSpoolChunkExt) {
+			continue
+		}
+
+		chunk := &LogStreamerChunk{}
+		if _, err := fmt.Sscanf(strings.TrimSuffix(name, logSpoolChunkExt), "%d-%d-%d", &chunk.Order, &chunk.Offset, &chunk.Size); err != nil {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(s.dir, name))
+		if err != nil {
+			return nil, err
+		}
+		chunk.Data = string(data)
+
+		chunks = append(chunks, chunk)
+	}
+
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Order < chunks[j].Order
+	})
+
+	return chunks, nil
+}
+
+// Close unlocks the spool. If every chunk has been uploaded, the spool
+// directory is removed. Closing more than once does nothing.
+func (s *logSpool) Close() error {
+	s.mu.Lock()
+	closed := s.closed
+	s.closed = true
+	s.mu.Unlock()
+	if closed {
+		return nil
+	}
+
+	n, err := s.Len()
+
+	if uerr := s.lock.Unlock(); uerr != nil {
+		return uerr
+	}
+	if err != nil || n > 0 {
+		return err
+	}
+
+	return os.RemoveAll(s.dir)
+}
+
+// removeLogSpools removes the spools left behind by jobs that didn't finish,
+// such as when the agent was killed. Those jobs are gone, and their chunks
+// can't be uploaded with another agent's token. Spools that are in use are
+// skipped.
+func removeLogSpools(l logger.Logger, buildPath string) {
+	entries, err := os.ReadDir(filepath.Join(buildPath, LogSpoolDirName))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			l.Warn("Couldn't read the log spool: %v", err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		jobID := entry.Name()
+
+		spool, err := openLogSpool(buildPath, jobID)
+		if err != nil {
+			l.Debug("Skipping log spool of job %s: %v", jobID, err)
+			continue
+		}
+
+		n, err := spool.Clear()
+		if err != nil {
+			l.Warn("Couldn't clear the log spool of job %s: %v", jobID, err)
+		}
+		if n > 0 {
+			l.Warn("Dropped %d log chunks of job %s that were never uploaded", n, jobID)
+		}
+
+		if err := spool.Close(); err != nil {
+			l.Warn("Couldn't close the log spool of job %s: %v", jobID, err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogSpool(t *testing.T) {
+	buildPath := t.TempDir()
+
+	spool, err := openLogSpool(buildPath, "my-job")
+	require.NoError(t, err)
+
+	// The spool can't be opened twice
+	_, err = openLogSpool(buildPath, "my-job")
+	assert.Error(t, err)
+
+	first := &LogStreamerChunk{Data: "hello ", Order: 1, Offset: 0, Size: 6}
+	second := &LogStreamerChunk{Data: "world\n", Order: 2, Offset: 6, Size: 6}
+	require.NoError(t, spool.Write(second))
+	require.NoError(t, spool.Write(first))
+
+	// Chunks being uploaded can't be claimed
+	claimed, err := spool.Claim()
+	require.NoError(t, err)
+	assert.Empty(t, claimed)
+
+	spool.Release(first)
+	spool.Release(second)
+
+	claimed, err = spool.Claim()
+	require.NoError(t, err)
+	assert.Equal(t, []*LogStreamerChunk{first, second}, claimed)
+
+	require.NoError(t, spool.Remove(first))
+	spool.Release(second)
+
+	n, err := spool.Len()
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// The spool is kept while it has chunks in it
+	require.NoError(t, spool.Close())
+	assert.DirExists(t, filepath.Join(buildPath, LogSpoolDirName, "my-job"))
+
+	spool, err = openLogSpool(buildPath, "my-job")
+	require.NoError(t, err)
+	require.NoError(t, spool.Remove(second))
+	require.NoError(t, spool.Close())
+
+	_, err = os.Stat(filepath.Join(buildPath, LogSpoolDirName, "my-job"))
+	assert.True(t, os.IsNotExist(err), "spool directory should be removed once it's empty")
+}
+
+func TestRemoveLogSpools(t *testing.T) {
+	buildPath := t.TempDir()
+
+	for _, jobID := range []string{"job-1", "job-2"} {
+		spool, err := openLogSpool(buildPath, jobID)
+		require.NoError(t, err)
+		require.NoError(t, spool.Write(&LogStreamerChunk{Data: jobID, Order: 1, Size: len(jobID)}))
+		require.NoError(t, spool.Close())
+	}
+
+	// A spool in use by a running job is left alone
+	running, err := openLogSpool(buildPath, "job-2")
+	require.NoError(t, err)
+	defer running.Close()
+
+	removeLogSpools(logger.Discard, buildPath)
+
+	assert.NoDirExists(t, filepath.Join(buildPath, LogSpoolDirName, "job-1"))
+	assert.DirExists(t, filepath.Join(buildPath, LogSpoolDirName, "job-2"))
+}
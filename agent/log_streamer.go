@@ -4,10 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"math"
+	"strings"
 	"sync"
 	"sync/atomic"
 
+	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/logger"
 	"github.com/buildkite/agent/v3/status"
 )
@@ -18,8 +19,27 @@ type LogStreamerConfig struct {
 
 	// The maximum size of chunks
 	MaxChunkSizeBytes int
+
+	// How chunks will be encoded for upload. When set, chunks are sized so
+	// that they're at most MaxChunkSizeBytes once encoded, otherwise the
+	// limit applies to the log itself.
+	Encoding string
+
+	// The most log that will be streamed as the job runs. Once the log
+	// grows past it the rest is held back, and when the streamer is stopped
+	// only the last TailSizeBytes of it are uploaded after a truncation
+	// marker. 0 means there is no limit.
+	MaxSizeBytes int
+
+	// How much of the end of a truncated log to upload
+	TailSizeBytes int
 }
 
+// maxChunkCompressionRatio limits how much log goes in a chunk that is sized
+// by its compressed size, so that very compressible logs don't make huge
+// chunks
+const maxChunkCompressionRatio = 10
+
 type LogStreamer struct {
 	// The configuration
 	conf LogStreamerConfig
@@ -39,9 +59,17 @@ type LogStreamer struct {
 	// Total size in bytes of the log
 	bytes int
 
+	// How much the last chunk was compressed by when it was encoded, which
+	// the next chunk is sized from
+	compressionRatio float64
+
 	// Each chunk is assigned an order
 	order int
 
+	// The most recent output passed to Process, kept once the log is over
+	// MaxSizeBytes so its tail can be uploaded when the streamer stops
+	truncatedOutput string
+
 	// Every time we add a job to the queue, we increase the wait group
 	// queue so when the streamer shuts down, we can block until all work
 	// has been added.
@@ -63,6 +91,10 @@ type LogStreamerChunk struct {
 
 	// The byte size of this chunk
 	Size int
+
+	// The contents encoded for upload, if they were encoded to size the
+	// chunk. It isn't spooled, so spooled chunks are encoded again.
+	Encoded []byte
 }
 
 // Creates a new instance of the log streamer
@@ -100,52 +132,145 @@ func (ls *LogStreamer) Process(output string) error {
 	// Only allow one streamer process at a time
 	ls.processMutex.Lock()
 
-	if ls.bytes != bytes {
+	if ls.truncatedOutput != "" {
+		// Past the maximum log size, hold on to the output for its tail
+		if bytes > len(ls.truncatedOutput) {
+			ls.truncatedOutput = output
+		}
+	} else if ls.bytes != bytes {
 		// Grab the part of the log that we haven't seen yet
 		blob := output[ls.bytes:bytes]
 
-		// How many chunks do we have that fit within the MaxChunkSizeBytes?
-		numberOfChunks := int(math.Ceil(float64(len(blob)) / float64(ls.conf.MaxChunkSizeBytes)))
+		if max := ls.conf.MaxSizeBytes; max > 0 && bytes > max {
+			ls.logger.Warn("The job log is over the maximum size of %d bytes, only its last %d bytes will be uploaded after this", max, ls.conf.TailSizeBytes)
+			blob = blob[:max-ls.bytes]
+			ls.truncatedOutput = output
+		}
 
-		// Increase the wait group by the amount of chunks we're going
-		// to add
-		ls.chunkWaitGroup.Add(numberOfChunks)
+		ls.enqueue(blob)
+	}
 
-		for i := 0; i < numberOfChunks; i++ {
-			// Find the upper limit of the blob
-			upperLimit := (i + 1) * ls.conf.MaxChunkSizeBytes
-			if upperLimit > len(blob) {
-				upperLimit = len(blob)
-			}
+	ls.processMutex.Unlock()
 
-			// Grab the 100kb section of the blob
-			partialChunk := blob[i*ls.conf.MaxChunkSizeBytes : upperLimit]
+	return nil
+}
 
-			// Increment the order
-			ls.order += 1
+// enqueue splits blob into chunks and adds them to the upload queue
+func (ls *LogStreamer) enqueue(blob string) {
+	for len(blob) > 0 {
+		// Grab as much of the blob as fits in a chunk
+		size, encoded := ls.nextChunk(blob)
+		partialChunk := blob[:size]
+		blob = blob[size:]
+
+		// Increment the order
+		ls.order += 1
+
+		// Create the chunk and append it to our list
+		chunk := LogStreamerChunk{
+			Data:    partialChunk,
+			Order:   ls.order,
+			Offset:  ls.bytes,
+			Size:    len(partialChunk),
+			Encoded: encoded,
+		}
 
-			// Create the chunk and append it to our list
-			chunk := LogStreamerChunk{
-				Data:   partialChunk,
-				Order:  ls.order,
-				Offset: ls.bytes,
-				Size:   len(partialChunk),
-			}
+		// Increase the wait group for the chunk we're going to add
+		ls.chunkWaitGroup.Add(1)
 
-			ls.queue <- &chunk
+		ls.queue <- &chunk
 
-			// Save the new amount of bytes
-			ls.bytes += len(partialChunk)
+		// Save the new amount of bytes
+		ls.bytes += len(partialChunk)
+	}
+}
+
+// enqueueTail adds the end of a log that went over MaxSizeBytes to the upload
+// queue, after a marker saying how much of it was left out
+func (ls *LogStreamer) enqueueTail() {
+	output := ls.truncatedOutput
+	ls.truncatedOutput = ""
+
+	// The part of the log that was held back
+	rest := output[ls.bytes:]
+	tail := rest
+	if ls.conf.TailSizeBytes >= 0 && ls.conf.TailSizeBytes < len(rest) {
+		tail = rest[len(rest)-ls.conf.TailSizeBytes:]
+
+		// Start the tail on a fresh line if there's one to start on
+		if i := strings.IndexByte(tail, '\n'); i >= 0 && i < len(tail)-1 {
+			tail = tail[i+1:]
 		}
 	}
 
-	ls.processMutex.Unlock()
+	if omitted := len(rest) - len(tail); omitted > 0 {
+		ls.enqueue(fmt.Sprintf("\n\n✂️ [%d bytes of this log were left out, as it is over the maximum job log size of %d bytes]\n\n", omitted, ls.conf.MaxSizeBytes))
+	}
 
-	return nil
+	ls.enqueue(tail)
+}
+
+// nextChunk returns how many bytes from the start of blob go in the next
+// chunk, and those bytes encoded if they were encoded to size the chunk
+func (ls *LogStreamer) nextChunk(blob string) (int, []byte) {
+	max := ls.conf.MaxChunkSizeBytes
+	rawSize := len(blob)
+	if rawSize > max {
+		rawSize = max
+	}
+
+	if ls.conf.Encoding == "" {
+		return rawSize, nil
+	}
+
+	// Logs tend to compress about as well as they did in the last chunk, so
+	// start from that to avoid encoding the chunk more than once
+	limit := max * maxChunkCompressionRatio
+	if ls.compressionRatio > 0 {
+		limit = int(float64(max) * ls.compressionRatio * 0.95)
+		if limit > max*maxChunkCompressionRatio {
+			limit = max * maxChunkCompressionRatio
+		}
+	}
+	size := len(blob)
+	if size > limit {
+		size = limit
+	}
+
+	for size > 0 {
+		encoded, err := api.EncodeChunk(ls.conf.Encoding, []byte(blob[:size]))
+		if err != nil {
+			ls.logger.Warn("Sizing chunks by the log size, as they couldn't be encoded (%s)", err)
+			return rawSize, nil
+		}
+		if len(encoded) <= max {
+			if len(encoded) > 0 {
+				ls.compressionRatio = float64(size) / float64(len(encoded))
+			}
+			return size, encoded
+		}
+
+		// Shrink the chunk by how far over the limit it is, with a bit to
+		// spare so that it's unlikely to be over again
+		next := int(float64(size) * float64(max) / float64(len(encoded)) * 0.95)
+		if next >= size {
+			next = size - 1
+		}
+		size = next
+	}
+
+	// The limit is too small for even a little bit of encoded log
+	return rawSize, nil
 }
 
 // Waits for all the chunks to be uploaded, then shuts down all the workers
 func (ls *LogStreamer) Stop() error {
+	ls.processMutex.Lock()
+	if ls.truncatedOutput != "" {
+		ls.enqueueTail()
+	}
+	ls.processMutex.Unlock()
+
 	ls.logger.Debug("[LogStreamer] Waiting for all the chunks to be uploaded")
 
 	ls.chunkWaitGroup.Wait()
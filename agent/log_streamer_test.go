@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func streamLog(t *testing.T, conf LogStreamerConfig, log string) []*LogStreamerChunk {
+	t.Helper()
+
+	var (
+		mu     sync.Mutex
+		chunks []*LogStreamerChunk
+	)
+
+	ls := NewLogStreamer(logger.Discard, func(_ context.Context, chunk *LogStreamerChunk) error {
+		mu.Lock()
+		defer mu.Unlock()
+		chunks = append(chunks, chunk)
+		return nil
+	}, conf)
+
+	require.NoError(t, ls.Start(context.Background()))
+	require.NoError(t, ls.Process(log))
+	require.NoError(t, ls.Stop())
+
+	mu.Lock()
+	defer mu.Unlock()
+	return chunks
+}
+
+func TestLogStreamerSizesChunksByLogSize(t *testing.T) {
+	log := strings.Repeat("a", 1000)
+
+	chunks := streamLog(t, LogStreamerConfig{Concurrency: 1, MaxChunkSizeBytes: 100}, log)
+
+	require.Len(t, chunks, 10)
+	for i, chunk := range chunks {
+		assert.Equal(t, i+1, chunk.Order)
+		assert.Equal(t, i*100, chunk.Offset)
+		assert.Equal(t, 100, chunk.Size)
+	}
+}
+
+func TestLogStreamerSizesChunksByEncodedSize(t *testing.T) {
+	var b strings.Builder
+	for i := 0; b.Len() < 200*1024; i++ {
+		b.WriteString("Step 3/7 : RUN go build ./... && echo done\n")
+	}
+	log := b.String()
+
+	const max = 1024
+	chunks := streamLog(t, LogStreamerConfig{Concurrency: 1, MaxChunkSizeBytes: max, Encoding: api.ChunkEncodingGzip}, log)
+
+	// A repetitive log compresses well, so far fewer chunks are needed than
+	// if they were sized by the log
+	assert.Less(t, len(chunks), len(log)/max/2)
+
+	var rebuilt strings.Builder
+	for i, chunk := range chunks {
+		assert.Equal(t, i+1, chunk.Order)
+		assert.Equal(t, rebuilt.Len(), chunk.Offset)
+		assert.LessOrEqual(t, chunk.Size, max*maxChunkCompressionRatio)
+
+		// The encoding used to size the chunk is kept for uploading it
+		assert.LessOrEqual(t, len(chunk.Encoded), max, "chunk %d is too big once encoded", chunk.Order)
+		zr, err := gzip.NewReader(bytes.NewReader(chunk.Encoded))
+		require.NoError(t, err)
+		decoded, err := io.ReadAll(zr)
+		require.NoError(t, err)
+		assert.Equal(t, chunk.Data, string(decoded))
+
+		rebuilt.WriteString(chunk.Data)
+	}
+	assert.Equal(t, log, rebuilt.String())
+}
+
+func TestLogStreamerTruncatesLogsOverMaxSize(t *testing.T) {
+	var log strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&log, "line %03d\n", i)
+	}
+
+	chunks := streamLog(t, LogStreamerConfig{
+		Concurrency:       1,
+		MaxChunkSizeBytes: 25,
+		MaxSizeBytes:      100,
+		TailSizeBytes:     35,
+	}, log.String())
+
+	var uploaded strings.Builder
+	for i, chunk := range chunks {
+		assert.Equal(t, i+1, chunk.Order)
+		assert.Equal(t, uploaded.Len(), chunk.Offset)
+		uploaded.WriteString(chunk.Data)
+	}
+
+	head, tail := log.String()[:100], "line 097\nline 098\nline 099\n"
+	omitted := log.Len() - len(head) - len(tail)
+	marker := fmt.Sprintf("\n\n✂️ [%d bytes of this log were left out, as it is over the maximum job log size of 100 bytes]\n\n", omitted)
+	assert.Equal(t, head+marker+tail, uploaded.String())
+}
+
+func TestLogStreamerDoesNotTruncateLogsUnderMaxSize(t *testing.T) {
+	log := strings.Repeat("a", 100)
+
+	chunks := streamLog(t, LogStreamerConfig{
+		Concurrency:       1,
+		MaxChunkSizeBytes: 25,
+		MaxSizeBytes:      100,
+		TailSizeBytes:     10,
+	}, log)
+
+	var uploaded strings.Builder
+	for _, chunk := range chunks {
+		uploaded.WriteString(chunk.Data)
+	}
+	assert.Equal(t, log, uploaded.String())
+}
+
+func TestLogStreamerKeepsTailFromLatestOutput(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		uploaded strings.Builder
+	)
+
+	ls := NewLogStreamer(logger.Discard, func(_ context.Context, chunk *LogStreamerChunk) error {
+		mu.Lock()
+		defer mu.Unlock()
+		uploaded.WriteString(chunk.Data)
+		return nil
+	}, LogStreamerConfig{Concurrency: 1, MaxChunkSizeBytes: 100, MaxSizeBytes: 10, TailSizeBytes: 4})
+
+	require.NoError(t, ls.Start(context.Background()))
+	require.NoError(t, ls.Process("0123456789abc"))
+	require.NoError(t, ls.Process("0123456789abcdefghij"))
+	require.NoError(t, ls.Stop())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.True(t, strings.HasPrefix(uploaded.String(), "0123456789"), "head = %q", uploaded.String())
+	assert.True(t, strings.HasSuffix(uploaded.String(), "]\n\nghij"), "tail = %q", uploaded.String())
+}
@@ -29,6 +29,9 @@ type S3DownloaderConfig struct {
 	// How many times should it retry the download before giving up
 	Retries int
 
+	// How long each attempt at downloading can take, if there's a limit
+	Timeout time.Duration
+
 	// If failed responses should be dumped to the log
 	DebugHTTP bool
 }
@@ -69,6 +72,7 @@ func (d S3Downloader) Start(ctx context.Context) error {
 		Path:        d.conf.Path,
 		Destination: d.conf.Destination,
 		Retries:     d.conf.Retries,
+		Timeout:     d.conf.Timeout,
 		DebugHTTP:   d.conf.DebugHTTP,
 	}).Start(ctx)
 }
@@ -1,23 +1,50 @@
 package agent
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/logger"
 )
 
+const (
+	// The part size and concurrency to use for multipart uploads, unless
+	// they're configured
+	DefaultUploadPartSize        = 16 * 1024 * 1024
+	DefaultUploadPartConcurrency = 4
+
+	// S3 doesn't accept parts smaller than this, other than the last one, or
+	// more parts than this
+	s3MinPartSize = 5 * 1024 * 1024
+	s3MaxParts    = 10000
+)
+
+// S3 doesn't copy objects bigger than this at once, so they're copied in
+// parts of this size
+var s3MaxCopySize int64 = 5 * 1024 * 1024 * 1024
+
 type S3UploaderConfig struct {
 	// The destination which includes the S3 bucket name and the path.
 	// For example, s3://my-bucket-name/foo/bar
 	Destination string
 
+	// Files larger than this are uploaded in parts of this size
+	PartSize int64
+
+	// How many parts of each file to upload at once
+	PartConcurrency int
+
 	// Whether or not HTTP calls should be debugged
 	DebugHTTP bool
 }
@@ -37,6 +64,11 @@ type S3Uploader struct {
 
 	// The logger instance to use
 	logger logger.Logger
+
+	// The IDs of multipart uploads that haven't finished, by key, so that
+	// uploads that failed part way through can be resumed
+	multipartMu      sync.Mutex
+	multipartUploads map[string]string
 }
 
 func NewS3Uploader(l logger.Logger, c S3UploaderConfig) (*S3Uploader, error) {
@@ -49,11 +81,12 @@ func NewS3Uploader(l logger.Logger, c S3UploaderConfig) (*S3Uploader, error) {
 	}
 
 	return &S3Uploader{
-		logger:     l,
-		conf:       c,
-		client:     s3Client,
-		BucketName: bucketName,
-		BucketPath: bucketPath,
+		logger:           l,
+		conf:             c,
+		client:           s3Client,
+		BucketName:       bucketName,
+		BucketPath:       bucketPath,
+		multipartUploads: map[string]string{},
 	}, nil
 }
 
@@ -87,36 +120,417 @@ func (u *S3Uploader) Upload(artifact *api.Artifact) error {
 		return err
 	}
 
-	// Create an uploader with the session and default options
-	uploader := s3manager.NewUploaderWithClient(u.client)
-
 	// Open file from filesystem
 	u.logger.Debug("Reading file \"%s\"", artifact.AbsolutePath)
 	f, err := os.Open(artifact.AbsolutePath)
 	if err != nil {
 		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
 	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file %q (%v)", artifact.AbsolutePath, err)
+	}
+
+	partSize := u.partSize(fi.Size())
+	if fi.Size() > partSize {
+		return u.uploadMultipart(artifact, f, fi.Size(), partSize, permission)
+	}
 
 	// Upload the file to S3.
 	u.logger.Debug("Uploading \"%s\" to bucket with permission `%s`", u.artifactPath(artifact), permission)
 
-	params := &s3manager.UploadInput{
+	params := &s3.PutObjectInput{
 		Bucket:      aws.String(u.BucketName),
 		Key:         aws.String(u.artifactPath(artifact)),
 		ContentType: aws.String(artifact.ContentType),
 		ACL:         aws.String(permission),
+		Metadata:    aws.StringMap(artifactDigestMetadata(artifact)),
 		Body:        f,
 	}
+	if artifact.ContentEncoding != "" {
+		params.ContentEncoding = aws.String(artifact.ContentEncoding)
+	}
 	// if enabled we assign the sse configuration
 	if u.serverSideEncryptionEnabled() {
 		params.ServerSideEncryption = aws.String("AES256")
 	}
 
-	_, err = uploader.Upload(params)
+	_, err = u.client.PutObject(params)
 
 	return err
 }
 
+func (u *S3Uploader) uploadsContentEncoding() {}
+
+// copyFromBlob copies the blob with the same content as an artifact to the
+// artifact's path, giving it the artifact's content type
+func (u *S3Uploader) copyFromBlob(artifact *api.Artifact) (bool, error) {
+	blobKey, ok := artifactBlobKey(artifact)
+	if !ok {
+		return false, nil
+	}
+
+	blob, err := u.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(u.BucketName),
+		Key:    aws.String(blobKey),
+	})
+	if err != nil {
+		var reqErr awserr.RequestFailure
+		if errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := checkArtifactBlob(artifact, aws.Int64Value(blob.ContentLength), aws.StringValue(blob.ContentEncoding), aws.StringValueMap(blob.Metadata)); err != nil {
+		return false, err
+	}
+
+	permission, err := u.resolvePermission()
+	if err != nil {
+		return false, err
+	}
+
+	u.logger.Debug("Copying \"%s\" to \"%s\" with permission `%s`", blobKey, u.artifactPath(artifact), permission)
+
+	params := &s3.CopyObjectInput{
+		Bucket:            aws.String(u.BucketName),
+		Key:               aws.String(u.artifactPath(artifact)),
+		CopySource:        aws.String(s3CopySource(u.BucketName, blobKey)),
+		ContentType:       aws.String(artifact.ContentType),
+		ContentEncoding:   blob.ContentEncoding,
+		ACL:               aws.String(permission),
+		Metadata:          aws.StringMap(artifactDigestMetadata(artifact)),
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+	}
+	if u.serverSideEncryptionEnabled() {
+		params.ServerSideEncryption = aws.String("AES256")
+	}
+
+	if err := u.copyObject(params, aws.Int64Value(blob.ContentLength)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// copyToBlob copies an artifact that's been uploaded to the blob for its
+// content
+func (u *S3Uploader) copyToBlob(artifact *api.Artifact) error {
+	blobKey, ok := artifactBlobKey(artifact)
+	if !ok {
+		return nil
+	}
+
+	permission, err := u.resolvePermission()
+	if err != nil {
+		return err
+	}
+
+	// Objects copied in parts don't keep their content type and metadata,
+	// so they're given them again
+	uploaded, err := u.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(u.BucketName),
+		Key:    aws.String(u.artifactPath(artifact)),
+	})
+	if err != nil {
+		return err
+	}
+
+	params := &s3.CopyObjectInput{
+		Bucket:            aws.String(u.BucketName),
+		Key:               aws.String(blobKey),
+		CopySource:        aws.String(s3CopySource(u.BucketName, u.artifactPath(artifact))),
+		ContentType:       uploaded.ContentType,
+		ContentEncoding:   uploaded.ContentEncoding,
+		ACL:               aws.String(permission),
+		Metadata:          uploaded.Metadata,
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+	}
+	if u.serverSideEncryptionEnabled() {
+		params.ServerSideEncryption = aws.String("AES256")
+	}
+
+	return u.copyObject(params, aws.Int64Value(uploaded.ContentLength))
+}
+
+// copyObject copies an object of a size, in parts if it's too big for S3 to
+// copy at once
+func (u *S3Uploader) copyObject(params *s3.CopyObjectInput, size int64) error {
+	if size <= s3MaxCopySize {
+		_, err := u.client.CopyObject(params)
+		return err
+	}
+
+	u.logger.Debug("Copying %s to \"%s\" in parts of %d bytes", aws.StringValue(params.CopySource), aws.StringValue(params.Key), s3MaxCopySize)
+
+	out, err := u.client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:               params.Bucket,
+		Key:                  params.Key,
+		ContentType:          params.ContentType,
+		ContentEncoding:      params.ContentEncoding,
+		ACL:                  params.ACL,
+		Metadata:             params.Metadata,
+		ServerSideEncryption: params.ServerSideEncryption,
+	})
+	if err != nil {
+		return err
+	}
+	uploadID := out.UploadId
+
+	var parts []*s3.CompletedPart
+	for offset, n := int64(0), int64(1); offset < size; offset, n = offset+s3MaxCopySize, n+1 {
+		last := offset + s3MaxCopySize - 1
+		if last >= size {
+			last = size - 1
+		}
+
+		part, err := u.client.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          params.Bucket,
+			Key:             params.Key,
+			UploadId:        uploadID,
+			PartNumber:      aws.Int64(n),
+			CopySource:      params.CopySource,
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, last)),
+		})
+		if err != nil {
+			u.abortMultipart(params, uploadID)
+			return fmt.Errorf("copying part %d: %w", n, err)
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: part.CopyPartResult.ETag, PartNumber: aws.Int64(n)})
+	}
+
+	if _, err := u.client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          params.Bucket,
+		Key:             params.Key,
+		UploadId:        uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	}); err != nil {
+		u.abortMultipart(params, uploadID)
+		return err
+	}
+	return nil
+}
+
+// abortMultipart aborts the multipart upload of a copy, so that the parts
+// copied aren't kept
+func (u *S3Uploader) abortMultipart(params *s3.CopyObjectInput, uploadID *string) {
+	if _, err := u.client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   params.Bucket,
+		Key:      params.Key,
+		UploadId: uploadID,
+	}); err != nil {
+		u.logger.Warn("Couldn't abort copying %s to \"%s\" (%s)", aws.StringValue(params.CopySource), aws.StringValue(params.Key), err)
+	}
+}
+
+// s3CopySource returns the URL encoded source of an object to copy
+func s3CopySource(bucket, key string) string {
+	return (&url.URL{Path: bucket + "/" + key}).EscapedPath()
+}
+
+// partSize returns the size of the parts to upload a file of a size in,
+// keeping within the limits of S3
+func (u *S3Uploader) partSize(size int64) int64 {
+	partSize := u.conf.PartSize
+	if partSize <= 0 {
+		partSize = DefaultUploadPartSize
+	}
+	if partSize < s3MinPartSize {
+		partSize = s3MinPartSize
+	}
+	if size/partSize >= s3MaxParts {
+		partSize = size/s3MaxParts + 1
+	}
+	return partSize
+}
+
+// uploadMultipart uploads a file in parts, several at a time. If any of the
+// parts fail, the upload is left in progress so that uploading the file again
+// only uploads the parts that are missing.
+func (u *S3Uploader) uploadMultipart(artifact *api.Artifact, f io.ReaderAt, size, partSize int64, permission string) error {
+	key := u.artifactPath(artifact)
+
+	u.multipartMu.Lock()
+	uploadID, resuming := u.multipartUploads[key]
+	u.multipartMu.Unlock()
+
+	completed := map[int64]*s3.CompletedPart{}
+	if resuming {
+		parts, err := u.uploadedParts(key, uploadID, size, partSize)
+		if err != nil {
+			// It may have been aborted, or expired, so start again
+			u.logger.Warn("Couldn't resume uploading \"%s\", starting again (%s)", key, err)
+			resuming = false
+		} else {
+			completed = parts
+		}
+	}
+
+	if !resuming {
+		u.logger.Debug("Uploading \"%s\" to bucket with permission `%s` in parts of %d bytes", key, permission, partSize)
+
+		params := &s3.CreateMultipartUploadInput{
+			Bucket:      aws.String(u.BucketName),
+			Key:         aws.String(key),
+			ContentType: aws.String(artifact.ContentType),
+			ACL:         aws.String(permission),
+			Metadata:    aws.StringMap(artifactDigestMetadata(artifact)),
+		}
+		if artifact.ContentEncoding != "" {
+			params.ContentEncoding = aws.String(artifact.ContentEncoding)
+		}
+		if u.serverSideEncryptionEnabled() {
+			params.ServerSideEncryption = aws.String("AES256")
+		}
+
+		out, err := u.client.CreateMultipartUpload(params)
+		if err != nil {
+			return err
+		}
+		uploadID = aws.StringValue(out.UploadId)
+
+		u.multipartMu.Lock()
+		u.multipartUploads[key] = uploadID
+		u.multipartMu.Unlock()
+	}
+
+	numParts := (size + partSize - 1) / partSize
+	var missing []int64
+	for n := int64(1); n <= numParts; n++ {
+		if _, done := completed[n]; !done {
+			missing = append(missing, n)
+		}
+	}
+	if resuming {
+		u.logger.Info("Resuming upload of \"%s\", %d of %d parts are left to upload", key, len(missing), numParts)
+	}
+
+	concurrency := u.conf.PartConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultUploadPartConcurrency
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		parts    = make(chan int64)
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Parts that fail don't stop the others, so that there's
+			// less to upload when resuming
+			for n := range parts {
+				offset := (n - 1) * partSize
+				length := partSize
+				if offset+length > size {
+					length = size - offset
+				}
+
+				out, err := u.client.UploadPart(&s3.UploadPartInput{
+					Bucket:        aws.String(u.BucketName),
+					Key:           aws.String(key),
+					UploadId:      aws.String(uploadID),
+					PartNumber:    aws.Int64(n),
+					Body:          io.NewSectionReader(f, offset, length),
+					ContentLength: aws.Int64(length),
+				})
+
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = fmt.Errorf("uploading part %d of %d: %w", n, numParts, err)
+					}
+				} else {
+					completed[n] = &s3.CompletedPart{ETag: out.ETag, PartNumber: aws.Int64(n)}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, n := range missing {
+		parts <- n
+	}
+	close(parts)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	sorted := make([]*s3.CompletedPart, 0, len(completed))
+	for _, part := range completed {
+		sorted = append(sorted, part)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return aws.Int64Value(sorted[i].PartNumber) < aws.Int64Value(sorted[j].PartNumber)
+	})
+
+	if _, err := u.client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(u.BucketName),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: sorted},
+	}); err != nil {
+		return err
+	}
+
+	u.multipartMu.Lock()
+	delete(u.multipartUploads, key)
+	u.multipartMu.Unlock()
+
+	return nil
+}
+
+// uploadedParts returns the parts of a multipart upload that have been
+// uploaded in full
+func (u *S3Uploader) uploadedParts(key, uploadID string, size, partSize int64) (map[int64]*s3.CompletedPart, error) {
+	parts := map[int64]*s3.CompletedPart{}
+	err := u.client.ListPartsPages(&s3.ListPartsInput{
+		Bucket:   aws.String(u.BucketName),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, part := range page.Parts {
+			n := aws.Int64Value(part.PartNumber)
+			want := partSize
+			if n*partSize > size {
+				want = size - (n-1)*partSize
+			}
+			if aws.Int64Value(part.Size) == want {
+				parts[n] = &s3.CompletedPart{ETag: part.ETag, PartNumber: part.PartNumber}
+			}
+		}
+		return true
+	})
+	return parts, err
+}
+
+// Close aborts any multipart uploads that didn't finish, so that their parts
+// aren't kept (and charged for)
+func (u *S3Uploader) Close() error {
+	u.multipartMu.Lock()
+	defer u.multipartMu.Unlock()
+
+	var firstErr error
+	for key, uploadID := range u.multipartUploads {
+		u.logger.Debug("Aborting unfinished upload of \"%s\"", key)
+		if _, err := u.client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(u.BucketName),
+			Key:      aws.String(key),
+			UploadId: aws.String(uploadID),
+		}); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(u.multipartUploads, key)
+	}
+	return firstErr
+}
+
 func (u *S3Uploader) artifactPath(artifact *api.Artifact) string {
 	parts := []string{u.BucketPath, artifact.Path}
 
@@ -1,9 +1,28 @@
 package agent
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/require"
 )
 
@@ -88,3 +107,414 @@ func TestResolvePermission(t *testing.T) {
 		os.Unsetenv("BUILDKITE_S3_ACL")
 	}
 }
+
+// fakeS3 implements enough of S3 to upload objects, whole or in parts, and
+// copy them
+type fakeS3 struct {
+	mu            sync.Mutex
+	objects       map[string][]byte
+	digests       map[string]string // key -> the sha256 metadata of its object
+	puts          []string          // the keys of objects uploaded whole
+	copies        []string          // "source -> destination" of objects copied
+	uploads       map[string]map[int][]byte
+	partPuts      []int
+	partCopies    []string          // "source range" of the parts copied
+	uploadDigests map[string]string // upload ID -> the sha256 metadata it was created with
+	failParts     map[int]int       // part number -> how many more times to fail it
+	nextID        int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects:       map[string][]byte{},
+		digests:       map[string]string{},
+		uploads:       map[string]map[int][]byte{},
+		uploadDigests: map[string]string{},
+		failParts:     map[int]int{},
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	q := r.URL.Query()
+	uploadID := q.Get("uploadId")
+
+	switch {
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		f.nextID++
+		id := fmt.Sprintf("upload-%d", f.nextID)
+		f.uploads[id] = map[int][]byte{}
+		f.uploadDigests[id] = r.Header.Get("X-Amz-Meta-Sha256")
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, key, id)
+
+	case r.Method == http.MethodPut && uploadID != "" && r.Header.Get("X-Amz-Copy-Source") != "":
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		source := strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/")
+		object, ok := f.objects[source]
+		parts, uploading := f.uploads[uploadID]
+		if !ok || !uploading {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		var first, last int
+		copyRange := r.Header.Get("X-Amz-Copy-Source-Range")
+		if _, err := fmt.Sscanf(copyRange, "bytes=%d-%d", &first, &last); err != nil || last >= len(object) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `<Error><Code>InvalidRange</Code></Error>`)
+			return
+		}
+		parts[n] = object[first : last+1]
+		f.partCopies = append(f.partCopies, source+" "+copyRange)
+		fmt.Fprintf(w, `<CopyPartResult><ETag>"etag-%d"</ETag></CopyPartResult>`, n)
+
+	case r.Method == http.MethodPut && uploadID != "":
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		body, _ := io.ReadAll(r.Body)
+		if f.failParts[n] > 0 {
+			f.failParts[n]--
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `<Error><Code>BadDigest</Code><Message>nope</Message></Error>`)
+			return
+		}
+		parts, ok := f.uploads[uploadID]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchUpload</Code></Error>`)
+			return
+		}
+		parts[n] = body
+		f.partPuts = append(f.partPuts, n)
+		w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, n))
+
+	case r.Method == http.MethodGet && uploadID != "":
+		parts, ok := f.uploads[uploadID]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchUpload</Code></Error>`)
+			return
+		}
+		fmt.Fprint(w, `<ListPartsResult><IsTruncated>false</IsTruncated>`)
+		for n, body := range parts {
+			fmt.Fprintf(w, `<Part><PartNumber>%d</PartNumber><ETag>"etag-%d"</ETag><Size>%d</Size></Part>`, n, n, len(body))
+		}
+		fmt.Fprint(w, `</ListPartsResult>`)
+
+	case r.Method == http.MethodPost && uploadID != "":
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+			} `xml:"Part"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var object []byte
+		for _, part := range complete.Parts {
+			object = append(object, f.uploads[uploadID][part.PartNumber]...)
+		}
+		f.objects[key] = object
+		f.digests[key] = f.uploadDigests[uploadID]
+		delete(f.uploads, uploadID)
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Key>%s</Key></CompleteMultipartUploadResult>`, key)
+
+	case r.Method == http.MethodDelete && uploadID != "":
+		delete(f.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source := strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/")
+		object, ok := f.objects[source]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		f.objects[key] = object
+		f.digests[key] = f.digests[source]
+		if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+			f.digests[key] = r.Header.Get("X-Amz-Meta-Sha256")
+		}
+		f.copies = append(f.copies, source+" -> "+key)
+		fmt.Fprint(w, `<CopyObjectResult><ETag>"etag"</ETag></CopyObjectResult>`)
+
+	case r.Method == http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		f.objects[key] = body
+		f.digests[key] = r.Header.Get("X-Amz-Meta-Sha256")
+		f.puts = append(f.puts, key)
+
+	case r.Method == http.MethodHead:
+		if _, ok := f.objects[key]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(f.objects[key])))
+		w.Header().Set("X-Amz-Meta-Sha256", f.digests[key])
+
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func newTestS3Uploader(t *testing.T, serverURL string, conf S3UploaderConfig) *S3Uploader {
+	t.Helper()
+
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(serverURL),
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	})
+	if err != nil {
+		t.Fatalf("session.NewSession() error = %v", err)
+	}
+
+	return &S3Uploader{
+		logger:           logger.Discard,
+		conf:             conf,
+		client:           s3.New(sess),
+		BucketName:       "my-bucket",
+		BucketPath:       "artifacts",
+		multipartUploads: map[string]string{},
+	}
+}
+
+func writeTestArtifact(t *testing.T, size int) (*api.Artifact, []byte) {
+	t.Helper()
+
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	path := filepath.Join(t.TempDir(), "big.bin")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+	return &api.Artifact{Path: "big.bin", AbsolutePath: path, FileSize: int64(size), ContentType: "application/octet-stream"}, content
+}
+
+func TestS3UploaderSmallFileIsUploadedWhole(t *testing.T) {
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	u := newTestS3Uploader(t, server.URL, S3UploaderConfig{PartSize: s3MinPartSize})
+	artifact, content := writeTestArtifact(t, 1024)
+
+	if err := u.Upload(artifact); err != nil {
+		t.Fatalf("u.Upload() error = %v", err)
+	}
+
+	if got := fake.objects["my-bucket/artifacts/big.bin"]; !bytes.Equal(got, content) {
+		t.Errorf("uploaded object has %d bytes, want %d", len(got), len(content))
+	}
+	if len(fake.partPuts) != 0 {
+		t.Errorf("uploaded parts %v, want none", fake.partPuts)
+	}
+}
+
+func TestS3UploaderMultipartResumesAfterFailure(t *testing.T) {
+	fake := newFakeS3()
+	fake.failParts[2] = 1
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	u := newTestS3Uploader(t, server.URL, S3UploaderConfig{PartSize: s3MinPartSize, PartConcurrency: 2})
+	artifact, content := writeTestArtifact(t, 2*s3MinPartSize+1000)
+
+	if err := u.Upload(artifact); err == nil {
+		t.Fatalf("u.Upload() error = nil, want an error from part 2")
+	}
+
+	// Uploading again should only upload the part that failed
+	fake.partPuts = nil
+	if err := u.Upload(artifact); err != nil {
+		t.Fatalf("u.Upload() error = %v", err)
+	}
+	if want := []int{2}; fmt.Sprint(fake.partPuts) != fmt.Sprint(want) {
+		t.Errorf("resumed upload uploaded parts %v, want %v", fake.partPuts, want)
+	}
+
+	if got := fake.objects["my-bucket/artifacts/big.bin"]; !bytes.Equal(got, content) {
+		t.Errorf("uploaded object has %d bytes, want %d (and the same content)", len(got), len(content))
+	}
+	if len(u.multipartUploads) != 0 {
+		t.Errorf("u.multipartUploads = %v, want it empty after the upload completed", u.multipartUploads)
+	}
+}
+
+func TestS3UploaderCloseAbortsUnfinishedUploads(t *testing.T) {
+	fake := newFakeS3()
+	fake.failParts[1] = 10
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	u := newTestS3Uploader(t, server.URL, S3UploaderConfig{PartSize: s3MinPartSize})
+	artifact, _ := writeTestArtifact(t, s3MinPartSize+1)
+
+	if err := u.Upload(artifact); err == nil {
+		t.Fatalf("u.Upload() error = nil, want an error from part 1")
+	}
+	if len(fake.uploads) != 1 {
+		t.Fatalf("fake has %d uploads in progress, want 1", len(fake.uploads))
+	}
+
+	if err := u.Close(); err != nil {
+		t.Fatalf("u.Close() error = %v", err)
+	}
+	if len(fake.uploads) != 0 {
+		t.Errorf("fake has %d uploads in progress after Close, want 0", len(fake.uploads))
+	}
+}
+
+func TestS3UploaderPartSize(t *testing.T) {
+	for _, tc := range []struct {
+		configured, size, want int64
+	}{
+		{configured: 0, size: 100, want: DefaultUploadPartSize},
+		{configured: 1024, size: 100, want: s3MinPartSize},
+		{configured: s3MinPartSize, size: s3MinPartSize * s3MaxParts * 2, want: s3MinPartSize*2 + 1},
+	} {
+		u := &S3Uploader{conf: S3UploaderConfig{PartSize: tc.configured}}
+		if got := u.partSize(tc.size); got != tc.want {
+			t.Errorf("partSize(%d) with PartSize %d = %d, want %d", tc.size, tc.configured, got, tc.want)
+		}
+	}
+}
+
+func TestS3UploaderDedupAcrossJobs(t *testing.T) {
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	artifact, content := writeTestArtifact(t, 1024)
+	artifact.Sha256Sum = fmt.Sprintf("%x", sha256.Sum256(content))
+	blobKey := "my-bucket/sha256/" + artifact.Sha256Sum
+
+	a := &ArtifactUploader{logger: logger.Discard, conf: ArtifactUploaderConfig{Dedup: true}}
+
+	// The first job uploads it, and keeps a copy under its digest
+	job1 := newTestS3Uploader(t, server.URL, S3UploaderConfig{})
+	job1.BucketPath = "job-1"
+	if err := a.uploadArtifact(context.Background(), job1, artifact); err != nil {
+		t.Fatalf("a.uploadArtifact(job1) error = %v", err)
+	}
+
+	// The second job has the same content, so copies it instead
+	job2 := newTestS3Uploader(t, server.URL, S3UploaderConfig{})
+	job2.BucketPath = "job-2"
+	if err := a.uploadArtifact(context.Background(), job2, artifact); err != nil {
+		t.Fatalf("a.uploadArtifact(job2) error = %v", err)
+	}
+
+	if diff := cmp.Diff(fake.puts, []string{"my-bucket/job-1/big.bin"}); diff != "" {
+		t.Errorf("uploaded objects diff (-got +want):\n%s", diff)
+	}
+	if diff := cmp.Diff(fake.copies, []string{
+		"my-bucket/job-1/big.bin -> " + blobKey,
+		blobKey + " -> my-bucket/job-2/big.bin",
+	}); diff != "" {
+		t.Errorf("copied objects diff (-got +want):\n%s", diff)
+	}
+	if got := fake.objects["my-bucket/job-2/big.bin"]; !bytes.Equal(got, content) {
+		t.Errorf("the second job's object is %d bytes, want the %d bytes uploaded by the first", len(got), len(content))
+	}
+	if got := fake.digests["my-bucket/job-2/big.bin"]; got != artifact.Sha256Sum {
+		t.Errorf("the second job's object has a sha256 of %q, want %q", got, artifact.Sha256Sum)
+	}
+
+	// Different content is uploaded, even to the same path
+	other, _ := writeTestArtifact(t, 2048)
+	other.Sha256Sum = strings.Repeat("ab", 32)
+	if err := a.uploadArtifact(context.Background(), job2, other); err != nil {
+		t.Fatalf("a.uploadArtifact(job2, other) error = %v", err)
+	}
+	if got, want := len(fake.puts), 2; got != want {
+		t.Errorf("uploaded %d objects, want %d", got, want)
+	}
+}
+
+func TestS3UploaderDedupCopiesLargeArtifactsInParts(t *testing.T) {
+	defer func(size int64) { s3MaxCopySize = size }(s3MaxCopySize)
+	s3MaxCopySize = 1000
+
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	artifact, content := writeTestArtifact(t, 2500)
+	artifact.Sha256Sum = fmt.Sprintf("%x", sha256.Sum256(content))
+	blobKey := "my-bucket/sha256/" + artifact.Sha256Sum
+
+	a := &ArtifactUploader{logger: logger.Discard, conf: ArtifactUploaderConfig{Dedup: true}}
+
+	job1 := newTestS3Uploader(t, server.URL, S3UploaderConfig{})
+	job1.BucketPath = "job-1"
+	if err := a.uploadArtifact(context.Background(), job1, artifact); err != nil {
+		t.Fatalf("a.uploadArtifact(job1) error = %v", err)
+	}
+
+	job2 := newTestS3Uploader(t, server.URL, S3UploaderConfig{})
+	job2.BucketPath = "job-2"
+	if err := a.uploadArtifact(context.Background(), job2, artifact); err != nil {
+		t.Fatalf("a.uploadArtifact(job2) error = %v", err)
+	}
+
+	if diff := cmp.Diff(fake.partCopies, []string{
+		"my-bucket/job-1/big.bin bytes=0-999",
+		"my-bucket/job-1/big.bin bytes=1000-1999",
+		"my-bucket/job-1/big.bin bytes=2000-2499",
+		blobKey + " bytes=0-999",
+		blobKey + " bytes=1000-1999",
+		blobKey + " bytes=2000-2499",
+	}); diff != "" {
+		t.Errorf("copied parts diff (-got +want):\n%s", diff)
+	}
+	if len(fake.copies) != 0 {
+		t.Errorf("copied objects %v whole, want them copied in parts", fake.copies)
+	}
+	if got := fake.objects["my-bucket/job-2/big.bin"]; !bytes.Equal(got, content) {
+		t.Errorf("the second job's object is %d bytes, want the %d bytes uploaded by the first", len(got), len(content))
+	}
+	if got := fake.digests["my-bucket/job-2/big.bin"]; got != artifact.Sha256Sum {
+		t.Errorf("the second job's object has a sha256 of %q, want %q", got, artifact.Sha256Sum)
+	}
+	if len(fake.uploads) != 0 {
+		t.Errorf("%d multipart uploads are unfinished, want none", len(fake.uploads))
+	}
+}
+
+func TestS3UploaderDedupDoesntCopyMismatchedBlobs(t *testing.T) {
+	for name, tamper := range map[string]func(fake *fakeS3, key string){
+		"size":   func(fake *fakeS3, key string) { fake.objects[key] = fake.objects[key][1:] },
+		"sha256": func(fake *fakeS3, key string) { fake.digests[key] = strings.Repeat("ab", 32) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			fake := newFakeS3()
+			server := httptest.NewServer(fake)
+			defer server.Close()
+
+			artifact, content := writeTestArtifact(t, 1024)
+			artifact.Sha256Sum = fmt.Sprintf("%x", sha256.Sum256(content))
+			blobKey := "my-bucket/sha256/" + artifact.Sha256Sum
+			fake.objects[blobKey] = content
+			fake.digests[blobKey] = artifact.Sha256Sum
+			tamper(fake, blobKey)
+
+			u := newTestS3Uploader(t, server.URL, S3UploaderConfig{})
+			copied, err := u.copyFromBlob(artifact)
+			if err == nil {
+				t.Errorf("u.copyFromBlob() error = nil, want an error for the blob's %s", name)
+			}
+			if copied || len(fake.copies) != 0 {
+				t.Errorf("u.copyFromBlob() copied %v, want nothing copied", fake.copies)
+			}
+		})
+	}
+}
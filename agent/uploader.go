@@ -12,3 +12,28 @@ type Uploader interface {
 	// The actual uploading of the file
 	Upload(*api.Artifact) error
 }
+
+// contentEncodingUploader is an Uploader that sets the Content-Encoding of
+// artifacts it uploads, so that artifacts that have been compressed for
+// uploading are decompressed when they're downloaded
+type contentEncodingUploader interface {
+	Uploader
+
+	uploadsContentEncoding()
+}
+
+// dedupUploader is an Uploader that keeps a copy of each artifact it uploads
+// under the SHA-256 of its content, in the root of the bucket, so that an
+// artifact with the same content can be copied from it within the bucket
+// rather than uploaded again, by any job
+type dedupUploader interface {
+	Uploader
+
+	// copyFromBlob copies the blob with the same content as an artifact to
+	// the artifact's path, returning false if there isn't one yet
+	copyFromBlob(*api.Artifact) (bool, error)
+
+	// copyToBlob copies an artifact that's been uploaded to the blob for its
+	// content
+	copyToBlob(*api.Artifact) error
+}
@@ -17,6 +17,7 @@ type AgentRegisterRequest struct {
 	PID                int      `json:"pid,omitempty"`
 	MachineID          string   `json:"machine_id,omitempty"`
 	Features           []string `json:"features"`
+	ChunkEncodings     []string `json:"chunk_encodings,omitempty"`
 }
 
 // AgentRegisterResponse is the response from the Buildkite Agent API
@@ -29,6 +30,10 @@ type AgentRegisterResponse struct {
 	JobStatusInterval int      `json:"job_status_interval"`
 	HeartbeatInterval int      `json:"heartbeat_interval"`
 	Tags              []string `json:"meta_data"`
+
+	// ChunkEncoding is how log chunks should be encoded. When it's set, the
+	// job's ChunksMaxSizeBytes is the maximum size of the encoded chunk.
+	ChunkEncoding string `json:"chunk_encoding,omitempty"`
 }
 
 // Registers the agent against the Buildkite Agent API. The client for this
@@ -0,0 +1,415 @@
+// Package apiserver serves the Buildkite Agent API over HTTP from a Backend,
+// which implements the routes in the same terms as api.Client calls them.
+// It's shared by the fake server used in tests and the local API used by
+// `buildkite-agent run`, so that there's one place that knows how requests
+// are routed and encoded.
+package apiserver
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/agent/v3/api"
+)
+
+// Backend implements the Agent API. The access token a request was made with
+// is available to its methods from Token.
+type Backend interface {
+	// Authenticate checks the access token of every request other than
+	// Register, which is given the registration token instead
+	Authenticate(ctx context.Context, token string) error
+
+	Register(ctx context.Context, req *api.AgentRegisterRequest) (*api.AgentRegisterResponse, error)
+	Connect(ctx context.Context) error
+	Disconnect(ctx context.Context) error
+	Heartbeat(ctx context.Context, beat *api.Heartbeat) (*api.Heartbeat, error)
+	Ping(ctx context.Context) (*api.Ping, error)
+
+	GetJobState(ctx context.Context, jobID string) (*api.JobState, error)
+	AcquireJob(ctx context.Context, jobID string) (*api.Job, error)
+	AcceptJob(ctx context.Context, jobID string) (*api.Job, error)
+	StartJob(ctx context.Context, job *api.Job) error
+	FinishJob(ctx context.Context, job *api.Job) error
+	UploadChunk(ctx context.Context, jobID string, chunk *api.Chunk) error
+	SaveHeaderTimes(ctx context.Context, jobID string, headerTimes *api.HeaderTimes) error
+
+	SetMetaData(ctx context.Context, jobID string, metaData *api.MetaData) error
+	GetMetaData(ctx context.Context, jobID, key string) (*api.MetaData, error)
+	ExistsMetaData(ctx context.Context, jobID, key string) (*api.MetaDataExists, error)
+	MetaDataKeys(ctx context.Context, jobID string) ([]string, error)
+
+	Annotate(ctx context.Context, jobID string, annotation *api.Annotation) error
+	AnnotationRemove(ctx context.Context, jobID, context string) error
+
+	CreateArtifacts(ctx context.Context, jobID string, batch *api.ArtifactBatch) (*api.ArtifactBatchCreateResponse, error)
+	UpdateArtifacts(ctx context.Context, jobID string, artifactStates map[string]string) error
+	SearchArtifacts(ctx context.Context, buildID string, opt *api.ArtifactSearchOptions) ([]*api.Artifact, error)
+
+	UploadPipeline(ctx context.Context, jobID string, pipeline *api.Pipeline) error
+	OIDCToken(ctx context.Context, req *api.OIDCTokenRequest) (*api.OIDCToken, error)
+	StepExport(ctx context.Context, stepIDOrKey string, req *api.StepExportRequest) (*api.StepExportResponse, error)
+	StepUpdate(ctx context.Context, stepIDOrKey string, update *api.StepUpdate) error
+}
+
+// Error is an error response with a status code. Any other error returned by
+// a Backend is an internal server error.
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Errorf returns an Error with the status and a formatted message
+func Errorf(status int, format string, v ...any) *Error {
+	return &Error{Status: status, Message: fmt.Sprintf(format, v...)}
+}
+
+// ErrUnsupported is returned by the methods of Unimplemented, and is served
+// as a 404 for the route
+var ErrUnsupported = errors.New("unsupported")
+
+// Unimplemented can be embedded in a Backend that only serves some routes.
+// Every method returns ErrUnsupported.
+type Unimplemented struct{}
+
+func (Unimplemented) Register(context.Context, *api.AgentRegisterRequest) (*api.AgentRegisterResponse, error) {
+	return nil, ErrUnsupported
+}
+func (Unimplemented) Connect(context.Context) error    { return ErrUnsupported }
+func (Unimplemented) Disconnect(context.Context) error { return ErrUnsupported }
+func (Unimplemented) Heartbeat(context.Context, *api.Heartbeat) (*api.Heartbeat, error) {
+	return nil, ErrUnsupported
+}
+func (Unimplemented) Ping(context.Context) (*api.Ping, error) { return nil, ErrUnsupported }
+func (Unimplemented) GetJobState(context.Context, string) (*api.JobState, error) {
+	return nil, ErrUnsupported
+}
+func (Unimplemented) AcquireJob(context.Context, string) (*api.Job, error) {
+	return nil, ErrUnsupported
+}
+func (Unimplemented) AcceptJob(context.Context, string) (*api.Job, error) {
+	return nil, ErrUnsupported
+}
+func (Unimplemented) StartJob(context.Context, *api.Job) error  { return ErrUnsupported }
+func (Unimplemented) FinishJob(context.Context, *api.Job) error { return ErrUnsupported }
+func (Unimplemented) UploadChunk(context.Context, string, *api.Chunk) error {
+	return ErrUnsupported
+}
+func (Unimplemented) SaveHeaderTimes(context.Context, string, *api.HeaderTimes) error {
+	return ErrUnsupported
+}
+func (Unimplemented) SetMetaData(context.Context, string, *api.MetaData) error {
+	return ErrUnsupported
+}
+func (Unimplemented) GetMetaData(context.Context, string, string) (*api.MetaData, error) {
+	return nil, ErrUnsupported
+}
+func (Unimplemented) ExistsMetaData(context.Context, string, string) (*api.MetaDataExists, error) {
+	return nil, ErrUnsupported
+}
+func (Unimplemented) MetaDataKeys(context.Context, string) ([]string, error) {
+	return nil, ErrUnsupported
+}
+func (Unimplemented) Annotate(context.Context, string, *api.Annotation) error {
+	return ErrUnsupported
+}
+func (Unimplemented) AnnotationRemove(context.Context, string, string) error {
+	return ErrUnsupported
+}
+func (Unimplemented) CreateArtifacts(context.Context, string, *api.ArtifactBatch) (*api.ArtifactBatchCreateResponse, error) {
+	return nil, ErrUnsupported
+}
+func (Unimplemented) UpdateArtifacts(context.Context, string, map[string]string) error {
+	return ErrUnsupported
+}
+func (Unimplemented) SearchArtifacts(context.Context, string, *api.ArtifactSearchOptions) ([]*api.Artifact, error) {
+	return nil, ErrUnsupported
+}
+func (Unimplemented) UploadPipeline(context.Context, string, *api.Pipeline) error {
+	return ErrUnsupported
+}
+func (Unimplemented) OIDCToken(context.Context, *api.OIDCTokenRequest) (*api.OIDCToken, error) {
+	return nil, ErrUnsupported
+}
+func (Unimplemented) StepExport(context.Context, string, *api.StepExportRequest) (*api.StepExportResponse, error) {
+	return nil, ErrUnsupported
+}
+func (Unimplemented) StepUpdate(context.Context, string, *api.StepUpdate) error {
+	return ErrUnsupported
+}
+
+type tokenKey struct{}
+
+// Token returns the access token a request was made with
+func Token(ctx context.Context) string {
+	token, _ := ctx.Value(tokenKey{}).(string)
+	return token
+}
+
+// Route returns the method and path of a request, with placeholders for IDs,
+// e.g. "POST jobs/:id/chunks" or "GET ping"
+func Route(r *http.Request) string {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) >= 2 && (parts[0] == "jobs" || parts[0] == "builds" || parts[0] == "steps") {
+		parts[1] = ":id"
+		if len(parts) == 4 && parts[2] == "annotations" {
+			parts[3] = ":context"
+		}
+	}
+	return r.Method + " " + strings.Join(parts, "/")
+}
+
+// Handler serves the Agent API from a Backend
+type Handler struct {
+	backend Backend
+}
+
+// New returns a Handler that serves the Agent API from the backend
+func New(backend Backend) *Handler {
+	return &Handler{backend: backend}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	route := Route(r)
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Token ")
+	ctx := context.WithValue(r.Context(), tokenKey{}, token)
+
+	if route != "POST register" {
+		if err := h.backend.Authenticate(ctx, token); err != nil {
+			writeResult(w, r, 0, nil, err)
+			return
+		}
+	}
+
+	var (
+		status = http.StatusOK
+		result any
+		err    error
+	)
+
+	switch route {
+	case "POST register":
+		var req api.AgentRegisterRequest
+		if err = decode(r, &req); err == nil {
+			result, err = h.backend.Register(ctx, &req)
+		}
+	case "POST connect":
+		err = h.backend.Connect(ctx)
+	case "POST disconnect":
+		err = h.backend.Disconnect(ctx)
+	case "POST heartbeat":
+		var beat api.Heartbeat
+		if err = decode(r, &beat); err == nil {
+			result, err = h.backend.Heartbeat(ctx, &beat)
+		}
+	case "GET ping":
+		result, err = h.backend.Ping(ctx)
+	case "GET jobs/:id":
+		result, err = h.backend.GetJobState(ctx, parts[1])
+	case "PUT jobs/:id/acquire":
+		result, err = h.backend.AcquireJob(ctx, parts[1])
+	case "PUT jobs/:id/accept":
+		result, err = h.backend.AcceptJob(ctx, parts[1])
+	case "PUT jobs/:id/start":
+		var req struct {
+			StartedAt string `json:"started_at"`
+		}
+		if err = decode(r, &req); err == nil {
+			err = h.backend.StartJob(ctx, &api.Job{ID: parts[1], StartedAt: req.StartedAt})
+		}
+	case "PUT jobs/:id/finish":
+		var req struct {
+			ExitStatus        string `json:"exit_status"`
+			Signal            string `json:"signal"`
+			SignalReason      string `json:"signal_reason"`
+			FinishedAt        string `json:"finished_at"`
+			ChunksFailedCount int    `json:"chunks_failed_count"`
+		}
+		if err = decode(r, &req); err == nil {
+			err = h.backend.FinishJob(ctx, &api.Job{
+				ID:                parts[1],
+				ExitStatus:        req.ExitStatus,
+				Signal:            req.Signal,
+				SignalReason:      req.SignalReason,
+				FinishedAt:        req.FinishedAt,
+				ChunksFailedCount: req.ChunksFailedCount,
+			})
+		}
+	case "POST jobs/:id/chunks":
+		status = http.StatusCreated
+		var chunk *api.Chunk
+		if chunk, err = decodeChunk(r); err == nil {
+			err = h.backend.UploadChunk(ctx, parts[1], chunk)
+		}
+	case "POST jobs/:id/header_times":
+		var headerTimes api.HeaderTimes
+		if err = decode(r, &headerTimes); err == nil {
+			err = h.backend.SaveHeaderTimes(ctx, parts[1], &headerTimes)
+		}
+	case "POST jobs/:id/data/set":
+		var md api.MetaData
+		if err = decode(r, &md); err == nil {
+			err = h.backend.SetMetaData(ctx, parts[1], &md)
+		}
+	case "POST jobs/:id/data/get":
+		var md api.MetaData
+		if err = decode(r, &md); err == nil {
+			result, err = h.backend.GetMetaData(ctx, parts[1], md.Key)
+		}
+	case "POST jobs/:id/data/exists":
+		var md api.MetaData
+		if err = decode(r, &md); err == nil {
+			result, err = h.backend.ExistsMetaData(ctx, parts[1], md.Key)
+		}
+	case "POST jobs/:id/data/keys":
+		result, err = h.backend.MetaDataKeys(ctx, parts[1])
+	case "POST jobs/:id/annotations":
+		status = http.StatusCreated
+		var annotation api.Annotation
+		if err = decode(r, &annotation); err == nil {
+			err = h.backend.Annotate(ctx, parts[1], &annotation)
+		}
+	case "DELETE jobs/:id/annotations/:context":
+		err = h.backend.AnnotationRemove(ctx, parts[1], parts[3])
+	case "POST jobs/:id/artifacts":
+		status = http.StatusCreated
+		var batch api.ArtifactBatch
+		if err = decode(r, &batch); err == nil {
+			result, err = h.backend.CreateArtifacts(ctx, parts[1], &batch)
+		}
+	case "PUT jobs/:id/artifacts":
+		var req api.ArtifactBatchUpdateRequest
+		if err = decode(r, &req); err == nil {
+			states := make(map[string]string, len(req.Artifacts))
+			for _, artifact := range req.Artifacts {
+				states[artifact.ID] = artifact.State
+			}
+			err = h.backend.UpdateArtifacts(ctx, parts[1], states)
+		}
+	case "GET builds/:id/artifacts/search":
+		query := r.URL.Query()
+		includeRetried, _ := strconv.ParseBool(query.Get("include_retried_jobs"))
+		includeDuplicates, _ := strconv.ParseBool(query.Get("include_duplicates"))
+		result, err = h.backend.SearchArtifacts(ctx, parts[1], &api.ArtifactSearchOptions{
+			Query:              query.Get("query"),
+			Scope:              query.Get("scope"),
+			State:              query.Get("state"),
+			IncludeRetriedJobs: includeRetried,
+			IncludeDuplicates:  includeDuplicates,
+		})
+	case "POST jobs/:id/pipelines":
+		status = http.StatusCreated
+		var pipeline api.Pipeline
+		if err = decode(r, &pipeline); err == nil {
+			err = h.backend.UploadPipeline(ctx, parts[1], &pipeline)
+		}
+	case "POST jobs/:id/oidc/tokens":
+		var req struct {
+			Audience string `json:"audience"`
+			Lifetime int    `json:"lifetime"`
+		}
+		if err = decode(r, &req); err == nil {
+			result, err = h.backend.OIDCToken(ctx, &api.OIDCTokenRequest{
+				Job:      parts[1],
+				Audience: req.Audience,
+				Lifetime: req.Lifetime,
+			})
+		}
+	case "POST steps/:id/export":
+		var req api.StepExportRequest
+		if err = decode(r, &req); err == nil {
+			result, err = h.backend.StepExport(ctx, parts[1], &req)
+		}
+	case "PUT steps/:id":
+		var update api.StepUpdate
+		if err = decode(r, &update); err == nil {
+			err = h.backend.StepUpdate(ctx, parts[1], &update)
+		}
+	default:
+		err = ErrUnsupported
+	}
+
+	writeResult(w, r, status, result, err)
+}
+
+func decode(r *http.Request, v any) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil && err != io.EOF {
+		return Errorf(http.StatusBadRequest, "Invalid JSON body: %v", err)
+	}
+	return nil
+}
+
+// decodeChunk reads a log chunk, which is sent as the request body with its
+// position in the query
+func decodeChunk(r *http.Request) (*api.Chunk, error) {
+	query := r.URL.Query()
+	sequence, err := strconv.Atoi(query.Get("sequence"))
+	if err != nil {
+		return nil, Errorf(http.StatusBadRequest, "Invalid sequence: %v", err)
+	}
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	size, _ := strconv.Atoi(query.Get("size"))
+
+	body := r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, Errorf(http.StatusBadRequest, "Invalid gzip body: %v", err)
+		}
+		defer zr.Close()
+		body = zr
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, Errorf(http.StatusBadRequest, "Reading chunk: %v", err)
+	}
+
+	return &api.Chunk{Data: string(data), Sequence: sequence, Offset: offset, Size: size}, nil
+}
+
+// WriteError writes an error response, as the Handler does for errors
+// returned by a Backend
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	writeResult(w, r, 0, nil, err)
+}
+
+func writeResult(w http.ResponseWriter, r *http.Request, status int, result any, err error) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err != nil {
+		status, message := http.StatusInternalServerError, err.Error()
+
+		var serr *Error
+		switch {
+		case errors.As(err, &serr):
+			status, message = serr.Status, serr.Message
+		case errors.Is(err, ErrUnsupported):
+			status, message = http.StatusNotFound, fmt.Sprintf("%s %s isn't supported", r.Method, r.URL.Path)
+		}
+
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(struct {
+			Message string `json:"message"`
+		}{message})
+		return
+	}
+
+	w.WriteHeader(status)
+	if result == nil {
+		result = struct{}{}
+	}
+	_ = json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,81 @@
+package apiserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type metaDataBackend struct {
+	Unimplemented
+	data map[string]string
+}
+
+func (b *metaDataBackend) Authenticate(ctx context.Context, token string) error {
+	if token != "llamas" {
+		return Errorf(http.StatusUnauthorized, "Invalid access token")
+	}
+	return nil
+}
+
+func (b *metaDataBackend) SetMetaData(ctx context.Context, jobID string, md *api.MetaData) error {
+	b.data[jobID+"/"+md.Key] = md.Value
+	return nil
+}
+
+func (b *metaDataBackend) GetMetaData(ctx context.Context, jobID, key string) (*api.MetaData, error) {
+	value, ok := b.data[jobID+"/"+key]
+	if !ok {
+		return nil, Errorf(http.StatusNotFound, "No key %q found", key)
+	}
+	return &api.MetaData{Key: key, Value: value}, nil
+}
+
+func TestHandlerServesBackend(t *testing.T) {
+	ctx := context.Background()
+
+	server := httptest.NewServer(New(&metaDataBackend{data: map[string]string{}}))
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL + "/", Token: "llamas"})
+
+	_, err := client.SetMetaData(ctx, "my-job", &api.MetaData{Key: "foo", Value: "bar"})
+	require.NoError(t, err)
+
+	md, _, err := client.GetMetaData(ctx, "my-job", "foo")
+	require.NoError(t, err)
+	assert.Equal(t, "bar", md.Value)
+
+	_, resp, err := client.GetMetaData(ctx, "my-job", "missing")
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Routes the backend doesn't implement aren't found
+	_, resp, err = client.MetaDataKeys(ctx, "my-job")
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	badClient := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL + "/", Token: "alpacas"})
+	_, resp, err = badClient.GetMetaData(ctx, "my-job", "foo")
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestRoute(t *testing.T) {
+	for path, want := range map[string]string{
+		"/ping":                         "GET ping",
+		"/jobs/abc/chunks":              "GET jobs/:id/chunks",
+		"/jobs/abc/annotations/default": "GET jobs/:id/annotations/:context",
+		"/builds/abc/artifacts/search":  "GET builds/:id/artifacts/search",
+		"/steps/my-step":                "GET steps/:id",
+	} {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		assert.Equal(t, want, Route(r), path)
+	}
+}
@@ -48,6 +48,10 @@ type Artifact struct {
 
 	// A specific Content-Type to use on upload
 	ContentType string `json:"-"`
+
+	// The Content-Encoding the file at AbsolutePath has, if it's been
+	// compressed for uploading
+	ContentEncoding string `json:"-"`
 }
 
 type ArtifactBatch struct {
@@ -7,35 +7,80 @@ import (
 	"fmt"
 )
 
+// Chunk encodings. The encoding is chosen by the Agent API when the agent
+// registers.
+const (
+	// ChunkEncodingGzip sends chunks compressed with gzip
+	ChunkEncodingGzip = "gzip"
+
+	// ChunkEncodingIdentity sends chunks uncompressed
+	ChunkEncodingIdentity = "identity"
+)
+
+// ChunkEncodings are the chunk encodings the client can send, in order of
+// preference
+var ChunkEncodings = []string{ChunkEncodingGzip, ChunkEncodingIdentity}
+
 // Chunk represents a Buildkite Agent API Chunk
 type Chunk struct {
 	Data     string
 	Sequence int
 	Offset   int
 	Size     int
+
+	// Data already encoded with the client's chunk encoding, so that it
+	// isn't encoded again. Data is encoded on upload if it's nil.
+	Encoded []byte
+}
+
+// EncodeChunk returns chunk data as it will be sent with the encoding. No
+// encoding means gzip, which is what was always sent before encodings were
+// negotiated.
+func EncodeChunk(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case "", ChunkEncodingGzip:
+		body := &bytes.Buffer{}
+		gzipper := gzip.NewWriter(body)
+		if _, err := gzipper.Write(data); err != nil {
+			return nil, err
+		}
+		if err := gzipper.Close(); err != nil {
+			return nil, err
+		}
+		return body.Bytes(), nil
+
+	case ChunkEncodingIdentity:
+		return data, nil
+
+	default:
+		return nil, fmt.Errorf("unknown chunk encoding %q", encoding)
+	}
 }
 
 // Uploads the chunk to the Buildkite Agent API. This request sends the
-// compressed log directly as a request body.
+// encoded log directly as a request body.
 func (c *Client) UploadChunk(ctx context.Context, jobId string, chunk *Chunk) (*Response, error) {
-	// Create a compressed buffer of the log content
-	body := &bytes.Buffer{}
-	gzipper := gzip.NewWriter(body)
-	gzipper.Write([]byte(chunk.Data))
-	if err := gzipper.Close(); err != nil {
-		return nil, err
+	body := chunk.Encoded
+	if body == nil {
+		var err error
+		body, err = EncodeChunk(c.conf.ChunkEncoding, []byte(chunk.Data))
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Pass most params as query
 	u := fmt.Sprintf("jobs/%s/chunks?sequence=%d&offset=%d&size=%d", jobId, chunk.Sequence, chunk.Offset, chunk.Size)
-	req, err := c.newFormRequest(ctx, "POST", u, body)
+	req, err := c.newFormRequest(ctx, "POST", u, bytes.NewBuffer(body))
 	if err != nil {
 		return nil, err
 	}
 
-	// Mark the request as a direct compressed log chunk
+	// Mark the request as a direct log chunk
 	req.Header.Add("Content-Type", "text/plain")
-	req.Header.Add("Content-Encoding", "gzip")
+	if c.conf.ChunkEncoding != ChunkEncodingIdentity {
+		req.Header.Add("Content-Encoding", "gzip")
+	}
 
 	return c.doRequest(req, nil)
 }
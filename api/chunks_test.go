@@ -0,0 +1,101 @@
+package api_test
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+func TestUploadChunkEncodings(t *testing.T) {
+	for _, tc := range []struct {
+		encoding        string
+		contentEncoding string
+	}{
+		{encoding: "", contentEncoding: "gzip"},
+		{encoding: api.ChunkEncodingGzip, contentEncoding: "gzip"},
+		{encoding: api.ChunkEncodingIdentity, contentEncoding: ""},
+	} {
+		tc := tc
+		t.Run(tc.encoding, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if got, want := req.Header.Get("Content-Encoding"), tc.contentEncoding; got != want {
+					t.Errorf("Content-Encoding = %q, want %q", got, want)
+				}
+
+				body := req.Body
+				if tc.contentEncoding == "gzip" {
+					zr, err := gzip.NewReader(req.Body)
+					if err != nil {
+						t.Fatalf("gzip.NewReader() error = %v", err)
+					}
+					body = zr
+				}
+
+				data, err := io.ReadAll(body)
+				if err != nil {
+					t.Fatalf("reading body error = %v", err)
+				}
+				if got, want := string(data), "hello world"; got != want {
+					t.Errorf("chunk data = %q, want %q", got, want)
+				}
+				rw.WriteHeader(http.StatusCreated)
+			}))
+			defer server.Close()
+
+			c := api.NewClient(logger.Discard, api.Config{
+				Endpoint:      server.URL,
+				Token:         "llamas",
+				ChunkEncoding: tc.encoding,
+			})
+
+			if _, err := c.UploadChunk(context.Background(), "my-job", &api.Chunk{Data: "hello world", Sequence: 1, Size: 11}); err != nil {
+				t.Errorf("c.UploadChunk() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestUploadChunkSendsAlreadyEncodedData(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Fatalf("reading body error = %v", err)
+		}
+		if got, want := string(data), "already encoded"; got != want {
+			t.Errorf("chunk body = %q, want %q", got, want)
+		}
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	c := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"})
+
+	chunk := &api.Chunk{Data: "hello world", Sequence: 1, Size: 11, Encoded: []byte("already encoded")}
+	if _, err := c.UploadChunk(context.Background(), "my-job", chunk); err != nil {
+		t.Errorf("c.UploadChunk() error = %v", err)
+	}
+}
+
+func TestChunkEncodingFromRegisterResponse(t *testing.T) {
+	c := api.NewClient(logger.Discard, api.Config{Token: "llamas"})
+
+	for _, tc := range []struct {
+		encoding string
+		want     string
+	}{
+		{encoding: "", want: ""},
+		{encoding: api.ChunkEncodingIdentity, want: api.ChunkEncodingIdentity},
+		{encoding: "brotli", want: ""},
+	} {
+		got := c.FromAgentRegisterResponse(&api.AgentRegisterResponse{ChunkEncoding: tc.encoding}).Config().ChunkEncoding
+		if got != tc.want {
+			t.Errorf("FromAgentRegisterResponse(ChunkEncoding: %q).Config().ChunkEncoding = %q, want %q", tc.encoding, got, tc.want)
+		}
+	}
+}
@@ -20,6 +20,7 @@ import (
 
 	"github.com/buildkite/agent/v3/logger"
 	"github.com/google/go-querystring/query"
+	"golang.org/x/exp/slices"
 )
 
 const (
@@ -47,6 +48,9 @@ type Config struct {
 
 	// The http client used, leave nil for the default
 	HTTPClient *http.Client
+
+	// How log chunks are encoded, one of ChunkEncodings. Defaults to gzip.
+	ChunkEncoding string
 }
 
 // A Client manages communication with the Buildkite Agent API.
@@ -124,6 +128,11 @@ func (c *Client) FromAgentRegisterResponse(resp *AgentRegisterResponse) *Client
 		conf.Endpoint = resp.Endpoint
 	}
 
+	// Encode chunks the way Buildkite asked for, if we know how
+	if slices.Contains(ChunkEncodings, resp.ChunkEncoding) {
+		conf.ChunkEncoding = resp.ChunkEncoding
+	}
+
 	return NewClient(c.logger, conf)
 }
 
@@ -0,0 +1,1010 @@
+// Package fakeserver provides an in-memory implementation of the Buildkite
+// Agent API, for testing agents and jobs end to end without Buildkite.
+//
+// A test starts a server, queues jobs on it, points an agent at its URL and
+// then inspects what the agent did:
+//
+//	server := fakeserver.New()
+//	defer server.Close()
+//
+//	job := server.AddJob(&api.Job{Env: map[string]string{"BUILDKITE_COMMAND": "true"}})
+//	// ... register an agent with server.RegistrationToken and start it ...
+//	got, _ := server.Job(job.ID)
+package fakeserver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/api/apiserver"
+	zglob "github.com/mattn/go-zglob"
+)
+
+// Job states, as reported by GetJobState
+const (
+	JobStateScheduled = "scheduled"
+	JobStateAssigned  = "assigned"
+	JobStateAccepted  = "accepted"
+	JobStateRunning   = "running"
+	JobStateCanceling = "canceling"
+	JobStateCanceled  = "canceled"
+	JobStateFinished  = "finished"
+)
+
+// Server is a fake Buildkite Agent API. All of its state is kept in memory
+// and can be inspected with its accessor methods, which return copies.
+type Server struct {
+	// URL is the endpoint of the server, for use in api.Config
+	URL string
+
+	// RegistrationToken is the token agents must register with
+	RegistrationToken string
+
+	// PingInterval, JobStatusInterval and HeartbeatInterval are returned to
+	// agents when they register, in seconds
+	PingInterval      int
+	JobStatusInterval int
+	HeartbeatInterval int
+
+	// ChunkEncoding is returned to agents that support it when they
+	// register. Chunks are accepted in any encoding regardless.
+	ChunkEncoding string
+
+	server  *httptest.Server
+	handler *apiserver.Handler
+
+	mu        sync.Mutex
+	agents    map[string]*agentState
+	tokens    map[string]string
+	jobs      map[string]*jobState
+	queue     []string
+	builds    map[string]*buildState
+	steps     map[string]map[string]string
+	artifacts map[string]*artifactState
+	failures  map[string]*failure
+}
+
+type failure struct {
+	remaining int
+	status    int
+}
+
+type agentState struct {
+	agent     Agent
+	action    string
+	currentID string
+}
+
+type jobState struct {
+	job         api.Job
+	agentID     string
+	buildID     string
+	chunks      map[int]string
+	headerTimes map[string]string
+	pipelines   []*api.Pipeline
+}
+
+type buildState struct {
+	metaData    map[string]string
+	annotations map[string]*api.Annotation
+	artifactIDs []string
+}
+
+type artifactState struct {
+	artifact api.Artifact
+	batchID  string
+	state    string
+	data     []byte
+}
+
+// Agent is a registered agent
+type Agent struct {
+	ID            string
+	Name          string
+	AccessToken   string
+	Connected     bool
+	Request       api.AgentRegisterRequest
+	LastPing      time.Time
+	LastHeartbeat time.Time
+}
+
+// Job is a job and everything the agent reported about it
+type Job struct {
+	api.Job
+
+	// AgentID is the agent the job was assigned to
+	AgentID string
+
+	// Log is the job log, assembled from the uploaded chunks
+	Log string
+
+	// Chunks is the number of distinct chunks uploaded
+	Chunks int
+
+	HeaderTimes map[string]string
+	Pipelines   []*api.Pipeline
+}
+
+// Artifact is an artifact created by a job
+type Artifact struct {
+	api.Artifact
+
+	// State is the last state the agent set, e.g. "finished" or "error"
+	State string
+
+	// Data is the uploaded file, if it was uploaded to this server
+	Data []byte
+}
+
+// New starts a fake Agent API server. Call Close when done with it.
+func New() *Server {
+	s := &Server{
+		RegistrationToken: api.NewUUID(),
+		PingInterval:      1,
+		JobStatusInterval: 1,
+		HeartbeatInterval: 60,
+		agents:            make(map[string]*agentState),
+		tokens:            make(map[string]string),
+		jobs:              make(map[string]*jobState),
+		builds:            make(map[string]*buildState),
+		steps:             make(map[string]map[string]string),
+		artifacts:         make(map[string]*artifactState),
+		failures:          make(map[string]*failure),
+	}
+	s.handler = apiserver.New(backend{s})
+	s.server = httptest.NewServer(s)
+	s.URL = s.server.URL + "/"
+	return s
+}
+
+// Close shuts down the server
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// AddJob queues a job, which is given to the next agent that pings. An ID is
+// generated if the job doesn't have one. Jobs with the same
+// BUILDKITE_BUILD_ID env share meta-data, annotations and artifacts, and
+// jobs without one are each their own build.
+func (s *Server) AddJob(job *api.Job) *api.Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j := *job
+	if j.ID == "" {
+		j.ID = api.NewUUID()
+	}
+	j.Env = copyMap(job.Env)
+	j.State = JobStateScheduled
+
+	buildID := j.Env["BUILDKITE_BUILD_ID"]
+	if buildID == "" {
+		buildID = j.ID
+	}
+
+	s.jobs[j.ID] = &jobState{
+		job:         j,
+		buildID:     buildID,
+		chunks:      make(map[int]string),
+		headerTimes: make(map[string]string),
+	}
+	s.queue = append(s.queue, j.ID)
+	if j.Token != "" {
+		s.tokens[j.Token] = j.ID
+	}
+
+	out := j
+	out.Env = copyMap(j.Env)
+	return &out
+}
+
+// CancelJob cancels a job. A queued job is removed from the queue, and a job
+// that has been accepted is marked as canceling so that the agent stops it.
+func (s *Server) CancelJob(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	js, ok := s.jobs[id]
+	if !ok {
+		return fmt.Errorf("no job with ID %q", id)
+	}
+
+	switch js.job.State {
+	case JobStateScheduled:
+		s.dequeue(id)
+		js.job.State = JobStateCanceled
+	case JobStateAssigned, JobStateAccepted, JobStateRunning:
+		js.job.State = JobStateCanceling
+	default:
+		return fmt.Errorf("job %q can't be canceled in state %q", id, js.job.State)
+	}
+	return nil
+}
+
+// DisconnectAgent tells an agent to disconnect on its next ping
+func (s *Server) DisconnectAgent(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	as, ok := s.agents[id]
+	if !ok {
+		return fmt.Errorf("no agent with ID %q", id)
+	}
+	as.action = "disconnect"
+	return nil
+}
+
+// FailRequests makes the next n requests to a route fail with the status, to
+// simulate problems reaching the API. Routes are a method and a path with
+// placeholders for IDs, e.g. "POST jobs/:id/chunks" or "GET ping".
+func (s *Server) FailRequests(route string, n, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures[route] = &failure{remaining: n, status: status}
+}
+
+// shouldFail returns the status to fail a request to the route with, if any
+func (s *Server) shouldFail(route string) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.failures[route]
+	if !ok || f.remaining <= 0 {
+		return 0, false
+	}
+	f.remaining--
+	return f.status, true
+}
+
+// Agents returns the registered agents, in no particular order
+func (s *Server) Agents() []Agent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	agents := make([]Agent, 0, len(s.agents))
+	for _, as := range s.agents {
+		agents = append(agents, as.agent)
+	}
+	return agents
+}
+
+// Job returns a job and what the agent has reported about it
+func (s *Server) Job(id string) (*Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	js, ok := s.jobs[id]
+	if !ok {
+		return nil, false
+	}
+
+	job := &Job{
+		Job:         js.job,
+		AgentID:     js.agentID,
+		Chunks:      len(js.chunks),
+		HeaderTimes: copyMap(js.headerTimes),
+		Pipelines:   append([]*api.Pipeline(nil), js.pipelines...),
+	}
+	job.Env = copyMap(js.job.Env)
+
+	sequences := make([]int, 0, len(js.chunks))
+	for seq := range js.chunks {
+		sequences = append(sequences, seq)
+	}
+	sort.Ints(sequences)
+
+	var log strings.Builder
+	for _, seq := range sequences {
+		log.WriteString(js.chunks[seq])
+	}
+	job.Log = log.String()
+
+	return job, true
+}
+
+// MetaData returns the meta-data set on a build
+func (s *Server) MetaData(buildID string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return copyMap(s.build(buildID).metaData)
+}
+
+// Annotations returns the annotations on a build, keyed by context
+func (s *Server) Annotations(buildID string) map[string]api.Annotation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	annotations := make(map[string]api.Annotation)
+	for context, annotation := range s.build(buildID).annotations {
+		annotations[context] = *annotation
+	}
+	return annotations
+}
+
+// Artifacts returns the artifacts created in a build, in the order they were
+// created
+func (s *Server) Artifacts(buildID string) []Artifact {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.build(buildID)
+	artifacts := make([]Artifact, 0, len(b.artifactIDs))
+	for _, id := range b.artifactIDs {
+		as := s.artifacts[id]
+		artifacts = append(artifacts, Artifact{
+			Artifact: as.artifact,
+			State:    as.state,
+			Data:     append([]byte(nil), as.data...),
+		})
+	}
+	return artifacts
+}
+
+// StepAttributes returns the attributes set on a step with step update
+func (s *Server) StepAttributes(stepIDOrKey string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return copyMap(s.steps[stepIDOrKey])
+}
+
+// build returns the state of a build, creating it if needed. The caller must
+// hold s.mu.
+func (s *Server) build(id string) *buildState {
+	b, ok := s.builds[id]
+	if !ok {
+		b = &buildState{
+			metaData:    make(map[string]string),
+			annotations: make(map[string]*api.Annotation),
+		}
+		s.builds[id] = b
+	}
+	return b
+}
+
+// dequeue removes a job from the queue. The caller must hold s.mu.
+func (s *Server) dequeue(id string) {
+	for i, queued := range s.queue {
+		if queued == id {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// ServeHTTP serves artifact transfers and any failures requested with
+// FailRequests, and the rest of the Agent API from the shared router
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	// Artifact transfers don't use the API token
+	if len(parts) == 2 && parts[0] == "_artifacts" {
+		if parts[1] == "upload" && r.Method == http.MethodPost {
+			if err := s.uploadArtifact(r); err != nil {
+				apiserver.WriteError(w, r, err)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		if r.Method == http.MethodGet {
+			s.downloadArtifact(w, r, parts[1])
+			return
+		}
+	}
+
+	route := apiserver.Route(r)
+	if status, fail := s.shouldFail(route); fail {
+		apiserver.WriteError(w, r, apiserver.Errorf(status, "Failing %s as requested", route))
+		return
+	}
+
+	s.handler.ServeHTTP(w, r)
+}
+
+// backend implements the routes of the Agent API on the server's state
+type backend struct {
+	*Server
+}
+
+func (s backend) Authenticate(ctx context.Context, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tokens[token]; token == "" || !ok {
+		return apiserver.Errorf(http.StatusUnauthorized, "Invalid access token")
+	}
+	return nil
+}
+
+func (s backend) Register(ctx context.Context, req *api.AgentRegisterRequest) (*api.AgentRegisterResponse, error) {
+	if apiserver.Token(ctx) != s.RegistrationToken {
+		return nil, apiserver.Errorf(http.StatusUnauthorized, "Invalid registration token")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := Agent{
+		ID:          api.NewUUID(),
+		Name:        req.Name,
+		AccessToken: api.NewUUID(),
+		Request:     *req,
+	}
+	if a.Name == "" {
+		a.Name = fmt.Sprintf("agent-%d", len(s.agents)+1)
+	}
+
+	s.agents[a.ID] = &agentState{agent: a}
+	s.tokens[a.AccessToken] = a.ID
+
+	chunkEncoding := ""
+	for _, encoding := range req.ChunkEncodings {
+		if encoding == s.ChunkEncoding {
+			chunkEncoding = encoding
+		}
+	}
+
+	return &api.AgentRegisterResponse{
+		UUID:              a.ID,
+		Name:              a.Name,
+		AccessToken:       a.AccessToken,
+		Endpoint:          s.URL,
+		PingInterval:      s.PingInterval,
+		JobStatusInterval: s.JobStatusInterval,
+		HeartbeatInterval: s.HeartbeatInterval,
+		Tags:              req.Tags,
+		ChunkEncoding:     chunkEncoding,
+	}, nil
+}
+
+// agentForToken returns the agent that made a request. The caller must hold
+// s.mu.
+func (s *Server) agentForToken(ctx context.Context) (*agentState, error) {
+	as, ok := s.agents[s.tokens[apiserver.Token(ctx)]]
+	if !ok {
+		return nil, apiserver.Errorf(http.StatusForbidden, "Only agents can do that")
+	}
+	return as, nil
+}
+
+// job returns the job with the ID. The caller must hold s.mu.
+func (s *Server) job(id string) (*jobState, error) {
+	js, ok := s.jobs[id]
+	if !ok {
+		return nil, apiserver.Errorf(http.StatusNotFound, "No job found with ID %q", id)
+	}
+	return js, nil
+}
+
+func (s backend) Connect(ctx context.Context) error {
+	return s.setConnected(ctx, true)
+}
+
+func (s backend) Disconnect(ctx context.Context) error {
+	return s.setConnected(ctx, false)
+}
+
+func (s *Server) setConnected(ctx context.Context, connected bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	as, err := s.agentForToken(ctx)
+	if err != nil {
+		return err
+	}
+	as.agent.Connected = connected
+	return nil
+}
+
+func (s backend) Heartbeat(ctx context.Context, beat *api.Heartbeat) (*api.Heartbeat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	as, err := s.agentForToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	as.agent.LastHeartbeat = now
+	beat.ReceivedAt = now.Format(time.RFC3339Nano)
+	return beat, nil
+}
+
+func (s backend) Ping(ctx context.Context) (*api.Ping, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	as, err := s.agentForToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	as.agent.LastPing = time.Now()
+
+	if as.action != "" {
+		ping := &api.Ping{Action: as.action}
+		as.action = ""
+		return ping, nil
+	}
+
+	// An agent only runs one job at a time
+	if current, ok := s.jobs[as.currentID]; ok && current.job.State != JobStateFinished && current.job.State != JobStateCanceled {
+		return &api.Ping{}, nil
+	}
+
+	if len(s.queue) == 0 {
+		return &api.Ping{}, nil
+	}
+
+	js := s.jobs[s.queue[0]]
+	s.queue = s.queue[1:]
+	js.job.State = JobStateAssigned
+	js.agentID = as.agent.ID
+	as.currentID = js.job.ID
+
+	job := js.job
+	job.Env = copyMap(js.job.Env)
+	return &api.Ping{Job: &job}, nil
+}
+
+func (s backend) GetJobState(ctx context.Context, id string) (*api.JobState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	js, err := s.job(id)
+	if err != nil {
+		return nil, err
+	}
+	return &api.JobState{State: js.job.State}, nil
+}
+
+func (s backend) AcquireJob(ctx context.Context, id string) (*api.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	as, err := s.agentForToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	js, err := s.job(id)
+	if err != nil {
+		return nil, err
+	}
+	if js.job.State != JobStateScheduled {
+		return nil, apiserver.Errorf(http.StatusUnprocessableEntity, "Job %q can't be acquired in state %q", id, js.job.State)
+	}
+
+	s.dequeue(id)
+	js.job.State = JobStateAccepted
+	js.agentID = as.agent.ID
+	as.currentID = id
+
+	job := js.job
+	job.Env = copyMap(js.job.Env)
+	return &job, nil
+}
+
+func (s backend) AcceptJob(ctx context.Context, id string) (*api.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	as, err := s.agentForToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	js, err := s.job(id)
+	if err != nil {
+		return nil, err
+	}
+	if js.agentID != as.agent.ID {
+		return nil, apiserver.Errorf(http.StatusUnprocessableEntity, "Job %q isn't assigned to this agent", id)
+	}
+
+	switch js.job.State {
+	case JobStateAssigned:
+		js.job.State = JobStateAccepted
+	case JobStateCanceling:
+		// The agent will find out it was canceled when it checks the state
+	default:
+		return nil, apiserver.Errorf(http.StatusUnprocessableEntity, "Job %q can't be accepted in state %q", id, js.job.State)
+	}
+
+	job := js.job
+	job.Env = copyMap(js.job.Env)
+	return &job, nil
+}
+
+func (s backend) StartJob(ctx context.Context, job *api.Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	js, err := s.job(job.ID)
+	if err != nil {
+		return err
+	}
+
+	switch js.job.State {
+	case JobStateAccepted:
+		js.job.State = JobStateRunning
+	case JobStateCanceling:
+	default:
+		return apiserver.Errorf(http.StatusUnprocessableEntity, "Job %q can't be started in state %q", job.ID, js.job.State)
+	}
+	js.job.StartedAt = job.StartedAt
+	return nil
+}
+
+func (s backend) FinishJob(ctx context.Context, job *api.Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	js, err := s.job(job.ID)
+	if err != nil {
+		return err
+	}
+	if js.job.State == JobStateFinished || js.job.State == JobStateScheduled {
+		return apiserver.Errorf(http.StatusUnprocessableEntity, "Job %q can't be finished in state %q", job.ID, js.job.State)
+	}
+
+	js.job.State = JobStateFinished
+	js.job.ExitStatus = job.ExitStatus
+	js.job.Signal = job.Signal
+	js.job.SignalReason = job.SignalReason
+	js.job.FinishedAt = job.FinishedAt
+	js.job.ChunksFailedCount = job.ChunksFailedCount
+	return nil
+}
+
+func (s backend) UploadChunk(ctx context.Context, id string, chunk *api.Chunk) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	js, err := s.job(id)
+	if err != nil {
+		return err
+	}
+	js.chunks[chunk.Sequence] = chunk.Data
+	return nil
+}
+
+func (s backend) SaveHeaderTimes(ctx context.Context, id string, headerTimes *api.HeaderTimes) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	js, err := s.job(id)
+	if err != nil {
+		return err
+	}
+	for k, v := range headerTimes.Times {
+		js.headerTimes[k] = v
+	}
+	return nil
+}
+
+// buildForJob returns the build a job is part of. The caller must hold s.mu.
+func (s *Server) buildForJob(jobID string) (*buildState, error) {
+	js, err := s.job(jobID)
+	if err != nil {
+		return nil, err
+	}
+	return s.build(js.buildID), nil
+}
+
+func (s backend) SetMetaData(ctx context.Context, jobID string, md *api.MetaData) error {
+	if strings.TrimSpace(md.Key) == "" || strings.TrimSpace(md.Value) == "" {
+		return apiserver.Errorf(http.StatusUnprocessableEntity, "Key and value can't be blank")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := s.buildForJob(jobID)
+	if err != nil {
+		return err
+	}
+	b.metaData[md.Key] = md.Value
+	return nil
+}
+
+func (s backend) GetMetaData(ctx context.Context, jobID, key string) (*api.MetaData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := s.buildForJob(jobID)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := b.metaData[key]
+	if !ok {
+		return nil, apiserver.Errorf(http.StatusNotFound, "No key %q found", key)
+	}
+	return &api.MetaData{Key: key, Value: value}, nil
+}
+
+func (s backend) ExistsMetaData(ctx context.Context, jobID, key string) (*api.MetaDataExists, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := s.buildForJob(jobID)
+	if err != nil {
+		return nil, err
+	}
+	_, ok := b.metaData[key]
+	return &api.MetaDataExists{Exists: ok}, nil
+}
+
+func (s backend) MetaDataKeys(ctx context.Context, jobID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := s.buildForJob(jobID)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(b.metaData))
+	for k := range b.metaData {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s backend) Annotate(ctx context.Context, jobID string, annotation *api.Annotation) error {
+	if annotation.Context == "" {
+		annotation.Context = "default"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := s.buildForJob(jobID)
+	if err != nil {
+		return err
+	}
+
+	if existing, ok := b.annotations[annotation.Context]; ok && annotation.Append {
+		existing.Body += annotation.Body
+		if annotation.Style != "" {
+			existing.Style = annotation.Style
+		}
+		return nil
+	}
+
+	annotation.Append = false
+	b.annotations[annotation.Context] = annotation
+	return nil
+}
+
+func (s backend) AnnotationRemove(ctx context.Context, jobID, context string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := s.buildForJob(jobID)
+	if err != nil {
+		return err
+	}
+	if _, ok := b.annotations[context]; !ok {
+		return apiserver.Errorf(http.StatusNotFound, "No annotation found with context %q", context)
+	}
+	delete(b.annotations, context)
+	return nil
+}
+
+func (s backend) CreateArtifacts(ctx context.Context, jobID string, batch *api.ArtifactBatch) (*api.ArtifactBatchCreateResponse, error) {
+	if batch.ID == "" {
+		batch.ID = api.NewUUID()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := s.buildForJob(jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &api.ArtifactBatchCreateResponse{
+		ID:                 batch.ID,
+		UploadInstructions: &api.ArtifactUploadInstructions{},
+	}
+	resp.UploadInstructions.Data = map[string]string{
+		"batch_id": batch.ID,
+		"path":     "${artifact:path}",
+	}
+	resp.UploadInstructions.Action.URL = s.server.URL
+	resp.UploadInstructions.Action.Method = http.MethodPost
+	resp.UploadInstructions.Action.Path = "/_artifacts/upload"
+	resp.UploadInstructions.Action.FileInput = "file"
+
+	for _, a := range batch.Artifacts {
+		as := &artifactState{
+			artifact: *a,
+			batchID:  batch.ID,
+			state:    "new",
+		}
+		as.artifact.ID = api.NewUUID()
+		as.artifact.JobID = jobID
+		as.artifact.UploadDestination = batch.UploadDestination
+		as.artifact.CreatedAt = time.Now().UTC()
+		if batch.UploadDestination == "" {
+			as.artifact.URL = fmt.Sprintf("%s/_artifacts/%s", s.server.URL, as.artifact.ID)
+		}
+
+		s.artifacts[as.artifact.ID] = as
+		b.artifactIDs = append(b.artifactIDs, as.artifact.ID)
+		resp.ArtifactIDs = append(resp.ArtifactIDs, as.artifact.ID)
+	}
+
+	return resp, nil
+}
+
+func (s backend) UpdateArtifacts(ctx context.Context, jobID string, artifactStates map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.job(jobID); err != nil {
+		return err
+	}
+
+	for id, state := range artifactStates {
+		as, ok := s.artifacts[id]
+		if !ok || as.artifact.JobID != jobID {
+			return apiserver.Errorf(http.StatusNotFound, "No artifact found with ID %q", id)
+		}
+		as.state = state
+	}
+	return nil
+}
+
+func (s backend) SearchArtifacts(ctx context.Context, buildID string, opt *api.ArtifactSearchOptions) ([]*api.Artifact, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.build(buildID)
+	artifacts := []*api.Artifact{}
+	for _, id := range b.artifactIDs {
+		as := s.artifacts[id]
+
+		if opt.State != "" && as.state != opt.State {
+			continue
+		}
+		if opt.Scope != "" && as.artifact.JobID != opt.Scope {
+			continue
+		}
+		if opt.Query != "" {
+			if matched, err := zglob.Match(opt.Query, as.artifact.Path); err != nil || !matched {
+				continue
+			}
+		}
+
+		a := as.artifact
+		artifacts = append(artifacts, &a)
+	}
+	return artifacts, nil
+}
+
+func (s *Server) uploadArtifact(r *http.Request) error {
+	batchID, path := r.FormValue("batch_id"), r.FormValue("path")
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		return apiserver.Errorf(http.StatusBadRequest, "Missing file: %v", err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return apiserver.Errorf(http.StatusBadRequest, "Reading file: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, as := range s.artifacts {
+		if as.batchID == batchID && as.artifact.Path == path {
+			as.data = data
+			return nil
+		}
+	}
+	return apiserver.Errorf(http.StatusNotFound, "No artifact %q in batch %q", path, batchID)
+}
+
+func (s *Server) downloadArtifact(w http.ResponseWriter, r *http.Request, id string) {
+	s.mu.Lock()
+	as, ok := s.artifacts[id]
+	var data []byte
+	if ok {
+		data = as.data
+	}
+	s.mu.Unlock()
+
+	if !ok || data == nil {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, as.artifact.Path, as.artifact.CreatedAt, bytes.NewReader(data))
+}
+
+func (s backend) UploadPipeline(ctx context.Context, jobID string, pipeline *api.Pipeline) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	js, err := s.job(jobID)
+	if err != nil {
+		return err
+	}
+
+	// Uploads are idempotent by UUID, so retries aren't added twice
+	for _, p := range js.pipelines {
+		if pipeline.UUID != "" && p.UUID == pipeline.UUID {
+			return nil
+		}
+	}
+	js.pipelines = append(js.pipelines, pipeline)
+	return nil
+}
+
+func (s backend) OIDCToken(ctx context.Context, req *api.OIDCTokenRequest) (*api.OIDCToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.job(req.Job); err != nil {
+		return nil, err
+	}
+	return &api.OIDCToken{Token: "fake-oidc-token-for-" + req.Job}, nil
+}
+
+func (s backend) StepExport(ctx context.Context, stepIDOrKey string, req *api.StepExportRequest) (*api.StepExportResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.steps[stepIDOrKey][req.Attribute]
+	if !ok {
+		return nil, apiserver.Errorf(http.StatusNotFound, "No attribute %q found on step %q", req.Attribute, stepIDOrKey)
+	}
+	return &api.StepExportResponse{Output: value}, nil
+}
+
+func (s backend) StepUpdate(ctx context.Context, stepIDOrKey string, update *api.StepUpdate) error {
+	if update.Attribute == "" {
+		return apiserver.Errorf(http.StatusUnprocessableEntity, "Attribute can't be blank")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attrs, ok := s.steps[stepIDOrKey]
+	if !ok {
+		attrs = make(map[string]string)
+		s.steps[stepIDOrKey] = attrs
+	}
+	if update.Append {
+		attrs[update.Attribute] += update.Value
+	} else {
+		attrs[update.Attribute] = update.Value
+	}
+	return nil
+}
+
+func copyMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
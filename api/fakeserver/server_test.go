@@ -0,0 +1,286 @@
+package fakeserver
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func registerAgent(t *testing.T, s *Server) (*api.AgentRegisterResponse, *api.Client) {
+	t.Helper()
+
+	reg, _, err := api.NewClient(logger.Discard, api.Config{
+		Endpoint: s.URL,
+		Token:    s.RegistrationToken,
+	}).Register(context.Background(), &api.AgentRegisterRequest{Name: "test-agent"})
+	require.NoError(t, err)
+
+	return reg, api.NewClient(logger.Discard, api.Config{
+		Endpoint: reg.Endpoint,
+		Token:    reg.AccessToken,
+	})
+}
+
+func TestRegisterRequiresRegistrationToken(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	_, resp, err := api.NewClient(logger.Discard, api.Config{
+		Endpoint: s.URL,
+		Token:    "llamas",
+	}).Register(context.Background(), &api.AgentRegisterRequest{})
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	_, client := registerAgent(t, s)
+	_, resp, err = api.NewClient(logger.Discard, api.Config{
+		Endpoint: s.URL,
+		Token:    "llamas",
+	}).Ping(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	_, _, err = client.Ping(context.Background())
+	assert.NoError(t, err)
+}
+
+func TestJobLifecycle(t *testing.T) {
+	ctx := context.Background()
+
+	s := New()
+	defer s.Close()
+
+	reg, client := registerAgent(t, s)
+
+	_, err := client.Connect(ctx)
+	require.NoError(t, err)
+
+	ping, _, err := client.Ping(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, ping.Job)
+
+	added := s.AddJob(&api.Job{Env: map[string]string{"BUILDKITE_COMMAND": "echo hello"}})
+
+	ping, _, err = client.Ping(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, ping.Job)
+	assert.Equal(t, added.ID, ping.Job.ID)
+
+	accepted, _, err := client.AcceptJob(ctx, ping.Job)
+	require.NoError(t, err)
+	assert.Equal(t, "echo hello", accepted.Env["BUILDKITE_COMMAND"])
+
+	// Accepting twice isn't allowed
+	_, resp, err := client.AcceptJob(ctx, ping.Job)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	accepted.StartedAt = "2023-01-01T00:00:00Z"
+	_, err = client.StartJob(ctx, accepted)
+	require.NoError(t, err)
+
+	state, _, err := client.GetJobState(ctx, accepted.ID)
+	require.NoError(t, err)
+	assert.Equal(t, JobStateRunning, state.State)
+
+	for _, chunk := range []*api.Chunk{
+		{Sequence: 2, Data: "world\n"},
+		{Sequence: 1, Data: "hello "},
+	} {
+		_, err := client.UploadChunk(ctx, accepted.ID, chunk)
+		require.NoError(t, err)
+	}
+
+	_, err = client.SaveHeaderTimes(ctx, accepted.ID, &api.HeaderTimes{Times: map[string]string{"0": "2023-01-01T00:00:01Z"}})
+	require.NoError(t, err)
+
+	accepted.ExitStatus = "0"
+	_, err = client.FinishJob(ctx, accepted)
+	require.NoError(t, err)
+
+	job, ok := s.Job(accepted.ID)
+	require.True(t, ok)
+	assert.Equal(t, JobStateFinished, job.State)
+	assert.Equal(t, reg.UUID, job.AgentID)
+	assert.Equal(t, "0", job.ExitStatus)
+	assert.Equal(t, "hello world\n", job.Log)
+	assert.Equal(t, 2, job.Chunks)
+	assert.Equal(t, map[string]string{"0": "2023-01-01T00:00:01Z"}, job.HeaderTimes)
+
+	agents := s.Agents()
+	require.Len(t, agents, 1)
+	assert.True(t, agents[0].Connected)
+	assert.False(t, agents[0].LastPing.IsZero())
+}
+
+func TestCancelJob(t *testing.T) {
+	ctx := context.Background()
+
+	s := New()
+	defer s.Close()
+
+	_, client := registerAgent(t, s)
+
+	queued := s.AddJob(&api.Job{})
+	require.NoError(t, s.CancelJob(queued.ID))
+
+	ping, _, err := client.Ping(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, ping.Job, "canceled jobs aren't assigned")
+
+	running := s.AddJob(&api.Job{})
+	ping, _, err = client.Ping(ctx)
+	require.NoError(t, err)
+	_, _, err = client.AcceptJob(ctx, ping.Job)
+	require.NoError(t, err)
+
+	require.NoError(t, s.CancelJob(running.ID))
+
+	state, _, err := client.GetJobState(ctx, running.ID)
+	require.NoError(t, err)
+	assert.Equal(t, JobStateCanceling, state.State)
+}
+
+func TestDisconnectAgent(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	reg, client := registerAgent(t, s)
+	require.NoError(t, s.DisconnectAgent(reg.UUID))
+
+	ping, _, err := client.Ping(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "disconnect", ping.Action)
+}
+
+func TestBuildState(t *testing.T) {
+	ctx := context.Background()
+
+	s := New()
+	defer s.Close()
+
+	_, client := registerAgent(t, s)
+
+	env := map[string]string{"BUILDKITE_BUILD_ID": "my-build"}
+	job1 := s.AddJob(&api.Job{Env: env})
+	job2 := s.AddJob(&api.Job{Env: env})
+
+	_, err := client.SetMetaData(ctx, job1.ID, &api.MetaData{Key: "foo", Value: "bar"})
+	require.NoError(t, err)
+
+	md, _, err := client.GetMetaData(ctx, job2.ID, "foo")
+	require.NoError(t, err)
+	assert.Equal(t, "bar", md.Value)
+
+	_, resp, err := client.GetMetaData(ctx, job2.ID, "missing")
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	exists, _, err := client.ExistsMetaData(ctx, job2.ID, "foo")
+	require.NoError(t, err)
+	assert.True(t, exists.Exists)
+
+	keys, _, err := client.MetaDataKeys(ctx, job2.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, keys)
+	assert.Equal(t, map[string]string{"foo": "bar"}, s.MetaData("my-build"))
+
+	_, err = client.Annotate(ctx, job1.ID, &api.Annotation{Body: "hello", Style: "info"})
+	require.NoError(t, err)
+	_, err = client.Annotate(ctx, job2.ID, &api.Annotation{Body: " world", Append: true})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]api.Annotation{
+		"default": {Body: "hello world", Context: "default", Style: "info"},
+	}, s.Annotations("my-build"))
+
+	_, err = client.AnnotationRemove(ctx, job1.ID, "default")
+	require.NoError(t, err)
+	assert.Empty(t, s.Annotations("my-build"))
+
+	created, _, err := client.CreateArtifacts(ctx, job1.ID, &api.ArtifactBatch{
+		Artifacts: []*api.Artifact{{Path: "logs/a.log"}, {Path: "report.xml"}},
+	})
+	require.NoError(t, err)
+	require.Len(t, created.ArtifactIDs, 2)
+	assert.Equal(t, "${artifact:path}", created.UploadInstructions.Data["path"])
+
+	_, err = client.UpdateArtifacts(ctx, job1.ID, map[string]string{created.ArtifactIDs[0]: "finished"})
+	require.NoError(t, err)
+
+	found, _, err := client.SearchArtifacts(ctx, "my-build", &api.ArtifactSearchOptions{Query: "logs/*", State: "finished"})
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Equal(t, "logs/a.log", found[0].Path)
+
+	artifacts := s.Artifacts("my-build")
+	require.Len(t, artifacts, 2)
+	assert.Equal(t, "finished", artifacts[0].State)
+	assert.Equal(t, "new", artifacts[1].State)
+
+	_, err = client.UploadPipeline(ctx, job1.ID, &api.Pipeline{UUID: "pipeline-1", Pipeline: map[string]any{"steps": []any{}}})
+	require.NoError(t, err)
+	_, err = client.UploadPipeline(ctx, job1.ID, &api.Pipeline{UUID: "pipeline-1", Pipeline: map[string]any{"steps": []any{}}})
+	require.NoError(t, err)
+
+	got, ok := s.Job(job1.ID)
+	require.True(t, ok)
+	assert.Len(t, got.Pipelines, 1)
+}
+
+func TestSteps(t *testing.T) {
+	ctx := context.Background()
+
+	s := New()
+	defer s.Close()
+
+	_, client := registerAgent(t, s)
+
+	_, err := client.StepUpdate(ctx, "my-step", &api.StepUpdate{Attribute: "label", Value: "Tests"})
+	require.NoError(t, err)
+	_, err = client.StepUpdate(ctx, "my-step", &api.StepUpdate{Attribute: "label", Value: " (retried)", Append: true})
+	require.NoError(t, err)
+
+	export, _, err := client.StepExport(ctx, "my-step", &api.StepExportRequest{Attribute: "label"})
+	require.NoError(t, err)
+	assert.Equal(t, "Tests (retried)", export.Output)
+	assert.Equal(t, map[string]string{"label": "Tests (retried)"}, s.StepAttributes("my-step"))
+
+	_, resp, err := client.StepExport(ctx, "my-step", &api.StepExportRequest{Attribute: "state"})
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestChunkEncodingNegotiation(t *testing.T) {
+	ctx := context.Background()
+
+	s := New()
+	defer s.Close()
+	s.ChunkEncoding = api.ChunkEncodingIdentity
+
+	registrationClient := api.NewClient(logger.Discard, api.Config{
+		Endpoint: s.URL,
+		Token:    s.RegistrationToken,
+	})
+
+	reg, _, err := registrationClient.Register(ctx, &api.AgentRegisterRequest{})
+	require.NoError(t, err)
+	assert.Empty(t, reg.ChunkEncoding, "agents that don't list encodings get the default")
+
+	reg, _, err = registrationClient.Register(ctx, &api.AgentRegisterRequest{ChunkEncodings: api.ChunkEncodings})
+	require.NoError(t, err)
+	assert.Equal(t, api.ChunkEncodingIdentity, reg.ChunkEncoding)
+
+	client := registrationClient.FromAgentRegisterResponse(reg)
+	job := s.AddJob(&api.Job{})
+
+	_, err = client.UploadChunk(ctx, job.ID, &api.Chunk{Data: "hello", Sequence: 1, Size: 5})
+	require.NoError(t, err)
+
+	got, _ := s.Job(job.ID)
+	assert.Equal(t, "hello", got.Log)
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/buildkite/agent/v3/agent/plugin"
 	"github.com/buildkite/agent/v3/bootstrap/shell"
 	"github.com/buildkite/agent/v3/env"
+	"github.com/buildkite/agent/v3/events"
 	"github.com/buildkite/agent/v3/experiments"
 	"github.com/buildkite/agent/v3/hook"
 	"github.com/buildkite/agent/v3/process"
@@ -53,6 +54,10 @@ type Bootstrap struct {
 
 	// A channel to track cancellation
 	cancelCh chan struct{}
+
+	// The lifecycle event stream, and the phase that's running
+	events *events.Stream
+	phase  string
 }
 
 // New returns a new Bootstrap instance
@@ -81,6 +86,9 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 
 	var err error
 
+	b.openEvents()
+	defer b.events.Close()
+
 	span, ctx, stopper := b.startTracing(ctx)
 	defer stopper()
 	defer func() { span.FinishWithError(err) }()
@@ -99,7 +107,10 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 
 	// Tear down the environment (and fire pre-exit hook) before we exit
 	defer func() {
-		if err = b.tearDown(ctx); err != nil {
+		finishPhase := b.startPhase("pre-exit")
+		err = b.tearDown(ctx)
+		finishPhase(err)
+		if err != nil {
 			b.shell.Errorf("Error tearing down bootstrap: %v", err)
 
 			// this gets passed back via the named return
@@ -108,7 +119,10 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 	}()
 
 	// Initialize the environment, a failure here will still call the tearDown
-	if err = b.setUp(ctx); err != nil {
+	finishPhase := b.startPhase("environment")
+	err = b.setUp(ctx)
+	finishPhase(err)
+	if err != nil {
 		b.shell.Errorf("Error setting up bootstrap: %v", err)
 		return shell.GetExitCode(err)
 	}
@@ -129,15 +143,19 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 	var phaseErr error
 
 	if includePhase("plugin") {
+		finishPhase := b.startPhase("plugin")
 		phaseErr = b.preparePlugins()
 
 		if phaseErr == nil {
 			phaseErr = b.PluginPhase(ctx)
 		}
+		finishPhase(phaseErr)
 	}
 
 	if phaseErr == nil && includePhase("checkout") {
+		finishPhase := b.startPhase("checkout")
 		phaseErr = b.CheckoutPhase(ctx)
+		finishPhase(phaseErr)
 	} else {
 		checkoutDir, exists := b.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH")
 		if exists {
@@ -146,12 +164,20 @@ func (b *Bootstrap) Run(ctx context.Context) (exitCode int) {
 	}
 
 	if phaseErr == nil && includePhase("plugin") {
+		finishPhase := b.startPhase("vendored-plugin")
 		phaseErr = b.VendoredPluginPhase(ctx)
+		finishPhase(phaseErr)
 	}
 
 	if phaseErr == nil && includePhase("command") {
 		var commandErr error
+		finishPhase := b.startPhase("command")
 		phaseErr, commandErr = b.CommandPhase(ctx)
+		if phaseErr != nil {
+			finishPhase(phaseErr)
+		} else {
+			finishPhase(commandErr)
+		}
 		/*
 			Five possible states at this point:
 
@@ -241,11 +267,10 @@ func (b *Bootstrap) tracingImplementationSpecificHookScope(scope string) string
 }
 
 // executeHook runs a hook script with the hookRunner
-func (b *Bootstrap) executeHook(ctx context.Context, hookCfg HookConfig) error {
+func (b *Bootstrap) executeHook(ctx context.Context, hookCfg HookConfig) (err error) {
 	scopeName := b.tracingImplementationSpecificHookScope(hookCfg.Scope)
 	spanName := b.implementationSpecificSpanName(fmt.Sprintf("%s %s hook", scopeName, hookCfg.Name), "hook.execute")
 	span, ctx := tracetools.StartSpanFromContext(ctx, spanName, b.Config.TracingBackend)
-	var err error
 	defer func() { span.FinishWithError(err) }()
 	span.AddAttributes(map[string]string{
 		"hook.type":    scopeName,
@@ -269,6 +294,16 @@ func (b *Bootstrap) executeHook(ctx context.Context, hookCfg HookConfig) error {
 
 	b.shell.Headerf("Running %s hook", hookName)
 
+	b.emit(b.hookEvent(events.HookStarted, hookCfg))
+	defer func() {
+		finished := b.hookEvent(events.HookFinished, hookCfg)
+		finished.ExitStatus = events.ExitStatus(shell.GetExitCode(err))
+		if err != nil {
+			finished.Error = err.Error()
+		}
+		b.emit(finished)
+	}()
+
 	redactors := b.setupRedactors()
 	defer redactors.Flush()
 
@@ -469,11 +504,6 @@ func (b *Bootstrap) executeLocalHook(ctx context.Context, name string) error {
 	})
 }
 
-func dirForAgentName(agentName string) string {
-	badCharsPattern := regexp.MustCompile("[[:^alnum:]]")
-	return badCharsPattern.ReplaceAllString(agentName, "-")
-}
-
 func dirForRepository(repository string) string {
 	badCharsPattern := regexp.MustCompile("[[:^alnum:]]")
 	return badCharsPattern.ReplaceAllString(repository, "-")
@@ -521,7 +551,7 @@ func (b *Bootstrap) setUp(ctx context.Context) error {
 			return fmt.Errorf("Must set either a BUILDKITE_BUILD_PATH or a BUILDKITE_BUILD_CHECKOUT_PATH")
 		}
 		b.shell.Env.Set("BUILDKITE_BUILD_CHECKOUT_PATH",
-			filepath.Join(b.BuildPath, dirForAgentName(b.AgentName), b.OrganizationSlug, b.PipelineSlug))
+			filepath.Join(b.BuildPath, utils.DirForAgentName(b.AgentName), b.OrganizationSlug, b.PipelineSlug))
 	}
 
 	// The job runner sets BUILDKITE_IGNORED_ENV with any keys that were ignored
@@ -1177,6 +1207,10 @@ func (b *Bootstrap) updateGitMirror(ctx context.Context) (string, error) {
 	}
 	defer mirrorCloneLock.Unlock()
 
+	// Record that the mirror is in use while we hold the clone lock, which
+	// the agent's mirror maintenance takes before removing unused mirrors
+	touchGitMirror(b.shell, mirrorDir)
+
 	// If we don't have a mirror, we need to clone it
 	if !utils.FileExists(mirrorDir) {
 		b.shell.Commentf("Cloning a mirror of the repository to %q", mirrorDir)
@@ -1242,6 +1276,54 @@ func (b *Bootstrap) updateGitMirror(ctx context.Context) (string, error) {
 	return mirrorDir, nil
 }
 
+// gitDeepenAttempts is how many times a shallow checkout is deepened looking
+// for the commit, doubling how much is fetched each time, before fetching the
+// rest of the history
+const gitDeepenAttempts = 3
+
+// deepenShallowCheckout fetches more history into a shallow checkout until it
+// includes the commit
+func (b *Bootstrap) deepenShallowCheckout(ctx context.Context, gitDir string, refSpecs []string) error {
+	if hasGitCommit(ctx, b.shell, gitDir, b.Commit) {
+		return nil
+	}
+
+	// --depth can't be used with --deepen or --unshallow
+	gitFetchFlags := withoutGitDepthFlags(b.GitFetchFlags)
+
+	deepen := b.GitCloneDepth
+	for i := 0; deepen > 0 && i < gitDeepenAttempts; i++ {
+		b.shell.Commentf("Commit %q isn't in the shallow history, fetching %d more commits", b.Commit, deepen)
+		if err := gitFetch(ctx, b.shell, fmt.Sprintf("%s --deepen=%d", gitFetchFlags, deepen), "origin", refSpecs...); err != nil {
+			return err
+		}
+		if hasGitCommit(ctx, b.shell, gitDir, b.Commit) {
+			return nil
+		}
+		deepen *= 2
+	}
+
+	b.shell.Commentf("Commit %q isn't in the shallow history, fetching all of it", b.Commit)
+	return gitFetch(ctx, b.shell, gitFetchFlags+" --unshallow", "origin", refSpecs...)
+}
+
+// fetchGitLFSObjects downloads the Git LFS objects of the checked out commit
+// and puts them in place of their pointer files. With a mirror, the objects
+// are stored alongside it, so that they're shared by every checkout using it.
+func (b *Bootstrap) fetchGitLFSObjects(ctx context.Context, mirrorDir string) error {
+	var storage string
+	if mirrorDir != "" {
+		storage = filepath.Join(mirrorDir, "lfs")
+	}
+
+	b.shell.Commentf("Fetching Git LFS objects")
+	if err := gitLFSFetch(ctx, b.shell, storage, b.GitLFSInclude, b.GitLFSExclude); err != nil {
+		return err
+	}
+
+	return gitLFSCheckout(ctx, b.shell, storage)
+}
+
 // defaultCheckoutPhase is called by the CheckoutPhase if no global or plugin checkout
 // hook exists. It performs the default checkout on the Repository provided in the config
 func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
@@ -1275,6 +1357,8 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 				// Fall back to a clean clone, rather than failing the clone and therefore the build
 				b.shell.Commentf("No existing mirror found for repository %s at %s.", b.Repository, mirrorDir)
 				mirrorDir = ""
+			} else {
+				touchGitMirror(b.shell, mirrorDir)
 			}
 		} else {
 			mirrorDir, err = b.updateGitMirror(ctx)
@@ -1296,8 +1380,47 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		gitCloneFlags += fmt.Sprintf(" --reference %q", mirrorDir)
 	}
 
+	sparseCheckoutPaths := gitSparseCheckoutPaths(b.GitSparseCheckoutPaths)
+	if len(sparseCheckoutPaths) > 0 {
+		span.AddAttributes(map[string]string{"checkout.is_sparse": "true"})
+		gitCloneFlags += " --sparse"
+
+		// Only download the files we check out. With a mirror, every object
+		// is already on disk, so there's nothing to save.
+		if mirrorDir == "" {
+			gitCloneFlags += " --filter=blob:none"
+		}
+	}
+
+	if b.GitCloneDepth > 0 {
+		gitCloneFlags += fmt.Sprintf(" --depth=%d", b.GitCloneDepth)
+	}
+
+	// Check out Git LFS pointer files rather than downloading each object as
+	// its file is checked out. The objects are either fetched in one go
+	// afterwards, or not needed at all.
+	restoreGitLFSSmudge := func() {}
+	if b.GitLFS || b.GitLFSSkipSmudge {
+		span.AddAttributes(map[string]string{"checkout.is_using_git_lfs": "true"})
+		restoreGitLFSSmudge = skipGitLFSSmudge(b.shell)
+	}
+	defer restoreGitLFSSmudge()
+
 	// Does the git directory exist?
 	existingGitDir := filepath.Join(b.shell.Getwd(), ".git")
+
+	// A checkout that borrowed objects from a mirror that has since been
+	// removed is broken, so start again with a fresh clone
+	if missing := missingGitAlternates(existingGitDir); len(missing) > 0 {
+		b.shell.Commentf("Removing the checkout, the git mirror it used is gone (%s)", strings.Join(missing, ", "))
+		if err := b.removeCheckoutDir(); err != nil {
+			return err
+		}
+		if err := b.createCheckoutDir(); err != nil {
+			return err
+		}
+	}
+
 	if utils.FileExists(existingGitDir) {
 		// Update the origin of the repository so we can gracefully handle repository renames
 		if err := b.shell.Run(ctx, "git", "remote", "set-url", "origin", b.Repository); err != nil {
@@ -1321,13 +1444,36 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		return err
 	}
 
+	// Set up the sparse checkout before checking out the commit, so that only
+	// the directories we need are written. Checkout directories are reused,
+	// so a sparse checkout left over from a previous job is undone too.
+	if len(sparseCheckoutPaths) > 0 {
+		b.shell.Commentf("Limiting the checkout to %s", strings.Join(sparseCheckoutPaths, ", "))
+		if err := gitSparseCheckout(ctx, b.shell, sparseCheckoutPaths); err != nil {
+			return err
+		}
+	} else if utils.FileExists(filepath.Join(existingGitDir, "info", "sparse-checkout")) {
+		b.shell.Commentf("Restoring the full checkout from a previous sparse checkout")
+		if err := gitSparseCheckoutDisable(ctx, b.shell, existingGitDir); err != nil {
+			return err
+		}
+	}
+
 	gitFetchFlags := b.GitFetchFlags
+	if b.GitCloneDepth > 0 {
+		gitFetchFlags += fmt.Sprintf(" --depth=%d", b.GitCloneDepth)
+	}
+
+	// The refspecs last fetched, which are deepened if they're shallow and
+	// don't include the commit
+	var fetchRefSpecs []string
 
 	// If a refspec is provided then use it instead.
 	// For example, `refs/not/a/head`
 	if b.RefSpec != "" {
 		b.shell.Commentf("Fetch and checkout custom refspec")
-		if err := gitFetch(ctx, b.shell, gitFetchFlags, "origin", b.RefSpec); err != nil {
+		fetchRefSpecs = []string{b.RefSpec}
+		if err := gitFetch(ctx, b.shell, gitFetchFlags, "origin", fetchRefSpecs...); err != nil {
 			return err
 		}
 
@@ -1337,9 +1483,9 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		// https://help.github.com/articles/checking-out-pull-requests-locally/#modifying-an-inactive-pull-request-locally
 	} else if b.PullRequest != "false" && strings.Contains(b.PipelineProvider, "github") {
 		b.shell.Commentf("Fetch and checkout pull request head from GitHub")
-		refspec := fmt.Sprintf("refs/pull/%s/head", b.PullRequest)
+		fetchRefSpecs = []string{fmt.Sprintf("refs/pull/%s/head", b.PullRequest)}
 
-		if err := gitFetch(ctx, b.shell, gitFetchFlags, "origin", refspec); err != nil {
+		if err := gitFetch(ctx, b.shell, gitFetchFlags, "origin", fetchRefSpecs...); err != nil {
 			return err
 		}
 
@@ -1350,7 +1496,8 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		// need to fetch the remote head and checkout the fetched head explicitly.
 	} else if b.Commit == "HEAD" {
 		b.shell.Commentf("Fetch and checkout remote branch HEAD commit")
-		if err := gitFetch(ctx, b.shell, gitFetchFlags, "origin", b.Branch); err != nil {
+		fetchRefSpecs = []string{b.Branch}
+		if err := gitFetch(ctx, b.shell, gitFetchFlags, "origin", fetchRefSpecs...); err != nil {
 			return err
 		}
 
@@ -1358,18 +1505,28 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		// support fetching a specific commit so we fall back to fetching all heads
 		// and tags, hoping that the commit is included.
 	} else {
-		if err := gitFetch(ctx, b.shell, gitFetchFlags, "origin", b.Commit); err != nil {
+		fetchRefSpecs = []string{b.Commit}
+		if err := gitFetch(ctx, b.shell, gitFetchFlags, "origin", fetchRefSpecs...); err != nil {
 			// By default `git fetch origin` will only fetch tags which are
 			// reachable from a fetches branch. git 1.9.0+ changed `--tags` to
 			// fetch all tags in addition to the default refspec, but pre 1.9.0 it
 			// excludes the default refspec.
 			gitFetchRefspec, _ := b.shell.RunAndCapture(ctx, "git", "config", "remote.origin.fetch")
-			if err := gitFetch(ctx, b.shell, gitFetchFlags, "origin", gitFetchRefspec, "+refs/tags/*:refs/tags/*"); err != nil {
+			fetchRefSpecs = []string{gitFetchRefspec, "+refs/tags/*:refs/tags/*"}
+			if err := gitFetch(ctx, b.shell, gitFetchFlags, "origin", fetchRefSpecs...); err != nil {
 				return err
 			}
 		}
 	}
 
+	// A shallow clone or fetch, whether from the clone depth or from --depth
+	// in the git flags, might not go back far enough to include the commit
+	if b.Commit != "HEAD" && utils.FileExists(filepath.Join(existingGitDir, "shallow")) {
+		if err := b.deepenShallowCheckout(ctx, existingGitDir, fetchRefSpecs); err != nil {
+			return err
+		}
+	}
+
 	if b.Commit == "HEAD" {
 		if err := gitCheckout(ctx, b.shell, "-f", "FETCH_HEAD"); err != nil {
 			return err
@@ -1380,6 +1537,20 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		}
 	}
 
+	if b.GitLFSSkipSmudge {
+		if b.GitLFS {
+			b.shell.Warningf("Not fetching Git LFS objects, as BUILDKITE_GIT_LFS_SKIP_SMUDGE is set")
+		}
+		b.shell.Commentf("Leaving Git LFS pointer files in place of their objects")
+	} else if b.GitLFS {
+		if err := b.fetchGitLFSObjects(ctx, mirrorDir); err != nil {
+			return err
+		}
+
+		// Submodules download their own objects as they're checked out
+		restoreGitLFSSmudge()
+	}
+
 	var gitSubmodules bool
 	if !b.GitSubmodules && hasGitSubmodules(b.shell) {
 		b.shell.Warningf("This repository has submodules, but submodules are disabled at an agent level")
@@ -1426,6 +1597,9 @@ func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
 		}
 	}
 
+	// Everything's checked out, so anything else can download LFS objects
+	restoreGitLFSSmudge()
+
 	// Git clean after checkout. We need to do this because submodules could have
 	// changed in between the last checkout and this one. A double clean is the only
 	// good solution to this problem that we've found
@@ -1822,6 +1996,9 @@ func (b *Bootstrap) artifactPhase(ctx context.Context) error {
 	var err error
 	defer func() { span.FinishWithError(err) }()
 
+	finishPhase := b.startPhase("artifact")
+	defer func() { finishPhase(err) }()
+
 	err = b.preArtifactHooks(ctx)
 	if err != nil {
 		return err
@@ -12,23 +12,6 @@ import (
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/opentracer"
 )
 
-var agentNameTests = []struct {
-	agentName string
-	expected  string
-}{
-	{"My Agent", "My-Agent"},
-	{":docker: My Agent", "-docker--My-Agent"},
-	{"My \"Agent\"", "My--Agent-"},
-}
-
-func TestDirForAgentName(t *testing.T) {
-	t.Parallel()
-
-	for _, test := range agentNameTests {
-		assert.Equal(t, test.expected, dirForAgentName(test.agentName))
-	}
-}
-
 var repositoryNameTests = []struct {
 	repositoryName string
 	expected       string
@@ -83,6 +83,27 @@ type Config struct {
 	// Flags to pass to "git clean" command
 	GitCleanFlags string `env:"BUILDKITE_GIT_CLEAN_FLAGS"`
 
+	// How many commits of history to clone and fetch, deepening it if the
+	// commit isn't included. The full history is fetched if it's 0.
+	GitCloneDepth int `env:"BUILDKITE_GIT_CLONE_DEPTH"`
+
+	// Comma separated directories to limit the checkout to, using a sparse
+	// checkout and a partial clone. Everything is checked out if it's empty.
+	GitSparseCheckoutPaths string `env:"BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS"`
+
+	// Whether to fetch the Git LFS objects of the commit after checking it
+	// out, rather than as each file is checked out
+	GitLFS bool `env:"BUILDKITE_GIT_LFS"`
+
+	// Comma separated patterns of the files to fetch Git LFS objects for, or
+	// not to. Objects are fetched for every file if both are empty.
+	GitLFSInclude string `env:"BUILDKITE_GIT_LFS_INCLUDE"`
+	GitLFSExclude string `env:"BUILDKITE_GIT_LFS_EXCLUDE"`
+
+	// Whether to leave Git LFS pointer files in the checkout without
+	// downloading their objects at all
+	GitLFSSkipSmudge bool `env:"BUILDKITE_GIT_LFS_SKIP_SMUDGE"`
+
 	// Config key=value pairs to pass to "git" when submodule init commands are invoked
 	GitSubmoduleCloneConfig []string `env:"BUILDKITE_GIT_SUBMODULE_CLONE_CONFIG" normalize:"list"`
 
@@ -151,6 +172,10 @@ type Config struct {
 
 	// Service name to use when reporting traces.
 	TracingServiceName string
+
+	// Where to write lifecycle events. A file, or a unix socket given as
+	// unix:///path/to/socket. If an empty string, no events are written.
+	EventStream string
 }
 
 // ReadFromEnvironment reads configuration from the Environment, returns a map
@@ -189,6 +214,17 @@ func (c *Config) ReadFromEnvironment(environ env.Environment) map[string]string
 				}
 				v.SetBool(newBool)
 				changed[tag] = newStr
+			case reflect.Int:
+				newInt, err := strconv.Atoi(newStr)
+				if err != nil {
+					log.Printf("warning: cannot parse %s=%s as int, ignoring", tag, newStr)
+					break
+				}
+				if int64(newInt) == v.Int() {
+					break
+				}
+				v.SetInt(int64(newInt))
+				changed[tag] = newStr
 			default:
 				log.Printf("warning: bootstrap.Config.ReadFromEnvironment does not support %v for %s", v.Kind(), tag)
 			}
@@ -80,3 +80,29 @@ func TestReadFromEnvironmentIgnoresMalformedBooleans(t *testing.T) {
 		t.Errorf("config.PluginsAlwaysCloneFresh = %t, want %t", got, want)
 	}
 }
+
+func TestReadFromEnvironmentParsesIntegers(t *testing.T) {
+	t.Parallel()
+	config := &Config{GitCloneDepth: 0}
+	environ := env.FromSlice([]string{"BUILDKITE_GIT_CLONE_DEPTH=50"})
+	changes := config.ReadFromEnvironment(environ)
+	if diff := cmp.Diff(changes, map[string]string{"BUILDKITE_GIT_CLONE_DEPTH": "50"}); diff != "" {
+		t.Errorf("config.ReadFromEnvironment(environ) diff (-got +want):\n%s", diff)
+	}
+	if got, want := config.GitCloneDepth, 50; got != want {
+		t.Errorf("config.GitCloneDepth = %d, want %d", got, want)
+	}
+}
+
+func TestReadFromEnvironmentIgnoresMalformedIntegers(t *testing.T) {
+	t.Parallel()
+	config := &Config{GitCloneDepth: 10}
+	environ := env.FromSlice([]string{"BUILDKITE_GIT_CLONE_DEPTH=lots"})
+	changes := config.ReadFromEnvironment(environ)
+	if len(changes) != 0 {
+		t.Errorf("changes = %v, want none", changes)
+	}
+	if got, want := config.GitCloneDepth, 10; got != want {
+		t.Errorf("config.GitCloneDepth = %d, want %d", got, want)
+	}
+}
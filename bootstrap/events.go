@@ -0,0 +1,54 @@
+package bootstrap
+
+import (
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/events"
+)
+
+// openEvents opens the lifecycle event stream the agent passed on, if any
+func (b *Bootstrap) openEvents() {
+	stream, err := events.Open(b.Config.EventStream)
+	if err != nil {
+		b.shell.Warningf("Lifecycle events won't be written (%v)", err)
+		return
+	}
+	b.events = stream.With(b.Config.AgentName, b.Config.JobID)
+}
+
+// emit writes an event to the lifecycle event stream, if there is one
+func (b *Bootstrap) emit(e events.Event) {
+	if err := b.events.Emit(e); err != nil {
+		b.shell.Warningf("%v", err)
+	}
+}
+
+// startPhase emits the start of a phase of the bootstrap, and returns a func
+// to call with the phase's error (if any) once it's over
+func (b *Bootstrap) startPhase(phase string) func(error) {
+	b.phase = phase
+	b.emit(events.Event{Type: events.PhaseStarted, Phase: phase})
+
+	return func(err error) {
+		finished := events.Event{
+			Type:       events.PhaseFinished,
+			Phase:      phase,
+			ExitStatus: events.ExitStatus(shell.GetExitCode(err)),
+		}
+		if err != nil {
+			finished.Error = err.Error()
+		}
+		b.emit(finished)
+		b.phase = ""
+	}
+}
+
+// hookEvent returns an event about a hook, in the phase it's run in
+func (b *Bootstrap) hookEvent(t events.Type, hookCfg HookConfig) events.Event {
+	return events.Event{
+		Type:       t,
+		Phase:      b.phase,
+		Hook:       hookCfg.Name,
+		HookScope:  hookCfg.Scope,
+		PluginName: hookCfg.PluginName,
+	}
+}
@@ -7,9 +7,12 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/buildkite/agent/v3/bootstrap/shell"
 	"github.com/buildkite/shellwords"
@@ -22,6 +25,8 @@ const (
 	gitErrorFetch
 	gitErrorClean
 	gitErrorCleanSubmodules
+	gitErrorSparseCheckout
+	gitErrorLFS
 )
 
 var errNoHostname = errors.New("no hostname found")
@@ -133,6 +138,153 @@ func gitFetch(ctx context.Context, sh shellRunner, gitFetchFlags, repository str
 	return nil
 }
 
+// gitSparseCheckoutPaths splits a comma or newline separated list of
+// directories to sparsely check out
+func gitSparseCheckoutPaths(paths string) []string {
+	var result []string
+	for _, path := range strings.FieldsFunc(paths, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if path = strings.Trim(strings.TrimSpace(path), "/"); path != "" {
+			result = append(result, path)
+		}
+	}
+	return result
+}
+
+// gitSparseCheckout limits the working tree to the files in the root of the
+// repository and the given directories
+func gitSparseCheckout(ctx context.Context, sh shellRunner, paths []string) error {
+	commandArgs := []string{"sparse-checkout", "set", "--cone", "--"}
+	commandArgs = append(commandArgs, paths...)
+
+	if err := sh.Run(ctx, "git", commandArgs...); err != nil {
+		return &gitError{error: err, Type: gitErrorSparseCheckout}
+	}
+
+	return nil
+}
+
+// gitSparseCheckoutDisable restores the full working tree of a sparse
+// checkout. Git leaves the sparse-checkout file behind, so it's removed too
+// so we can tell next time that there's nothing to restore.
+func gitSparseCheckoutDisable(ctx context.Context, sh shellRunner, gitDir string) error {
+	if err := sh.Run(ctx, "git", "sparse-checkout", "disable"); err != nil {
+		return &gitError{error: err, Type: gitErrorSparseCheckout}
+	}
+
+	return os.Remove(filepath.Join(gitDir, "info", "sparse-checkout"))
+}
+
+// gitLFSFetch downloads the Git LFS objects of the files in HEAD that match
+// the include patterns and don't match the exclude ones, into storage, or the
+// repository's own LFS storage if it's empty
+func gitLFSFetch(ctx context.Context, sh shellRunner, storage, include, exclude string) error {
+	commandArgs := gitLFSArgs(storage, "fetch")
+	if include = strings.TrimSpace(include); include != "" {
+		commandArgs = append(commandArgs, "--include="+include)
+	}
+	if exclude = strings.TrimSpace(exclude); exclude != "" {
+		commandArgs = append(commandArgs, "--exclude="+exclude)
+	}
+	commandArgs = append(commandArgs, "origin", "HEAD")
+
+	if err := sh.Run(ctx, "git", commandArgs...); err != nil {
+		return &gitError{error: err, Type: gitErrorLFS}
+	}
+
+	return nil
+}
+
+// gitLFSCheckout replaces the Git LFS pointer files in the working tree with
+// the objects from storage that have been fetched
+func gitLFSCheckout(ctx context.Context, sh shellRunner, storage string) error {
+	if err := sh.Run(ctx, "git", gitLFSArgs(storage, "checkout")...); err != nil {
+		return &gitError{error: err, Type: gitErrorLFS}
+	}
+
+	return nil
+}
+
+// gitLFSArgs are the arguments to git for a Git LFS command that uses
+// storage for its objects. It's set just for the command so that it isn't
+// left in the checkout's config for other commands to find.
+func gitLFSArgs(storage string, args ...string) []string {
+	commandArgs := []string{"lfs"}
+	if storage != "" {
+		commandArgs = []string{"-c", "lfs.storage=" + storage, "lfs"}
+	}
+	return append(commandArgs, args...)
+}
+
+// skipGitLFSSmudge has git leave Git LFS pointer files in the working tree
+// rather than downloading each object as it's checked out, until the returned
+// function is called
+func skipGitLFSSmudge(sh *shell.Shell) func() {
+	previous, existed := sh.Env.Get("GIT_LFS_SKIP_SMUDGE")
+	sh.Env.Set("GIT_LFS_SKIP_SMUDGE", "1")
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if existed {
+				sh.Env.Set("GIT_LFS_SKIP_SMUDGE", previous)
+			} else {
+				sh.Env.Remove("GIT_LFS_SKIP_SMUDGE")
+			}
+		})
+	}
+}
+
+var gitDepthFlagPattern = regexp.MustCompile(`(^|\s)--depth(=|\s+)\S+`)
+
+// withoutGitDepthFlags removes --depth from git clone or fetch flags
+func withoutGitDepthFlags(flags string) string {
+	return strings.TrimSpace(gitDepthFlagPattern.ReplaceAllString(flags, ""))
+}
+
+// missingGitAlternates returns the alternate object directories of a git
+// directory, such as the mirrors a checkout was cloned with --reference to,
+// that no longer exist
+func missingGitAlternates(gitDir string) []string {
+	f, err := os.Open(filepath.Join(gitDir, "objects", "info", "alternates"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var missing []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		dir := strings.TrimSpace(scanner.Text())
+		if dir == "" || strings.HasPrefix(dir, "#") {
+			continue
+		}
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(gitDir, "objects", dir)
+		}
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			missing = append(missing, dir)
+		}
+	}
+	return missing
+}
+
+// touchGitMirror records that a mirror has just been used, so that the
+// agent's mirror maintenance doesn't remove it
+func touchGitMirror(sh *shell.Shell, mirrorDir string) {
+	path := mirrorDir + ".lastused"
+	now := time.Now()
+	err := os.Chtimes(path, now, now)
+	if os.IsNotExist(err) {
+		var f *os.File
+		if f, err = os.Create(path); err == nil {
+			err = f.Close()
+		}
+	}
+	if err != nil {
+		sh.Warningf("Failed to record that the git mirror %s was used (%s)", mirrorDir, err)
+	}
+}
+
 func gitEnumerateSubmoduleURLs(ctx context.Context, sh *shell.Shell) ([]string, error) {
 	urls := []string{}
 
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/buildkite/agent/v3/bootstrap/shell"
@@ -217,6 +219,87 @@ func TestGitFetch(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestGitSparseCheckoutPaths(t *testing.T) {
+	for paths, want := range map[string][]string{
+		"":                        nil,
+		"frontend":                {"frontend"},
+		"frontend, /docs/,":       {"frontend", "docs"},
+		"frontend\nlibs/shared\n": {"frontend", "libs/shared"},
+	} {
+		assert.Equal(t, want, gitSparseCheckoutPaths(paths), "gitSparseCheckoutPaths(%q)", paths)
+	}
+}
+
+func TestGitSparseCheckout(t *testing.T) {
+	sh := new(mockShellRunner).Expect("git", "sparse-checkout", "set", "--cone", "--", "frontend", "docs")
+	defer sh.Check(t)
+	err := gitSparseCheckout(context.Background(), sh, []string{"frontend", "docs"})
+	require.NoError(t, err)
+}
+
+func TestGitLFSFetch(t *testing.T) {
+	sh := new(mockShellRunner).
+		Expect("git", "lfs", "fetch", "origin", "HEAD").
+		Expect("git", "-c", "lfs.storage=/mirrors/repo/lfs", "lfs", "fetch", "--include=assets/**,*.psd", "--exclude=docs/**", "origin", "HEAD")
+	defer sh.Check(t)
+	require.NoError(t, gitLFSFetch(context.Background(), sh, "", "", " "))
+	require.NoError(t, gitLFSFetch(context.Background(), sh, "/mirrors/repo/lfs", "assets/**,*.psd", "docs/**"))
+}
+
+func TestGitLFSCheckout(t *testing.T) {
+	sh := new(mockShellRunner).
+		Expect("git", "lfs", "checkout").
+		Expect("git", "-c", "lfs.storage=/mirrors/repo/lfs", "lfs", "checkout")
+	defer sh.Check(t)
+	require.NoError(t, gitLFSCheckout(context.Background(), sh, ""))
+	require.NoError(t, gitLFSCheckout(context.Background(), sh, "/mirrors/repo/lfs"))
+}
+
+func TestSkipGitLFSSmudge(t *testing.T) {
+	sh := shell.NewTestShell(t)
+
+	sh.Env.Remove("GIT_LFS_SKIP_SMUDGE")
+	restore := skipGitLFSSmudge(sh)
+	assert.Equal(t, "1", sh.Env["GIT_LFS_SKIP_SMUDGE"])
+	restore()
+	restore()
+	assert.False(t, sh.Env.Exists("GIT_LFS_SKIP_SMUDGE"))
+
+	sh.Env.Set("GIT_LFS_SKIP_SMUDGE", "0")
+	restore = skipGitLFSSmudge(sh)
+	assert.Equal(t, "1", sh.Env["GIT_LFS_SKIP_SMUDGE"])
+	restore()
+	assert.Equal(t, "0", sh.Env["GIT_LFS_SKIP_SMUDGE"])
+}
+
+func TestWithoutGitDepthFlags(t *testing.T) {
+	for flags, want := range map[string]string{
+		"":                           "",
+		"-v --prune":                 "-v --prune",
+		"--depth=1":                  "",
+		"-v --depth 10 --prune":      "-v --prune",
+		"--depth=5 -v":               "-v",
+		"--shallow-since=2020-01-01": "--shallow-since=2020-01-01",
+	} {
+		assert.Equal(t, want, withoutGitDepthFlags(flags), "withoutGitDepthFlags(%q)", flags)
+	}
+}
+
+func TestMissingGitAlternates(t *testing.T) {
+	gitDir := t.TempDir()
+	mirror := t.TempDir()
+	gone := filepath.Join(t.TempDir(), "gone")
+
+	assert.Empty(t, missingGitAlternates(gitDir))
+
+	infoDir := filepath.Join(gitDir, "objects", "info")
+	require.NoError(t, os.MkdirAll(infoDir, 0o777))
+	alternates := strings.Join([]string{mirror, "# a comment", gone, ""}, "\n")
+	require.NoError(t, os.WriteFile(filepath.Join(infoDir, "alternates"), []byte(alternates), 0o644))
+
+	assert.Equal(t, []string{gone}, missingGitAlternates(gitDir))
+}
+
 // mockShellRunner implements shellRunner for testing expected calls.
 type mockShellRunner struct {
 	got, want [][]string
@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
 	"sync/atomic"
@@ -748,6 +750,11 @@ func TestGitMirrorEnv(t *testing.T) {
 	if !strings.HasPrefix(gitMirrorPath, tester.GitMirrorsDir) {
 		t.Errorf("gitMirrorPath = %q, want prefix %q", gitMirrorPath, tester.GitMirrorsDir)
 	}
+
+	// The agent's mirror maintenance keeps mirrors that jobs have used
+	if _, err := os.Stat(gitMirrorPath + ".lastused"); err != nil {
+		t.Errorf("os.Stat(%q) error = %v, want the mirror marked as used", gitMirrorPath+".lastused", err)
+	}
 }
 
 type subDirMatcher struct {
@@ -768,3 +775,509 @@ func (mf subDirMatcher) String() string {
 func matchSubDir(dir string) bintest.Matcher {
 	return subDirMatcher{dir: dir}
 }
+
+func TestCheckingOutSparseCheckoutOfLocalGitProject(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	if err := addSparseCheckoutDirs(tester.Repo); err != nil {
+		t.Fatalf("addSparseCheckoutDirs() error = %v", err)
+	}
+
+	env := []string{
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLONE_MIRROR_FLAGS=--bare",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+		"BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS=frontend, /docs/",
+	}
+
+	// Actually execute git commands, but with expectations
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	// But assert which ones are called
+	if experiments.IsEnabled("git-mirrors") {
+		git.ExpectAll([][]any{
+			{"clone", "--mirror", "--bare", "--", tester.Repo.Path, matchSubDir(tester.GitMirrorsDir)},
+			{"clone", "-v", "--reference", matchSubDir(tester.GitMirrorsDir), "--sparse", "--", tester.Repo.Path, "."},
+			{"clean", "-fdq"},
+			{"sparse-checkout", "set", "--cone", "--", "frontend", "docs"},
+			{"fetch", "-v", "--", "origin", "master"},
+			{"checkout", "-f", "FETCH_HEAD"},
+			{"clean", "-fdq"},
+			{"--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color", "--"},
+		})
+	} else {
+		git.ExpectAll([][]any{
+			{"clone", "-v", "--sparse", "--filter=blob:none", "--", tester.Repo.Path, "."},
+			{"clean", "-fdq"},
+			{"sparse-checkout", "set", "--cone", "--", "frontend", "docs"},
+			{"fetch", "-v", "--", "origin", "master"},
+			{"checkout", "-f", "FETCH_HEAD"},
+			{"clean", "-fdq"},
+			{"--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color", "--"},
+		})
+	}
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+
+	for path, want := range map[string]bool{
+		"test.txt":             true,
+		"frontend/app.js":      true,
+		"docs/index.md":        true,
+		"backend/server.go":    false,
+		"backend/vendor/a.txt": false,
+	} {
+		_, err := os.Stat(filepath.Join(tester.CheckoutDir(), filepath.FromSlash(path)))
+		if got := err == nil; got != want {
+			t.Errorf("%s checked out = %t, want %t (os.Stat() error = %v)", path, got, want, err)
+		}
+	}
+}
+
+func TestCheckingOutRestoresAPreviousSparseCheckout(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	if err := addSparseCheckoutDirs(tester.Repo); err != nil {
+		t.Fatalf("addSparseCheckoutDirs() error = %v", err)
+	}
+
+	// Create an existing sparse checkout, as a previous job would have
+	if out, err := tester.Repo.Execute("clone", "--sparse", "--", tester.Repo.Path, tester.CheckoutDir()); err != nil {
+		t.Fatalf("tester.Repo.Execute(clone) error = %v\nout = %s", err, out)
+	}
+	if out, err := tester.Repo.Execute("-C", tester.CheckoutDir(), "sparse-checkout", "set", "frontend"); err != nil {
+		t.Fatalf("tester.Repo.Execute(sparse-checkout set) error = %v\nout = %s", err, out)
+	}
+
+	env := []string{
+		"BUILDKITE_GIT_CLONE_MIRROR_FLAGS=--bare",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+	}
+
+	// Actually execute git commands, but with expectations
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	// Mirrors are only used when cloning, so the existing checkout is
+	// updated the same way with or without them
+	if experiments.IsEnabled("git-mirrors") {
+		git.Expect("clone", "--mirror", "--bare", "--", tester.Repo.Path, matchSubDir(tester.GitMirrorsDir))
+	}
+	git.ExpectAll([][]any{
+		{"remote", "set-url", "origin", tester.Repo.Path},
+		{"clean", "-fdq"},
+		{"sparse-checkout", "disable"},
+		{"fetch", "-v", "--", "origin", "master"},
+		{"checkout", "-f", "FETCH_HEAD"},
+		{"clean", "-fdq"},
+		{"--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color", "--"},
+	})
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+
+	if _, err := os.Stat(filepath.Join(tester.CheckoutDir(), "backend", "server.go")); err != nil {
+		t.Errorf("os.Stat(backend/server.go) error = %v, want the full checkout restored", err)
+	}
+}
+
+// addSparseCheckoutDirs commits some directories to a test repository to
+// sparsely check out
+func addSparseCheckoutDirs(repo *gitRepository) error {
+	for _, path := range []string{"frontend/app.js", "docs/index.md", "backend/server.go", "backend/vendor/a.txt"} {
+		abs := filepath.Join(repo.Path, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(abs), 0o777); err != nil {
+			return err
+		}
+		if err := os.WriteFile(abs, []byte(path), 0o600); err != nil {
+			return err
+		}
+		if err := repo.Add(abs); err != nil {
+			return err
+		}
+	}
+	return repo.Commit("Add directories")
+}
+
+func TestCheckingOutDeepensAShallowCloneToFindTheCommit(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	commit, err := addCommitsOnTop(tester.Repo, 3)
+	if err != nil {
+		t.Fatalf("addCommitsOnTop() error = %v", err)
+	}
+
+	// Local clones ignore --depth, but file:// ones don't
+	repo := "file://" + filepath.ToSlash(tester.Repo.Path)
+
+	env := []string{
+		"BUILDKITE_REPO=" + repo,
+		"BUILDKITE_COMMIT=" + commit,
+		"BUILDKITE_REFSPEC=master",
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLONE_MIRROR_FLAGS=--bare",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+		"BUILDKITE_GIT_CLONE_DEPTH=1",
+	}
+
+	// Actually execute git commands, but with expectations
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	hasCommit := []any{"--git-dir", bintest.MatchAny(), "rev-parse", commit + "^{commit}"}
+
+	// But assert which ones are called. The mirror has every commit, so
+	// there's nothing to deepen with one.
+	if experiments.IsEnabled("git-mirrors") {
+		git.ExpectAll([][]any{
+			{"clone", "--mirror", "--bare", "--", repo, matchSubDir(tester.GitMirrorsDir)},
+			{"clone", "-v", "--reference", matchSubDir(tester.GitMirrorsDir), "--depth=1", "--", repo, "."},
+			{"clean", "-fdq"},
+			{"fetch", "-v", "--depth=1", "--", "origin", "master"},
+			hasCommit,
+			{"checkout", "-f", commit},
+			{"clean", "-fdq"},
+			{"--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color", "--"},
+		})
+	} else {
+		git.ExpectAll([][]any{
+			{"clone", "-v", "--depth=1", "--", repo, "."},
+			{"clean", "-fdq"},
+			{"fetch", "-v", "--depth=1", "--", "origin", "master"},
+			hasCommit,
+			{"fetch", "-v", "--deepen=1", "--", "origin", "master"},
+			hasCommit,
+			{"fetch", "-v", "--deepen=2", "--", "origin", "master"},
+			hasCommit,
+			{"checkout", "-f", commit},
+			{"clean", "-fdq"},
+			{"--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color", "--"},
+		})
+	}
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+}
+
+func TestCheckingOutUnshallowsACloneFromDepthFlags(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	commit, err := addCommitsOnTop(tester.Repo, 2)
+	if err != nil {
+		t.Fatalf("addCommitsOnTop() error = %v", err)
+	}
+
+	// Local clones ignore --depth, but file:// ones don't
+	repo := "file://" + filepath.ToSlash(tester.Repo.Path)
+
+	env := []string{
+		"BUILDKITE_REPO=" + repo,
+		"BUILDKITE_COMMIT=" + commit,
+		"BUILDKITE_REFSPEC=master",
+		"BUILDKITE_GIT_CLONE_FLAGS=--depth=1",
+		"BUILDKITE_GIT_CLONE_MIRROR_FLAGS=--bare",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v --depth 1",
+	}
+
+	// Actually execute git commands, but with expectations
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	hasCommit := []any{"--git-dir", bintest.MatchAny(), "rev-parse", commit + "^{commit}"}
+
+	// But assert which ones are called. The mirror has every commit, so
+	// there's nothing to fetch with one.
+	if experiments.IsEnabled("git-mirrors") {
+		git.ExpectAll([][]any{
+			{"clone", "--mirror", "--bare", "--", repo, matchSubDir(tester.GitMirrorsDir)},
+			{"clone", "--depth=1", "--reference", matchSubDir(tester.GitMirrorsDir), "--", repo, "."},
+			{"clean", "-fdq"},
+			{"fetch", "-v", "--depth", "1", "--", "origin", "master"},
+			hasCommit,
+			{"checkout", "-f", commit},
+			{"clean", "-fdq"},
+			{"--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color", "--"},
+		})
+	} else {
+		git.ExpectAll([][]any{
+			{"clone", "--depth=1", "--", repo, "."},
+			{"clean", "-fdq"},
+			{"fetch", "-v", "--depth", "1", "--", "origin", "master"},
+			hasCommit,
+			{"fetch", "-v", "--unshallow", "--", "origin", "master"},
+			{"checkout", "-f", commit},
+			{"clean", "-fdq"},
+			{"--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color", "--"},
+		})
+	}
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+}
+
+// addCommitsOnTop adds commits to the master branch of a test repository,
+// returning the commit they were added on top of
+func addCommitsOnTop(repo *gitRepository, count int) (string, error) {
+	commit, err := repo.RevParse("master")
+	if err != nil {
+		return "", err
+	}
+	for i := 0; i < count; i++ {
+		path := filepath.Join(repo.Path, fmt.Sprintf("commit-%d.txt", i))
+		if err := os.WriteFile(path, []byte("more history"), 0o600); err != nil {
+			return "", err
+		}
+		if err := repo.Add(path); err != nil {
+			return "", err
+		}
+		if err := repo.Commit("Commit %d", i); err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSpace(commit), nil
+}
+
+func TestCheckingOutReplacesACheckoutWhoseMirrorIsGone(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	// Create an existing checkout that borrows objects from a mirror, then
+	// remove the mirror as the agent's mirror maintenance would
+	mirrorDir, err := os.MkdirTemp("", "removed-git-mirror")
+	if err != nil {
+		t.Fatalf("os.MkdirTemp() error = %v", err)
+	}
+	if out, err := tester.Repo.Execute("clone", "--mirror", "--", tester.Repo.Path, mirrorDir); err != nil {
+		t.Fatalf("tester.Repo.Execute(clone --mirror) error = %v\nout = %s", err, out)
+	}
+	if out, err := tester.Repo.Execute("clone", "--reference", mirrorDir, "--", tester.Repo.Path, tester.CheckoutDir()); err != nil {
+		t.Fatalf("tester.Repo.Execute(clone --reference) error = %v\nout = %s", err, out)
+	}
+	if err := os.RemoveAll(mirrorDir); err != nil {
+		t.Fatalf("os.RemoveAll() error = %v", err)
+	}
+
+	env := []string{
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLONE_MIRROR_FLAGS=--bare",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+	}
+
+	// Actually execute git commands, but with expectations
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	// But assert which ones are called
+	if experiments.IsEnabled("git-mirrors") {
+		git.ExpectAll([][]any{
+			{"clone", "--mirror", "--bare", "--", tester.Repo.Path, matchSubDir(tester.GitMirrorsDir)},
+			{"clone", "-v", "--reference", matchSubDir(tester.GitMirrorsDir), "--", tester.Repo.Path, "."},
+			{"clean", "-fdq"},
+			{"fetch", "-v", "--", "origin", "master"},
+			{"checkout", "-f", "FETCH_HEAD"},
+			{"clean", "-fdq"},
+			{"--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color", "--"},
+		})
+	} else {
+		git.ExpectAll([][]any{
+			{"clone", "-v", "--", tester.Repo.Path, "."},
+			{"clean", "-fdq"},
+			{"fetch", "-v", "--", "origin", "master"},
+			{"checkout", "-f", "FETCH_HEAD"},
+			{"clean", "-fdq"},
+			{"--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color", "--"},
+		})
+	}
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+
+	if !strings.Contains(tester.Output, "the git mirror it used is gone") {
+		t.Errorf("tester.Output does not contain %q", "the git mirror it used is gone")
+	}
+}
+
+func TestCheckingOutFetchesGitLFSObjectsAfterTheCheckout(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	env := []string{
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLONE_MIRROR_FLAGS=--bare",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+		"BUILDKITE_GIT_LFS=true",
+		"BUILDKITE_GIT_LFS_INCLUDE=assets/**",
+		"BUILDKITE_GIT_LFS_EXCLUDE=*.psd",
+	}
+
+	// git-lfs isn't necessarily installed, so only the git commands are
+	// actually executed
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Fatalf("exec.LookPath(git) error = %v", err)
+	}
+
+	git := tester.MustMock(t, "git")
+
+	if experiments.IsEnabled("git-mirrors") {
+		git.Expect("clone", "--mirror", "--bare", "--", tester.Repo.Path, matchSubDir(tester.GitMirrorsDir)).AndPassthroughToLocalCommand(realGit)
+		git.Expect("clone", "-v", "--reference", matchSubDir(tester.GitMirrorsDir), "--", tester.Repo.Path, ".").
+			AndCallFunc(passthroughWithGitLFSSmudge(realGit, "1"))
+	} else {
+		git.Expect("clone", "-v", "--", tester.Repo.Path, ".").AndCallFunc(passthroughWithGitLFSSmudge(realGit, "1"))
+	}
+	git.Expect("clean", "-fdq").Exactly(2).AndPassthroughToLocalCommand(realGit)
+	git.Expect("fetch", "-v", "--", "origin", "master").AndPassthroughToLocalCommand(realGit)
+	git.Expect("checkout", "-f", "FETCH_HEAD").AndCallFunc(passthroughWithGitLFSSmudge(realGit, "1"))
+
+	// With a mirror, the objects are stored alongside it to share them
+	if experiments.IsEnabled("git-mirrors") {
+		storage := bintest.MatchPattern(`^lfs\.storage=` + regexp.QuoteMeta(tester.GitMirrorsDir) + `.+/lfs$`)
+		git.Expect("-c", storage, "lfs", "fetch", "--include=assets/**", "--exclude=*.psd", "origin", "HEAD").AndExitWith(0)
+		git.Expect("-c", storage, "lfs", "checkout").AndExitWith(0)
+	} else {
+		git.Expect("lfs", "fetch", "--include=assets/**", "--exclude=*.psd", "origin", "HEAD").AndExitWith(0)
+		git.Expect("lfs", "checkout").AndExitWith(0)
+	}
+
+	// Smudging is only skipped while checking out
+	git.Expect("--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color", "--").
+		AndCallFunc(passthroughWithGitLFSSmudge(realGit, ""))
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+}
+
+func TestCheckingOutSkipsGitLFSSmudging(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	env := []string{
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLONE_MIRROR_FLAGS=--bare",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+		"BUILDKITE_GIT_LFS=true",
+		"BUILDKITE_GIT_LFS_SKIP_SMUDGE=true",
+	}
+
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Fatalf("exec.LookPath(git) error = %v", err)
+	}
+
+	git := tester.MustMock(t, "git")
+
+	if experiments.IsEnabled("git-mirrors") {
+		git.Expect("clone", "--mirror", "--bare", "--", tester.Repo.Path, matchSubDir(tester.GitMirrorsDir)).AndPassthroughToLocalCommand(realGit)
+		git.Expect("clone", "-v", "--reference", matchSubDir(tester.GitMirrorsDir), "--", tester.Repo.Path, ".").
+			AndCallFunc(passthroughWithGitLFSSmudge(realGit, "1"))
+	} else {
+		git.Expect("clone", "-v", "--", tester.Repo.Path, ".").AndCallFunc(passthroughWithGitLFSSmudge(realGit, "1"))
+	}
+	git.Expect("clean", "-fdq").Exactly(2).AndPassthroughToLocalCommand(realGit)
+	git.Expect("fetch", "-v", "--", "origin", "master").AndPassthroughToLocalCommand(realGit)
+	git.Expect("checkout", "-f", "FETCH_HEAD").AndCallFunc(passthroughWithGitLFSSmudge(realGit, "1"))
+
+	// No git lfs commands are expected, as the objects aren't needed
+	git.Expect("--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color", "--").
+		AndCallFunc(passthroughWithGitLFSSmudge(realGit, ""))
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+
+	if !strings.Contains(tester.Output, "Not fetching Git LFS objects") {
+		t.Errorf("tester.Output does not contain %q", "Not fetching Git LFS objects")
+	}
+}
+
+// passthroughWithGitLFSSmudge passes a call through to git, failing it unless
+// GIT_LFS_SKIP_SMUDGE is set to skipSmudge
+func passthroughWithGitLFSSmudge(realGit, skipSmudge string) func(*bintest.Call) {
+	return func(c *bintest.Call) {
+		if got := c.GetEnv("GIT_LFS_SKIP_SMUDGE"); got != skipSmudge {
+			c.Fatal(fmt.Errorf("GIT_LFS_SKIP_SMUDGE = %q, want %q", got, skipSmudge))
+			return
+		}
+		c.Passthrough(realGit)
+	}
+}
@@ -1,6 +1,8 @@
 package integration
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -11,7 +13,9 @@ import (
 	"time"
 
 	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/events"
 	"github.com/buildkite/bintest/v3"
+	"github.com/google/go-cmp/cmp"
 )
 
 func TestEnvironmentVariablesPassBetweenHooks(t *testing.T) {
@@ -488,3 +492,65 @@ func TestPreExitHooksFireAfterCancel(t *testing.T) {
 
 	tester.CheckMocks(t)
 }
+
+func TestHooksAndPhasesEmitLifecycleEvents(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	tester.ExpectGlobalHook("command").Once().AndExitWith(0)
+
+	stream := filepath.Join(t.TempDir(), "events.ndjson")
+	tester.RunAndCheck(t, events.EnvVar+"="+stream)
+
+	f, err := os.Open(stream)
+	if err != nil {
+		t.Fatalf("os.Open(%q) error = %v", stream, err)
+	}
+	defer f.Close()
+
+	var got []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e events.Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("json.Unmarshal(%q) error = %v", scanner.Text(), err)
+		}
+		if e.JobID == "" {
+			t.Errorf("event %q has no job ID", scanner.Text())
+		}
+
+		desc := fmt.Sprintf("%s %s", e.Type, e.Phase)
+		if e.Hook != "" {
+			desc += fmt.Sprintf(" %s %s", e.HookScope, e.Hook)
+		}
+		if e.ExitStatus != nil {
+			desc += fmt.Sprintf(" %d", *e.ExitStatus)
+		}
+		got = append(got, desc)
+	}
+
+	want := []string{
+		"phase.started environment",
+		"phase.finished environment 0",
+		"phase.started plugin",
+		"phase.finished plugin 0",
+		"phase.started checkout",
+		"phase.finished checkout 0",
+		"phase.started vendored-plugin",
+		"phase.finished vendored-plugin 0",
+		"phase.started command",
+		"hook.started command global command",
+		"hook.finished command global command 0",
+		"phase.finished command 0",
+		"phase.started pre-exit",
+		"phase.finished pre-exit 0",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("lifecycle events diff (-want +got):\n%s", diff)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/bootstrap/shell"
 	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/events"
 	"github.com/buildkite/agent/v3/experiments"
 	"github.com/buildkite/agent/v3/hook"
 	"github.com/buildkite/agent/v3/logger"
@@ -67,7 +68,10 @@ type AgentStartConfig struct {
 	BootstrapScript             string   `cli:"bootstrap-script" normalize:"commandpath"`
 	CancelGracePeriod           int      `cli:"cancel-grace-period"`
 	EnableJobLogTmpfile         bool     `cli:"enable-job-log-tmpfile"`
+	MaxJobLogSize               int      `cli:"max-job-log-size"`
+	JobLogTailSize              int      `cli:"job-log-tail-size"`
 	BuildPath                   string   `cli:"build-path" normalize:"filepath" validate:"required"`
+	BuildPathMinFreeSpace       string   `cli:"build-path-min-free-space"`
 	HooksPath                   string   `cli:"hooks-path" normalize:"filepath"`
 	PluginsPath                 string   `cli:"plugins-path" normalize:"filepath"`
 	Shell                       string   `cli:"shell"`
@@ -88,9 +92,17 @@ type AgentStartConfig struct {
 	GitCloneMirrorFlags         string   `cli:"git-clone-mirror-flags"`
 	GitCleanFlags               string   `cli:"git-clean-flags"`
 	GitFetchFlags               string   `cli:"git-fetch-flags"`
+	GitCloneDepth               int      `cli:"git-clone-depth"`
+	GitSparseCheckoutPaths      string   `cli:"git-sparse-checkout-paths"`
+	GitLFS                      bool     `cli:"git-lfs"`
+	GitLFSInclude               string   `cli:"git-lfs-include"`
+	GitLFSExclude               string   `cli:"git-lfs-exclude"`
+	GitLFSSkipSmudge            bool     `cli:"git-lfs-skip-smudge"`
 	GitMirrorsPath              string   `cli:"git-mirrors-path" normalize:"filepath"`
 	GitMirrorsLockTimeout       int      `cli:"git-mirrors-lock-timeout"`
 	GitMirrorsSkipUpdate        bool     `cli:"git-mirrors-skip-update"`
+	GitMirrorsMaintenance       string   `cli:"git-mirrors-maintenance-interval"`
+	GitMirrorsMaxUnusedDays     int      `cli:"git-mirrors-max-unused-days"`
 	NoGitSubmodules             bool     `cli:"no-git-submodules"`
 	NoSSHKeyscan                bool     `cli:"no-ssh-keyscan"`
 	NoCommandEval               bool     `cli:"no-command-eval"`
@@ -101,11 +113,16 @@ type AgentStartConfig struct {
 	NoFeatureReporting          bool     `cli:"no-feature-reporting"`
 	TimestampLines              bool     `cli:"timestamp-lines"`
 	HealthCheckAddr             string   `cli:"health-check-addr"`
+	ControlSocket               string   `cli:"control-socket" normalize:"filepath"`
+	ControlToken                string   `cli:"control-token"`
 	MetricsDatadog              bool     `cli:"metrics-datadog"`
 	MetricsDatadogHost          string   `cli:"metrics-datadog-host"`
 	MetricsDatadogDistributions bool     `cli:"metrics-datadog-distributions"`
+	MetricsPrometheus           bool     `cli:"metrics-prometheus"`
+	MetricsPrometheusAddr       string   `cli:"metrics-prometheus-addr"`
 	TracingBackend              string   `cli:"tracing-backend"`
 	TracingServiceName          string   `cli:"tracing-service-name"`
+	EventStream                 string   `cli:"event-stream"`
 	Spawn                       int      `cli:"spawn"`
 	SpawnWithPriority           bool     `cli:"spawn-with-priority"`
 	LogFormat                   string   `cli:"log-format"`
@@ -282,6 +299,18 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Store the job logs in a temporary file ′BUILDKITE_JOB_LOG_TMPFILE′ that is accessible during the job and removed at the end of the job",
 			EnvVar: "BUILDKITE_ENABLE_JOB_LOG_TMPFILE",
 		},
+		cli.IntFlag{
+			Name:   "max-job-log-size",
+			Value:  0,
+			Usage:  "The maximum number of bytes of a job's log to upload as it runs. Past this, only the end of the log is uploaded once the job finishes. The default of 0 means no limit",
+			EnvVar: "BUILDKITE_MAX_JOB_LOG_SIZE",
+		},
+		cli.IntFlag{
+			Name:   "job-log-tail-size",
+			Value:  1024 * 1024,
+			Usage:  "The number of bytes from the end of a job's log to upload when it goes over --max-job-log-size. If it isn't set and the maximum is smaller than the default, half the maximum is used",
+			EnvVar: "BUILDKITE_JOB_LOG_TAIL_SIZE",
+		},
 		cli.StringFlag{
 			Name:   "shell",
 			Value:  DefaultShell(),
@@ -384,6 +413,40 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Flags to pass to \"git fetch\" command",
 			EnvVar: "BUILDKITE_GIT_FETCH_FLAGS",
 		},
+		cli.IntFlag{
+			Name:   "git-clone-depth",
+			Value:  0,
+			Usage:  "How many commits of history to clone and fetch, or 0 for all of it. More history is fetched if the commit isn't included. Can be overridden per job with BUILDKITE_GIT_CLONE_DEPTH",
+			EnvVar: "BUILDKITE_GIT_CLONE_DEPTH",
+		},
+		cli.StringFlag{
+			Name:   "git-sparse-checkout-paths",
+			Value:  "",
+			Usage:  "Comma separated directories to limit checkouts to, using a sparse checkout and a partial clone. Can be overridden per job with BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS",
+			EnvVar: "BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS",
+		},
+		cli.BoolFlag{
+			Name:   "git-lfs",
+			Usage:  "Fetch the Git LFS objects of the commit in one go after checking it out, sharing them through the git mirror if there is one. Can be overridden per job with BUILDKITE_GIT_LFS",
+			EnvVar: "BUILDKITE_GIT_LFS",
+		},
+		cli.StringFlag{
+			Name:   "git-lfs-include",
+			Value:  "",
+			Usage:  "Comma separated patterns of the files to fetch Git LFS objects for, with --git-lfs. Can be overridden per job with BUILDKITE_GIT_LFS_INCLUDE",
+			EnvVar: "BUILDKITE_GIT_LFS_INCLUDE",
+		},
+		cli.StringFlag{
+			Name:   "git-lfs-exclude",
+			Value:  "",
+			Usage:  "Comma separated patterns of the files not to fetch Git LFS objects for, with --git-lfs. Can be overridden per job with BUILDKITE_GIT_LFS_EXCLUDE",
+			EnvVar: "BUILDKITE_GIT_LFS_EXCLUDE",
+		},
+		cli.BoolFlag{
+			Name:   "git-lfs-skip-smudge",
+			Usage:  "Leave Git LFS pointer files in the checkout instead of downloading their objects. Can be overridden per job with BUILDKITE_GIT_LFS_SKIP_SMUDGE",
+			EnvVar: "BUILDKITE_GIT_LFS_SKIP_SMUDGE",
+		},
 		cli.StringFlag{
 			Name:   "git-clone-mirror-flags",
 			Value:  "-v",
@@ -407,6 +470,18 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Skip updating the Git mirror",
 			EnvVar: "BUILDKITE_GIT_MIRRORS_SKIP_UPDATE",
 		},
+		cli.DurationFlag{
+			Name:   "git-mirrors-maintenance-interval",
+			Usage:  "How often to fetch into and garbage collect the git mirrors in the background, and remove unused ones. Disabled if it's 0",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_MAINTENANCE_INTERVAL",
+			Value:  0,
+		},
+		cli.IntFlag{
+			Name:   "git-mirrors-max-unused-days",
+			Value:  0,
+			Usage:  "Remove git mirrors that no job has used for this many days during background maintenance. Mirrors are kept forever if it's 0",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_MAX_UNUSED_DAYS",
+		},
 		cli.StringFlag{
 			Name:   "bootstrap-script",
 			Value:  "",
@@ -419,6 +494,12 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Path to where the builds will run from",
 			EnvVar: "BUILDKITE_BUILD_PATH",
 		},
+		cli.StringFlag{
+			Name:   "build-path-min-free-space",
+			Value:  "",
+			Usage:  "Before each job, remove the agent's least recently used checkouts from the build path until the disk has this much free space, either a percentage like \"10%\" or a size like \"20GB\". Disabled if it's empty",
+			EnvVar: "BUILDKITE_BUILD_PATH_MIN_FREE_SPACE",
+		},
 		cli.StringFlag{
 			Name:   "hooks-path",
 			Value:  "",
@@ -438,9 +519,19 @@ var AgentStartCommand = cli.Command{
 		},
 		cli.StringFlag{
 			Name:   "health-check-addr",
-			Usage:  "Start an HTTP server on this addr:port that returns whether the agent is healthy, disabled by default",
+			Usage:  "Start an HTTP server on this addr:port that returns whether the agent is healthy, with JSON liveness and readiness at /healthz and /readyz, disabled by default",
 			EnvVar: "BUILDKITE_AGENT_HEALTH_CHECK_ADDR",
 		},
+		cli.StringFlag{
+			Name:   "control-socket",
+			Usage:  "Listen on a unix socket at this path for requests to pause, resume, cancel the current job, stop gracefully or report the state of the agent, disabled by default",
+			EnvVar: "BUILDKITE_AGENT_CONTROL_SOCKET",
+		},
+		cli.StringFlag{
+			Name:   "control-token",
+			Usage:  "The token that requests to the control socket have to send as \"Authorization: Bearer <token>\"",
+			EnvVar: "BUILDKITE_AGENT_CONTROL_TOKEN",
+		},
 		cli.BoolFlag{
 			Name:   "no-pty",
 			Usage:  "Do not run jobs within a pseudo terminal",
@@ -497,6 +588,16 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Use Datadog Distributions for Timing metrics",
 			EnvVar: "BUILDKITE_METRICS_DATADOG_DISTRIBUTIONS",
 		},
+		cli.BoolFlag{
+			Name:   "metrics-prometheus",
+			Usage:  "Serve metrics for Prometheus to scrape at /metrics, on --metrics-prometheus-addr or the health check server",
+			EnvVar: "BUILDKITE_METRICS_PROMETHEUS",
+		},
+		cli.StringFlag{
+			Name:   "metrics-prometheus-addr",
+			Usage:  "Start a separate HTTP server on this address to serve Prometheus metrics, rather than using --health-check-addr",
+			EnvVar: "BUILDKITE_METRICS_PROMETHEUS_ADDR",
+		},
 		cli.StringFlag{
 			Name:   "log-format",
 			Usage:  "The format to use for the logger output",
@@ -532,6 +633,11 @@ var AgentStartCommand = cli.Command{
 			EnvVar: "BUILDKITE_TRACING_SERVICE_NAME",
 			Value:  "buildkite-agent",
 		},
+		cli.StringFlag{
+			Name:   "event-stream",
+			Usage:  "Write job lifecycle events as newline-delimited JSON to this file, or to a listening unix socket given as unix:///path/to/socket",
+			EnvVar: "BUILDKITE_AGENT_EVENT_STREAM",
+		},
 
 		// API Flags
 		AgentRegisterTokenFlag,
@@ -716,6 +822,20 @@ var AgentStartCommand = cli.Command{
 			}
 		}
 
+		var gitMirrorsMaintenanceInterval time.Duration
+		if t := cfg.GitMirrorsMaintenance; t != "" {
+			var err error
+			gitMirrorsMaintenanceInterval, err = time.ParseDuration(t)
+			if err != nil {
+				l.Fatal("Failed to parse git mirrors maintenance interval: %v", err)
+			}
+		}
+
+		buildPathMinFreeSpace, err := agent.ParseDiskSpaceThreshold(cfg.BuildPathMinFreeSpace)
+		if err != nil {
+			l.Fatal("Failed to parse build path min free space: %v", err)
+		}
+
 		var gcpLabelsTimeout time.Duration
 		if t := cfg.WaitForGCPLabelsTimeout; t != "" {
 			var err error
@@ -729,8 +849,40 @@ var AgentStartCommand = cli.Command{
 			Datadog:              cfg.MetricsDatadog,
 			DatadogHost:          cfg.MetricsDatadogHost,
 			DatadogDistributions: cfg.MetricsDatadogDistributions,
+			Prometheus:           cfg.MetricsPrometheus,
 		})
 
+		if cfg.MetricsPrometheus && cfg.MetricsPrometheusAddr == "" && cfg.HealthCheckAddr == "" {
+			l.Fatal("Prometheus metrics need somewhere to be served, set either --metrics-prometheus-addr or --health-check-addr")
+		}
+
+		if cfg.MaxJobLogSize < 0 {
+			l.Fatal("--max-job-log-size can't be negative, use 0 for no limit")
+		}
+		if cfg.JobLogTailSize < 0 {
+			l.Fatal("--job-log-tail-size can't be negative")
+		}
+		if cfg.MaxJobLogSize > 0 && cfg.JobLogTailSize >= cfg.MaxJobLogSize {
+			isSetJobLogTailSize := c.IsSet("job-log-tail-size")
+			if loader.File != nil {
+				if _, exists := loader.File.Config["job-log-tail-size"]; exists {
+					isSetJobLogTailSize = true
+				}
+			}
+
+			// Only conflicting values that were both asked for are fatal,
+			// the default tail is shrunk to fit under a small maximum
+			if isSetJobLogTailSize {
+				l.Fatal("--job-log-tail-size (%d) must be less than --max-job-log-size (%d)", cfg.JobLogTailSize, cfg.MaxJobLogSize)
+			}
+			l.Warn("The default --job-log-tail-size (%d) isn't less than --max-job-log-size (%d), using %d instead", cfg.JobLogTailSize, cfg.MaxJobLogSize, cfg.MaxJobLogSize/2)
+			cfg.JobLogTailSize = cfg.MaxJobLogSize / 2
+		}
+
+		if cfg.ControlSocket != "" && cfg.ControlToken == "" {
+			l.Fatal("The control socket needs a token to authenticate requests with, set --control-token")
+		}
+
 		// Sense check supported tracing backends, we don't want bootstrapped jobs to silently have no tracing
 		if _, has := tracetools.ValidTracingBackends[cfg.TracingBackend]; !has {
 			l.Fatal("The given tracing backend %q is not supported. Valid backends are: %q", cfg.TracingBackend, maps.Keys(tracetools.ValidTracingBackends))
@@ -740,6 +892,7 @@ var AgentStartCommand = cli.Command{
 		agentConf := agent.AgentConfiguration{
 			BootstrapScript:            cfg.BootstrapScript,
 			BuildPath:                  cfg.BuildPath,
+			BuildPathMinFreeSpace:      buildPathMinFreeSpace,
 			GitMirrorsPath:             cfg.GitMirrorsPath,
 			GitMirrorsLockTimeout:      cfg.GitMirrorsLockTimeout,
 			GitMirrorsSkipUpdate:       cfg.GitMirrorsSkipUpdate,
@@ -749,6 +902,12 @@ var AgentStartCommand = cli.Command{
 			GitCloneMirrorFlags:        cfg.GitCloneMirrorFlags,
 			GitCleanFlags:              cfg.GitCleanFlags,
 			GitFetchFlags:              cfg.GitFetchFlags,
+			GitCloneDepth:              cfg.GitCloneDepth,
+			GitSparseCheckoutPaths:     cfg.GitSparseCheckoutPaths,
+			GitLFS:                     cfg.GitLFS,
+			GitLFSInclude:              cfg.GitLFSInclude,
+			GitLFSExclude:              cfg.GitLFSExclude,
+			GitLFSSkipSmudge:           cfg.GitLFSSkipSmudge,
 			GitSubmodules:              !cfg.NoGitSubmodules,
 			SSHKeyscan:                 !cfg.NoSSHKeyscan,
 			CommandEval:                !cfg.NoCommandEval,
@@ -761,11 +920,14 @@ var AgentStartCommand = cli.Command{
 			DisconnectAfterIdleTimeout: cfg.DisconnectAfterIdleTimeout,
 			CancelGracePeriod:          cfg.CancelGracePeriod,
 			EnableJobLogTmpfile:        cfg.EnableJobLogTmpfile,
+			MaxJobLogSize:              cfg.MaxJobLogSize,
+			JobLogTailSize:             cfg.JobLogTailSize,
 			Shell:                      cfg.Shell,
 			RedactedVars:               cfg.RedactedVars,
 			AcquireJob:                 cfg.AcquireJob,
 			TracingBackend:             cfg.TracingBackend,
 			TracingServiceName:         cfg.TracingServiceName,
+			EventStream:                cfg.EventStream,
 		}
 
 		if loader.File != nil {
@@ -871,6 +1033,7 @@ var AgentStartCommand = cli.Command{
 			// specific job.
 			IgnoreInDispatches: cfg.AcquireJob != "",
 			Features:           cfg.Features(),
+			ChunkEncodings:     api.ChunkEncodings,
 		}
 
 		// Spawning multiple agents doesn't work if the agent is being
@@ -879,6 +1042,13 @@ var AgentStartCommand = cli.Command{
 			l.Fatal("You can't spawn multiple agents and acquire a job at the same time")
 		}
 
+		// Open the lifecycle event stream that all the workers share
+		eventStream, err := events.Open(cfg.EventStream)
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+		defer eventStream.Close()
+
 		var workers []*agent.AgentWorker
 
 		for i := 1; i <= cfg.Spawn; i++ {
@@ -911,6 +1081,7 @@ var AgentStartCommand = cli.Command{
 						Debug:              cfg.Debug,
 						DebugHTTP:          cfg.DebugHTTP,
 						SpawnIndex:         i,
+						Events:             eventStream,
 					}))
 		}
 
@@ -943,8 +1114,16 @@ var AgentStartCommand = cli.Command{
 				}
 			})
 
+			http.HandleFunc("/healthz", pool.ServeHealthz)
+			http.HandleFunc("/readyz", pool.ServeReadyz)
+
 			if experiments.IsEnabled("inbuilt-status-page") {
 				http.HandleFunc("/status", status.Handle)
+				http.HandleFunc("/status.json", status.HandleJSON)
+			}
+
+			if cfg.MetricsPrometheus && cfg.MetricsPrometheusAddr == "" {
+				http.Handle("/metrics", mc.Handler())
 			}
 
 			go func() {
@@ -960,6 +1139,57 @@ var AgentStartCommand = cli.Command{
 			}()
 		}
 
+		// Serve Prometheus metrics on their own address
+		if cfg.MetricsPrometheus && cfg.MetricsPrometheusAddr != "" {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", mc.Handler())
+
+			go func() {
+				_, setStatus, done := status.AddSimpleItem(ctx, "Prometheus metrics server")
+				defer done()
+				setStatus("👂 Listening")
+
+				l.Notice("Starting Prometheus metrics server on %v", cfg.MetricsPrometheusAddr)
+				err := http.ListenAndServe(cfg.MetricsPrometheusAddr, mux)
+				if err != nil {
+					l.Error("Could not start Prometheus metrics server: %v", err)
+				}
+			}()
+		}
+
+		// Listen for requests to pause, resume or cancel jobs
+		if cfg.ControlSocket != "" {
+			cs, err := agent.NewControlServer(l, pool, cfg.ControlSocket, cfg.ControlToken)
+			if err != nil {
+				l.Fatal("Could not start control server: %v", err)
+			}
+			defer cs.Close()
+
+			go func() {
+				_, setStatus, done := status.AddSimpleItem(ctx, "Control server")
+				defer done()
+				setStatus("👂 Listening")
+
+				l.Notice("Starting control server on %v", cfg.ControlSocket)
+				if err := cs.Serve(); err != nil {
+					l.Error("Control server failed: %v", err)
+				}
+			}()
+		}
+
+		// Look after the git mirrors in the background while the agents run
+		if cfg.GitMirrorsPath != "" && gitMirrorsMaintenanceInterval > 0 {
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			l.Info("Maintaining git mirrors in %s every %s", cfg.GitMirrorsPath, gitMirrorsMaintenanceInterval)
+			go agent.NewGitMirrorMaintainer(l, agent.GitMirrorMaintainerConfig{
+				MirrorsPath: cfg.GitMirrorsPath,
+				Interval:    gitMirrorsMaintenanceInterval,
+				MaxUnused:   time.Duration(cfg.GitMirrorsMaxUnusedDays) * 24 * time.Hour,
+			}).Start(ctx)
+		}
+
 		// Start the agent pool
 		if err := pool.Start(ctx); err != nil {
 			l.Fatal("%s", err)
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/buildkite/agent/v3/agent"
 	"github.com/buildkite/agent/v3/api"
@@ -46,14 +47,37 @@ Example:
 
    $ buildkite-agent artifact download "pkg/*.tar.gz" . --step "tests" --build xxx
 
-   You can also use the step's jobs id (provided by the environment variable $BUILDKITE_JOB_ID)`
+   You can also use the step's jobs id (provided by the environment variable $BUILDKITE_JOB_ID)
+
+   Paths can be rewritten as they're downloaded. For example, to download
+   'dist/linux/app' and 'dist/darwin/app' as 'linux/app' and 'darwin/app',
+   leaving out source maps:
+
+   $ buildkite-agent artifact download "dist/**/*" . --strip-components 1 --exclude "**/*.map"
+
+   When artifacts from more than one job would be downloaded to the same file,
+   the last one found is kept, and files that are already there are replaced.
+   Use --on-conflict skip to keep the first one and existing files instead, or
+   --on-conflict fail to stop.
+
+   Bundles uploaded with 'buildkite-agent artifact upload --bundle' are
+   unpacked into <destination>, unless --no-unpack is used.`
 
 type ArtifactDownloadConfig struct {
-	Query              string `cli:"arg:0" label:"artifact search query" validate:"required"`
-	Destination        string `cli:"arg:1" label:"artifact download path" validate:"required"`
-	Step               string `cli:"step"`
-	Build              string `cli:"build" validate:"required"`
-	IncludeRetriedJobs bool   `cli:"include-retried-jobs"`
+	Query              string   `cli:"arg:0" label:"artifact search query" validate:"required"`
+	Destination        string   `cli:"arg:1" label:"artifact download path" validate:"required"`
+	Step               string   `cli:"step"`
+	Build              string   `cli:"build" validate:"required"`
+	IncludeRetriedJobs bool     `cli:"include-retried-jobs"`
+	Exclude            []string `cli:"exclude" normalize:"list"`
+	StripComponents    int      `cli:"strip-components"`
+	Flatten            bool     `cli:"flatten"`
+	OnConflict         string   `cli:"on-conflict"`
+	NoUnpack           bool     `cli:"no-unpack"`
+	Verify             bool     `cli:"verify"`
+	DownloadTimeout    string   `cli:"download-timeout"`
+	CacheDir           string   `cli:"cache-dir" normalize:"filepath"`
+	ArtifactBackends   []string `cli:"artifact-backend" normalize:"list"`
 
 	// Global flags
 	Debug       bool     `cli:"debug"`
@@ -90,6 +114,49 @@ var ArtifactDownloadCommand = cli.Command{
 			EnvVar: "BUILDKITE_AGENT_INCLUDE_RETRIED_JOBS",
 			Usage:  "Include artifacts from retried jobs in the search",
 		},
+		cli.StringSliceFlag{
+			Name:   "exclude",
+			Value:  &cli.StringSlice{},
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_EXCLUDE",
+			Usage:  "Don't download artifacts with paths matching this glob, which can be given more than once",
+		},
+		cli.IntFlag{
+			Name:   "strip-components",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_STRIP_COMPONENTS",
+			Usage:  "Remove this many leading directories from the paths of artifacts, skipping artifacts that have no more than that",
+		},
+		cli.BoolFlag{
+			Name:   "flatten",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_FLATTEN",
+			Usage:  "Download every artifact into <destination> itself, without the directories in its path",
+		},
+		cli.StringFlag{
+			Name:   "on-conflict",
+			Value:  agent.ArtifactConflictOverwrite,
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_ON_CONFLICT",
+			Usage:  "What to do when more than one artifact would be downloaded to the same file, or the file already exists: overwrite, skip or fail",
+		},
+		cli.BoolFlag{
+			Name:   "no-unpack",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_NO_UNPACK",
+			Usage:  "Don't unpack bundles made by artifact upload --bundle",
+		},
+		cli.BoolFlag{
+			Name:   "verify",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_VERIFY",
+			Usage:  "Check downloaded artifacts against their SHA-256 (or SHA-1 if they don't have one), downloading them again if they don't match, and failing if they still don't",
+		},
+		cli.DurationFlag{
+			Name:   "download-timeout",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_TIMEOUT",
+			Usage:  "How long each attempt at downloading an artifact can take before it's retried, carrying on from where it got to (e.g. 10m). There's no limit by default",
+		},
+		cli.StringFlag{
+			Name:   "cache-dir",
+			EnvVar: "BUILDKITE_ARTIFACT_CACHE_DIR",
+			Usage:  "Keep downloaded artifacts in this directory by their SHA-256, and copy artifacts with the same content from it instead of downloading them again. Artifacts are checked against their SHA-256 before they're cached",
+		},
+		ArtifactBackendFlag,
 
 		// API Flags
 		AgentAccessTokenFlag,
@@ -128,6 +195,19 @@ var ArtifactDownloadCommand = cli.Command{
 		done := HandleGlobalFlags(l, cfg)
 		defer done()
 
+		if err := registerArtifactBackends(cfg.ArtifactBackends); err != nil {
+			l.Fatal("%s", err)
+		}
+
+		var downloadTimeout time.Duration
+		if t := cfg.DownloadTimeout; t != "" {
+			var err error
+			downloadTimeout, err = time.ParseDuration(t)
+			if err != nil {
+				l.Fatal("Failed to parse download timeout: %v", err)
+			}
+		}
+
 		// Create the API client
 		client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
 
@@ -138,6 +218,14 @@ var ArtifactDownloadCommand = cli.Command{
 			BuildID:            cfg.Build,
 			Step:               cfg.Step,
 			IncludeRetriedJobs: cfg.IncludeRetriedJobs,
+			Exclude:            cfg.Exclude,
+			StripComponents:    cfg.StripComponents,
+			Flatten:            cfg.Flatten,
+			OnConflict:         cfg.OnConflict,
+			NoUnpack:           cfg.NoUnpack,
+			Verify:             cfg.Verify,
+			DownloadTimeout:    downloadTimeout,
+			CacheDir:           cfg.CacheDir,
 			DebugHTTP:          cfg.DebugHTTP,
 		})
 
@@ -4,10 +4,12 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/buildkite/agent/v3/agent"
 	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/events"
 	"github.com/urfave/cli"
 )
 
@@ -23,8 +25,8 @@ Description:
    built-in shell path globbing will provide the files, which is currently not
    supported.
 
-   You can specify an alternate destination on Amazon S3, Google Cloud Storage
-   or Artifactory as per the examples below. This may be specified in the
+   You can specify an alternate destination on Amazon S3, Google Cloud Storage,
+   Azure Blob Storage or Artifactory as per the examples below. This may be specified in the
    'destination' argument, or in the 'BUILDKITE_ARTIFACT_UPLOAD_DESTINATION'
    environment variable.  Otherwise, artifacts are uploaded to a
    Buildkite-managed Amazon S3 bucket, where they’re retained for six months.
@@ -55,7 +57,47 @@ Example:
    $ export BUILDKITE_ARTIFACTORY_URL=http://my-artifactory-instance.com/artifactory
    $ export BUILDKITE_ARTIFACTORY_USER=carol-danvers
    $ export BUILDKITE_ARTIFACTORY_PASSWORD=xxx
-   $ buildkite-agent artifact upload "log/**/*.log" rt://name-of-your-artifactory-repo/$BUILDKITE_JOB_ID`
+   $ buildkite-agent artifact upload "log/**/*.log" rt://name-of-your-artifactory-repo/$BUILDKITE_JOB_ID
+
+   Or upload directly to Azure Blob Storage, authorizing with either a SAS token
+   or an account key:
+
+   $ export BUILDKITE_AZURE_BLOB_SAS_TOKEN="sv=...&sig=..." # or BUILDKITE_AZURE_BLOB_ACCOUNT_KEY=xxx
+   $ buildkite-agent artifact upload "log/**/*.log" az://your-storage-account/your-container/$BUILDKITE_JOB_ID
+
+   Or copy them into a directory, like a shared NFS volume, where they're kept
+   under the IDs of their build and job:
+
+   $ buildkite-agent artifact upload "log/**/*.log" file:///mnt/artifacts
+
+   Or upload anywhere else with a command of your own, which is also used to
+   download the artifacts again:
+
+   $ export BUILDKITE_ARTIFACT_BACKENDS=myobj=/usr/local/bin/myobj-artifacts
+   $ buildkite-agent artifact upload "log/**/*.log" myobj://name-of-your-bucket/$BUILDKITE_JOB_ID
+
+   Files can be left out with --exclude, or patterns in a .buildkiteignore file
+   in the working directory, and a manifest of what was uploaded written out:
+
+   $ buildkite-agent artifact upload "dist/**/*" --exclude "**/*.map" --manifest artifacts.json
+
+   Lots of small files are much quicker to upload bundled into one archive,
+   which 'buildkite-agent artifact download' unpacks again:
+
+   $ buildkite-agent artifact upload "coverage/**/*" --bundle coverage.tar.gz
+
+   Or each file can be gzipped, and uploaded with a Content-Encoding so that
+   it's decompressed when it's downloaded (S3, Google Cloud Storage and Azure
+   Blob Storage destinations only):
+
+   $ buildkite-agent artifact upload "log/**/*.log" s3://name-of-your-s3-bucket/$BUILDKITE_JOB_ID --gzip
+
+   Files that don't change between builds, like toolchains, can be copied
+   within the bucket from an earlier upload of the same content, by any job,
+   rather than uploaded again. A copy of each file is kept in the bucket's
+   sha256/ directory for this:
+
+   $ buildkite-agent artifact upload "toolchain/**/*" s3://name-of-your-s3-bucket/$BUILDKITE_JOB_ID --dedup`
 
 var FollowSymlinksFlag = cli.BoolFlag{
 	Name:   "follow-symlinks",
@@ -63,10 +105,33 @@ var FollowSymlinksFlag = cli.BoolFlag{
 	EnvVar: "BUILDKITE_AGENT_ARTIFACT_SYMLINKS",
 }
 
+var ArtifactBackendFlag = cli.StringSliceFlag{
+	Name:   "artifact-backend",
+	Value:  &cli.StringSlice{},
+	Usage:  "Upload and download artifacts with destinations of a URL scheme by running a command, given as scheme=command, e.g. \"myobj=/usr/local/bin/myobj-artifacts\", and split into arguments like a shell would. The command is run with \"upload <destination> <artifact path> <local file>\" or \"download <upload destination> <artifact path> <local file>\"",
+	EnvVar: "BUILDKITE_ARTIFACT_BACKENDS",
+}
+
+// registerArtifactBackends registers the external artifact backends given
+// with --artifact-backend
+func registerArtifactBackends(backends []string) error {
+	for _, b := range backends {
+		scheme, backend, err := agent.ParseExternalArtifactBackend(b)
+		if err != nil {
+			return err
+		}
+		if err := agent.RegisterArtifactBackend(scheme, backend); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type ArtifactUploadConfig struct {
 	UploadPaths string `cli:"arg:0" label:"upload paths" validate:"required"`
 	Destination string `cli:"arg:1" label:"destination" env:"BUILDKITE_ARTIFACT_UPLOAD_DESTINATION"`
 	Job         string `cli:"job" validate:"required"`
+	Build       string `cli:"build"`
 	ContentType string `cli:"content-type"`
 
 	// Global flags
@@ -83,7 +148,18 @@ type ArtifactUploadConfig struct {
 	NoHTTP2          bool   `cli:"no-http2"`
 
 	// Uploader flags
-	FollowSymlinks bool `cli:"follow-symlinks"`
+	FollowSymlinks   bool     `cli:"follow-symlinks"`
+	EventStream      string   `cli:"event-stream"`
+	EventRelay       string   `cli:"event-relay"`
+	ArtifactBackends []string `cli:"artifact-backend" normalize:"list"`
+	PartSize         int      `cli:"part-size"`
+	PartConcurrency  int      `cli:"part-concurrency"`
+	Bundle           string   `cli:"bundle"`
+	Gzip             bool     `cli:"gzip"`
+	Dedup            bool     `cli:"dedup"`
+	Exclude          []string `cli:"exclude" normalize:"list"`
+	IgnoreFile       string   `cli:"ignore-file" normalize:"filepath"`
+	Manifest         string   `cli:"manifest" normalize:"filepath"`
 }
 
 var ArtifactUploadCommand = cli.Command{
@@ -97,6 +173,12 @@ var ArtifactUploadCommand = cli.Command{
 			Usage:  "Which job should the artifacts be uploaded to",
 			EnvVar: "BUILDKITE_JOB_ID",
 		},
+		cli.StringFlag{
+			Name:   "build",
+			Value:  "",
+			Usage:  "Which build the job belongs to, which artifacts are kept under in file:// destinations",
+			EnvVar: "BUILDKITE_BUILD_ID",
+		},
 		cli.StringFlag{
 			Name:   "content-type",
 			Value:  "",
@@ -117,6 +199,61 @@ var ArtifactUploadCommand = cli.Command{
 		ExperimentsFlag,
 		ProfileFlag,
 		FollowSymlinksFlag,
+		cli.StringFlag{
+			Name:   "event-stream",
+			Usage:  "Write upload progress events as newline-delimited JSON to this file, or to a listening unix socket given as unix:///path/to/socket",
+			EnvVar: "BUILDKITE_AGENT_EVENT_STREAM",
+		},
+		cli.StringFlag{
+			Name:   "event-relay",
+			Usage:  "Where the agent running the job receives events to record metrics from, set by the agent",
+			EnvVar: "BUILDKITE_AGENT_EVENT_RELAY",
+			Hidden: true,
+		},
+		ArtifactBackendFlag,
+		cli.IntFlag{
+			Name:   "part-size",
+			Value:  agent.DefaultUploadPartSize,
+			Usage:  "Upload files larger than this many bytes in parts of this size, for S3 and Google Cloud Storage destinations. Parts that fail are retried without uploading the rest of the file again",
+			EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_PART_SIZE",
+		},
+		cli.IntFlag{
+			Name:   "part-concurrency",
+			Value:  agent.DefaultUploadPartConcurrency,
+			Usage:  "How many parts of each file to upload at once, for S3 destinations. Google Cloud Storage destinations upload parts one at a time, as they have to be sent in order",
+			EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_PART_CONCURRENCY",
+		},
+		cli.StringFlag{
+			Name:   "bundle",
+			Usage:  "Bundle the files into an archive with this name, ending in .zip, .tar.gz, .tgz or .tar.zst, and upload it instead of them. Bundles are unpacked by artifact download",
+			EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_BUNDLE",
+		},
+		cli.BoolFlag{
+			Name:   "gzip",
+			Usage:  "Gzip each file, and upload it with a Content-Encoding of gzip",
+			EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_GZIP",
+		},
+		cli.BoolFlag{
+			Name:   "dedup",
+			Usage:  "Copy files that have been uploaded to the bucket before with the same SHA-256, by any job, instead of uploading them again, for S3 and Google Cloud Storage destinations",
+			EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_DEDUP",
+		},
+		cli.StringSliceFlag{
+			Name:   "exclude",
+			Value:  &cli.StringSlice{},
+			Usage:  "Don't upload files with paths matching this glob, which can be given more than once",
+			EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_EXCLUDE",
+		},
+		cli.StringFlag{
+			Name:   "ignore-file",
+			Usage:  "Don't upload files matching the patterns in this file, which are like the patterns in a .gitignore (default: .buildkiteignore, if it exists)",
+			EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_IGNORE_FILE",
+		},
+		cli.StringFlag{
+			Name:   "manifest",
+			Usage:  "Write a JSON manifest of the uploaded artifacts, with their IDs, URLs, sizes and checksums, to this file",
+			EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_MANIFEST",
+		},
 	},
 	Action: func(c *cli.Context) {
 		ctx := context.Background()
@@ -142,17 +279,45 @@ var ArtifactUploadCommand = cli.Command{
 		done := HandleGlobalFlags(l, cfg)
 		defer done()
 
+		if err := registerArtifactBackends(cfg.ArtifactBackends); err != nil {
+			l.Fatal("%s", err)
+		}
+
+		// Only S3 uploads parts in parallel. Google Cloud Storage resumable
+		// uploads have to send their parts in order.
+		if c.IsSet("part-concurrency") && !strings.HasPrefix(cfg.Destination, "s3://") {
+			l.Warn("--part-concurrency only applies to S3 destinations, and will be ignored")
+		}
+
 		// Create the API client
 		client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
 
+		// Send progress to the lifecycle event stream, if there is one, and
+		// to the agent so that it can record metrics
+		eventStream, err := events.Open(cfg.EventStream, cfg.EventRelay)
+		if err != nil {
+			l.Warn("Upload progress events won't be written (%s)", err)
+		}
+		defer eventStream.Close()
+
 		// Setup the uploader
 		uploader := agent.NewArtifactUploader(l, client, agent.ArtifactUploaderConfig{
-			JobID:          cfg.Job,
-			Paths:          cfg.UploadPaths,
-			Destination:    cfg.Destination,
-			ContentType:    cfg.ContentType,
-			DebugHTTP:      cfg.DebugHTTP,
-			FollowSymlinks: cfg.FollowSymlinks,
+			JobID:           cfg.Job,
+			BuildID:         cfg.Build,
+			Paths:           cfg.UploadPaths,
+			Destination:     cfg.Destination,
+			ContentType:     cfg.ContentType,
+			DebugHTTP:       cfg.DebugHTTP,
+			FollowSymlinks:  cfg.FollowSymlinks,
+			PartSize:        int64(cfg.PartSize),
+			PartConcurrency: cfg.PartConcurrency,
+			Bundle:          cfg.Bundle,
+			Gzip:            cfg.Gzip,
+			Dedup:           cfg.Dedup,
+			Exclude:         cfg.Exclude,
+			IgnoreFile:      cfg.IgnoreFile,
+			Manifest:        cfg.Manifest,
+			Events:          eventStream.With("", cfg.Job),
 		})
 
 		// Upload the artifacts
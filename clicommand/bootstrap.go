@@ -64,6 +64,12 @@ type BootstrapConfig struct {
 	CleanCheckout                bool     `cli:"clean-checkout"`
 	GitCloneFlags                string   `cli:"git-clone-flags"`
 	GitFetchFlags                string   `cli:"git-fetch-flags"`
+	GitCloneDepth                int      `cli:"git-clone-depth"`
+	GitSparseCheckoutPaths       string   `cli:"git-sparse-checkout-paths"`
+	GitLFS                       bool     `cli:"git-lfs"`
+	GitLFSInclude                string   `cli:"git-lfs-include"`
+	GitLFSExclude                string   `cli:"git-lfs-exclude"`
+	GitLFSSkipSmudge             bool     `cli:"git-lfs-skip-smudge"`
 	GitCloneMirrorFlags          string   `cli:"git-clone-mirror-flags"`
 	GitCleanFlags                string   `cli:"git-clean-flags"`
 	GitMirrorsPath               string   `cli:"git-mirrors-path" normalize:"filepath"`
@@ -90,6 +96,7 @@ type BootstrapConfig struct {
 	RedactedVars                 []string `cli:"redacted-vars" normalize:"list"`
 	TracingBackend               string   `cli:"tracing-backend"`
 	TracingServiceName           string   `cli:"tracing-service-name"`
+	EventStream                  string   `cli:"event-stream"`
 }
 
 var BootstrapCommand = cli.Command{
@@ -222,6 +229,40 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Flags to pass to \"git fetch\" command",
 			EnvVar: "BUILDKITE_GIT_FETCH_FLAGS",
 		},
+		cli.IntFlag{
+			Name:   "git-clone-depth",
+			Value:  0,
+			Usage:  "How many commits of history to clone and fetch, or 0 for all of it. More history is fetched if the commit isn't included",
+			EnvVar: "BUILDKITE_GIT_CLONE_DEPTH",
+		},
+		cli.StringFlag{
+			Name:   "git-sparse-checkout-paths",
+			Value:  "",
+			Usage:  "Comma separated directories to limit the checkout to, using a sparse checkout and a partial clone",
+			EnvVar: "BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS",
+		},
+		cli.BoolFlag{
+			Name:   "git-lfs",
+			Usage:  "Fetch the Git LFS objects of the commit in one go after checking it out, sharing them through the git mirror if there is one",
+			EnvVar: "BUILDKITE_GIT_LFS",
+		},
+		cli.StringFlag{
+			Name:   "git-lfs-include",
+			Value:  "",
+			Usage:  "Comma separated patterns of the files to fetch Git LFS objects for, with --git-lfs",
+			EnvVar: "BUILDKITE_GIT_LFS_INCLUDE",
+		},
+		cli.StringFlag{
+			Name:   "git-lfs-exclude",
+			Value:  "",
+			Usage:  "Comma separated patterns of the files not to fetch Git LFS objects for, with --git-lfs",
+			EnvVar: "BUILDKITE_GIT_LFS_EXCLUDE",
+		},
+		cli.BoolFlag{
+			Name:   "git-lfs-skip-smudge",
+			Usage:  "Leave Git LFS pointer files in the checkout instead of downloading their objects",
+			EnvVar: "BUILDKITE_GIT_LFS_SKIP_SMUDGE",
+		},
 		cli.StringSliceFlag{
 			Name:   "git-submodule-clone-config",
 			Value:  &cli.StringSlice{},
@@ -343,6 +384,11 @@ var BootstrapCommand = cli.Command{
 			EnvVar: "BUILDKITE_TRACING_SERVICE_NAME",
 			Value:  "buildkite-agent",
 		},
+		cli.StringFlag{
+			Name:   "event-stream",
+			Usage:  "Write lifecycle events as newline-delimited JSON to this file, or to a listening unix socket given as unix:///path/to/socket",
+			EnvVar: "BUILDKITE_AGENT_EVENT_STREAM",
+		},
 		DebugFlag,
 		LogLevelFlag,
 		ExperimentsFlag,
@@ -414,6 +460,12 @@ var BootstrapCommand = cli.Command{
 			GitCloneFlags:                cfg.GitCloneFlags,
 			GitCloneMirrorFlags:          cfg.GitCloneMirrorFlags,
 			GitFetchFlags:                cfg.GitFetchFlags,
+			GitCloneDepth:                cfg.GitCloneDepth,
+			GitSparseCheckoutPaths:       cfg.GitSparseCheckoutPaths,
+			GitLFS:                       cfg.GitLFS,
+			GitLFSInclude:                cfg.GitLFSInclude,
+			GitLFSExclude:                cfg.GitLFSExclude,
+			GitLFSSkipSmudge:             cfg.GitLFSSkipSmudge,
 			GitMirrorsLockTimeout:        cfg.GitMirrorsLockTimeout,
 			GitMirrorsPath:               cfg.GitMirrorsPath,
 			GitMirrorsSkipUpdate:         cfg.GitMirrorsSkipUpdate,
@@ -442,6 +494,7 @@ var BootstrapCommand = cli.Command{
 			Tag:                          cfg.Tag,
 			TracingBackend:               cfg.TracingBackend,
 			TracingServiceName:           cfg.TracingServiceName,
+			EventStream:                  cfg.EventStream,
 		})
 
 		ctx, cancel := context.WithCancel(context.Background())
@@ -169,21 +169,9 @@ var PipelineUploadCommand = cli.Command{
 		} else {
 			l.Info("Searching for pipeline config...")
 
-			paths := []string{
-				"buildkite.yml",
-				"buildkite.yaml",
-				"buildkite.json",
-				filepath.FromSlash(".buildkite/pipeline.yml"),
-				filepath.FromSlash(".buildkite/pipeline.yaml"),
-				filepath.FromSlash(".buildkite/pipeline.json"),
-				filepath.FromSlash("buildkite/pipeline.yml"),
-				filepath.FromSlash("buildkite/pipeline.yaml"),
-				filepath.FromSlash("buildkite/pipeline.json"),
-			}
-
 			// Collect all the files that exist
 			exists := []string{}
-			for _, path := range paths {
+			for _, path := range defaultPipelinePaths() {
 				if _, err := os.Stat(path); err == nil {
 					exists = append(exists, path)
 				}
@@ -333,3 +321,19 @@ var PipelineUploadCommand = cli.Command{
 		l.Info("Successfully uploaded and parsed pipeline config")
 	},
 }
+
+// defaultPipelinePaths are the files searched for a pipeline when one isn't
+// given, in order of preference
+func defaultPipelinePaths() []string {
+	return []string{
+		"buildkite.yml",
+		"buildkite.yaml",
+		"buildkite.json",
+		filepath.FromSlash(".buildkite/pipeline.yml"),
+		filepath.FromSlash(".buildkite/pipeline.yaml"),
+		filepath.FromSlash(".buildkite/pipeline.json"),
+		filepath.FromSlash("buildkite/pipeline.yml"),
+		filepath.FromSlash("buildkite/pipeline.yaml"),
+		filepath.FromSlash("buildkite/pipeline.json"),
+	}
+}
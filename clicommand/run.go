@@ -0,0 +1,819 @@
+package clicommand
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/env"
+	"github.com/buildkite/agent/v3/metrics"
+	"github.com/buildkite/agent/v3/process"
+	"github.com/buildkite/shellwords"
+	"github.com/urfave/cli"
+)
+
+var RunHelpDescription = `Usage:
+
+   buildkite-agent run [pipeline] [options...]
+
+Description:
+
+   Runs a single step of a pipeline on this machine, without connecting to
+   Buildkite. The step is run by the bootstrap in the same way as a job
+   dispatched by Buildkite, so hooks, plugins and the checkout all apply, but
+   the job log is written to the terminal.
+
+   Meta-data, annotations, artifacts and pipeline uploads made by the job are
+   recorded to a directory (see --record-path) instead of being sent to
+   Buildkite.
+
+   If no pipeline file is given, the same default locations as
+   "buildkite-agent pipeline upload" are searched. The step to run is chosen
+   with --step, which matches a step's key or label. Alternatively, a single
+   command can be run with --command.
+
+   By default the repository is the git repository of the current directory,
+   at its current HEAD commit. Uncommitted changes won't be in the checkout.
+
+Example:
+
+   $ buildkite-agent run --step "tests"
+   $ buildkite-agent run .buildkite/release.yml --step publish --env DRY_RUN=true
+   $ buildkite-agent run --command "make test" --hooks-path ./hooks`
+
+type RunConfig struct {
+	Config            string   `cli:"config"`
+	PipelineFile      string   `cli:"arg:0" label:"pipeline file"`
+	Step              string   `cli:"step"`
+	Command           string   `cli:"command"`
+	Env               []string `cli:"env" normalize:"list"`
+	Repository        string   `cli:"repository"`
+	Commit            string   `cli:"commit"`
+	Branch            string   `cli:"branch"`
+	Phases            []string `cli:"phases" normalize:"list"`
+	Name              string   `cli:"name"`
+	RecordPath        string   `cli:"record-path" normalize:"filepath"`
+	BootstrapScript   string   `cli:"bootstrap-script" normalize:"commandpath"`
+	BuildPath         string   `cli:"build-path" normalize:"filepath"`
+	HooksPath         string   `cli:"hooks-path" normalize:"filepath"`
+	PluginsPath       string   `cli:"plugins-path" normalize:"filepath"`
+	GitMirrorsPath    string   `cli:"git-mirrors-path" normalize:"filepath"`
+	GitCloneFlags     string   `cli:"git-clone-flags"`
+	GitCleanFlags     string   `cli:"git-clean-flags"`
+	GitFetchFlags     string   `cli:"git-fetch-flags"`
+	GitCloneDepth     int      `cli:"git-clone-depth"`
+	GitSparsePaths    string   `cli:"git-sparse-checkout-paths"`
+	GitLFS            bool     `cli:"git-lfs"`
+	GitLFSInclude     string   `cli:"git-lfs-include"`
+	GitLFSExclude     string   `cli:"git-lfs-exclude"`
+	GitLFSSkipSmudge  bool     `cli:"git-lfs-skip-smudge"`
+	Shell             string   `cli:"shell"`
+	CancelGracePeriod int      `cli:"cancel-grace-period"`
+	CancelSignal      string   `cli:"cancel-signal"`
+	NoPTY             bool     `cli:"no-pty"`
+	NoPlugins         bool     `cli:"no-plugins"`
+	NoLocalHooks      bool     `cli:"no-local-hooks"`
+	NoGitSubmodules   bool     `cli:"no-git-submodules"`
+	RedactedVars      []string `cli:"redacted-vars" normalize:"list"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var RunCommand = cli.Command{
+	Name:        "run",
+	Usage:       "Run a pipeline step locally, without Buildkite",
+	Description: RunHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Value:  "",
+			Usage:  "Path to an agent configuration file, which hooks, plugins and git settings are read from",
+			EnvVar: "BUILDKITE_AGENT_CONFIG",
+		},
+		cli.StringFlag{
+			Name:  "step",
+			Value: "",
+			Usage: "The key or label of the step to run. Not needed if the pipeline has exactly one command step",
+		},
+		cli.StringFlag{
+			Name:  "command",
+			Value: "",
+			Usage: "A command to run instead of a step from a pipeline",
+		},
+		cli.StringSliceFlag{
+			Name:  "env",
+			Value: &cli.StringSlice{},
+			Usage: "Additional environment for the job, as KEY=VALUE pairs",
+		},
+		cli.StringFlag{
+			Name:  "repository",
+			Value: "",
+			Usage: "The repository to check out, defaults to the git repository of the current directory",
+		},
+		cli.StringFlag{
+			Name:  "commit",
+			Value: "",
+			Usage: "The commit to check out, defaults to the current HEAD",
+		},
+		cli.StringFlag{
+			Name:  "branch",
+			Value: "",
+			Usage: "The branch of the commit, defaults to the current branch",
+		},
+		cli.StringSliceFlag{
+			Name:  "phases",
+			Value: &cli.StringSlice{},
+			Usage: "The bootstrap phases to run (plugin, checkout or command), defaults to all of them",
+		},
+		cli.StringFlag{
+			Name:  "name",
+			Value: "local",
+			Usage: "The agent name to present to the job",
+		},
+		cli.StringFlag{
+			Name:  "record-path",
+			Value: filepath.Join(os.TempDir(), "buildkite-agent-run", "records"),
+			Usage: "Directory where meta-data, annotations, artifacts and pipeline uploads are recorded, in a sub-directory per job",
+		},
+		cli.StringFlag{
+			Name:   "bootstrap-script",
+			Value:  "",
+			Usage:  "The command that is executed for bootstrapping a job, defaults to the bootstrap sub-command of this binary",
+			EnvVar: "BUILDKITE_BOOTSTRAP_SCRIPT_PATH",
+		},
+		cli.StringFlag{
+			Name:  "build-path",
+			Value: filepath.Join(os.TempDir(), "buildkite-agent-run", "builds"),
+			Usage: "Path to where the builds will run from",
+		},
+		cli.StringFlag{
+			Name:   "hooks-path",
+			Value:  "",
+			Usage:  "Directory where the hook scripts are found",
+			EnvVar: "BUILDKITE_HOOKS_PATH",
+		},
+		cli.StringFlag{
+			Name:  "plugins-path",
+			Value: filepath.Join(os.TempDir(), "buildkite-agent-run", "plugins"),
+			Usage: "Directory where the plugins are saved to",
+		},
+		cli.StringFlag{
+			Name:   "git-mirrors-path",
+			Value:  "",
+			Usage:  "Path to where mirrors of git repositories are stored",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_PATH",
+		},
+		cli.StringFlag{
+			Name:   "git-clone-flags",
+			Value:  "-v",
+			Usage:  "Flags to pass to the \"git clone\" command",
+			EnvVar: "BUILDKITE_GIT_CLONE_FLAGS",
+		},
+		cli.StringFlag{
+			Name:   "git-clean-flags",
+			Value:  "-ffxdq",
+			Usage:  "Flags to pass to \"git clean\" command",
+			EnvVar: "BUILDKITE_GIT_CLEAN_FLAGS",
+		},
+		cli.StringFlag{
+			Name:   "git-fetch-flags",
+			Value:  "-v --prune",
+			Usage:  "Flags to pass to \"git fetch\" command",
+			EnvVar: "BUILDKITE_GIT_FETCH_FLAGS",
+		},
+		cli.IntFlag{
+			Name:   "git-clone-depth",
+			Value:  0,
+			Usage:  "How many commits of history to clone and fetch, or 0 for all of it. More history is fetched if the commit isn't included. Can be overridden per job with BUILDKITE_GIT_CLONE_DEPTH",
+			EnvVar: "BUILDKITE_GIT_CLONE_DEPTH",
+		},
+		cli.StringFlag{
+			Name:   "git-sparse-checkout-paths",
+			Value:  "",
+			Usage:  "Comma separated directories to limit checkouts to, using a sparse checkout and a partial clone. Can be overridden per job with BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS",
+			EnvVar: "BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS",
+		},
+		cli.BoolFlag{
+			Name:   "git-lfs",
+			Usage:  "Fetch the Git LFS objects of the commit in one go after checking it out, sharing them through the git mirror if there is one. Can be overridden per job with BUILDKITE_GIT_LFS",
+			EnvVar: "BUILDKITE_GIT_LFS",
+		},
+		cli.StringFlag{
+			Name:   "git-lfs-include",
+			Value:  "",
+			Usage:  "Comma separated patterns of the files to fetch Git LFS objects for, with --git-lfs. Can be overridden per job with BUILDKITE_GIT_LFS_INCLUDE",
+			EnvVar: "BUILDKITE_GIT_LFS_INCLUDE",
+		},
+		cli.StringFlag{
+			Name:   "git-lfs-exclude",
+			Value:  "",
+			Usage:  "Comma separated patterns of the files not to fetch Git LFS objects for, with --git-lfs. Can be overridden per job with BUILDKITE_GIT_LFS_EXCLUDE",
+			EnvVar: "BUILDKITE_GIT_LFS_EXCLUDE",
+		},
+		cli.BoolFlag{
+			Name:   "git-lfs-skip-smudge",
+			Usage:  "Leave Git LFS pointer files in the checkout instead of downloading their objects. Can be overridden per job with BUILDKITE_GIT_LFS_SKIP_SMUDGE",
+			EnvVar: "BUILDKITE_GIT_LFS_SKIP_SMUDGE",
+		},
+		cli.StringFlag{
+			Name:   "shell",
+			Value:  DefaultShell(),
+			Usage:  "The shell command used to interpret build commands, e.g /bin/bash -e -c",
+			EnvVar: "BUILDKITE_SHELL",
+		},
+		cli.IntFlag{
+			Name:   "cancel-grace-period",
+			Value:  10,
+			Usage:  "The number of seconds a canceled job is given to gracefully terminate",
+			EnvVar: "BUILDKITE_CANCEL_GRACE_PERIOD",
+		},
+		cli.StringFlag{
+			Name:   "cancel-signal",
+			Usage:  "The signal to use for cancellation",
+			EnvVar: "BUILDKITE_CANCEL_SIGNAL",
+			Value:  "SIGTERM",
+		},
+		cli.BoolFlag{
+			Name:   "no-pty",
+			Usage:  "Do not run jobs within a pseudo terminal",
+			EnvVar: "BUILDKITE_NO_PTY",
+		},
+		cli.BoolFlag{
+			Name:   "no-plugins",
+			Usage:  "Don't allow this agent to load plugins",
+			EnvVar: "BUILDKITE_NO_PLUGINS",
+		},
+		cli.BoolFlag{
+			Name:   "no-local-hooks",
+			Usage:  "Don't allow local hooks to be run from checked out repositories",
+			EnvVar: "BUILDKITE_NO_LOCAL_HOOKS",
+		},
+		cli.BoolFlag{
+			Name:   "no-git-submodules",
+			Usage:  "Don't automatically checkout git submodules",
+			EnvVar: "BUILDKITE_NO_GIT_SUBMODULES,BUILDKITE_DISABLE_GIT_SUBMODULES",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+		RedactedVars,
+	},
+	Action: func(c *cli.Context) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// The configuration will be loaded into this struct
+		cfg := RunConfig{}
+
+		loader := cliconfig.Loader{
+			CLI:                    c,
+			Config:                 &cfg,
+			DefaultConfigFilePaths: DefaultConfigFilePaths(),
+		}
+		warnings, err := loader.Load()
+		if err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		l := CreateLogger(&cfg)
+
+		// Now that we have a logger, log out the warnings that loading config generated
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		// Remove any config env from the environment to prevent them propagating to bootstrap
+		if err := UnsetConfigFromEnvironment(c); err != nil {
+			fmt.Printf("%s", err)
+			os.Exit(1)
+		}
+
+		// Work out the code the job will check out
+		if err := resolveLocalRepository(&cfg); err != nil {
+			l.Fatal("%s", err)
+		}
+
+		// Work out what the job will run
+		var step *localStep
+		var pipelineEnv map[string]string
+		if cfg.Command != "" {
+			step = &localStep{Label: cfg.Command, Command: cfg.Command}
+		} else {
+			filename, input, err := readLocalPipeline(cfg.PipelineFile)
+			if err != nil {
+				l.Fatal("%s", err)
+			}
+
+			l.Info("Reading pipeline from %q", filename)
+
+			result, err := agent.PipelineParser{
+				Env:      env.FromSlice(os.Environ()),
+				Filename: filepath.Base(filename),
+				Pipeline: input,
+			}.Parse()
+			if err != nil {
+				l.Fatal("Pipeline parsing of %q failed (%s)", filename, err)
+			}
+
+			parsed, err := result.MarshalJSON()
+			if err != nil {
+				l.Fatal("%s", err)
+			}
+
+			var steps []*localStep
+			steps, pipelineEnv, err = parseLocalSteps(parsed)
+			if err != nil {
+				l.Fatal("%s", err)
+			}
+
+			step, err = selectLocalStep(steps, cfg.Step)
+			if err != nil {
+				l.Fatal("%s", err)
+			}
+		}
+
+		jobID := api.NewUUID()
+		job := &api.Job{
+			ID:                 jobID,
+			ChunksMaxSizeBytes: 100 * 1024,
+			Env:                localJobEnv(cfg, jobID, step, pipelineEnv),
+		}
+
+		for _, kv := range cfg.Env {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				l.Fatal("Invalid --env %q, expected KEY=VALUE", kv)
+			}
+			job.Env[k] = v
+		}
+
+		// Set a useful default for the bootstrap script
+		if cfg.BootstrapScript == "" {
+			exePath, err := os.Executable()
+			if err != nil {
+				l.Fatal("Unable to find executable path for bootstrap")
+			}
+			cfg.BootstrapScript = fmt.Sprintf("%s bootstrap", shellwords.Quote(exePath))
+		}
+
+		if runtime.GOOS == "windows" {
+			cfg.NoPTY = true
+		}
+
+		cancelSig, err := process.ParseSignal(cfg.CancelSignal)
+		if err != nil {
+			l.Fatal("Failed to parse cancel-signal: %v", err)
+		}
+
+		// Actual file permissions will be reduced by umask, and won't be 0777 unless the user has manually changed the umask to 000
+		if err := os.MkdirAll(cfg.BuildPath, 0777); err != nil {
+			l.Fatal("Failed to create builds path: %v", err)
+		}
+
+		// Commands run by the job, such as `buildkite-agent meta-data set`,
+		// talk to the local client over loopback HTTP
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			l.Fatal("Failed to listen for API requests from the job: %v", err)
+		}
+		defer listener.Close()
+
+		recordPath := filepath.Join(cfg.RecordPath, job.ID)
+		client, err := agent.NewLocalAPIClient(l, agent.LocalAPIClientConfig{
+			Job:      job,
+			Dir:      recordPath,
+			Output:   os.Stdout,
+			Endpoint: fmt.Sprintf("http://%s/", listener.Addr()),
+			Token:    api.NewUUID(),
+		})
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+
+		go func() {
+			if err := http.Serve(listener, client); err != nil && !errors.Is(err, net.ErrClosed) {
+				l.Error("Local API server stopped: %v", err)
+			}
+		}()
+
+		ag, _, err := client.Register(ctx, &api.AgentRegisterRequest{Name: cfg.Name})
+		if err != nil {
+			l.Fatal("Failed to register with the local API server: %v", err)
+		}
+
+		jr, err := agent.NewJobRunner(l, metrics.NewCollector(l, metrics.CollectorConfig{}).Scope(metrics.Tags{}), ag, job, client, agent.JobRunnerConfig{
+			Debug:        cfg.Debug,
+			CancelSignal: cancelSig,
+			AgentConfiguration: agent.AgentConfiguration{
+				BootstrapScript:        cfg.BootstrapScript,
+				BuildPath:              cfg.BuildPath,
+				HooksPath:              cfg.HooksPath,
+				PluginsPath:            cfg.PluginsPath,
+				GitMirrorsPath:         cfg.GitMirrorsPath,
+				GitCloneFlags:          cfg.GitCloneFlags,
+				GitCleanFlags:          cfg.GitCleanFlags,
+				GitFetchFlags:          cfg.GitFetchFlags,
+				GitCloneDepth:          cfg.GitCloneDepth,
+				GitSparseCheckoutPaths: cfg.GitSparsePaths,
+				GitLFS:                 cfg.GitLFS,
+				GitLFSInclude:          cfg.GitLFSInclude,
+				GitLFSExclude:          cfg.GitLFSExclude,
+				GitLFSSkipSmudge:       cfg.GitLFSSkipSmudge,
+				GitSubmodules:          !cfg.NoGitSubmodules,
+				CommandEval:            true,
+				PluginsEnabled:         !cfg.NoPlugins,
+				LocalHooksEnabled:      !cfg.NoLocalHooks,
+				RunInPty:               !cfg.NoPTY,
+				CancelGracePeriod:      cfg.CancelGracePeriod,
+				Shell:                  cfg.Shell,
+				RedactedVars:           cfg.RedactedVars,
+			},
+		})
+		if err != nil {
+			l.Fatal("Failed to initialize job: %v", err)
+		}
+
+		// Cancel the job on the first signal, the same as the job being
+		// cancelled in Buildkite
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(signals)
+
+		go func() {
+			if _, ok := <-signals; ok {
+				l.Info("Cancelling job, send again to exit immediately")
+				client.Cancel()
+				signal.Stop(signals)
+			}
+		}()
+
+		l.Info("Running %q in %s", step.Label, cfg.BuildPath)
+
+		if err := jr.Run(ctx); err != nil {
+			l.Fatal("Failed to run job: %v", err)
+		}
+
+		l.Info("Meta-data, annotations, artifacts and pipelines were recorded to %s", recordPath)
+
+		exitStatus, err := strconv.Atoi(client.ExitStatus())
+		if err != nil || exitStatus < 0 {
+			exitStatus = 1
+		}
+		if exitStatus != 0 {
+			l.Error("Job exited with status %d", exitStatus)
+		}
+		os.Exit(exitStatus)
+	},
+}
+
+// localStep is the part of a command step needed to run it as a job
+type localStep struct {
+	Key           string
+	Label         string
+	Command       string
+	Env           map[string]string
+	Plugins       string
+	ArtifactPaths string
+}
+
+// pipelineStep is how a step appears in a parsed pipeline. Only command steps
+// and groups are of interest, everything else is skipped.
+type pipelineStep struct {
+	Key           string            `json:"key"`
+	Identifier    string            `json:"identifier"`
+	ID            string            `json:"id"`
+	Label         string            `json:"label"`
+	Name          string            `json:"name"`
+	Command       json.RawMessage   `json:"command"`
+	Commands      json.RawMessage   `json:"commands"`
+	Env           map[string]any    `json:"env"`
+	Plugins       json.RawMessage   `json:"plugins"`
+	ArtifactPaths json.RawMessage   `json:"artifact_paths"`
+	Steps         []json.RawMessage `json:"steps"`
+}
+
+// parseLocalSteps returns the command steps of a parsed pipeline, flattening
+// any groups, along with the pipeline level env
+func parseLocalSteps(pipeline []byte) ([]*localStep, map[string]string, error) {
+	var top struct {
+		Env   map[string]any    `json:"env"`
+		Steps []json.RawMessage `json:"steps"`
+	}
+	if err := json.Unmarshal(pipeline, &top); err != nil {
+		return nil, nil, fmt.Errorf("Failed to read steps from pipeline: %v", err)
+	}
+
+	steps, err := collectLocalSteps(top.Steps)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return steps, stringifyEnv(top.Env), nil
+}
+
+func collectLocalSteps(raw []json.RawMessage) ([]*localStep, error) {
+	var steps []*localStep
+
+	for _, r := range raw {
+		// Steps like "wait" can be plain strings
+		if bytes.HasPrefix(bytes.TrimSpace(r), []byte(`"`)) {
+			continue
+		}
+
+		var ps pipelineStep
+		if err := json.Unmarshal(r, &ps); err != nil {
+			return nil, fmt.Errorf("Failed to read step: %v", err)
+		}
+
+		if ps.Steps != nil {
+			nested, err := collectLocalSteps(ps.Steps)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, nested...)
+			continue
+		}
+
+		// Only command steps (which may be plugins alone) can be run
+		if ps.Command == nil && ps.Commands == nil && ps.Plugins == nil {
+			continue
+		}
+
+		commands, err := stringOrList(ps.Command)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read step command: %v", err)
+		}
+		moreCommands, err := stringOrList(ps.Commands)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read step commands: %v", err)
+		}
+		artifactPaths, err := stringOrList(ps.ArtifactPaths)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read step artifact_paths: %v", err)
+		}
+		plugins, err := pluginsAsList(ps.Plugins)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read step plugins: %v", err)
+		}
+
+		step := &localStep{
+			Key:           firstNonEmpty(ps.Key, ps.Identifier, ps.ID),
+			Label:         firstNonEmpty(ps.Label, ps.Name),
+			Command:       strings.Join(append(commands, moreCommands...), "\n"),
+			Env:           stringifyEnv(ps.Env),
+			Plugins:       plugins,
+			ArtifactPaths: strings.Join(artifactPaths, agent.ArtifactPathDelimiter),
+		}
+		if step.Label == "" {
+			step.Label = firstNonEmpty(step.Key, step.Command)
+		}
+
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+// selectLocalStep finds the step with the given key or label. With no name,
+// the only step is chosen.
+func selectLocalStep(steps []*localStep, name string) (*localStep, error) {
+	if len(steps) == 0 {
+		return nil, errors.New("The pipeline has no command steps to run")
+	}
+
+	if name == "" {
+		if len(steps) == 1 {
+			return steps[0], nil
+		}
+		return nil, fmt.Errorf("The pipeline has %d command steps, choose one to run with --step: %s", len(steps), describeLocalSteps(steps))
+	}
+
+	var matches []*localStep
+	for _, step := range steps {
+		if step.Key == name || step.Label == name {
+			matches = append(matches, step)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("No step matches %q, the command steps are: %s", name, describeLocalSteps(steps))
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, fmt.Errorf("%d steps match %q, give each step a unique key to choose between them", len(matches), name)
+	}
+}
+
+func describeLocalSteps(steps []*localStep) string {
+	names := make([]string, 0, len(steps))
+	for _, step := range steps {
+		if step.Key != "" {
+			names = append(names, fmt.Sprintf("%q (key %q)", step.Label, step.Key))
+		} else {
+			names = append(names, fmt.Sprintf("%q", step.Label))
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// localJobEnv is the env that Buildkite would have sent with the job
+func localJobEnv(cfg RunConfig, jobID string, step *localStep, pipelineEnv map[string]string) map[string]string {
+	jobEnv := map[string]string{}
+
+	for k, v := range pipelineEnv {
+		jobEnv[k] = v
+	}
+	for k, v := range step.Env {
+		jobEnv[k] = v
+	}
+
+	for k, v := range map[string]string{
+		"CI":                          "true",
+		"BUILDKITE":                   "true",
+		"BUILDKITE_SOURCE":            "local",
+		"BUILDKITE_JOB_ID":            jobID,
+		"BUILDKITE_BUILD_ID":          api.NewUUID(),
+		"BUILDKITE_BUILD_NUMBER":      "1",
+		"BUILDKITE_STEP_ID":           api.NewUUID(),
+		"BUILDKITE_STEP_KEY":          step.Key,
+		"BUILDKITE_LABEL":             step.Label,
+		"BUILDKITE_COMMAND":           step.Command,
+		"BUILDKITE_PLUGINS":           step.Plugins,
+		"BUILDKITE_ARTIFACT_PATHS":    step.ArtifactPaths,
+		"BUILDKITE_AGENT_NAME":        cfg.Name,
+		"BUILDKITE_ORGANIZATION_SLUG": "local",
+		"BUILDKITE_PIPELINE_SLUG":     "local",
+		"BUILDKITE_PIPELINE_PROVIDER": "git",
+		"BUILDKITE_REPO":              cfg.Repository,
+		"BUILDKITE_COMMIT":            cfg.Commit,
+		"BUILDKITE_BRANCH":            cfg.Branch,
+		"BUILDKITE_PULL_REQUEST":      "false",
+	} {
+		jobEnv[k] = v
+	}
+
+	if len(cfg.Phases) > 0 {
+		jobEnv["BUILDKITE_BOOTSTRAP_PHASES"] = strings.Join(cfg.Phases, ",")
+	}
+
+	return jobEnv
+}
+
+// resolveLocalRepository defaults the repository, commit and branch to those
+// of the git repository in the current directory
+func resolveLocalRepository(cfg *RunConfig) error {
+	gitOutput := func(args ...string) (string, error) {
+		out, err := exec.Command("git", args...).Output()
+		if err != nil {
+			return "", fmt.Errorf("Failed to run git %s, use --repository, --commit and --branch if this isn't a git repository (%v)", strings.Join(args, " "), err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	var err error
+	if cfg.Repository == "" {
+		if cfg.Repository, err = gitOutput("rev-parse", "--show-toplevel"); err != nil {
+			return err
+		}
+	}
+	if cfg.Commit == "" {
+		if cfg.Commit, err = gitOutput("rev-parse", "HEAD"); err != nil {
+			return err
+		}
+	}
+	if cfg.Branch == "" {
+		if cfg.Branch, err = gitOutput("rev-parse", "--abbrev-ref", "HEAD"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readLocalPipeline reads the given pipeline file, or the first one found in
+// the default locations
+func readLocalPipeline(path string) (string, []byte, error) {
+	if path == "" {
+		for _, p := range defaultPipelinePaths() {
+			if _, err := os.Stat(p); err == nil {
+				path = p
+				break
+			}
+		}
+		if path == "" {
+			return "", nil, errors.New("Could not find a default pipeline configuration file. Give the path to a pipeline file, or use --command.")
+		}
+	}
+
+	input, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to read file %q (%v)", path, err)
+	}
+	if len(input) == 0 {
+		return "", nil, fmt.Errorf("Pipeline file %q is empty", path)
+	}
+
+	return path, input, nil
+}
+
+// stringOrList decodes a JSON value that is either a string or a list of
+// strings
+func stringOrList(raw json.RawMessage) ([]string, error) {
+	if raw == nil {
+		return nil, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return []string{s}, nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// pluginsAsList returns plugins as the JSON list that BUILDKITE_PLUGINS
+// holds. Pipelines can also give plugins as a map, which is converted to a
+// list in the same order.
+func pluginsAsList(raw json.RawMessage) (string, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	if raw[0] != '{' {
+		return string(raw), nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if _, err := dec.Token(); err != nil {
+		return "", err
+	}
+
+	plugins := []map[string]json.RawMessage{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return "", err
+		}
+
+		var config json.RawMessage
+		if err := dec.Decode(&config); err != nil {
+			return "", err
+		}
+
+		plugins = append(plugins, map[string]json.RawMessage{tok.(string): config})
+	}
+
+	b, err := json.Marshal(plugins)
+	return string(b), err
+}
+
+func stringifyEnv(in map[string]any) map[string]string {
+	out := make(map[string]string, len(in))
+	for k, v := range in {
+		out[k] = fmt.Sprint(v)
+	}
+	return out
+}
+
+func firstNonEmpty(s ...string) string {
+	for _, v := range s {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
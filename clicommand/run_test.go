@@ -0,0 +1,76 @@
+package clicommand
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLocalSteps(t *testing.T) {
+	pipeline := []byte(`{
+		"env": {"FOO": "bar", "COUNT": 2},
+		"steps": [
+			{"label": "tests", "key": "tests", "command": ["make deps", "make test"], "artifact_paths": ["a.txt", "b.txt"]},
+			"wait",
+			{"block": "Deploy?"},
+			{"group": "lint", "steps": [
+				{"label": "vet", "command": "go vet", "env": {"GOFLAGS": "-mod=mod"}}
+			]},
+			{"label": "docker", "plugins": {"docker#v5.0.0": {"image": "golang"}, "other#v1.0.0": null}},
+			{"trigger": "deploy"}
+		]
+	}`)
+
+	steps, env, err := parseLocalSteps(pipeline)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{"FOO": "bar", "COUNT": "2"}, env)
+	require.Len(t, steps, 3)
+
+	assert.Equal(t, &localStep{
+		Key:           "tests",
+		Label:         "tests",
+		Command:       "make deps\nmake test",
+		Env:           map[string]string{},
+		ArtifactPaths: "a.txt;b.txt",
+	}, steps[0])
+
+	assert.Equal(t, "vet", steps[1].Label)
+	assert.Equal(t, "go vet", steps[1].Command)
+	assert.Equal(t, map[string]string{"GOFLAGS": "-mod=mod"}, steps[1].Env)
+
+	assert.Equal(t, "docker", steps[2].Label)
+	assert.JSONEq(t, `[{"docker#v5.0.0": {"image": "golang"}}, {"other#v1.0.0": null}]`, steps[2].Plugins)
+}
+
+func TestSelectLocalStep(t *testing.T) {
+	tests := &localStep{Key: "tests", Label: ":go: Tests"}
+	lint := &localStep{Label: "lint"}
+	steps := []*localStep{tests, lint}
+
+	step, err := selectLocalStep(steps, "tests")
+	require.NoError(t, err)
+	assert.Equal(t, tests, step)
+
+	step, err = selectLocalStep(steps, ":go: Tests")
+	require.NoError(t, err)
+	assert.Equal(t, tests, step)
+
+	step, err = selectLocalStep(steps, "lint")
+	require.NoError(t, err)
+	assert.Equal(t, lint, step)
+
+	_, err = selectLocalStep(steps, "")
+	assert.Error(t, err)
+
+	_, err = selectLocalStep(steps, "deploy")
+	assert.Error(t, err)
+
+	step, err = selectLocalStep([]*localStep{lint}, "")
+	require.NoError(t, err)
+	assert.Equal(t, lint, step)
+
+	_, err = selectLocalStep(nil, "")
+	assert.Error(t, err)
+}
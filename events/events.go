@@ -0,0 +1,235 @@
+// Package events provides a stream of structured events describing what the
+// agent and the jobs it runs are doing, as newline-delimited JSON.
+//
+// The agent, the bootstrap and the commands they run are separate processes,
+// so each one opens the stream for itself and writes whole lines to it.
+//
+// It is intended for internal use by buildkite-agent only.
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnvVar is the environment variable that passes the stream destination on to
+// the bootstrap and the commands it runs
+const EnvVar = "BUILDKITE_AGENT_EVENT_STREAM"
+
+// RelayEnvVar is the environment variable that passes the agent's Relay on to
+// the commands a job runs, so that the agent can record metrics from the
+// events of commands like artifact upload whether or not there's a stream
+const RelayEnvVar = "BUILDKITE_AGENT_EVENT_RELAY"
+
+// unixPrefix marks a destination as a unix socket, rather than a file
+const unixPrefix = "unix://"
+
+// Type is the kind of lifecycle transition an event describes
+type Type string
+
+const (
+	JobAccepted            Type = "job.accepted"
+	JobStarted             Type = "job.started"
+	JobCanceled            Type = "job.canceled"
+	JobFinished            Type = "job.finished"
+	PhaseStarted           Type = "phase.started"
+	PhaseFinished          Type = "phase.finished"
+	HookStarted            Type = "hook.started"
+	HookFinished           Type = "hook.finished"
+	ArtifactUploadStarted  Type = "artifact_upload.started"
+	ArtifactUploadProgress Type = "artifact_upload.progress"
+	ArtifactUploadFinished Type = "artifact_upload.finished"
+)
+
+// Event is a single line in the stream. Only the fields that make sense for
+// its Type are set.
+type Event struct {
+	Type Type      `json:"type"`
+	Time time.Time `json:"time"`
+
+	AgentName string `json:"agent_name,omitempty"`
+	JobID     string `json:"job_id,omitempty"`
+
+	// The bootstrap phase, or the phase a hook is run in
+	Phase string `json:"phase,omitempty"`
+
+	// The hook name (e.g. "pre-command"), and where it came from ("global",
+	// "local" or "plugin"), along with the plugin's name
+	Hook       string `json:"hook,omitempty"`
+	HookScope  string `json:"hook_scope,omitempty"`
+	PluginName string `json:"plugin_name,omitempty"`
+
+	// Set on finished events. The exit status is a pointer so that a
+	// successful 0 is still reported.
+	ExitStatus   *int   `json:"exit_status,omitempty"`
+	Signal       string `json:"signal,omitempty"`
+	SignalReason string `json:"signal_reason,omitempty"`
+	Error        string `json:"error,omitempty"`
+
+	// Artifact upload progress
+	ArtifactPath       string `json:"artifact_path,omitempty"`
+	ArtifactsUploaded  int    `json:"artifacts_uploaded,omitempty"`
+	ArtifactsFailed    int    `json:"artifacts_failed,omitempty"`
+	ArtifactsTotal     int    `json:"artifacts_total,omitempty"`
+	ArtifactBytes      int64  `json:"artifact_bytes,omitempty"`
+	ArtifactBytesTotal int64  `json:"artifact_bytes_total,omitempty"`
+}
+
+// ExitStatus is a helper for setting Event.ExitStatus
+func ExitStatus(status int) *int {
+	return &status
+}
+
+// Stream writes events to a file or a unix socket. A nil *Stream discards
+// events, so callers don't need to check if one is configured.
+type Stream struct {
+	// The fields that every event from this stream gets
+	base Event
+
+	// Shared by streams made with With
+	outs []*output
+}
+
+type output struct {
+	mu     sync.Mutex
+	w      io.WriteCloser
+	dest   string
+	failed bool
+}
+
+// Open returns a stream that writes every event to each of dests. A dest
+// starting with unix:// is a unix socket that something else is listening
+// on, anything else is a file that events are appended to. Empty dests are
+// skipped, and if there are none left Open returns a nil Stream. If a dest
+// can't be opened, the stream writes to the others and the error is
+// returned along with it.
+func Open(dests ...string) (*Stream, error) {
+	var (
+		outs     []*output
+		firstErr error
+	)
+
+	for _, dest := range dests {
+		if dest == "" {
+			continue
+		}
+
+		var (
+			w   io.WriteCloser
+			err error
+		)
+
+		if path := strings.TrimPrefix(dest, unixPrefix); path != dest {
+			w, err = net.Dial("unix", path)
+		} else {
+			w, err = os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("opening event stream %q: %w", dest, err)
+			}
+			continue
+		}
+
+		outs = append(outs, &output{w: w, dest: dest})
+	}
+
+	if len(outs) == 0 {
+		return nil, firstErr
+	}
+	return &Stream{outs: outs}, firstErr
+}
+
+// With returns a stream that writes to the same place, and fills in the
+// agent name and job ID of every event it emits when they're not set
+func (s *Stream) With(agentName, jobID string) *Stream {
+	if s == nil {
+		return nil
+	}
+
+	base := s.base
+	if agentName != "" {
+		base.AgentName = agentName
+	}
+	if jobID != "" {
+		base.JobID = jobID
+	}
+
+	return &Stream{base: base, outs: s.outs}
+}
+
+// Emit writes an event to the stream. Events are best effort, so that a
+// missing listener never gets in the way of running jobs: once a write fails
+// the stream stops writing, and the error is returned once.
+func (s *Stream) Emit(e Event) error {
+	if s == nil {
+		return nil
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if e.AgentName == "" {
+		e.AgentName = s.base.AgentName
+	}
+	if e.JobID == "" {
+		e.JobID = s.base.JobID
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	var firstErr error
+	for _, out := range s.outs {
+		if err := out.write(line); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (o *output) write(line []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.failed {
+		return nil
+	}
+
+	// A single write per event, so that lines from different processes
+	// appending to the same file don't get mixed up
+	if _, err := o.w.Write(line); err != nil {
+		o.failed = true
+		return fmt.Errorf("writing to event stream %q: %w", o.dest, err)
+	}
+
+	return nil
+}
+
+// Close closes the underlying files and sockets, for every stream that shares
+// them
+func (s *Stream) Close() error {
+	if s == nil {
+		return nil
+	}
+
+	var firstErr error
+	for _, out := range s.outs {
+		out.mu.Lock()
+		out.failed = true
+		if err := out.w.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		out.mu.Unlock()
+	}
+	return firstErr
+}
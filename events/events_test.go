@@ -0,0 +1,180 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readEvents(t *testing.T, data string) []Event {
+	t.Helper()
+
+	var got []Event
+	for _, line := range strings.Split(strings.TrimSuffix(data, "\n"), "\n") {
+		var e Event
+		require.NoError(t, json.Unmarshal([]byte(line), &e), "line %q", line)
+		got = append(got, e)
+	}
+	return got
+}
+
+func TestStreamAppendsToFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+
+	// Each process opens the stream for itself
+	for _, jobID := range []string{"job-1", "job-2"} {
+		s, err := Open(path)
+		require.NoError(t, err)
+
+		job := s.With("my-agent", jobID)
+		require.NoError(t, job.Emit(Event{Type: JobFinished, ExitStatus: ExitStatus(0)}))
+		require.NoError(t, s.Close())
+	}
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	got := readEvents(t, string(data))
+	require.Len(t, got, 2)
+	for i, jobID := range []string{"job-1", "job-2"} {
+		assert.Equal(t, JobFinished, got[i].Type)
+		assert.Equal(t, "my-agent", got[i].AgentName)
+		assert.Equal(t, jobID, got[i].JobID)
+		assert.False(t, got[i].Time.IsZero())
+		require.NotNil(t, got[i].ExitStatus)
+		assert.Equal(t, 0, *got[i].ExitStatus)
+	}
+}
+
+func TestStreamWritesToEveryDestination(t *testing.T) {
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first.ndjson"), filepath.Join(dir, "second.ndjson")
+
+	// A destination that can't be opened doesn't stop the others
+	s, err := Open(first, "", "unix://"+filepath.Join(dir, "nobody-listening.sock"), second)
+	assert.Error(t, err)
+	require.NotNil(t, s)
+
+	require.NoError(t, s.Emit(Event{Type: JobStarted}))
+	require.NoError(t, s.Close())
+
+	for _, path := range []string{first, second} {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+
+		got := readEvents(t, string(data))
+		require.Len(t, got, 1, path)
+		assert.Equal(t, JobStarted, got[0].Type)
+	}
+}
+
+func TestStreamWritesToUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.sock")
+
+	ln, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	defer ln.Close()
+
+	received := make(chan string)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(received)
+			return
+		}
+		defer conn.Close()
+
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			received <- scanner.Text()
+		}
+		close(received)
+	}()
+
+	s, err := Open("unix://" + path)
+	require.NoError(t, err)
+
+	require.NoError(t, s.With("", "my-job").Emit(Event{Type: HookStarted, Phase: "command", Hook: "pre-command", HookScope: "global"}))
+	require.NoError(t, s.Close())
+
+	got := readEvents(t, <-received)
+	require.Len(t, got, 1)
+	assert.Equal(t, HookStarted, got[0].Type)
+	assert.Equal(t, "my-job", got[0].JobID)
+	assert.Equal(t, "pre-command", got[0].Hook)
+	assert.Nil(t, got[0].ExitStatus)
+}
+
+func TestStreamStopsAfterFailedWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.sock")
+
+	ln, err := net.Listen("unix", path)
+	require.NoError(t, err)
+
+	s, err := Open("unix://" + path)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Once nothing's listening, writes fail, but only the first one errors
+	conn, err := ln.Accept()
+	require.NoError(t, err)
+	conn.Close()
+	ln.Close()
+
+	var errs int
+	for i := 0; i < 10; i++ {
+		if err := s.Emit(Event{Type: JobStarted}); err != nil {
+			errs++
+		}
+	}
+	assert.LessOrEqual(t, errs, 1)
+}
+
+func TestNilStreamDiscardsEvents(t *testing.T) {
+	s, err := Open("")
+	require.NoError(t, err)
+	assert.Nil(t, s)
+
+	assert.NoError(t, s.With("my-agent", "my-job").Emit(Event{Type: JobAccepted}))
+	assert.NoError(t, s.Close())
+}
+
+func TestRelay(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got []Event
+	)
+
+	path := filepath.Join(t.TempDir(), "relay.sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	require.NoError(t, err)
+
+	r := NewRelay(path, ln, func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, e)
+	})
+
+	for _, phase := range []string{"checkout", "command"} {
+		s, err := Open(r.Destination())
+		require.NoError(t, err)
+		require.NoError(t, s.Emit(Event{Type: PhaseStarted, Phase: phase}))
+		require.NoError(t, s.Close())
+	}
+
+	// Close waits for the events that have been written
+	require.NoError(t, r.Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, got, 2)
+	assert.ElementsMatch(t, []string{"checkout", "command"}, []string{got[0].Phase, got[1].Phase})
+}
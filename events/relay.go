@@ -0,0 +1,130 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// How long Close keeps accepting connections for, so that processes
+	// that connected just before it don't have their events lost
+	relayAcceptGrace = 100 * time.Millisecond
+
+	// How long Close waits for processes that are still connected to finish
+	// writing their events
+	relayDrainTimeout = 5 * time.Second
+)
+
+// Relay listens on a unix socket for the events of other processes, so that
+// they can be looked at (and passed on) by the process that runs them
+type Relay struct {
+	path     string
+	ln       *net.UnixListener
+	accepted chan struct{}
+	handle   func(Event)
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// NewRelay accepts connections on ln, a unix socket listening at path, and
+// calls handle with each event that's written to it. handle is called from
+// one goroutine per connection. The relay closes ln and removes path when
+// it's closed.
+func NewRelay(path string, ln *net.UnixListener, handle func(Event)) *Relay {
+	r := &Relay{
+		path:     path,
+		ln:       ln,
+		accepted: make(chan struct{}),
+		handle:   handle,
+		conns:    map[net.Conn]struct{}{},
+	}
+
+	go r.accept()
+
+	return r
+}
+
+// Destination is what to pass to Open to write events to the relay
+func (r *Relay) Destination() string {
+	return unixPrefix + r.path
+}
+
+func (r *Relay) accept() {
+	defer close(r.accepted)
+
+	for {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		r.mu.Lock()
+		r.conns[conn] = struct{}{}
+		r.mu.Unlock()
+
+		r.wg.Add(1)
+		go r.read(conn)
+	}
+}
+
+func (r *Relay) read(conn net.Conn) {
+	defer r.wg.Done()
+	defer func() {
+		r.mu.Lock()
+		delete(r.conns, conn)
+		r.mu.Unlock()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// Not an event, but the rest might be
+			continue
+		}
+		r.handle(e)
+	}
+}
+
+// Close stops accepting connections, and waits a little while for events
+// from processes that are still connected before closing them too
+func (r *Relay) Close() error {
+	// Connections waiting to be accepted are accepted straight away, so once
+	// accepting times out there are none left
+	if err := r.ln.SetDeadline(time.Now().Add(relayAcceptGrace)); err != nil {
+		return err
+	}
+	<-r.accepted
+	err := r.ln.Close()
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(relayDrainTimeout):
+		r.mu.Lock()
+		for conn := range r.conns {
+			conn.Close()
+		}
+		r.mu.Unlock()
+		<-done
+	}
+
+	// The listener normally removes the socket, but make sure of it
+	if rmErr := os.Remove(r.path); rmErr != nil && !os.IsNotExist(rmErr) && err == nil {
+		err = rmErr
+	}
+
+	return err
+}
@@ -116,6 +116,7 @@ func main() {
 		},
 		clicommand.EnvCommand,
 		clicommand.BootstrapCommand,
+		clicommand.RunCommand,
 	}
 
 	app.ErrWriter = os.Stderr
@@ -1,10 +1,12 @@
-// Package metrics provides a wrapper around Datadog metrics collection.
+// Package metrics provides a wrapper around Datadog metrics collection, and
+// exposes the same metrics for Prometheus to scrape.
 //
 // It is intended for internal use by buildkite-agent only.
 package metrics
 
 import (
 	"fmt"
+	"net/http"
 	"regexp"
 	"sort"
 	"strings"
@@ -27,19 +29,25 @@ type Collector struct {
 	config CollectorConfig
 	logger logger.Logger
 	client *statsd.Client
+	prom   *prometheusRegistry
 }
 
 type CollectorConfig struct {
 	Datadog              bool
 	DatadogHost          string
 	DatadogDistributions bool
+	Prometheus           bool
 }
 
 func NewCollector(l logger.Logger, c CollectorConfig) *Collector {
-	return &Collector{
+	collector := &Collector{
 		config: c,
 		logger: l,
 	}
+	if c.Prometheus {
+		collector.prom = newPrometheusRegistry()
+	}
+	return collector
 }
 
 var portSuffixRegexp = regexp.MustCompile(`:\d+$`)
@@ -72,6 +80,20 @@ func (c *Collector) Stop() error {
 	return nil
 }
 
+// Handler returns a handler that serves metrics for Prometheus to scrape, or
+// nil if Prometheus metrics aren't enabled
+func (c *Collector) Handler() http.Handler {
+	if c.prom == nil {
+		return nil
+	}
+	return c.prom
+}
+
+// Enabled returns whether metrics are being collected at all
+func (c *Collector) Enabled() bool {
+	return c.config.Datadog || c.config.Prometheus
+}
+
 func (c *Collector) Scope(tags Tags) *Scope {
 	return &Scope{
 		Tags: tags,
@@ -84,8 +106,17 @@ type Scope struct {
 	c    *Collector
 }
 
+// Enabled returns whether the collector is collecting metrics at all
+func (s *Scope) Enabled() bool {
+	return s.c.Enabled()
+}
+
 // Timing sends timing information in milliseconds.
 func (s *Scope) Timing(name string, value time.Duration, tags ...Tags) {
+	if s.c.prom != nil {
+		s.c.prom.timing(name, value, s.mergeTags(tags...))
+	}
+
 	if s.c.client == nil {
 		return
 	}
@@ -120,6 +151,10 @@ func (s *Scope) With(tags Tags) *Scope {
 
 // Count tracks how many times something happened per second.
 func (s *Scope) Count(name string, value int64, tags ...Tags) {
+	if s.c.prom != nil {
+		s.c.prom.count(name, value, s.mergeTags(tags...))
+	}
+
 	if s.c.client == nil {
 		return
 	}
@@ -132,6 +167,24 @@ func (s *Scope) Count(name string, value int64, tags ...Tags) {
 	}
 }
 
+// Gauge records the current value of something.
+func (s *Scope) Gauge(name string, value float64, tags ...Tags) {
+	if s.c.prom != nil {
+		s.c.prom.gauge(name, value, s.mergeTags(tags...))
+	}
+
+	if s.c.client == nil {
+		return
+	}
+
+	mergedTags := s.mergeTags(tags...).StringSlice()
+	s.c.logger.Debug("Metrics gauge %s=%v %v", name, value, mergedTags)
+
+	if err := s.c.client.Gauge(name, value, mergedTags, 1); err != nil {
+		s.c.logger.Error("Metrics gauge failed: %v", err)
+	}
+}
+
 func (s *Scope) mergeTags(tagsSlice ...Tags) Tags {
 	merged := Tags{}
 	for k, v := range s.Tags {
@@ -0,0 +1,209 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Every metric is exposed with this prefix, like the datadog namespace
+	prometheusNamespace = "buildkite_"
+
+	// The content type of the Prometheus text exposition format
+	prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// Bucket upper bounds in seconds for timings. These are spread wide, as the
+// same timings cover both API calls and whole jobs.
+var prometheusBuckets = []float64{
+	0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+	30, 60, 300, 600, 1800, 3600, 7200, 14400,
+}
+
+// Prometheus allows alphas, digits and '_' in names
+var prometheusNameRegex = regexp.MustCompile(`[^_a-zA-Z0-9]+`)
+
+func prometheusName(name string) string {
+	return prometheusNameRegex.ReplaceAllString(name, "_")
+}
+
+type prometheusKind string
+
+const (
+	prometheusCounter   prometheusKind = "counter"
+	prometheusGauge     prometheusKind = "gauge"
+	prometheusHistogram prometheusKind = "histogram"
+)
+
+// prometheusSeries is a metric with one set of labels
+type prometheusSeries struct {
+	labels string
+
+	// The counter total or gauge value, or the histogram sum
+	value float64
+
+	// Histogram observations, with a count for each bucket
+	count   uint64
+	buckets []uint64
+}
+
+type prometheusFamily struct {
+	kind   prometheusKind
+	series map[string]*prometheusSeries
+}
+
+// prometheusRegistry keeps the current value of every metric, to be scraped
+type prometheusRegistry struct {
+	mu       sync.Mutex
+	families map[string]*prometheusFamily
+}
+
+func newPrometheusRegistry() *prometheusRegistry {
+	return &prometheusRegistry{families: map[string]*prometheusFamily{}}
+}
+
+// series returns the series for a metric and its tags, creating it if need be
+func (r *prometheusRegistry) series(kind prometheusKind, name string, tags Tags) *prometheusSeries {
+	name = prometheusNamespace + prometheusName(name)
+	switch kind {
+	case prometheusCounter:
+		name += "_total"
+	case prometheusHistogram:
+		name += "_seconds"
+	}
+
+	family, ok := r.families[name]
+	if !ok {
+		family = &prometheusFamily{kind: kind, series: map[string]*prometheusSeries{}}
+		r.families[name] = family
+	}
+
+	labels := prometheusLabels(tags)
+	s, ok := family.series[labels]
+	if !ok {
+		s = &prometheusSeries{labels: labels}
+		if kind == prometheusHistogram {
+			s.buckets = make([]uint64, len(prometheusBuckets))
+		}
+		family.series[labels] = s
+	}
+	return s
+}
+
+func (r *prometheusRegistry) count(name string, value int64, tags Tags) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.series(prometheusCounter, name, tags).value += float64(value)
+}
+
+func (r *prometheusRegistry) gauge(name string, value float64, tags Tags) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.series(prometheusGauge, name, tags).value = value
+}
+
+func (r *prometheusRegistry) timing(name string, value time.Duration, tags Tags) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.series(prometheusHistogram, name, tags)
+	seconds := value.Seconds()
+	s.value += seconds
+	s.count++
+	for i, le := range prometheusBuckets {
+		if seconds <= le {
+			s.buckets[i]++
+		}
+	}
+}
+
+// WriteTo writes every metric in the Prometheus text exposition format
+func (r *prometheusRegistry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var b strings.Builder
+
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		family := r.families[name]
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, family.kind)
+
+		labelSets := make([]string, 0, len(family.series))
+		for labels := range family.series {
+			labelSets = append(labelSets, labels)
+		}
+		sort.Strings(labelSets)
+
+		for _, labels := range labelSets {
+			s := family.series[labels]
+			if family.kind != prometheusHistogram {
+				fmt.Fprintf(&b, "%s%s %s\n", name, braces(labels), formatFloat(s.value))
+				continue
+			}
+
+			for i, le := range prometheusBuckets {
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", name, braces(joinLabels(labels, `le="`+formatFloat(le)+`"`)), s.buckets[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", name, braces(joinLabels(labels, `le="+Inf"`)), s.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", name, braces(labels), formatFloat(s.value))
+			fmt.Fprintf(&b, "%s_count%s %d\n", name, braces(labels), s.count)
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP serves the metrics for Prometheus to scrape
+func (r *prometheusRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", prometheusContentType)
+	_, _ = r.WriteTo(w)
+}
+
+// prometheusLabels formats tags as sorted, comma separated label pairs
+func prometheusLabels(tags Tags) string {
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if k == "" || v == "" {
+			continue
+		}
+		pairs = append(pairs, prometheusName(k)+"="+strconv.Quote(v))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
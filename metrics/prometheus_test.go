@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPrometheusHandler(t *testing.T) {
+	c := NewCollector(logger.Discard, CollectorConfig{Prometheus: true})
+	scope := c.Scope(Tags{"agent_name": "my-agent"})
+
+	scope.Count("jobs.success", 1)
+	scope.Count("jobs.success", 2)
+	scope.Count("jobs.failed", 1, Tags{"exit_code": "1"})
+	scope.Gauge("agent.busy", 1)
+	scope.Gauge("agent.busy", 0)
+	scope.Timing("queue.duration", 20*time.Second)
+
+	rec := httptest.NewRecorder()
+	c.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if got, want := rec.Header().Get("Content-Type"), prometheusContentType; got != want {
+		t.Errorf("Content-Type = %q, want %q", got, want)
+	}
+
+	want := []string{
+		`# TYPE buildkite_agent_busy gauge`,
+		`buildkite_agent_busy{agent_name="my_agent"} 0`,
+		`# TYPE buildkite_jobs_failed_total counter`,
+		`buildkite_jobs_failed_total{agent_name="my_agent",exit_code="1"} 1`,
+		`# TYPE buildkite_jobs_success_total counter`,
+		`buildkite_jobs_success_total{agent_name="my_agent"} 3`,
+		`# TYPE buildkite_queue_duration_seconds histogram`,
+	}
+	for _, le := range prometheusBuckets {
+		count := "0"
+		if le >= 20 {
+			count = "1"
+		}
+		want = append(want, `buildkite_queue_duration_seconds_bucket{agent_name="my_agent",le="`+formatFloat(le)+`"} `+count)
+	}
+	want = append(want,
+		`buildkite_queue_duration_seconds_bucket{agent_name="my_agent",le="+Inf"} 1`,
+		`buildkite_queue_duration_seconds_sum{agent_name="my_agent"} 20`,
+		`buildkite_queue_duration_seconds_count{agent_name="my_agent"} 1`,
+	)
+
+	got := strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n")
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("metrics diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestPrometheusDisabled(t *testing.T) {
+	c := NewCollector(logger.Discard, CollectorConfig{})
+	if c.Handler() != nil {
+		t.Errorf("c.Handler() = %v, want nil", c.Handler())
+	}
+
+	// Metrics go nowhere, but don't fail
+	c.Scope(Tags{}).Gauge("agent.busy", 1)
+}
@@ -90,9 +90,52 @@ type item interface {
 	delSubItem(string)
 
 	Eval(context.Context) template.HTML
+	JSON(context.Context) itemJSON
 	Items() map[string]item
 }
 
+// statusJSON is the JSON representation of the status page.
+type statusJSON struct {
+	Version      string              `json:"version"`
+	Build        string              `json:"build"`
+	Hostname     string              `json:"hostname"`
+	Username     string              `json:"username"`
+	ExePath      string              `json:"exe_path"`
+	PID          int                 `json:"pid"`
+	Compiler     string              `json:"compiler"`
+	RuntimeVer   string              `json:"runtime_version"`
+	GOOS         string              `json:"goos"`
+	GOARCH       string              `json:"goarch"`
+	NumCPU       int                 `json:"num_cpu"`
+	NumGoroutine int                 `json:"num_goroutine"`
+	StartTime    time.Time           `json:"start_time"`
+	CurrentTime  time.Time           `json:"current_time"`
+	Items        map[string]itemJSON `json:"items"`
+}
+
+// itemJSON is the JSON representation of an item and its sub-items. Simple
+// items have a Status, templated items have the Data returned by their
+// callback.
+type itemJSON struct {
+	Status string              `json:"status,omitempty"`
+	Data   json.RawMessage     `json:"data,omitempty"`
+	Error  string              `json:"error,omitempty"`
+	Items  map[string]itemJSON `json:"items,omitempty"`
+}
+
+// itemsJSON converts items, and all their sub-items, to JSON.
+func itemsJSON(ctx context.Context, items map[string]item) map[string]itemJSON {
+	out := make(map[string]itemJSON, len(items))
+	for title, i := range items {
+		j := i.JSON(ctx)
+		if sub := i.Items(); len(sub) > 0 {
+			j.Items = itemsJSON(ctx, sub)
+		}
+		out[title] = j
+	}
+	return out
+}
+
 type itemCtxKey struct{}
 
 func parentItem(ctx context.Context) item {
@@ -150,6 +193,13 @@ func (i *simpleItem) Eval(ctx context.Context) template.HTML {
 	return template.HTML(template.HTMLEscapeString(i.stat))
 }
 
+// JSON returns the current item value.
+func (i *simpleItem) JSON(ctx context.Context) itemJSON {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return itemJSON{Status: i.stat}
+}
+
 // ItemCallback funcs are used by templated status items to provide the value to
 // hydrate the item template.
 type ItemCallback = func(context.Context) (any, error)
@@ -185,6 +235,68 @@ func (i *templatedItem) Eval(ctx context.Context) template.HTML {
 	return template.HTML(sb.String())
 }
 
+// JSON calls the item callback, and returns the result as is, rather than
+// feeding it through the item's template.
+func (i *templatedItem) JSON(ctx context.Context) itemJSON {
+	var j itemJSON
+
+	data, err := i.cb(ctx)
+	if err != nil {
+		j.Error = fmt.Sprintf("Error from item callback: %v", err)
+	}
+
+	// Items with broken templates wrap their data in an errorData
+	if ed, ok := data.(*errorData); ok {
+		if j.Error == "" {
+			j.Error = fmt.Sprintf("%s: %v", ed.Operation, ed.Error)
+		}
+		data = ed.Item
+	}
+
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			j.Error = fmt.Sprintf("Error while marshalling item data: %v", err)
+		} else {
+			j.Data = raw
+		}
+	}
+	return j
+}
+
+// HandleJSON handles status page requests, responding with the same
+// information as Handle, as JSON.
+func HandleJSON(w http.ResponseWriter, r *http.Request) {
+	rootItem.mu.RLock()
+	items := itemsJSON(r.Context(), rootItem.items)
+	rootItem.mu.RUnlock()
+
+	data := &statusJSON{
+		Version:      version.Version(),
+		Build:        version.BuildVersion(),
+		Hostname:     hostname,
+		Username:     username,
+		ExePath:      exepath,
+		PID:          os.Getpid(),
+		Compiler:     runtime.Compiler,
+		RuntimeVer:   runtime.Version(),
+		GOOS:         runtime.GOOS,
+		GOARCH:       runtime.GOARCH,
+		NumCPU:       runtime.NumCPU(),
+		NumGoroutine: runtime.NumGoroutine(),
+		StartTime:    startTime,
+		CurrentTime:  time.Now(),
+		Items:        items,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 // Handle handles status page requests.
 func Handle(w http.ResponseWriter, r *http.Request) {
 	data := &statusData{
@@ -1,7 +1,9 @@
 package status
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"html/template"
 	"io"
@@ -88,3 +90,68 @@ func TestSmokeHandle(t *testing.T) {
 		t.Errorf("Handle(rec, req): rec.Result().StatusCode = %v, want %v", got, want)
 	}
 }
+
+func TestHandleJSON(t *testing.T) {
+	ctx := context.Background()
+	cctx, setStat, done := AddSimpleItem(ctx, "Llamas")
+	defer done()
+	setStat("Essence of Llama")
+
+	_, done2 := AddItem(cctx, "Alpacas", "{{.Alpacas}} alpacas", func(context.Context) (any, error) {
+		return struct {
+			Alpacas int `json:"alpacas"`
+		}{42}, nil
+	})
+	defer done2()
+
+	_, done3 := AddItem(ctx, "Vicuñas", "{{.Vicuñas", func(context.Context) (any, error) {
+		return []string{"Vicky"}, nil
+	})
+	defer done3()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/status.json", nil)
+	if err != nil {
+		t.Fatalf("http.NewReqeustWithContext(GET /status.json) error = %v", err)
+	}
+	rec := httptest.NewRecorder()
+	HandleJSON(rec, req)
+	if got, want := rec.Result().StatusCode, http.StatusOK; got != want {
+		t.Errorf("HandleJSON(rec, req): rec.Result().StatusCode = %v, want %v", got, want)
+	}
+	if got, want := rec.Result().Header.Get("Content-Type"), "application/json"; got != want {
+		t.Errorf("HandleJSON(rec, req): Content-Type = %q, want %q", got, want)
+	}
+
+	// Items are indented along with everything else, so compact them again
+	compact := func(raw json.RawMessage) string {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, raw); err != nil {
+			t.Errorf("json.Compact(%s) error = %v", raw, err)
+		}
+		return buf.String()
+	}
+
+	var got statusJSON
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("json.Unmarshal(rec.Body) error = %v", err)
+	}
+	if got.PID != os.Getpid() {
+		t.Errorf("got.PID = %d, want %d", got.PID, os.Getpid())
+	}
+
+	llamas := got.Items["Llamas"]
+	if want := "Essence of Llama"; llamas.Status != want {
+		t.Errorf(`got.Items["Llamas"].Status = %q, want %q`, llamas.Status, want)
+	}
+	if got, want := compact(llamas.Items["Alpacas"].Data), `{"alpacas":42}`; got != want {
+		t.Errorf(`got.Items["Llamas"].Items["Alpacas"].Data = %s, want %s`, got, want)
+	}
+
+	vicunas := got.Items["Vicuñas"]
+	if vicunas.Error == "" {
+		t.Error(`got.Items["Vicuñas"].Error = "", want a template parse error`)
+	}
+	if got, want := compact(vicunas.Data), `["Vicky"]`; got != want {
+		t.Errorf(`got.Items["Vicuñas"].Data = %s, want %s`, got, want)
+	}
+}
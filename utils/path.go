@@ -5,8 +5,11 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"regexp"
 )
 
+var agentNameBadCharsPattern = regexp.MustCompile("[[:^alnum:]]")
+
 // NormalizeCommand has very similar semantics to `NormalizeFilePath`, except
 // we only "absolute" the path if it exists on the filesystem. This will ensure
 // that:
@@ -90,3 +93,11 @@ func ExpandHome(path string) (string, error) {
 
 	return filepath.Join(usr.HomeDir, path[1:]), nil
 }
+
+// DirForAgentName returns the directory that jobs run by an agent are checked
+// out in, within the build path. The bootstrap checks out into it, and the
+// agent removes checkouts from it when the build path runs out of space, so
+// both need to use this.
+func DirForAgentName(agentName string) string {
+	return agentNameBadCharsPattern.ReplaceAllString(agentName, "-")
+}
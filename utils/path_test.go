@@ -55,3 +55,20 @@ func TestNormalizingCommands(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, c, "cat test.log")
 }
+
+var agentNameTests = []struct {
+	agentName string
+	expected  string
+}{
+	{"My Agent", "My-Agent"},
+	{":docker: My Agent", "-docker--My-Agent"},
+	{"My \"Agent\"", "My--Agent-"},
+}
+
+func TestDirForAgentName(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range agentNameTests {
+		assert.Equal(t, test.expected, DirForAgentName(test.agentName))
+	}
+}